@@ -0,0 +1,83 @@
+/*
+Caryatid reference exec backend helper
+
+Stores catalogs and boxes in a local directory, just like the built-in file backend,
+but runs out of process and speaks the exec backend protocol on stdin and stdout.
+With this program in $PATH, caryatid and the Packer plugin accept URIs like dir:///path/to/catalog.json
+
+It is meant as a starting point for writing other helpers;
+see the documentation for CaryatidExecBackend in pkg/caryatid for a description of the protocol.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+
+	"github.com/mrled/caryatid/pkg/caryatid"
+)
+
+const helperScheme = "dir"
+
+// A backend that maps dir:// URIs onto the built-in file backend
+type dirBackend struct {
+	caryatid.CaryatidLocalFileBackend
+	manager *caryatid.BackendManager
+}
+
+// Convert a dir:// URI to the equivalent file:// URI
+func fileUri(uri string) (result string, err error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return
+	}
+	if u.Scheme != helperScheme {
+		err = fmt.Errorf("Expected scheme '%v' but was given a URI with scheme '%v'", helperScheme, u.Scheme)
+		return
+	}
+	u.Scheme = "file"
+	result = u.String()
+	return
+}
+
+func (backend *dirBackend) SetManager(manager *caryatid.BackendManager) (err error) {
+	var catalogUri string
+	backend.manager = manager
+	if catalogUri, err = fileUri(manager.CatalogUri); err != nil {
+		return
+	}
+	return backend.CaryatidLocalFileBackend.SetManager(&caryatid.BackendManager{CatalogUri: catalogUri, Backend: backend})
+}
+
+func (backend *dirBackend) GetManager() (*caryatid.BackendManager, error) {
+	if backend.manager == nil {
+		return nil, fmt.Errorf("The Manager property was not set")
+	}
+	return backend.manager, nil
+}
+
+func (backend *dirBackend) DeleteFile(uri string) (err error) {
+	if uri, err = fileUri(uri); err != nil {
+		return
+	}
+	return backend.CaryatidLocalFileBackend.DeleteFile(uri)
+}
+
+func (backend *dirBackend) Scheme() string {
+	return helperScheme
+}
+
+func main() {
+	// Stdout carries the protocol, so anything else that would print there must go to stderr instead
+	protocolOut := os.Stdout
+	os.Stdout = os.Stderr
+	log.SetOutput(os.Stderr)
+
+	if err := caryatid.ServeExecBackend(&dirBackend{}, os.Stdin, protocolOut); err != nil {
+		log.Printf("Error serving exec backend protocol: %v\n", err)
+		os.Exit(1)
+	}
+}
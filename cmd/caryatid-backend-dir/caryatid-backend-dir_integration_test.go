@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/mrled/caryatid/internal/util"
+	"github.com/mrled/caryatid/pkg/caryatid"
+)
+
+// Build this helper, put it in $PATH, and drive it through caryatid's exec backend
+func TestDirHelperConformance(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "caryatid-backend-dir-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	binDir := filepath.Join(tempDir, "bin")
+	helperName := caryatid.ExecBackendPrefix + helperScheme
+	if runtime.GOOS == "windows" {
+		helperName += ".exe"
+	}
+	build := exec.Command("go", "build", "-o", filepath.Join(binDir, helperName), ".")
+	if output, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("Error building helper: %v\n%v", err, string(output))
+	}
+
+	origPath := os.Getenv("PATH")
+	os.Setenv("PATH", binDir+string(os.PathListSeparator)+origPath)
+	defer os.Setenv("PATH", origPath)
+
+	if !util.StringInSlice(caryatid.ExecBackendHelpers(), helperScheme) {
+		t.Fatalf("Expected '%v' in exec backend helpers %v", helperScheme, caryatid.ExecBackendHelpers())
+	}
+
+	catalogPath := filepath.Join(tempDir, "catalog", "DirBox.json")
+	catalogUri := fmt.Sprintf("%v://%v", helperScheme, filepath.ToSlash(catalogPath))
+	backend, err := caryatid.NewBackendFromUri(catalogUri)
+	if err != nil {
+		t.Fatalf("Error getting backend for '%v': %v", catalogUri, err)
+	}
+	execBackend, ok := backend.(*caryatid.CaryatidExecBackend)
+	if !ok {
+		t.Fatalf("Expected a *CaryatidExecBackend but got a %T", backend)
+	}
+	defer execBackend.Close()
+
+	if err = caryatid.CheckBackendConformance(backend, catalogUri, tempDir); err != nil {
+		t.Fatalf("Helper is not conformant: %v", err)
+	}
+	if !util.PathExists(catalogPath) {
+		t.Fatalf("Helper did not write the catalog to '%v'", catalogPath)
+	}
+}
@@ -1,17 +1,21 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log"
 	"path/filepath"
 	"regexp"
+	"strings"
 
+	"github.com/mrled/caryatid/internal/util"
 	"github.com/mrled/caryatid/pkg/caryatid"
 )
 
 // Test whether a string is a valid URI
 func testValidUri(uri string) bool {
-	matched, err := regexp.MatchString("^[a-zA-Z0-9]+://", uri)
+	matched, err := regexp.MatchString("^[a-zA-Z][a-zA-Z0-9+.-]*://", uri)
 	if err != nil {
 		matched = false
 	}
@@ -72,20 +76,66 @@ func createTestBoxAction(boxName string, providerName string) (err error) {
 	return
 }
 
-func addAction(boxPath string, boxName string, boxDescription string, boxVersion string, catalogUri string) (err error) {
+// Return a manager that keeps every change in memory, if dryRun is set
+// The returned store records the operations that would have been performed, and is nil if dryRun is not set
+func getDryRunManager(manager *caryatid.BackendManager, dryRun bool) (result *caryatid.BackendManager, store *caryatid.MemoryStore, err error) {
+	if !dryRun {
+		result = manager
+		return
+	}
+	result, store, err = caryatid.NewDryRunManager(manager)
+	if err != nil {
+		log.Printf("Error creating a dry run manager: %v\n", err)
+	}
+	return
+}
+
+// Describe the operations recorded in a dry run store, one per line
+func dryRunResult(store *caryatid.MemoryStore) (result string) {
+	if store == nil {
+		return
+	}
+	for _, op := range store.Operations() {
+		result += fmt.Sprintf("Would %v\n", op)
+	}
+	return
+}
+
+func addAction(boxPath string, boxName string, boxDescription string, boxVersion string, catalogUri string, publicBaseUri string, boxPathTemplate string, dryRun bool) (result string, err error) {
 	// TODO: Reduce code duplication between here and packer-post-processor-caryatid
 	digestType, digest, provider, err := caryatid.DeriveArtifactInfoFromBoxFile(boxPath)
 	if err != nil {
 		panic(fmt.Sprintf("Could not determine artifact info: %v", err))
 	}
 
+	return addBoxWith(catalogUri, publicBaseUri, boxPathTemplate, dryRun, func(manager *caryatid.BackendManager) error {
+		return manager.AddBox(boxPath, boxName, boxDescription, boxVersion, provider, digestType, digest)
+	})
+}
+
+// Add a box read from a stream, such as standard input, whose sha1 checksum is calculated as it is stored
+// Unlike a box file, the provider cannot be read from the box's metadata.json, so it must be passed in
+func addStreamAction(reader io.Reader, provider string, boxName string, boxDescription string, boxVersion string, catalogUri string, publicBaseUri string, boxPathTemplate string, dryRun bool) (result string, err error) {
+	return addBoxWith(catalogUri, publicBaseUri, boxPathTemplate, dryRun, func(manager *caryatid.BackendManager) error {
+		return manager.AddBoxFromReader(context.Background(), reader, -1, boxName, boxDescription, boxVersion, provider, "sha1", "")
+	})
+}
+
+// Configure a manager for adding a box, and add it with add
+func addBoxWith(catalogUri string, publicBaseUri string, boxPathTemplate string, dryRun bool, add func(*caryatid.BackendManager) error) (result string, err error) {
 	manager, err := getManager(catalogUri)
 	if err != nil {
 		log.Printf("Error getting a BackendManager")
 		return
 	}
+	manager.PublicBaseUri = publicBaseUri
+	manager.BoxPathTemplate = boxPathTemplate
+	manager, store, err := getDryRunManager(manager, dryRun)
+	if err != nil {
+		return
+	}
 
-	err = manager.AddBox(boxPath, boxName, boxDescription, boxVersion, provider, digestType, digest)
+	err = add(manager)
 	if err != nil {
 		log.Printf("Error adding box metadata to catalog: %v\n", err)
 		return
@@ -99,6 +149,7 @@ func addAction(boxPath string, boxName string, boxDescription string, boxVersion
 	}
 	log.Printf("New catalog is:\n%v\n", catalog)
 
+	result = dryRunResult(store)
 	return
 }
 
@@ -125,17 +176,207 @@ func queryAction(catalogUri string, versionQuery string, providerQuery string) (
 	return
 }
 
-func deleteAction(catalogUri string, versionQuery string, providerQuery string) (err error) {
+func deleteAction(catalogUri string, versionQuery string, providerQuery string, publicBaseUri string, dryRun bool) (result string, err error) {
 	manager, err := getManager(catalogUri)
 	if err != nil {
 		log.Printf("Error getting a BackendManager")
 		return
 	}
+	manager.PublicBaseUri = publicBaseUri
+	manager, store, err := getDryRunManager(manager, dryRun)
+	if err != nil {
+		return
+	}
 
 	queryParams := caryatid.CatalogQueryParams{Version: versionQuery, Provider: providerQuery}
 	if err = manager.DeleteBox(queryParams); err != nil {
 		return
 	}
 
+	result = dryRunResult(store)
+	return
+}
+
+// Derive every box URL in a catalog from its storage URI again, such as to re-sign presigned S3 URLs before they expire
+func refreshUrlsAction(catalogUri string, publicBaseUri string, dryRun bool) (result string, err error) {
+	var refreshed int
+
+	manager, err := getManager(catalogUri)
+	if err != nil {
+		log.Printf("Error getting a BackendManager")
+		return
+	}
+	manager.PublicBaseUri = publicBaseUri
+	manager, store, err := getDryRunManager(manager, dryRun)
+	if err != nil {
+		return
+	}
+
+	if refreshed, err = manager.RefreshUris(); err != nil {
+		return
+	}
+
+	result = fmt.Sprintf("Refreshed %v box URLs in catalog '%v'\n", refreshed, manager.CatalogUri) + dryRunResult(store)
+	return
+}
+
+// Reconcile a catalog with the box files in its backend, and describe any problems
+// If fix is set, drop dangling references from the catalog and delete orphaned files
+// Unless fix is set, finding any problem is an error, so that scheduled checks can alert on it
+func fsckAction(catalogUri string, publicBaseUri string, boxPathTemplate string, fix bool) (result string, err error) {
+	var report caryatid.FsckReport
+
+	manager, err := getManager(catalogUri)
+	if err != nil {
+		log.Printf("Error getting a BackendManager")
+		return
+	}
+	manager.PublicBaseUri = publicBaseUri
+	manager.BoxPathTemplate = boxPathTemplate
+
+	if fix {
+		report, err = manager.FsckFix("caryatid fsck")
+	} else {
+		report, err = manager.Fsck()
+	}
+	result = report.String()
+	if err != nil {
+		return
+	}
+
+	if report.Clean() {
+		result = fmt.Sprintf("Catalog '%v' matches its storage\n", manager.CatalogUri)
+	} else if fix {
+		result += fmt.Sprintf("Dropped %v dangling references and deleted %v orphaned files\n", len(report.Dangling), len(report.Orphans))
+	} else {
+		err = fmt.Errorf("Catalog '%v' does not match its storage; pass -fix to drop dangling references and delete orphaned files", manager.CatalogUri)
+	}
+	return
+}
+
+// Rebuild a lost or corrupted catalog from the box files in its backend
+// Unless force is set, a catalog that can still be read and has boxes in it is not replaced
+func recoverAction(catalogUri string, boxName string, boxDescription string, publicBaseUri string, checkProvider bool, force bool) (result string, err error) {
+	var (
+		catalog caryatid.Catalog
+		skipped []caryatid.RecoverySkip
+	)
+
+	manager, err := getManager(catalogUri)
+	if err != nil {
+		log.Printf("Error getting a BackendManager")
+		return
+	}
+	manager.PublicBaseUri = publicBaseUri
+
+	catalog, skipped, err = manager.RecoverCatalog(boxName, boxDescription, checkProvider, force)
+	for _, skip := range skipped {
+		result += fmt.Sprintf("Skipped %v\n", skip)
+	}
+	if err != nil {
+		return
+	}
+	result += fmt.Sprintf("Recovered catalog '%v':\n%v", manager.CatalogUri, catalog.DisplayString())
+	return
+}
+
+// Copy a catalog and all of its boxes to another backend
+// If versionQuery or providerQuery are set, only the matching boxes are copied
+// If mirror is set, the destination may already have boxes, and only missing or changed ones are copied
+func migrateAction(fromUri string, fromPublicBaseUri string, toUri string, publicBaseUri string, boxPathTemplate string, versionQuery string, providerQuery string, mirror bool) (result string, err error) {
+	var report caryatid.MigrationReport
+
+	from, err := getManager(fromUri)
+	if err != nil {
+		log.Printf("Error getting a BackendManager")
+		return
+	}
+	from.PublicBaseUri = fromPublicBaseUri
+	to, err := getManager(toUri)
+	if err != nil {
+		log.Printf("Error getting a BackendManager")
+		return
+	}
+	to.PublicBaseUri = publicBaseUri
+	to.BoxPathTemplate = boxPathTemplate
+
+	queryParams := caryatid.CatalogQueryParams{Version: versionQuery, Provider: providerQuery}
+	if report, err = caryatid.MigrateCatalog(from, to, queryParams, mirror); err != nil {
+		return
+	}
+	for _, ref := range report.Copied {
+		result += fmt.Sprintf("Copied version %v provider %v to %v\n", ref.Version, ref.ProviderName, ref.Uri)
+	}
+	result += fmt.Sprintf("Copied %v boxes from '%v' to '%v'", len(report.Copied), from.CatalogUri, to.CatalogUri)
+	if mirror {
+		result += fmt.Sprintf("; %v were already up to date", len(report.Unchanged))
+	}
+	result += "\n"
+	return
+}
+
+// Return a list of the URI schemes that have a backend, one per line
+// Schemes handled by an exec backend helper in $PATH are marked as such
+func backendsAction() (result string) {
+	var lines []string
+	registered := caryatid.RegisteredBackends()
+	lines = append(lines, registered...)
+	for _, scheme := range caryatid.ExecBackendHelpers() {
+		if !util.StringInSlice(registered, scheme) {
+			lines = append(lines, fmt.Sprintf("%v (%v%v helper)", scheme, caryatid.ExecBackendPrefix, scheme))
+		}
+	}
+	if len(lines) > 0 {
+		result = strings.Join(lines, "\n") + "\n"
+	}
+	return
+}
+
+// Describe the lock held on a catalog, if any
+func lockStatusAction(catalogUri string) (result string, err error) {
+	var lock *caryatid.CatalogLock
+
+	manager, err := getManager(catalogUri)
+	if err != nil {
+		log.Printf("Error getting a BackendManager")
+		return
+	}
+	if lock, err = manager.LockStatus(); err != nil {
+		return
+	}
+
+	if lock == nil {
+		result = fmt.Sprintf("Catalog '%v' is not locked\n", manager.CatalogUri)
+	} else {
+		result = fmt.Sprintf("Catalog '%v' is %v\n", manager.CatalogUri, lock)
+	}
+	return
+}
+
+// Remove the lock held on a catalog, such as one left behind by a crashed process
+// Unless force is set, refuse to break a lock that has not expired, since its holder may still be working
+func breakLockAction(catalogUri string, force bool) (result string, err error) {
+	var lock *caryatid.CatalogLock
+
+	manager, err := getManager(catalogUri)
+	if err != nil {
+		log.Printf("Error getting a BackendManager")
+		return
+	}
+	if lock, err = manager.LockStatus(); err != nil {
+		return
+	}
+
+	if lock == nil {
+		result = fmt.Sprintf("Catalog '%v' is not locked\n", manager.CatalogUri)
+		return
+	} else if !lock.Expired() && !force {
+		err = fmt.Errorf("Catalog '%v' is %v\nMake sure its holder is no longer running, then pass -force to break the lock anyway", manager.CatalogUri, lock)
+		return
+	}
+	if err = manager.BreakLock(); err != nil {
+		return
+	}
+	result = fmt.Sprintf("Broke lock on catalog '%v', which was %v\n", manager.CatalogUri, lock)
 	return
 }
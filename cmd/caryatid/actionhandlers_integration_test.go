@@ -143,7 +143,7 @@ func TestAddAction(t *testing.T) {
 	}
 
 	// Test adding to an empty catalog
-	err = addAction(boxPath, boxName, boxDesc, boxVersion, catalogUri)
+	_, err = addAction(boxPath, boxName, boxDesc, boxVersion, catalogUri, "", "", false)
 	if err != nil {
 		t.Fatalf("addAction() failed with error: %v\n", err)
 	}
@@ -170,7 +170,7 @@ func TestAddAction(t *testing.T) {
 	}
 
 	// Test adding another box to the same, now non-empty, catalog
-	err = addAction(boxPath, boxName, boxDesc, boxVersion2, catalogUri)
+	_, err = addAction(boxPath, boxName, boxDesc, boxVersion2, catalogUri, "", "", false)
 	if err != nil {
 		t.Fatalf("addAction() failed with error: %v\n", err)
 	}
@@ -515,7 +515,7 @@ func TestDeleteAction(t *testing.T) {
 			}
 		}
 
-		if err = deleteAction(catalogUri, tc.VersionQuery, tc.ProviderQuery); err != nil {
+		if _, err = deleteAction(catalogUri, tc.VersionQuery, tc.ProviderQuery, "", false); err != nil {
 			t.Fatalf("deleteAction(*, *, '%v', '%v') returned an unexpected error: %v\n", tc.VersionQuery, tc.ProviderQuery, err)
 		}
 
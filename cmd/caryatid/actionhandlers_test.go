@@ -1,7 +1,11 @@
 package main
 
 import (
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/mrled/caryatid/pkg/caryatid"
 )
 
 type IoPair struct {
@@ -16,6 +20,7 @@ func TestTestValidUri(t *testing.T) {
 		IoPair{"file:///usr/local/bin", true},
 		IoPair{"http://google.com/evil.txt", true},
 		IoPair{"s3://bucket_name/some/key/value", true},
+		IoPair{"git+ssh://git@example.com/catalogs.git#catalog.json", true},
 	}
 
 	for _, pair := range ioPairs {
@@ -30,6 +35,7 @@ func TestGetManager(t *testing.T) {
 		IoPair{"file://whatever", true},
 		IoPair{"file:///whatever", true},
 		IoPair{"whatever", true},
+		IoPair{"https://example.com/whatever.json", true},
 		IoPair{"invalidbackend://whatever", false},
 	}
 
@@ -46,3 +52,202 @@ func TestGetManager(t *testing.T) {
 		}
 	}
 }
+
+func TestBackendsAction(t *testing.T) {
+	result := backendsAction()
+	for _, scheme := range []string{"file", "s3", "sftp"} {
+		if !strings.Contains(result, scheme+"\n") {
+			t.Fatalf("backendsAction() result did not include '%v':\n%v", scheme, result)
+		}
+	}
+}
+
+func TestAddStreamAction(t *testing.T) {
+	var (
+		catalogUri = "mem://add-stream/StreamBox.json"
+		boxUri     = "mem://add-stream/StreamBox/StreamBox_1.0.0_virtualbox.box"
+	)
+
+	store := caryatid.GetMemoryStore("add-stream")
+	store.Reset()
+	if _, err := addStreamAction(strings.NewReader("streamed box"), "virtualbox", "StreamBox", "desc", "1.0.0", catalogUri, "", "", false); err != nil {
+		t.Fatalf("addStreamAction() failed with error: %v", err)
+	}
+	if contents, _ := store.ReadFile(boxUri); string(contents) != "streamed box" {
+		t.Fatalf("addStreamAction() did not store the box at '%v'; the store has %v", boxUri, store.Files())
+	}
+
+	catalog, err := queryAction(catalogUri, "", "")
+	if err != nil {
+		t.Fatalf("queryAction() failed with error: %v", err)
+	}
+	if refs := catalog.BoxReferences(); len(refs) != 1 || refs[0].Uri != boxUri || refs[0].ProviderName != "virtualbox" {
+		t.Fatalf("addStreamAction() did not add the box to the catalog:\n%v", catalog.DisplayString())
+	}
+}
+
+func TestDeleteActionDryRun(t *testing.T) {
+	var (
+		catalogUri = "mem://delete-dry-run/DryRunBox.json"
+		boxUri     = "mem://delete-dry-run/DryRunBox/DryRunBox_1.0.0_virtualbox.box"
+	)
+
+	store := caryatid.GetMemoryStore("delete-dry-run")
+	store.Reset()
+	manager, err := getManager(catalogUri)
+	if err != nil {
+		t.Fatalf("Error getting manager: %v", err)
+	}
+	catalog := caryatid.Catalog{Name: "DryRunBox"}
+	catalog.AddBox(catalogUri, "DryRunBox", "desc", "1.0.0", "virtualbox", "sha1", "0xDECAFBAD")
+	if err = manager.SaveCatalog(catalog); err != nil {
+		t.Fatalf("Error saving catalog: %v", err)
+	}
+	store.WriteFile(boxUri, []byte("box"))
+
+	result, err := deleteAction(catalogUri, "1.0.0", "", "", true)
+	if err != nil {
+		t.Fatalf("deleteAction() failed with error: %v", err)
+	}
+	if !strings.Contains(result, "Would delete "+boxUri) {
+		t.Fatalf("deleteAction() dry run result did not mention deleting the box:\n%v", result)
+	}
+	if len(store.Operations()) != 2 {
+		t.Fatalf("deleteAction() dry run modified the store: %v", store.Operations())
+	}
+}
+
+func TestBreakLockAction(t *testing.T) {
+	catalogUri := "mem://break-lock/LockBox.json"
+	caryatid.GetMemoryStore("break-lock").Reset()
+
+	manager, err := getManager(catalogUri)
+	if err != nil {
+		t.Fatalf("Error getting manager: %v", err)
+	}
+	if err = manager.Lock("crashed-job", time.Hour); err != nil {
+		t.Fatalf("Error taking lock: %v", err)
+	}
+
+	result, err := lockStatusAction(catalogUri)
+	if err != nil || !strings.Contains(result, "crashed-job") {
+		t.Fatalf("lockStatusAction() did not describe the lock; returned '%v' and error '%v'", result, err)
+	}
+	if _, err = breakLockAction(catalogUri, false); err == nil {
+		t.Fatalf("breakLockAction() broke a lock that had not expired without -force")
+	}
+	if _, err = breakLockAction(catalogUri, true); err != nil {
+		t.Fatalf("breakLockAction() failed with error: %v", err)
+	}
+	if result, err = lockStatusAction(catalogUri); err != nil || !strings.Contains(result, "not locked") {
+		t.Fatalf("Catalog was still locked after breakLockAction(); lockStatusAction() returned '%v' and error '%v'", result, err)
+	}
+}
+
+func TestRefreshUrlsActionDryRun(t *testing.T) {
+	catalogUri := "mem://refresh-urls/RefreshBox.json"
+	store := caryatid.GetMemoryStore("refresh-urls")
+	store.Reset()
+
+	manager, err := getManager(catalogUri)
+	if err != nil {
+		t.Fatalf("Error getting manager: %v", err)
+	}
+	catalog := caryatid.Catalog{Name: "RefreshBox"}
+	catalog.AddBox(catalogUri, "RefreshBox", "desc", "1.0.0", "virtualbox", "sha1", "0xDECAFBAD")
+	if err = manager.SaveCatalog(catalog); err != nil {
+		t.Fatalf("Error saving catalog: %v", err)
+	}
+
+	result, err := refreshUrlsAction(catalogUri, "https://cdn.example.com/boxes", true)
+	if err != nil {
+		t.Fatalf("refreshUrlsAction() failed with error: %v", err)
+	}
+	if !strings.Contains(result, "Refreshed 1 box URLs") || !strings.Contains(result, "Would write "+catalogUri) {
+		t.Fatalf("refreshUrlsAction() dry run result did not describe the refresh:\n%v", result)
+	}
+	if len(store.Operations()) != 1 {
+		t.Fatalf("refreshUrlsAction() dry run modified the store: %v", store.Operations())
+	}
+}
+
+func TestFsckAction(t *testing.T) {
+	var (
+		catalogUri = "mem://fsck/FsckBox.json"
+		boxUri     = "mem://fsck/FsckBox/FsckBox_1.0.0_virtualbox.box"
+		orphanUri  = "mem://fsck/FsckBox/FsckBox_0.9.0_virtualbox.box"
+	)
+
+	store := caryatid.GetMemoryStore("fsck")
+	store.Reset()
+	manager, err := getManager(catalogUri)
+	if err != nil {
+		t.Fatalf("Error getting manager: %v", err)
+	}
+	catalog := caryatid.Catalog{Name: "FsckBox"}
+	catalog.AddBox(catalogUri, "FsckBox", "desc", "1.0.0", "virtualbox", "sha1", "0xDECAFBAD")
+	if err = manager.SaveCatalog(catalog); err != nil {
+		t.Fatalf("Error saving catalog: %v", err)
+	}
+	store.WriteFile(boxUri, []byte("box"))
+	store.WriteFile(orphanUri, []byte("old box"))
+
+	result, err := fsckAction(catalogUri, "", "", false)
+	if err == nil || !strings.Contains(result, "Orphaned file: "+orphanUri) {
+		t.Fatalf("fsckAction() did not report the orphaned file; returned '%v' and error '%v'", result, err)
+	}
+	if result, err = fsckAction(catalogUri, "", "", true); err != nil || !strings.Contains(result, "deleted 1 orphaned files") {
+		t.Fatalf("fsckAction() did not fix the orphaned file; returned '%v' and error '%v'", result, err)
+	}
+	if result, err = fsckAction(catalogUri, "", "", false); err != nil || !strings.Contains(result, "matches its storage") {
+		t.Fatalf("fsckAction() found problems after fixing them; returned '%v' and error '%v'", result, err)
+	}
+}
+
+func TestRecoverAction(t *testing.T) {
+	catalogUri := "mem://recover/RecoverBox.json"
+	store := caryatid.GetMemoryStore("recover")
+	store.Reset()
+	store.WriteFile("mem://recover/RecoverBox/RecoverBox_1.0.0_virtualbox.box", []byte("box"))
+	store.WriteFile("mem://recover/RecoverBox/notes.txt", []byte("not a box"))
+
+	result, err := recoverAction(catalogUri, "RecoverBox", "Recovered", "", false, false)
+	if err != nil {
+		t.Fatalf("recoverAction() failed with error: %v", err)
+	}
+	if !strings.Contains(result, "Skipped mem://recover/RecoverBox/notes.txt") || !strings.Contains(result, "v1.0.0") {
+		t.Fatalf("recoverAction() result did not describe the recovery:\n%v", result)
+	}
+	if _, err = recoverAction(catalogUri, "RecoverBox", "Recovered", "", false, false); err == nil {
+		t.Fatalf("recoverAction() replaced a catalog with boxes in it without -force")
+	}
+}
+
+func TestMigrateAction(t *testing.T) {
+	fromStore := caryatid.GetMemoryStore("migrate-from")
+	fromStore.Reset()
+	toStore := caryatid.GetMemoryStore("migrate-to")
+	toStore.Reset()
+	fromStore.WriteFile("mem://migrate-from/MigrateBox.json", []byte(`{"name": "MigrateBox", "versions": [{"version": "1.0.0", "providers": [
+		{"name": "virtualbox", "url": "https://cdn.example.com/MigrateBox/MigrateBox_1.0.0_virtualbox.box", "checksum_type": "sha1", "checksum": "c7d8a6d722a1ec9a16fae165177c418d4fd63175"}]}]}`))
+	fromStore.WriteFile("mem://migrate-from/MigrateBox/MigrateBox_1.0.0_virtualbox.box", []byte("box"))
+
+	if _, err := migrateAction("mem://migrate-from/MigrateBox.json", "", "mem://migrate-to/MigrateBox.json", "", "", "", "", false); err == nil {
+		t.Fatalf("migrateAction() copied a box without its public base URL")
+	}
+	result, err := migrateAction("mem://migrate-from/MigrateBox.json", "https://cdn.example.com", "mem://migrate-to/MigrateBox.json", "", "", "", "", false)
+	if err != nil {
+		t.Fatalf("migrateAction() failed with error: %v", err)
+	}
+	if !strings.Contains(result, "Copied version 1.0.0 provider virtualbox to mem://migrate-to/MigrateBox/MigrateBox_1.0.0_virtualbox.box") {
+		t.Fatalf("migrateAction() result did not describe the migration:\n%v", result)
+	}
+
+	result, err = migrateAction("mem://migrate-from/MigrateBox.json", "https://cdn.example.com", "mem://migrate-to/MigrateBox.json", "", "", "", "", true)
+	if err != nil {
+		t.Fatalf("migrateAction() failed to mirror with error: %v", err)
+	}
+	if !strings.Contains(result, "Copied 0 boxes") || !strings.Contains(result, "1 were already up to date") {
+		t.Fatalf("migrateAction() result did not describe the mirror:\n%v", result)
+	}
+}
@@ -24,6 +24,15 @@ var (
 	descriptionFlag string
 	providerFlag    string
 	nameFlag        string
+	publicBaseFlag  string
+	boxPathFlag     string
+	fromFlag        string
+	fromPublicFlag  string
+	toFlag          string
+	dryRunFlag      bool
+	forceFlag       bool
+	fixFlag         bool
+	checkFlag       bool
 )
 
 func init() {
@@ -36,30 +45,95 @@ func init() {
 		fmt.Printf("EXAMPLE: Add a box to a catalog:\n")
 		fmt.Printf("caryatid add -catalog uri:///path/to/catalog.json -name testbox -description 'this is a test box' -box /local/path/to/name.box -version 1.2.5\n\n")
 
+		fmt.Printf("EXAMPLE: Add a box to a catalog in S3, served to Vagrant clients from a CDN:\n")
+		fmt.Printf("caryatid add -catalog s3://bucket/boxes/catalog.json -public-base-url https://cdn.example.com/boxes -name testbox -description 'this is a test box' -box /local/path/to/name.box -version 1.2.5\n\n")
+
+		fmt.Printf("EXAMPLE: Add a box to a catalog, storing it under a name derived from its checksum:\n")
+		fmt.Printf("caryatid add -catalog uri:///path/to/catalog.json -name testbox -description 'this is a test box' -box /local/path/to/name.box -version 1.2.5 -box-path 'blobs/{{.Name}}/{{.Checksum}}.box'\n\n")
+
+		fmt.Printf("EXAMPLE: Add a box streamed from another build host, without saving it to local disk first:\n")
+		fmt.Printf("ssh buildhost cat /path/to/name.box | caryatid add -catalog s3://bucket/boxes/catalog.json -name testbox -description 'this is a test box' -provider virtualbox -box - -version 1.2.5\n\n")
+
+		fmt.Printf("EXAMPLE: Show what deleting old boxes would do, without changing the catalog:\n")
+		fmt.Printf("caryatid delete -catalog uri:///path/to/catalog.json -version '<1.2.5' -dry-run\n\n")
+
+		fmt.Printf("EXAMPLE: Clear a lock left behind on a catalog by a crashed CI job:\n")
+		fmt.Printf("caryatid lock-status -catalog s3://bucket/boxes/catalog.json\n")
+		fmt.Printf("caryatid break-lock -catalog s3://bucket/boxes/catalog.json -force\n\n")
+
+		fmt.Printf("EXAMPLE: Re-sign the presigned box URLs in a catalog in a private S3 bucket, such as from a daily cron job:\n")
+		fmt.Printf("caryatid refresh-urls -catalog 's3://bucket/boxes/catalog.json?presign=168h'\n\n")
+
+		fmt.Printf("EXAMPLE: Find box files that a catalog doesn't reference, and catalog entries whose box files are missing, then clean them up:\n")
+		fmt.Printf("caryatid fsck -catalog s3://bucket/boxes/catalog.json\n")
+		fmt.Printf("caryatid fsck -catalog s3://bucket/boxes/catalog.json -fix\n\n")
+
+		fmt.Printf("EXAMPLE: Rebuild a deleted or corrupted catalog from the box files under s3://bucket/boxes/testbox/:\n")
+		fmt.Printf("caryatid recover -catalog s3://bucket/boxes/catalog.json -name testbox -description 'this is a test box' -check-provider\n\n")
+
+		fmt.Printf("EXAMPLE: Move a catalog and its boxes from a local directory to S3:\n")
+		fmt.Printf("caryatid migrate -from file:///srv/boxes/catalog.json -to s3://bucket/boxes/catalog.json\n\n")
+
+		fmt.Printf("EXAMPLE: Copy new and changed boxes to a disaster recovery replica, such as from a nightly cron job:\n")
+		fmt.Printf("caryatid mirror -from s3://bucket/boxes/catalog.json -to 's3://replica/boxes/catalog.json?region=us-west-2'\n\n")
+
+		fmt.Printf("EXAMPLE: Mirror the virtualbox boxes from version 2.0.0 on in a catalog that Caryatid doesn't manage, such as for an air-gapped network:\n")
+		fmt.Printf("caryatid mirror -from https://example.com/path/to/catalog.json -to file:///srv/boxes/catalog.json -version '>=2.0.0' -provider virtualbox\n\n")
+
 		fmt.Printf("EXAMPLE: Query a catalog:\n")
 		fmt.Printf("caryatid query -catalog uri:///path/to/catalog.json -version '>=1.2.5'\n\n")
+
+		fmt.Printf("EXAMPLE: Query a catalog that Caryatid doesn't manage:\n")
+		fmt.Printf("caryatid query -catalog https://example.com/path/to/catalog.json -provider virtualbox\n\n")
 	}
 
 	cFlag.StringVar(
 		&actionFlag, "action", "",
-		"One of 'show', 'create-test-box', 'query', 'add', or 'delete'.")
+		"One of 'show', 'create-test-box', 'query', 'add', 'delete', 'refresh-urls', 'fsck', 'recover', 'migrate', 'mirror', 'lock-status', 'break-lock', or 'backends'.")
 	cFlag.StringVar(
 		&catalogFlag, "catalog", "",
 		"URI for the Vagrant Catalog to operate on")
 	cFlag.StringVar(
-		&boxFlag, "box", "", "Local path to a box file")
+		&boxFlag, "box", "", "Local path to a box file. When adding a box, '-' reads the box from standard input, and -provider must be passed too.")
 	cFlag.StringVar(
 		&versionFlag, "version", "",
-		"A version specifier. When querying boxes or deleting a box, this restricts the query to only the versions matched, and its value may include specifiers such as less-than signs, like '<=1.2.3'. When adding a box, the version must be exact, and such specifiers are not supported.")
+		"A version specifier. When querying boxes, deleting a box, or migrating or mirroring a catalog, this restricts the query to only the versions matched, and its value may include specifiers such as less-than signs, like '<=1.2.3'. When adding a box, the version must be exact, and such specifiers are not supported.")
 	cFlag.StringVar(
 		&descriptionFlag, "description", "",
 		"A description for a box in the Vagrant catalog")
 	cFlag.StringVar(
 		&providerFlag, "provider", "",
-		"The name of a provider. When querying boxes or deleting a box, this restricts the query to only the providers matched, and its value may include asterisks to glob such as '*-iso'. When adding a box, globbing is not supported and an asterisk will be interpreted literally.")
+		"The name of a provider. When querying boxes, deleting a box, or migrating or mirroring a catalog, this restricts the query to only the providers matched, and its value may include asterisks to glob such as '*-iso'. When adding a box, globbing is not supported and an asterisk will be interpreted literally.")
 	cFlag.StringVar(
 		&nameFlag, "name", "",
-		"The name of the box tracked in the Vagrant catalog. When deleting a box, this restricts the query to only boxes matching this name, and may include asterisks for globbing. When adding a box, globbing is not supported and an asterisk will be interpreted literally.")
+		"The name of the box tracked in the Vagrant catalog. When recovering a catalog, box files are found in the directory for this name. When deleting a box, this restricts the query to only boxes matching this name, and may include asterisks for globbing. When adding a box, globbing is not supported and an asterisk will be interpreted literally.")
+	cFlag.StringVar(
+		&publicBaseFlag, "public-base-url", "",
+		"An optional base URL that Vagrant clients download boxes from, like 'https://cdn.example.com/boxes'. When adding a box, the box is written next to the catalog, but its URL in the catalog is relative to this URL instead. When deleting a box or refreshing box URLs, pass the same value so that box URLs in the catalog can be mapped back to the catalog's storage.")
+	cFlag.StringVar(
+		&boxPathFlag, "box-path", "",
+		"When adding a box, or migrating or mirroring a catalog, where to write boxes relative to the catalog's directory, as a Go template using {{.Name}}, {{.Version}}, {{.Provider}}, {{.Arch}}, {{.ChecksumType}} and {{.Checksum}}. Defaults to '"+caryatid.DefaultBoxPathTemplate+"'. When checking a catalog with fsck, pass the same value so that its boxes can be found.")
+	cFlag.StringVar(
+		&fromFlag, "from", "",
+		"When migrating or mirroring a catalog, the URI of the catalog to copy from")
+	cFlag.StringVar(
+		&fromPublicFlag, "from-public-base-url", "",
+		"When migrating or mirroring a catalog, the public base URL that boxes in the catalog being copied from were added with, if any. The -public-base-url flag applies to the catalog being copied to.")
+	cFlag.StringVar(
+		&toFlag, "to", "",
+		"When migrating or mirroring a catalog, the URI of the catalog to copy to")
+	cFlag.BoolVar(
+		&dryRunFlag, "dry-run", false,
+		"When adding or deleting a box, or refreshing box URLs, print the changes that would be made to the catalog and its storage, without making them.")
+	cFlag.BoolVar(
+		&forceFlag, "force", false,
+		"When breaking a lock, break it even if it has not expired. When recovering a catalog, replace it even if it can still be read and has boxes in it.")
+	cFlag.BoolVar(
+		&fixFlag, "fix", false,
+		"When checking a catalog with fsck, drop catalog entries whose box files are missing, and delete box files that the catalog does not reference.")
+	cFlag.BoolVar(
+		&checkFlag, "check-provider", false,
+		"When recovering a catalog, open each box file and skip it unless its metadata.json names the same provider as its file name.")
 }
 
 func main() {
@@ -98,7 +172,15 @@ func main() {
 		if boxFlag == "" || nameFlag == "" || descriptionFlag == "" || versionFlag == "" || catalogFlag == "" {
 			missingFlags("box", "name", "description", "version", "catalog")
 		}
-		err = addAction(boxFlag, nameFlag, descriptionFlag, versionFlag, catalogFlag)
+		if boxFlag == "-" {
+			if providerFlag == "" {
+				missingFlags("provider")
+			}
+			result, err = addStreamAction(os.Stdin, providerFlag, nameFlag, descriptionFlag, versionFlag, catalogFlag, publicBaseFlag, boxPathFlag, dryRunFlag)
+		} else {
+			result, err = addAction(boxFlag, nameFlag, descriptionFlag, versionFlag, catalogFlag, publicBaseFlag, boxPathFlag, dryRunFlag)
+		}
+		fmt.Printf("%v", result)
 	case "query":
 		if catalogFlag == "" {
 			missingFlags("catalog")
@@ -115,7 +197,46 @@ func main() {
 			cFlag.Usage()
 			os.Exit(1)
 		}
-		err = deleteAction(catalogFlag, versionFlag, providerFlag)
+		result, err = deleteAction(catalogFlag, versionFlag, providerFlag, publicBaseFlag, dryRunFlag)
+		fmt.Printf("%v", result)
+	case "refresh-urls":
+		if catalogFlag == "" {
+			missingFlags("catalog")
+		}
+		result, err = refreshUrlsAction(catalogFlag, publicBaseFlag, dryRunFlag)
+		fmt.Printf("%v", result)
+	case "fsck":
+		if catalogFlag == "" {
+			missingFlags("catalog")
+		}
+		result, err = fsckAction(catalogFlag, publicBaseFlag, boxPathFlag, fixFlag)
+		fmt.Printf("%v", result)
+	case "recover":
+		if catalogFlag == "" || nameFlag == "" {
+			missingFlags("catalog", "name")
+		}
+		result, err = recoverAction(catalogFlag, nameFlag, descriptionFlag, publicBaseFlag, checkFlag, forceFlag)
+		fmt.Printf("%v", result)
+	case "migrate", "mirror":
+		if fromFlag == "" || toFlag == "" {
+			missingFlags("from", "to")
+		}
+		result, err = migrateAction(fromFlag, fromPublicFlag, toFlag, publicBaseFlag, boxPathFlag, versionFlag, providerFlag, actionFlag == "mirror")
+		fmt.Printf("%v", result)
+	case "lock-status":
+		if catalogFlag == "" {
+			missingFlags("catalog")
+		}
+		result, err = lockStatusAction(catalogFlag)
+		fmt.Printf("%v", result)
+	case "break-lock":
+		if catalogFlag == "" {
+			missingFlags("catalog")
+		}
+		result, err = breakLockAction(catalogFlag, forceFlag)
+		fmt.Printf("%v", result)
+	case "backends":
+		fmt.Printf("%v", backendsAction())
 	default:
 		fmt.Printf("Unknown (or missing) -action: '%v'\n", actionFlag)
 		cFlag.Usage()
@@ -9,6 +9,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/hashicorp/packer/common"
 	"github.com/hashicorp/packer/helper/config"
@@ -40,6 +41,40 @@ type Config struct {
 	// Whether to keep the input artifact
 	KeepInputArtifact bool `mapstructure:"keep_input_artifact"`
 
+	// An optional base URL that Vagrant clients download boxes from
+	// Boxes are still written next to the catalog, but their URLs in the catalog are relative to this
+	PublicBaseUrl string `mapstructure:"public_base_url"`
+
+	// Where to write the box, relative to the catalog's directory, as a Go template like "{{.Name}}/{{.Version}}/{{.Provider}}.box"
+	// The fields are those of caryatid.BoxPathParams; defaults to caryatid.DefaultBoxPathTemplate
+	BoxPathTemplate string `mapstructure:"box_path_template"`
+
+	// Settings for the S3 backend
+	// These take precedence over the equivalent query parameters in the catalog URI
+	S3Endpoint  string `mapstructure:"s3_endpoint"`
+	S3Region    string `mapstructure:"s3_region"`
+	S3Profile   string `mapstructure:"s3_profile"`
+	S3PathStyle bool   `mapstructure:"s3_path_style"`
+
+	// If set, write presigned S3 URLs that expire after this long into the catalog, like "168h"
+	S3PresignExpiry time.Duration `mapstructure:"s3_presign_expiry"`
+
+	// Options for the catalog object in the S3 backend
+	S3CatalogSSE          string `mapstructure:"s3_catalog_sse"`
+	S3CatalogSSEKMSKeyId  string `mapstructure:"s3_catalog_sse_kms_key_id"`
+	S3CatalogStorageClass string `mapstructure:"s3_catalog_storage_class"`
+	S3CatalogACL          string `mapstructure:"s3_catalog_acl"`
+	S3CatalogCacheControl string `mapstructure:"s3_catalog_cache_control"`
+	S3CatalogContentType  string `mapstructure:"s3_catalog_content_type"`
+
+	// Options for box objects in the S3 backend
+	S3BoxSSE          string `mapstructure:"s3_box_sse"`
+	S3BoxSSEKMSKeyId  string `mapstructure:"s3_box_sse_kms_key_id"`
+	S3BoxStorageClass string `mapstructure:"s3_box_storage_class"`
+	S3BoxACL          string `mapstructure:"s3_box_acl"`
+	S3BoxCacheControl string `mapstructure:"s3_box_cache_control"`
+	S3BoxContentType  string `mapstructure:"s3_box_content_type"`
+
 	ctx interpolate.Context
 }
 
@@ -53,6 +88,10 @@ func (pp *CaryatidPostProcessor) Configure(raws ...interface{}) error {
 		&config.DecodeOpts{
 			Interpolate:        true,
 			InterpolateContext: &pp.config.ctx,
+			// The box path template uses the same syntax as Packer's own templates, but is rendered by Caryatid
+			InterpolateFilter: &interpolate.RenderFilter{
+				Exclude: []string{"box_path_template"},
+			},
 		},
 		raws...)
 	if err != nil {
@@ -65,6 +104,9 @@ func (pp *CaryatidPostProcessor) Configure(raws ...interface{}) error {
 	if pp.config.CatalogUri == "" {
 		return fmt.Errorf("CatalogUri required")
 	}
+	if _, err = caryatid.ParseBoxPathTemplate(pp.config.BoxPathTemplate); err != nil {
+		return fmt.Errorf("Invalid box_path_template: %v", err)
+	}
 
 	return nil
 }
@@ -85,7 +127,34 @@ func (pp *CaryatidPostProcessor) PostProcess(ui packer.Ui, artifact packer.Artif
 		log.Printf("PostProcess(): Error trying to get backend: %v\n", err)
 		return
 	}
+	if s3Backend, ok := backend.(*caryatid.CaryatidS3Backend); ok {
+		s3Backend.Settings = caryatid.S3Settings{
+			Endpoint:      pp.config.S3Endpoint,
+			Region:        pp.config.S3Region,
+			Profile:       pp.config.S3Profile,
+			PathStyle:     pp.config.S3PathStyle,
+			PresignExpiry: pp.config.S3PresignExpiry,
+			Catalog: caryatid.S3ObjectOptions{
+				ServerSideEncryption: pp.config.S3CatalogSSE,
+				SSEKMSKeyId:          pp.config.S3CatalogSSEKMSKeyId,
+				StorageClass:         pp.config.S3CatalogStorageClass,
+				ACL:                  pp.config.S3CatalogACL,
+				CacheControl:         pp.config.S3CatalogCacheControl,
+				ContentType:          pp.config.S3CatalogContentType,
+			},
+			Box: caryatid.S3ObjectOptions{
+				ServerSideEncryption: pp.config.S3BoxSSE,
+				SSEKMSKeyId:          pp.config.S3BoxSSEKMSKeyId,
+				StorageClass:         pp.config.S3BoxStorageClass,
+				ACL:                  pp.config.S3BoxACL,
+				CacheControl:         pp.config.S3BoxCacheControl,
+				ContentType:          pp.config.S3BoxContentType,
+			},
+		}
+	}
 	manager := caryatid.NewBackendManager(pp.config.CatalogUri, &backend)
+	manager.PublicBaseUri = pp.config.PublicBaseUrl
+	manager.BoxPathTemplate = pp.config.BoxPathTemplate
 
 	err = manager.AddBox(inBoxFile, pp.config.Name, pp.config.Description, pp.config.Version, provider, digestType, digest)
 	if err != nil {
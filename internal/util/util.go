@@ -5,10 +5,20 @@ This package contains generic functions used by caryatid. It should not be used
 package util
 
 import (
+	"crypto/md5"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
+	"fmt"
+	"hash"
 	"io"
+	"math/rand"
 	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
 )
 
 // PathExists tests whether path exists
@@ -18,6 +28,43 @@ func PathExists(path string) bool {
 	return !os.IsNotExist(err)
 }
 
+// HomeDir returns the current user's home directory, from $HOME if it is set
+func HomeDir() (home string, err error) {
+	if home = os.Getenv("HOME"); home != "" {
+		return
+	}
+	current, err := user.Current()
+	if err != nil {
+		return
+	}
+	return current.HomeDir, nil
+}
+
+// CacheDir returns the directory for the current user's cached data,
+// like %LOCALAPPDATA% on Windows, ~/Library/Caches on macOS, and $XDG_CACHE_HOME or ~/.cache elsewhere
+func CacheDir() (cacheDir string, err error) {
+	var home string
+	switch runtime.GOOS {
+	case "windows":
+		if cacheDir = os.Getenv("LOCALAPPDATA"); cacheDir == "" {
+			err = fmt.Errorf("%%LOCALAPPDATA%% is not set")
+		}
+		return
+	case "darwin":
+		if home, err = HomeDir(); err != nil {
+			return
+		}
+		return filepath.Join(home, "Library", "Caches"), nil
+	}
+	if cacheDir = os.Getenv("XDG_CACHE_HOME"); cacheDir != "" {
+		return
+	}
+	if home, err = HomeDir(); err != nil {
+		return
+	}
+	return filepath.Join(home, ".cache"), nil
+}
+
 // Sha1sum returns the SHA1 hash for a file on the filesystem
 func Sha1sum(filePath string) (result string, err error) {
 	file, err := os.Open(filePath)
@@ -36,6 +83,46 @@ func Sha1sum(filePath string) (result string, err error) {
 	return
 }
 
+// NewHasher returns a hash for one of the checksum types that Vagrant understands:
+// md5, sha1, sha256, sha384, or sha512, in any case
+func NewHasher(checksumType string) (hasher hash.Hash, err error) {
+	switch strings.ToLower(checksumType) {
+	case "md5":
+		hasher = md5.New()
+	case "sha1":
+		hasher = sha1.New()
+	case "sha256":
+		hasher = sha256.New()
+	case "sha384":
+		hasher = sha512.New384()
+	case "sha512":
+		hasher = sha512.New()
+	default:
+		err = fmt.Errorf("Unsupported checksum type '%v'", checksumType)
+	}
+	return
+}
+
+// Checksum returns the hash for a file on the filesystem, using one of the checksum types that NewHasher understands
+func Checksum(filePath string, checksumType string) (result string, err error) {
+	hasher, err := NewHasher(checksumType)
+	if err != nil {
+		return
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	if _, err = io.Copy(hasher, file); err != nil {
+		return
+	}
+	result = hex.EncodeToString(hasher.Sum(nil))
+	return
+}
+
 // CopyFile copies a file
 func CopyFile(src string, dst string) (written int64, err error) {
 	in, err := os.Open(src)
@@ -65,3 +152,88 @@ func StringInSlice(slice []string, str string) bool {
 	}
 	return false
 }
+
+// WriteFileAtomic writes data to a file so that readers only ever see its old contents or all of its new contents
+// If the file already exists, its permissions are kept; otherwise it is created with perm, less the umask
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) (err error) {
+	_, err = writeAtomic(path, perm, func(out io.Writer) (int64, error) {
+		written, err := out.Write(data)
+		return int64(written), err
+	})
+	return
+}
+
+// CopyFileAtomic copies a file so that readers of dst only ever see its old contents or all of its new contents
+func CopyFileAtomic(src string, dst string) (written int64, err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	return CopyReaderAtomic(in, dst)
+}
+
+// CopyReaderAtomic copies everything from a reader to a file so that readers of dst only ever see its old contents or all of its new contents
+// If the reader fails partway through, dst is left alone
+func CopyReaderAtomic(src io.Reader, dst string) (written int64, err error) {
+	return writeAtomic(dst, 0666, func(out io.Writer) (int64, error) {
+		return io.Copy(out, src)
+	})
+}
+
+// Write a file by writing a temporary file in the same directory, syncing it to disk, and renaming it into place
+// The directory is synced too, so that the rename itself survives a crash
+// If the process is killed partway through, a hidden temporary file like ".name.tmp12345" may be left behind
+func writeAtomic(path string, perm os.FileMode, write func(io.Writer) (int64, error)) (written int64, err error) {
+	var (
+		tmpFile *os.File
+		tmpPath string
+	)
+	dir, name := filepath.Split(path)
+
+	for {
+		tmpPath = filepath.Join(dir, fmt.Sprintf(".%v.tmp%v", name, rand.Uint32()))
+		tmpFile, err = os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+		if !os.IsExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tmpFile.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	if info, statErr := os.Stat(path); statErr == nil {
+		if err = tmpFile.Chmod(info.Mode().Perm()); err != nil {
+			return
+		}
+	}
+	if written, err = write(tmpFile); err != nil {
+		return
+	}
+	if err = tmpFile.Sync(); err != nil {
+		return
+	}
+	if err = tmpFile.Close(); err != nil {
+		return
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return
+	}
+
+	// Windows cannot sync a directory, but makes renames durable on its own
+	if runtime.GOOS != "windows" {
+		var dirFile *os.File
+		if dirFile, err = os.Open(filepath.Clean(dir + ".")); err != nil {
+			return
+		}
+		defer dirFile.Close()
+		err = dirFile.Sync()
+	}
+	return
+}
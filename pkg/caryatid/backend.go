@@ -4,6 +4,13 @@ The interface for a Caryatid backend
 
 package caryatid
 
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+)
+
 type CaryatidBackend interface {
 	// Set the manager to an internal property so the backend can access its properties/methods
 	// This is an appropriate place for setup code, since it's always called from NewBackendManager()
@@ -30,3 +37,158 @@ type CaryatidBackend interface {
 	// such as "file" for a "file:///tmp/catalog.json" catalog
 	Scheme() string
 }
+
+// A backend whose URIs Vagrant cannot download from may also implement CaryatidFrontendBackend
+// The BackendManager uses it to record downloadable URIs in the catalog,
+// and to map those URIs back to the backend when deleting boxes
+type CaryatidFrontendBackend interface {
+	// Return the URI that Vagrant clients should use to download the file stored at a backend URI
+	FrontendUri(storageUri string) (string, error)
+
+	// Return the backend URI for the file that Vagrant clients download from a frontend URI
+	StorageUri(frontendUri string) (string, error)
+}
+
+// A backend that can detect concurrent changes to its catalog may also implement CaryatidVersionedBackend
+// The BackendManager uses it so that when two processes change the same catalog at once, neither change is lost
+type CaryatidVersionedBackend interface {
+	// Get the raw byte value held in the Vagrant catalog, along with an opaque version string for it
+	// The version is empty if the catalog does not exist yet
+	GetCatalogBytesVersion() ([]byte, string, error)
+
+	// Save a raw byte value to the Vagrant catalog, but only if the catalog is still at a version from GetCatalogBytesVersion()
+	// An empty version means that the catalog must not exist yet
+	// If the catalog has changed, return a *CatalogConflictError and leave the catalog alone
+	SetCatalogBytesIfVersion([]byte, string) error
+}
+
+// CatalogConflictError means that a catalog was changed by someone else between reading it and saving it
+type CatalogConflictError struct {
+	CatalogUri string
+	// The version the catalog was expected to be at
+	Expected string
+	// The version the catalog was actually at, if the backend knows it
+	Actual string
+}
+
+func (err *CatalogConflictError) Error() string {
+	return fmt.Sprintf("Catalog '%v' was changed by someone else: expected version '%v' but found version '%v'", err.CatalogUri, err.Expected, err.Actual)
+}
+
+// IsCatalogConflict returns true if an error is a *CatalogConflictError
+func IsCatalogConflict(err error) bool {
+	_, ok := err.(*CatalogConflictError)
+	return ok
+}
+
+// Return a version string for catalog contents, for backends that have nothing better to use
+// Nil contents have no version, since they represent a catalog that does not exist
+func catalogContentVersion(catalogBytes []byte) string {
+	if catalogBytes == nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(catalogBytes))
+}
+
+// A backend that can hold an advisory lock on its catalog may also implement CaryatidLockingBackend
+// While one BackendManager holds the lock, other BackendManagers refuse to change the catalog
+// This lets a long operation, like pruning old boxes, keep the catalog to itself from start to finish
+type CaryatidLockingBackend interface {
+	// Take the lock on the catalog
+	// If someone else holds a lock that has not expired, return a *CatalogLockedError
+	Lock(CatalogLock) error
+
+	// Release a lock taken with Lock()
+	Unlock() error
+
+	// Return the lock currently held on the catalog by anyone, or nil if it is not locked
+	LockStatus() (*CatalogLock, error)
+
+	// Remove any lock on the catalog, no matter who holds it
+	BreakLock() error
+}
+
+// A backend that can upload files to arbitrary URIs may also implement CaryatidUploadingBackend
+// The BackendManager uses it to store boxes at the path given by its BoxPathTemplate,
+// which CopyBoxFile cannot do
+type CaryatidUploadingBackend interface {
+	// Copy a local file to a URI, replacing any file already there
+	UploadFile(localPath string, uri string) error
+}
+
+// A backend that can tell whether a file exists may also implement CaryatidSizingBackend
+// The BackendManager uses it to verify uploads, and to avoid replacing a box that it could not restore
+type CaryatidSizingBackend interface {
+	// Return the size in bytes of the file at a URI, and whether it exists
+	// A size of -1 means the file exists but the backend could not tell how big it is
+	FileSize(uri string) (int64, bool, error)
+}
+
+// A backend that can upload files to arbitrary URIs and move them may also implement CaryatidStagingBackend
+// The BackendManager uses it to upload a box to a staging location, verify it, and move it into place
+// before publishing it in the catalog, so that a failed upload never leaves a catalog pointing at a broken box
+type CaryatidStagingBackend interface {
+	CaryatidUploadingBackend
+	CaryatidSizingBackend
+
+	// Move a file from one URI to another, replacing any file already there
+	MoveFile(fromUri string, toUri string) error
+}
+
+// A backend that can write and read files as streams may also implement CaryatidStreamingBackend
+// The BackendManager uses it to add boxes that are not on the local disk,
+// such as a box streamed from another build host or produced in a pipe
+// Catalogs are still read and written whole, with GetCatalogBytes() and SetCatalogBytes(), since they are small and parsed all at once
+type CaryatidStreamingBackend interface {
+	// Copy everything from a reader to a URI, replacing any file already there
+	// The size is the number of bytes the reader will return, or -1 if it is not known in advance
+	PutBox(ctx context.Context, uri string, reader io.Reader, size int64) error
+
+	// Open the file at a URI for reading
+	// The caller must close it
+	OpenBox(ctx context.Context, uri string) (io.ReadCloser, error)
+}
+
+// A reader that fails once its context is done, for backends whose writes do not take a context themselves
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (reader contextReader) Read(p []byte) (n int, err error) {
+	if err = reader.ctx.Err(); err != nil {
+		return
+	}
+	return reader.reader.Read(p)
+}
+
+// A file stored in a backend
+type BackendFile struct {
+	Uri  string
+	Size int64
+}
+
+// A backend that can enumerate the files it stores may also implement CaryatidListingBackend
+// The BackendManager uses it to reconcile a catalog with its storage
+type CaryatidListingBackend interface {
+	// List every file under a directory URI, including files in its subdirectories
+	// Each file's URI is the directory URI, a slash, and the file's path relative to the directory
+	// A directory that does not exist has no files
+	ListFiles(dirUri string) ([]BackendFile, error)
+}
+
+// A backend that can copy its files to the local filesystem may also implement CaryatidDownloadingBackend
+// The BackendManager uses it to examine box files that are already in storage
+type CaryatidDownloadingBackend interface {
+	// Copy the file at a URI to a local path, replacing any file already there
+	DownloadFile(uri string, localPath string) error
+}
+
+// A backend that keeps box files in another backend may also implement CaryatidDelegatingBackend,
+// such as one that stores its catalog somewhere that is no place for large binaries
+// The BackendManager reads and writes box files through the delegate,
+// and box paths are relative to the delegate's catalog URI instead of its own
+type CaryatidDelegatingBackend interface {
+	// Return the backend that box files are stored in, and the catalog URI that box paths are relative to
+	BoxDelegate() (CaryatidBackend, string)
+}
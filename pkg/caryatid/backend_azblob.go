@@ -0,0 +1,734 @@
+/*
+The Azure Blob Storage backend, for dealing with a Vagrant catalog in an Azure storage container
+
+It uses the Blob service REST API directly, so it also works with emulators like Azurite
+*/
+
+package caryatid
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The version of the Blob service REST API that the backend speaks, and that its SAS tokens are signed for
+const azureBlobApiVersion = "2020-02-10"
+
+// Files larger than this are uploaded in blocks of azureBlobBlockSize, rather than with a single request
+var azureBlobMaxPutSize int64 = 256 * 1024 * 1024
+
+// The size of each block when uploading larger files
+var azureBlobBlockSize int64 = 100 * 1024 * 1024
+
+// Settings for connecting to Azure Blob Storage or an emulator like Azurite
+// Each may also be set with a query parameter in the catalog URI,
+// like azblob://account/container/catalog.json?endpoint=http://127.0.0.1:10000/devstoreaccount1&presign=168h
+type AzureBlobSettings struct {
+	// The URL of the storage account's Blob service; the "endpoint" query parameter
+	// If empty, https://ACCOUNT.blob.core.windows.net is used
+	Endpoint string
+
+	// If set, write SAS URLs that expire after this long into the catalog, instead of azblob:// URIs,
+	// so Vagrant can download boxes from a private container; the "presign" query parameter, like presign=168h
+	// Signing URLs requires the account key
+	PresignExpiry time.Duration
+}
+
+// Fill in any settings that are not already set from the query parameters of an azblob:// URI
+func (settings *AzureBlobSettings) mergeQuery(query url.Values) (err error) {
+	if settings.Endpoint == "" {
+		settings.Endpoint = query.Get("endpoint")
+	}
+	if presign := query.Get("presign"); settings.PresignExpiry == 0 && presign != "" {
+		if settings.PresignExpiry, err = time.ParseDuration(presign); err != nil {
+			err = fmt.Errorf("Invalid value '%v' for the Azure Blob presign setting; expected a duration like 168h", presign)
+			return
+		}
+	}
+	if settings.PresignExpiry < 0 {
+		err = fmt.Errorf("Invalid Azure Blob presign expiry '%v'", settings.PresignExpiry)
+	}
+	return
+}
+
+type CaryatidAzureBlobBackend struct {
+	// Settings for connecting to Azure Blob Storage
+	// Any setting left empty here is taken from the query parameters of the catalog URI
+	Settings AzureBlobSettings
+
+	// The base64 storage account key, which signs requests with Shared Key authorization
+	// Taken from the AZURE_STORAGE_KEY environment variable if not set
+	AccountKey string
+
+	// A SAS token to add to each request, used if there is no account key
+	// Taken from the AZURE_STORAGE_SAS_TOKEN environment variable if not set
+	SasToken string
+
+	// The HTTP client to make requests with; http.DefaultClient if nil
+	HttpClient *http.Client
+
+	Manager *BackendManager
+
+	CatalogLocation *caryatidAzureBlobLocation
+
+	accountKey []byte
+
+	// The lock this backend holds on the catalog, if any
+	heldLock *CatalogLock
+}
+
+func init() {
+	RegisterBackend("azblob", func() CaryatidBackend { return &CaryatidAzureBlobBackend{} })
+}
+
+type caryatidAzureBlobLocation struct {
+	Account   string
+	Container string
+	Blob      string
+}
+
+// Get the account, container, and blob name from an azblob:// URI
+// Any query string is ignored, since it holds settings rather than part of the blob name
+func uri2azureblobLocation(uri string) (loc *caryatidAzureBlobLocation, err error) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "azblob" || u.Host == "" {
+		err = fmt.Errorf("Invalid Azure Blob URI '%v'; expected a URI like azblob://account/container/path", uri)
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)
+	if parts[0] == "" {
+		err = fmt.Errorf("Invalid Azure Blob URI '%v'; expected a URI like azblob://account/container/path", uri)
+		return
+	}
+
+	loc = &caryatidAzureBlobLocation{Account: u.Host, Container: parts[0]}
+	if len(parts) == 2 {
+		loc.Blob = parts[1]
+	}
+	return
+}
+
+func (loc *caryatidAzureBlobLocation) uri() string {
+	return fmt.Sprintf("azblob://%v/%v/%v", loc.Account, loc.Container, loc.Blob)
+}
+
+func (backend *CaryatidAzureBlobBackend) SetManager(manager *BackendManager) (err error) {
+	var u *url.URL
+
+	backend.Manager = manager
+
+	if u, err = url.Parse(backend.Manager.CatalogUri); err != nil {
+		return
+	}
+	if err = backend.Settings.mergeQuery(u.Query()); err != nil {
+		return
+	}
+	if backend.CatalogLocation, err = uri2azureblobLocation(backend.Manager.CatalogUri); err != nil {
+		return
+	}
+	if backend.Settings.Endpoint == "" {
+		backend.Settings.Endpoint = fmt.Sprintf("https://%v.blob.core.windows.net", backend.CatalogLocation.Account)
+	}
+	backend.Settings.Endpoint = strings.TrimSuffix(backend.Settings.Endpoint, "/")
+
+	if backend.AccountKey == "" {
+		backend.AccountKey = os.Getenv("AZURE_STORAGE_KEY")
+	}
+	if backend.SasToken == "" {
+		backend.SasToken = os.Getenv("AZURE_STORAGE_SAS_TOKEN")
+	}
+	backend.SasToken = strings.TrimPrefix(backend.SasToken, "?")
+	if backend.AccountKey != "" {
+		if backend.accountKey, err = base64.StdEncoding.DecodeString(backend.AccountKey); err != nil {
+			err = fmt.Errorf("Invalid Azure storage account key; expected base64: %v", err)
+			return
+		}
+	}
+	if backend.Settings.PresignExpiry != 0 && backend.accountKey == nil {
+		err = fmt.Errorf("Signing Azure Blob URLs requires the storage account key")
+		return
+	}
+
+	if backend.HttpClient == nil {
+		backend.HttpClient = http.DefaultClient
+	}
+	return
+}
+
+func (backend *CaryatidAzureBlobBackend) GetManager() (manager *BackendManager, err error) {
+	manager = backend.Manager
+	if manager == nil {
+		err = fmt.Errorf("The Manager property was not set")
+	}
+	return
+}
+
+// Return the URL of a blob, or of its container if the blob name is empty
+func (backend *CaryatidAzureBlobBackend) blobUrl(loc *caryatidAzureBlobLocation) string {
+	var segments []string
+	for _, segment := range strings.Split(loc.Blob, "/") {
+		segments = append(segments, url.PathEscape(segment))
+	}
+	blobUrl := backend.Settings.Endpoint + "/" + url.PathEscape(loc.Container)
+	if loc.Blob != "" {
+		blobUrl += "/" + strings.Join(segments, "/")
+	}
+	return blobUrl
+}
+
+// Return the string that Shared Key authorization signs for a request
+func azureSharedKeyStringToSign(method string, u *url.URL, header http.Header, contentLength int64, account string) string {
+	var (
+		contentLengthString string
+		headerNames         []string
+		canonicalHeaders    bytes.Buffer
+		queryNames          []string
+		canonicalResource   bytes.Buffer
+	)
+
+	if contentLength > 0 {
+		contentLengthString = strconv.FormatInt(contentLength, 10)
+	}
+
+	for name := range header {
+		if strings.HasPrefix(strings.ToLower(name), "x-ms-") {
+			headerNames = append(headerNames, name)
+		}
+	}
+	sort.Slice(headerNames, func(i, j int) bool { return strings.ToLower(headerNames[i]) < strings.ToLower(headerNames[j]) })
+	for _, name := range headerNames {
+		fmt.Fprintf(&canonicalHeaders, "%v:%v\n", strings.ToLower(name), strings.TrimSpace(strings.Join(header[name], ",")))
+	}
+
+	fmt.Fprintf(&canonicalResource, "/%v%v", account, u.EscapedPath())
+	query := u.Query()
+	for name := range query {
+		queryNames = append(queryNames, name)
+	}
+	sort.Strings(queryNames)
+	for _, name := range queryNames {
+		values := append([]string{}, query[name]...)
+		sort.Strings(values)
+		fmt.Fprintf(&canonicalResource, "\n%v:%v", strings.ToLower(name), strings.Join(values, ","))
+	}
+
+	return strings.Join([]string{
+		method,
+		header.Get("Content-Encoding"),
+		header.Get("Content-Language"),
+		contentLengthString,
+		header.Get("Content-MD5"),
+		header.Get("Content-Type"),
+		header.Get("Date"),
+		header.Get("If-Modified-Since"),
+		header.Get("If-Match"),
+		header.Get("If-None-Match"),
+		header.Get("If-Unmodified-Since"),
+		header.Get("Range"),
+	}, "\n") + "\n" + canonicalHeaders.String() + canonicalResource.String()
+}
+
+// Return the base64 HMAC-SHA256 of a string, signed with an account key
+func azureSign(key []byte, stringToSign string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Make an authorized request to the Blob service, returning the response whatever its status
+func (backend *CaryatidAzureBlobBackend) request(method string, requestUrl string, body io.Reader, contentLength int64, header http.Header) (resp *http.Response, err error) {
+	if backend.accountKey == nil && backend.SasToken != "" {
+		if strings.Contains(requestUrl, "?") {
+			requestUrl += "&" + backend.SasToken
+		} else {
+			requestUrl += "?" + backend.SasToken
+		}
+	}
+	req, err := http.NewRequest(method, requestUrl, body)
+	if err != nil {
+		return
+	}
+	req.ContentLength = contentLength
+	for name, values := range header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureBlobApiVersion)
+	if backend.accountKey != nil {
+		stringToSign := azureSharedKeyStringToSign(method, req.URL, req.Header, contentLength, backend.CatalogLocation.Account)
+		req.Header.Set("Authorization", fmt.Sprintf("SharedKey %v:%v", backend.CatalogLocation.Account, azureSign(backend.accountKey, stringToSign)))
+	}
+	return backend.HttpClient.Do(req)
+}
+
+// Make an authorized request, returning an error along with the response for any status other than a successful one
+// The caller must close the response body if there is no error
+func (backend *CaryatidAzureBlobBackend) requestExpect(method string, requestUrl string, body io.Reader, contentLength int64, header http.Header) (resp *http.Response, err error) {
+	if resp, err = backend.request(method, requestUrl, body, contentLength, header); err != nil {
+		return
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var apiError struct {
+			Message string `xml:"Message"`
+		}
+		responseBody, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		message := resp.Header.Get("x-ms-error-code")
+		if xml.Unmarshal(responseBody, &apiError) == nil && apiError.Message != "" {
+			message = strings.SplitN(apiError.Message, "\n", 2)[0]
+		}
+		err = fmt.Errorf("%v '%v' failed with status '%v': %v", method, requestUrl, resp.Status, message)
+	}
+	return
+}
+
+// Get a blob along with its ETag, which is used as its version
+// If the blob does not exist, return nil contents and an empty version
+func (backend *CaryatidAzureBlobBackend) getBlobVersion(blob string) (contents []byte, version string, err error) {
+	loc := &caryatidAzureBlobLocation{Account: backend.CatalogLocation.Account, Container: backend.CatalogLocation.Container, Blob: blob}
+	resp, err := backend.request("GET", backend.blobUrl(loc), nil, 0, nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		if resp.Header.Get("x-ms-error-code") == "ContainerNotFound" {
+			err = fmt.Errorf("Container '%v' does not exist in storage account '%v'", loc.Container, loc.Account)
+		}
+		return
+	} else if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("GET '%v' failed with status '%v': %v", loc.uri(), resp.Status, resp.Header.Get("x-ms-error-code"))
+		return
+	}
+
+	if contents, err = ioutil.ReadAll(resp.Body); err != nil {
+		return
+	}
+	version = resp.Header.Get("ETag")
+	return
+}
+
+// Upload a blob in a single request
+// The header may hold conditions like If-Match, in which case the status tells whether they failed
+func (backend *CaryatidAzureBlobBackend) putBlob(loc *caryatidAzureBlobLocation, body io.Reader, contentLength int64, contentType string, header http.Header) (status int, err error) {
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("x-ms-blob-type", "BlockBlob")
+	header.Set("Content-Type", contentType)
+	resp, err := backend.requestExpect("PUT", backend.blobUrl(loc), body, contentLength, header)
+	if resp != nil {
+		status = resp.StatusCode
+	}
+	if err == nil {
+		resp.Body.Close()
+	}
+	return
+}
+
+// Upload a large blob one block at a time, then commit the blocks
+func (backend *CaryatidAzureBlobBackend) putBlocks(loc *caryatidAzureBlobLocation, file io.Reader, size int64, contentType string) (err error) {
+	var (
+		resp     *http.Response
+		blockIds []string
+	)
+
+	for offset := int64(0); offset < size; offset += azureBlobBlockSize {
+		blockSize := azureBlobBlockSize
+		if offset+blockSize > size {
+			blockSize = size - offset
+		}
+		// Every block ID in a blob must be the same length
+		blockId := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("caryatid-block-%08d", len(blockIds))))
+		blockUrl := fmt.Sprintf("%v?comp=block&blockid=%v", backend.blobUrl(loc), url.QueryEscape(blockId))
+		if resp, err = backend.requestExpect("PUT", blockUrl, io.LimitReader(file, blockSize), blockSize, nil); err != nil {
+			return
+		}
+		resp.Body.Close()
+		blockIds = append(blockIds, blockId)
+	}
+
+	var blockList bytes.Buffer
+	blockList.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+	for _, blockId := range blockIds {
+		fmt.Fprintf(&blockList, "<Latest>%v</Latest>", blockId)
+	}
+	blockList.WriteString("</BlockList>")
+	header := http.Header{"x-ms-blob-content-type": {contentType}}
+	if resp, err = backend.requestExpect("PUT", backend.blobUrl(loc)+"?comp=blocklist", &blockList, int64(blockList.Len()), header); err != nil {
+		return
+	}
+	resp.Body.Close()
+	log.Printf("Uploaded %v blocks to '%v'\n", len(blockIds), loc.uri())
+	return
+}
+
+// Upload the catalog or its lease, but only if it is at a version from getBlobVersion()
+// An empty version means that the blob must not exist yet
+func (backend *CaryatidAzureBlobBackend) putBlobIfVersion(blob string, contents []byte, version string) (err error) {
+	var status int
+	header := http.Header{}
+	if version == "" {
+		header.Set("If-None-Match", "*")
+	} else {
+		header.Set("If-Match", version)
+	}
+	loc := &caryatidAzureBlobLocation{Account: backend.CatalogLocation.Account, Container: backend.CatalogLocation.Container, Blob: blob}
+	status, err = backend.putBlob(loc, bytes.NewReader(contents), int64(len(contents)), "application/json", header)
+	// 412 Precondition Failed means the ETag did not match, and 409 Conflict means the blob already exists
+	if status == http.StatusPreconditionFailed || status == http.StatusConflict {
+		return &CatalogConflictError{CatalogUri: loc.uri(), Expected: version}
+	}
+	return
+}
+
+func (backend *CaryatidAzureBlobBackend) GetCatalogBytes() (catalogBytes []byte, err error) {
+	catalogBytes, _, err = backend.GetCatalogBytesVersion()
+	return
+}
+
+func (backend *CaryatidAzureBlobBackend) SetCatalogBytes(serializedCatalog []byte) (err error) {
+	_, err = backend.putBlob(backend.CatalogLocation, bytes.NewReader(serializedCatalog), int64(len(serializedCatalog)), "application/json", nil)
+	if err != nil {
+		log.Println("CaryatidAzureBlobBackend.SetCatalogBytes(): Error trying to upload catalog: ", err)
+	}
+	return
+}
+
+func (backend *CaryatidAzureBlobBackend) GetCatalogBytesVersion() (catalogBytes []byte, version string, err error) {
+	catalogBytes, version, err = backend.getBlobVersion(backend.CatalogLocation.Blob)
+	if err != nil {
+		log.Printf("CaryatidAzureBlobBackend.GetCatalogBytesVersion(): Could not download from Azure: %v", err)
+	} else if catalogBytes == nil {
+		log.Printf("No file at '%v'; starting with empty catalog\n", backend.Manager.CatalogUri)
+		catalogBytes = []byte("{}")
+	}
+	return
+}
+
+func (backend *CaryatidAzureBlobBackend) SetCatalogBytesIfVersion(serializedCatalog []byte, version string) (err error) {
+	err = backend.putBlobIfVersion(backend.CatalogLocation.Blob, serializedCatalog, version)
+	if err != nil && !IsCatalogConflict(err) {
+		log.Println("CaryatidAzureBlobBackend.SetCatalogBytesIfVersion(): Error trying to upload catalog: ", err)
+	}
+	return
+}
+
+// The Azure Blob backend keeps its lock in a lease blob next to the catalog, like azblob://account/container/catalog.json.lock
+// This is Caryatid's own lease file, not an Azure blob lease, so that it works like the other backends' locks
+type azureBlobLeaseStore struct {
+	backend *CaryatidAzureBlobBackend
+}
+
+func (lease azureBlobLeaseStore) key() string {
+	return lease.backend.CatalogLocation.Blob + ".lock"
+}
+
+func (lease azureBlobLeaseStore) readLease() ([]byte, string, error) {
+	return lease.backend.getBlobVersion(lease.key())
+}
+
+func (lease azureBlobLeaseStore) writeLease(leaseBytes []byte, version string) error {
+	return lease.backend.putBlobIfVersion(lease.key(), leaseBytes, version)
+}
+
+func (lease azureBlobLeaseStore) deleteLease() error {
+	loc := *lease.backend.CatalogLocation
+	loc.Blob = lease.key()
+	return lease.backend.DeleteFile(loc.uri())
+}
+
+func (backend *CaryatidAzureBlobBackend) Lock(lock CatalogLock) (err error) {
+	if err = acquireLease(azureBlobLeaseStore{backend}, backend.Manager.CatalogUri, lock); err == nil {
+		backend.heldLock = &lock
+	}
+	return
+}
+
+func (backend *CaryatidAzureBlobBackend) Unlock() (err error) {
+	if backend.heldLock == nil {
+		return fmt.Errorf("Not holding the lock on '%v'", backend.Manager.CatalogUri)
+	}
+	if err = releaseLease(azureBlobLeaseStore{backend}, backend.Manager.CatalogUri, *backend.heldLock); err == nil {
+		backend.heldLock = nil
+	}
+	return
+}
+
+func (backend *CaryatidAzureBlobBackend) LockStatus() (lock *CatalogLock, err error) {
+	lock, _, err = leaseStatus(azureBlobLeaseStore{backend})
+	return
+}
+
+func (backend *CaryatidAzureBlobBackend) BreakLock() (err error) {
+	return azureBlobLeaseStore{backend}.deleteLease()
+}
+
+func (backend *CaryatidAzureBlobBackend) CopyBoxFile(path string, boxName string, boxVersion string, boxProvider string) (err error) {
+	var boxUri string
+	if boxUri, err = BoxUriFromCatalogUri(backend.Manager.CatalogUri, boxName, boxVersion, boxProvider); err != nil {
+		return
+	}
+	return backend.UploadFile(path, boxUri)
+}
+
+func (backend *CaryatidAzureBlobBackend) UploadFile(path string, uri string) (err error) {
+	var (
+		fileLoc     *caryatidAzureBlobLocation
+		fileHandler *os.File
+		fileInfo    os.FileInfo
+	)
+
+	if fileLoc, err = uri2azureblobLocation(uri); err != nil {
+		return
+	}
+	if fileHandler, err = os.Open(path); err != nil {
+		return
+	}
+	defer fileHandler.Close()
+	if fileInfo, err = fileHandler.Stat(); err != nil {
+		return
+	}
+
+	if fileInfo.Size() > azureBlobMaxPutSize {
+		return backend.putBlocks(fileLoc, fileHandler, fileInfo.Size(), "application/octet-stream")
+	}
+	_, err = backend.putBlob(fileLoc, fileHandler, fileInfo.Size(), "application/octet-stream", nil)
+	return
+}
+
+func (backend *CaryatidAzureBlobBackend) FileSize(uri string) (size int64, exists bool, err error) {
+	var (
+		fileLoc *caryatidAzureBlobLocation
+		resp    *http.Response
+	)
+
+	if fileLoc, err = uri2azureblobLocation(uri); err != nil {
+		return
+	}
+	if resp, err = backend.request("HEAD", backend.blobUrl(fileLoc), nil, 0, nil); err != nil {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, false, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return 0, false, fmt.Errorf("HEAD '%v' failed with status '%v'", uri, resp.Status)
+	}
+	return resp.ContentLength, true, nil
+}
+
+func (backend *CaryatidAzureBlobBackend) DownloadFile(uri string, localPath string) (err error) {
+	var (
+		fileLoc   *caryatidAzureBlobLocation
+		resp      *http.Response
+		localFile *os.File
+	)
+
+	if fileLoc, err = uri2azureblobLocation(uri); err != nil {
+		return
+	}
+	if resp, err = backend.requestExpect("GET", backend.blobUrl(fileLoc), nil, 0, nil); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if localFile, err = os.Create(localPath); err != nil {
+		return
+	}
+	if _, err = io.Copy(localFile, resp.Body); err != nil {
+		localFile.Close()
+		os.Remove(localPath)
+		return
+	}
+	return localFile.Close()
+}
+
+func (backend *CaryatidAzureBlobBackend) ListFiles(dirUri string) (files []BackendFile, err error) {
+	var (
+		dirLoc *caryatidAzureBlobLocation
+		resp   *http.Response
+		page   struct {
+			Blobs []struct {
+				Name          string `xml:"Name"`
+				ContentLength int64  `xml:"Properties>Content-Length"`
+			} `xml:"Blobs>Blob"`
+			NextMarker string `xml:"NextMarker"`
+		}
+	)
+
+	if dirLoc, err = uri2azureblobLocation(dirUri); err != nil {
+		return
+	}
+	containerLoc := &caryatidAzureBlobLocation{Account: dirLoc.Account, Container: dirLoc.Container}
+	query := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {strings.TrimSuffix(dirLoc.Blob, "/") + "/"}}
+	for {
+		if resp, err = backend.requestExpect("GET", backend.blobUrl(containerLoc)+"?"+query.Encode(), nil, 0, nil); err != nil {
+			return
+		}
+		page.Blobs, page.NextMarker = nil, ""
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return
+		}
+		for _, blob := range page.Blobs {
+			files = append(files, BackendFile{Uri: fmt.Sprintf("azblob://%v/%v/%v", dirLoc.Account, dirLoc.Container, blob.Name), Size: blob.ContentLength})
+		}
+		if page.NextMarker == "" {
+			return
+		}
+		query.Set("marker", page.NextMarker)
+	}
+}
+
+// Azure cannot rename blobs, so copy the blob to its new name and delete the old one
+// Copies within a storage account usually finish immediately, but may continue in the background, so wait for them
+func (backend *CaryatidAzureBlobBackend) MoveFile(fromUri string, toUri string) (err error) {
+	var (
+		fromLoc *caryatidAzureBlobLocation
+		toLoc   *caryatidAzureBlobLocation
+		resp    *http.Response
+	)
+
+	if fromLoc, err = uri2azureblobLocation(fromUri); err != nil {
+		return
+	}
+	if toLoc, err = uri2azureblobLocation(toUri); err != nil {
+		return
+	}
+
+	copySource := backend.blobUrl(fromLoc)
+	if backend.accountKey == nil && backend.SasToken != "" {
+		copySource += "?" + backend.SasToken
+	}
+	if resp, err = backend.requestExpect("PUT", backend.blobUrl(toLoc), nil, 0, http.Header{"x-ms-copy-source": {copySource}}); err != nil {
+		return
+	}
+	resp.Body.Close()
+
+	for delay := 100 * time.Millisecond; ; delay *= 2 {
+		switch status := resp.Header.Get("x-ms-copy-status"); status {
+		case "success":
+			return backend.DeleteFile(fromUri)
+		case "pending":
+			log.Printf("Waiting for the copy from '%v' to '%v' to finish: %v\n", fromUri, toUri, resp.Header.Get("x-ms-copy-progress"))
+		default:
+			return fmt.Errorf("Copying '%v' to '%v' failed with status '%v': %v", fromUri, toUri, status, resp.Header.Get("x-ms-copy-status-description"))
+		}
+		if delay > 10*time.Second {
+			delay = 10 * time.Second
+		}
+		time.Sleep(delay)
+		if resp, err = backend.requestExpect("HEAD", backend.blobUrl(toLoc), nil, 0, nil); err != nil {
+			return
+		}
+		resp.Body.Close()
+	}
+}
+
+// Delete a blob; like S3, deleting a blob that doesn't exist is not an error
+func (backend *CaryatidAzureBlobBackend) DeleteFile(uri string) (err error) {
+	var (
+		fileLoc *caryatidAzureBlobLocation
+		resp    *http.Response
+	)
+
+	if fileLoc, err = uri2azureblobLocation(uri); err != nil {
+		return
+	}
+	if resp, err = backend.request("DELETE", backend.blobUrl(fileLoc), nil, 0, nil); err != nil {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		err = fmt.Errorf("DELETE '%v' failed with status '%v': %v", uri, resp.Status, resp.Header.Get("x-ms-error-code"))
+	}
+	return
+}
+
+// Return the string that a service SAS for reading a blob signs
+// The fields are those of the SAS version that the backend uses, most of which it leaves empty
+func azureBlobSasStringToSign(loc *caryatidAzureBlobLocation, permissions string, expiry string) string {
+	return strings.Join([]string{
+		permissions,
+		"", // signed start
+		expiry,
+		fmt.Sprintf("/blob/%v/%v/%v", loc.Account, loc.Container, loc.Blob),
+		"", // signed identifier
+		"", // signed IP
+		"", // signed protocol
+		azureBlobApiVersion,
+		"b", // signed resource
+		"",  // signed snapshot time
+		"",  // rscc
+		"",  // rscd
+		"",  // rsce
+		"",  // rscl
+		"",  // rsct
+	}, "\n")
+}
+
+// FrontendUri returns a SAS URL for an azblob:// URI if SAS URLs are enabled, and the URI unchanged otherwise
+func (backend *CaryatidAzureBlobBackend) FrontendUri(storageUri string) (frontendUri string, err error) {
+	var fileLoc *caryatidAzureBlobLocation
+
+	if backend.Settings.PresignExpiry == 0 {
+		return storageUri, nil
+	}
+	if fileLoc, err = uri2azureblobLocation(storageUri); err != nil {
+		return
+	}
+	expiry := time.Now().UTC().Add(backend.Settings.PresignExpiry).Format("2006-01-02T15:04:05Z")
+	query := url.Values{
+		"sv":  {azureBlobApiVersion},
+		"se":  {expiry},
+		"sr":  {"b"},
+		"sp":  {"r"},
+		"sig": {azureSign(backend.accountKey, azureBlobSasStringToSign(fileLoc, "r", expiry))},
+	}
+	frontendUri = backend.blobUrl(fileLoc) + "?" + query.Encode()
+	return
+}
+
+// StorageUri converts an HTTPS URL for a blob in the catalog's container, like a SAS URL, back to an azblob:// URI
+// This works whether or not SAS URLs are enabled, so catalogs with SAS URLs can still be managed after turning them off
+func (backend *CaryatidAzureBlobBackend) StorageUri(frontendUri string) (storageUri string, err error) {
+	var u *url.URL
+
+	if u, err = url.Parse(frontendUri); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return frontendUri, err
+	}
+	containerLoc := &caryatidAzureBlobLocation{Account: backend.CatalogLocation.Account, Container: backend.CatalogLocation.Container}
+	containerUrl, err := url.Parse(backend.blobUrl(containerLoc) + "/")
+	if err != nil {
+		return
+	}
+	if u.Scheme != containerUrl.Scheme || u.Host != containerUrl.Host || !strings.HasPrefix(u.Path, containerUrl.Path) {
+		return frontendUri, nil
+	}
+	containerLoc.Blob = strings.TrimPrefix(u.Path, containerUrl.Path)
+	storageUri = containerLoc.uri()
+	return
+}
+
+func (backend *CaryatidAzureBlobBackend) Scheme() string {
+	return "azblob"
+}
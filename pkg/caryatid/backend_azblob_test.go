@@ -0,0 +1,356 @@
+package caryatid
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The account name and key that Azurite accepts by default
+const (
+	testAzureAccount    = "devstoreaccount1"
+	testAzureAccountKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+// A blob stored in a testAzureBlobServer
+type testAzureBlob struct {
+	Data []byte
+	ETag string
+}
+
+// A minimal in-process Blob service for the operations the Azure Blob backend uses, with one container
+// Like Azurite, it addresses blobs like http://host/account/container/blob, and checks Shared Key and SAS signatures
+type testAzureBlobServer struct {
+	*httptest.Server
+	Container string
+	Blobs     map[string]testAzureBlob
+	Blocks    map[string][]byte
+	lock      sync.Mutex
+
+	// Copies are reported as pending until the copied blob is next read, to exercise waiting for them
+	pendingCopies map[string]bool
+}
+
+func newTestAzureBlobServer(container string) (server *testAzureBlobServer) {
+	server = &testAzureBlobServer{Container: container, Blobs: map[string]testAzureBlob{}, Blocks: map[string][]byte{}, pendingCopies: map[string]bool{}}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.handle))
+	return
+}
+
+// The endpoint of the server's storage account
+func (server *testAzureBlobServer) Endpoint() string {
+	return server.URL + "/" + testAzureAccount
+}
+
+func (server *testAzureBlobServer) writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"utf-8\"?><Error><Code>%v</Code><Message>%v</Message></Error>", code, code)
+}
+
+// Check a request's Shared Key signature, or for a read, its SAS signature
+func (server *testAzureBlobServer) authorized(r *http.Request, blob string) bool {
+	key, _ := base64.StdEncoding.DecodeString(testAzureAccountKey)
+	if sig := r.URL.Query().Get("sig"); sig != "" {
+		expiry, err := time.Parse("2006-01-02T15:04:05Z", r.URL.Query().Get("se"))
+		loc := &caryatidAzureBlobLocation{Account: testAzureAccount, Container: server.Container, Blob: blob}
+		return err == nil && time.Now().Before(expiry) && r.Method == "GET" && r.URL.Query().Get("sp") == "r" &&
+			sig == azureSign(key, azureBlobSasStringToSign(loc, "r", r.URL.Query().Get("se")))
+	}
+	if r.Header.Get("x-ms-version") == "" || r.Header.Get("x-ms-date") == "" {
+		return false
+	}
+	stringToSign := azureSharedKeyStringToSign(r.Method, r.URL, r.Header, r.ContentLength, testAzureAccount)
+	return r.Header.Get("Authorization") == fmt.Sprintf("SharedKey %v:%v", testAzureAccount, azureSign(key, stringToSign))
+}
+
+func (server *testAzureBlobServer) handle(w http.ResponseWriter, r *http.Request) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+	if len(parts) < 2 || parts[0] != testAzureAccount {
+		server.writeError(w, http.StatusBadRequest, "InvalidUri")
+		return
+	}
+	var blob string
+	if len(parts) == 3 {
+		blob = parts[2]
+	}
+	if !server.authorized(r, blob) {
+		server.writeError(w, http.StatusForbidden, "AuthenticationFailed")
+		return
+	}
+	if parts[1] != server.Container {
+		server.writeError(w, http.StatusNotFound, "ContainerNotFound")
+		return
+	}
+
+	query := r.URL.Query()
+	if blob == "" {
+		if r.Method == "GET" && query.Get("restype") == "container" && query.Get("comp") == "list" {
+			server.list(w, query.Get("prefix"), query.Get("marker"))
+		} else {
+			server.writeError(w, http.StatusNotImplemented, "NotImplemented")
+		}
+		return
+	}
+	existing, exists := server.Blobs[blob]
+
+	switch {
+	case r.Method == "GET" || r.Method == "HEAD":
+		if !exists {
+			server.writeError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		if server.pendingCopies[blob] {
+			w.Header().Set("x-ms-copy-status", "success")
+			delete(server.pendingCopies, blob)
+		}
+		w.Header().Set("ETag", existing.ETag)
+		w.Header().Set("Content-Length", strconv.Itoa(len(existing.Data)))
+		if r.Method == "GET" {
+			w.Write(existing.Data)
+		}
+
+	case r.Method == "PUT" && query.Get("comp") == "block":
+		data, _ := ioutil.ReadAll(r.Body)
+		server.Blocks[blob+"/"+query.Get("blockid")] = data
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == "PUT" && query.Get("comp") == "blocklist":
+		var blockList struct {
+			Latest []string `xml:"Latest"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&blockList); err != nil {
+			server.writeError(w, http.StatusBadRequest, "InvalidXmlDocument")
+			return
+		}
+		var data []byte
+		for _, blockId := range blockList.Latest {
+			block, ok := server.Blocks[blob+"/"+blockId]
+			if !ok {
+				server.writeError(w, http.StatusBadRequest, "InvalidBlockList")
+				return
+			}
+			data = append(data, block...)
+		}
+		server.putBlob(w, blob, data)
+
+	case r.Method == "PUT":
+		if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && (!exists || ifMatch != existing.ETag) {
+			server.writeError(w, http.StatusPreconditionFailed, "ConditionNotMet")
+			return
+		}
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			server.writeError(w, http.StatusConflict, "BlobAlreadyExists")
+			return
+		}
+		if copySource := r.Header.Get("x-ms-copy-source"); copySource != "" {
+			sourceUrl, _ := url.Parse(copySource)
+			source, ok := server.Blobs[strings.TrimPrefix(sourceUrl.Path, fmt.Sprintf("/%v/%v/", testAzureAccount, server.Container))]
+			if !ok {
+				server.writeError(w, http.StatusNotFound, "CannotVerifyCopySource")
+				return
+			}
+			server.pendingCopies[blob] = true
+			w.Header().Set("x-ms-copy-status", "pending")
+			server.putBlob(w, blob, source.Data)
+			return
+		}
+		if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+			server.writeError(w, http.StatusBadRequest, "MissingRequiredHeader")
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		server.putBlob(w, blob, data)
+
+	case r.Method == "DELETE":
+		if !exists {
+			server.writeError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		delete(server.Blobs, blob)
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		server.writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (server *testAzureBlobServer) putBlob(w http.ResponseWriter, blob string, data []byte) {
+	server.Blobs[blob] = testAzureBlob{Data: data, ETag: fmt.Sprintf("\"0x%X\"", md5.Sum(append([]byte(time.Now().String()), data...)))}
+	w.Header().Set("ETag", server.Blobs[blob].ETag)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Respond to a List Blobs request with every blob whose name starts with prefix, two to a page, to exercise paging
+func (server *testAzureBlobServer) list(w http.ResponseWriter, prefix string, marker string) {
+	var names []string
+	for name := range server.Blobs {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	start, _ := strconv.Atoi(marker)
+
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"utf-8\"?><EnumerationResults ContainerName=\"%v\"><Prefix>%v</Prefix><Blobs>", server.Container, prefix)
+	for i := start; i < len(names) && i < start+2; i++ {
+		fmt.Fprintf(w, "<Blob><Name>%v</Name><Properties><Content-Length>%v</Content-Length></Properties></Blob>", names[i], len(server.Blobs[names[i]].Data))
+	}
+	fmt.Fprintf(w, "</Blobs><NextMarker>")
+	if start+2 < len(names) {
+		fmt.Fprintf(w, "%v", start+2)
+	}
+	fmt.Fprintf(w, "</NextMarker></EnumerationResults>")
+}
+
+// Keep the backend from finding any real Azure credentials in the environment
+// The returned function restores the environment
+func setTestAzureEnvironment() (restore func()) {
+	return setTestEnvironment(map[string]string{
+		"AZURE_STORAGE_KEY":       testAzureAccountKey,
+		"AZURE_STORAGE_SAS_TOKEN": "",
+	})
+}
+
+func TestCaryatidAzureBlobBackend_ImplementsCaryatidBackend(t *testing.T) {
+	var _ CaryatidBackend = new(CaryatidAzureBlobBackend)
+	var _ CaryatidVersionedBackend = new(CaryatidAzureBlobBackend)
+	var _ CaryatidLockingBackend = new(CaryatidAzureBlobBackend)
+	var _ CaryatidStagingBackend = new(CaryatidAzureBlobBackend)
+	var _ CaryatidListingBackend = new(CaryatidAzureBlobBackend)
+	var _ CaryatidDownloadingBackend = new(CaryatidAzureBlobBackend)
+	var _ CaryatidFrontendBackend = new(CaryatidAzureBlobBackend)
+}
+
+func TestCaryatidAzureBlobBackendConformance(t *testing.T) {
+	defer setTestAzureEnvironment()()
+	server := newTestAzureBlobServer("test-container")
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "caryatid-azblob-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	catalogUri := fmt.Sprintf("azblob://%v/test-container/some/path/catalog.json?endpoint=%v", testAzureAccount, url.QueryEscape(server.Endpoint()))
+	if err = CheckBackendConformance(&CaryatidAzureBlobBackend{}, catalogUri, tempDir); err != nil {
+		t.Fatalf("Azure Blob backend is not conformant: %v", err)
+	}
+	if _, exists := server.Blobs["some/path/catalog.json"]; !exists {
+		t.Fatalf("Expected the catalog at 'some/path/catalog.json' on the fake Blob service, but found %v", server.Blobs)
+	}
+}
+
+func TestCaryatidAzureBlobBackendSasUrls(t *testing.T) {
+	defer setTestAzureEnvironment()()
+	server := newTestAzureBlobServer("test-container")
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "caryatid-azblob-sas-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Upload the box in blocks, as larger boxes would be
+	defer func(maxPutSize int64, blockSize int64) {
+		azureBlobMaxPutSize, azureBlobBlockSize = maxPutSize, blockSize
+	}(azureBlobMaxPutSize, azureBlobBlockSize)
+	azureBlobMaxPutSize, azureBlobBlockSize = 100, 50
+
+	var (
+		catalogUri                 = fmt.Sprintf("azblob://%v/test-container/vagrant/catalog.json?endpoint=%v&presign=1h", testAzureAccount, url.QueryEscape(server.Endpoint()))
+		boxPath                    = filepath.Join(tempDir, "test.box")
+		backend    CaryatidBackend = &CaryatidAzureBlobBackend{}
+		manager                    = NewBackendManager(catalogUri, &backend)
+	)
+	if err = CreateTestBoxFile(boxPath, "hyperv", true); err != nil {
+		t.Fatalf("Error creating test box: %v", err)
+	}
+	original, _ := ioutil.ReadFile(boxPath)
+	if int64(len(original)) <= azureBlobMaxPutSize {
+		t.Fatalf("Expected the test box to be larger than %v bytes, but it is %v bytes", azureBlobMaxPutSize, len(original))
+	}
+
+	if err = manager.AddBox(boxPath, "SasBox", "A box with a SAS URL", "1.0.0", "hyperv", "sha1", "0xDECAFBAD"); err != nil {
+		t.Fatalf("Error adding box: %v", err)
+	}
+	catalog, _ := manager.GetCatalog()
+	boxUrl := catalog.BoxReferences()[0].Uri
+	if !strings.HasPrefix(boxUrl, server.Endpoint()+"/test-container/vagrant/SasBox/SasBox_1.0.0_hyperv.box?") {
+		t.Fatalf("Expected the catalog to refer to a SAS URL, but got '%v'", boxUrl)
+	}
+
+	// Vagrant downloads the box with the SAS URL, without credentials
+	resp, err := http.Get(boxUrl)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Error downloading box from '%v': %v %v", boxUrl, resp, err)
+	}
+	downloaded, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(downloaded) != string(original) {
+		t.Fatalf("Downloaded box from '%v' does not match the box that was added", boxUrl)
+	}
+	if resp, err = http.Get(strings.Replace(boxUrl, "hyperv.box", "virtualbox.box", 1)); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected a SAS URL for another blob to be refused, but got %v %v", resp, err)
+	}
+	resp.Body.Close()
+
+	// SAS URLs are still managed after turning them off
+	var unsigned CaryatidBackend = &CaryatidAzureBlobBackend{}
+	if err = NewBackendManager(strings.TrimSuffix(catalogUri, "&presign=1h"), &unsigned).DeleteBox(CatalogQueryParams{Version: "1.0.0"}); err != nil {
+		t.Fatalf("Error deleting box: %v", err)
+	}
+	if _, exists := server.Blobs["vagrant/SasBox/SasBox_1.0.0_hyperv.box"]; exists {
+		t.Fatalf("Expected the box to be deleted from the fake Blob service, but found %v", server.Blobs)
+	}
+
+	os.Setenv("AZURE_STORAGE_KEY", "")
+	var invalid CaryatidBackend = &CaryatidAzureBlobBackend{SasToken: "sv=2020-02-10&sig=unused"}
+	if err = invalid.SetManager(&BackendManager{CatalogUri: catalogUri}); err == nil {
+		t.Fatalf("Expected SAS URLs without the account key to fail")
+	}
+	if err = invalid.SetManager(&BackendManager{CatalogUri: fmt.Sprintf("azblob://%v/catalog.json", testAzureAccount)}); err == nil {
+		t.Fatalf("Expected a URI without a container to fail")
+	}
+}
+
+// Run the conformance tests against Azurite if CARYATID_TEST_AZURITE is set to its Blob service endpoint,
+// like http://127.0.0.1:10000/devstoreaccount1, and it has a 'caryatid-test' container
+func TestCaryatidAzureBlobBackendEmulator(t *testing.T) {
+	emulatorUrl := os.Getenv("CARYATID_TEST_AZURITE")
+	if emulatorUrl == "" {
+		t.Skip("CARYATID_TEST_AZURITE is not set")
+	}
+	defer setTestAzureEnvironment()()
+
+	tempDir, err := ioutil.TempDir("", "caryatid-azblob-emulator-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	catalogUri := fmt.Sprintf("azblob://%v/caryatid-test/%v/catalog.json?endpoint=%v", testAzureAccount, time.Now().UnixNano(), url.QueryEscape(emulatorUrl))
+	if err = CheckBackendConformance(&CaryatidAzureBlobBackend{}, catalogUri, tempDir); err != nil {
+		t.Fatalf("Azure Blob backend is not conformant with Azurite at '%v': %v", emulatorUrl, err)
+	}
+}
@@ -0,0 +1,296 @@
+/*
+The exec backend, for backends that run as separate helper programs
+
+When no backend is registered for a URI scheme like "foo",
+NewBackend() looks for an executable named "caryatid-backend-foo" in $PATH,
+in the same spirit as git remote helpers.
+Caryatid starts the helper once per backend and talks to it over its stdin and stdout,
+so helpers can be added without rebuilding caryatid or the Packer plugin.
+
+The protocol is a series of JSON objects, one per line.
+Caryatid writes an ExecBackendRequest to the helper's stdin,
+and the helper replies with exactly one ExecBackendResponse on its stdout.
+The first request is always a "SetManager" request carrying the catalog URI;
+after that, requests map one to one onto the CaryatidBackend methods:
+
+	{"method":"SetManager","catalog_uri":"foo://host/path/catalog.json"}
+	{"method":"GetCatalogBytes"}
+	{"method":"SetCatalogBytes","data":"<base64 catalog>"}
+	{"method":"CopyBoxFile","local_path":"/path/to/local.box","box_name":"name","box_version":"1.0.0","box_provider":"virtualbox"}
+	{"method":"DeleteFile","uri":"foo://host/path/name/name_1.0.0_virtualbox.box"}
+
+A response has "data" (base64, for GetCatalogBytes) and/or "error" (a message, if the request failed).
+The helper should exit when its stdin is closed, and must write any logging to stderr, never stdout.
+
+Helpers written in Go can wrap any CaryatidBackend with ServeExecBackend().
+*/
+
+package caryatid
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The prefix of helper executables; the helper for the "foo" scheme is named "caryatid-backend-foo"
+const ExecBackendPrefix = "caryatid-backend-"
+
+// A request from caryatid to an exec backend helper
+type ExecBackendRequest struct {
+	Method      string `json:"method"`
+	CatalogUri  string `json:"catalog_uri,omitempty"`
+	Data        []byte `json:"data,omitempty"`
+	LocalPath   string `json:"local_path,omitempty"`
+	BoxName     string `json:"box_name,omitempty"`
+	BoxVersion  string `json:"box_version,omitempty"`
+	BoxProvider string `json:"box_provider,omitempty"`
+	Uri         string `json:"uri,omitempty"`
+}
+
+// A response from an exec backend helper to caryatid
+type ExecBackendResponse struct {
+	Data  []byte `json:"data,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type CaryatidExecBackend struct {
+	// Path to the helper executable
+	ExecutablePath string
+
+	Manager *BackendManager
+
+	scheme    string
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	requests  *json.Encoder
+	responses *json.Decoder
+	lock      sync.Mutex
+}
+
+// Find the helper executable for a URI scheme in $PATH
+func findExecBackend(scheme string) (helperPath string, err error) {
+	return exec.LookPath(ExecBackendPrefix + scheme)
+}
+
+// ExecBackendHelpers returns a sorted list of the URI schemes that have a helper executable in $PATH
+func ExecBackendHelpers() (schemes []string) {
+	found := map[string]bool{}
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		matches, _ := filepath.Glob(filepath.Join(dir, ExecBackendPrefix+"*"))
+		for _, match := range matches {
+			scheme := strings.TrimPrefix(filepath.Base(match), ExecBackendPrefix)
+			scheme = strings.TrimSuffix(scheme, filepath.Ext(scheme))
+			if _, err := findExecBackend(scheme); err == nil && !found[scheme] {
+				found[scheme] = true
+				schemes = append(schemes, scheme)
+			}
+		}
+	}
+	sort.Strings(schemes)
+	return
+}
+
+func (backend *CaryatidExecBackend) SetManager(manager *BackendManager) (err error) {
+	var u *url.URL
+
+	backend.Manager = manager
+	if u, err = url.Parse(backend.Manager.CatalogUri); err != nil {
+		return
+	}
+	backend.scheme = u.Scheme
+
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	return backend.start()
+}
+
+func (backend *CaryatidExecBackend) GetManager() (manager *BackendManager, err error) {
+	manager = backend.Manager
+	if manager == nil {
+		err = fmt.Errorf("The Manager property was not set")
+	}
+	return
+}
+
+// Start the helper and send it the catalog URI, unless it is already running
+// Must be called with the lock held
+func (backend *CaryatidExecBackend) start() (err error) {
+	var stdout io.ReadCloser
+
+	if backend.requests != nil {
+		return
+	}
+	if backend.Manager == nil {
+		return fmt.Errorf("The Manager property was not set")
+	}
+	if backend.ExecutablePath == "" {
+		if backend.ExecutablePath, err = findExecBackend(backend.scheme); err != nil {
+			return
+		}
+	}
+
+	backend.cmd = exec.Command(backend.ExecutablePath)
+	backend.cmd.Stderr = os.Stderr
+	if backend.stdin, err = backend.cmd.StdinPipe(); err != nil {
+		return
+	}
+	if stdout, err = backend.cmd.StdoutPipe(); err != nil {
+		return
+	}
+	if err = backend.cmd.Start(); err != nil {
+		return fmt.Errorf("Could not start backend helper '%v': %v", backend.ExecutablePath, err)
+	}
+	log.Printf("Started backend helper '%v' for scheme '%v'\n", backend.ExecutablePath, backend.scheme)
+
+	return backend.attach(backend.stdin, stdout)
+}
+
+// Begin talking to a helper over its stdin and stdout, and send it the catalog URI
+// Must be called with the lock held
+func (backend *CaryatidExecBackend) attach(helperStdin io.WriteCloser, helperStdout io.Reader) (err error) {
+	backend.stdin = helperStdin
+	backend.requests = json.NewEncoder(helperStdin)
+	backend.responses = json.NewDecoder(bufio.NewReader(helperStdout))
+	_, err = backend.roundTrip(ExecBackendRequest{Method: "SetManager", CatalogUri: backend.Manager.CatalogUri})
+	return
+}
+
+// Send a request and wait for its response
+// Must be called with the lock held
+func (backend *CaryatidExecBackend) roundTrip(request ExecBackendRequest) (response ExecBackendResponse, err error) {
+	if err = backend.requests.Encode(request); err != nil {
+		return response, fmt.Errorf("Could not send '%v' request to backend helper: %v", request.Method, err)
+	}
+	if err = backend.responses.Decode(&response); err != nil {
+		return response, fmt.Errorf("Could not read '%v' response from backend helper: %v", request.Method, err)
+	}
+	if response.Error != "" {
+		err = fmt.Errorf("%v", response.Error)
+	}
+	return
+}
+
+// Start the helper if necessary, then send a request and wait for its response
+func (backend *CaryatidExecBackend) call(request ExecBackendRequest) (response ExecBackendResponse, err error) {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	if err = backend.start(); err != nil {
+		return
+	}
+	return backend.roundTrip(request)
+}
+
+// Close stops the helper by closing its stdin and waiting for it to exit
+func (backend *CaryatidExecBackend) Close() (err error) {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	if backend.stdin == nil {
+		return
+	}
+	backend.stdin.Close()
+	if backend.cmd != nil {
+		err = backend.cmd.Wait()
+	}
+	backend.stdin = nil
+	backend.requests = nil
+	backend.responses = nil
+	return
+}
+
+func (backend *CaryatidExecBackend) GetCatalogBytes() (catalogBytes []byte, err error) {
+	response, err := backend.call(ExecBackendRequest{Method: "GetCatalogBytes"})
+	catalogBytes = response.Data
+	return
+}
+
+func (backend *CaryatidExecBackend) SetCatalogBytes(serializedCatalog []byte) (err error) {
+	_, err = backend.call(ExecBackendRequest{Method: "SetCatalogBytes", Data: serializedCatalog})
+	return
+}
+
+func (backend *CaryatidExecBackend) CopyBoxFile(localPath string, boxName string, boxVersion string, boxProvider string) (err error) {
+	if localPath, err = filepath.Abs(localPath); err != nil {
+		return
+	}
+	_, err = backend.call(ExecBackendRequest{
+		Method:      "CopyBoxFile",
+		LocalPath:   localPath,
+		BoxName:     boxName,
+		BoxVersion:  boxVersion,
+		BoxProvider: boxProvider,
+	})
+	return
+}
+
+func (backend *CaryatidExecBackend) DeleteFile(uri string) (err error) {
+	_, err = backend.call(ExecBackendRequest{Method: "DeleteFile", Uri: uri})
+	return
+}
+
+func (backend *CaryatidExecBackend) Scheme() string {
+	return backend.scheme
+}
+
+// ServeExecBackend answers exec backend requests from in by calling methods on backend, writing responses to out
+// It returns when in is closed
+// The backend's manager is created from the catalog URI in the first request, which must be a "SetManager" request
+func ServeExecBackend(backend CaryatidBackend, in io.Reader, out io.Writer) (err error) {
+	var (
+		requests  = json.NewDecoder(bufio.NewReader(in))
+		responses = json.NewEncoder(out)
+	)
+
+	for {
+		var (
+			request    ExecBackendRequest
+			response   ExecBackendResponse
+			requestErr error
+		)
+
+		if err = requests.Decode(&request); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return
+		}
+
+		if request.Method != "SetManager" {
+			if _, managerErr := backend.GetManager(); managerErr != nil {
+				requestErr = fmt.Errorf("Received a '%v' request before a 'SetManager' request", request.Method)
+			}
+		}
+
+		if requestErr == nil {
+			switch request.Method {
+			case "SetManager":
+				requestErr = backend.SetManager(&BackendManager{CatalogUri: request.CatalogUri, Backend: backend})
+			case "GetCatalogBytes":
+				response.Data, requestErr = backend.GetCatalogBytes()
+			case "SetCatalogBytes":
+				requestErr = backend.SetCatalogBytes(request.Data)
+			case "CopyBoxFile":
+				requestErr = backend.CopyBoxFile(request.LocalPath, request.BoxName, request.BoxVersion, request.BoxProvider)
+			case "DeleteFile":
+				requestErr = backend.DeleteFile(request.Uri)
+			default:
+				requestErr = fmt.Errorf("Unknown method '%v'", request.Method)
+			}
+		}
+
+		if requestErr != nil {
+			response.Error = requestErr.Error()
+		}
+		if err = responses.Encode(response); err != nil {
+			return
+		}
+	}
+}
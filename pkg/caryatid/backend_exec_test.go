@@ -0,0 +1,71 @@
+package caryatid
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCaryatidExecBackend_ImplementsCaryatidBackend(t *testing.T) {
+	var _ CaryatidBackend = new(CaryatidExecBackend)
+}
+
+// Run the exec backend protocol against a local file backend in-process, over pipes instead of a helper's stdin/stdout
+func TestCaryatidExecBackendProtocol(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "caryatid-exec-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	requestReader, requestWriter := io.Pipe()
+	responseReader, responseWriter := io.Pipe()
+	served := make(chan error)
+	go func() {
+		served <- ServeExecBackend(&CaryatidLocalFileBackend{}, requestReader, responseWriter)
+	}()
+
+	catalogUri := fmt.Sprintf("file://%v", filepath.ToSlash(filepath.Join(tempDir, "ExecBox.json")))
+	execBackend := &CaryatidExecBackend{scheme: "file", Manager: &BackendManager{CatalogUri: catalogUri}}
+	if err = execBackend.attach(requestWriter, responseReader); err != nil {
+		t.Fatalf("Error attaching to in-process helper: %v", err)
+	}
+
+	if err = CheckBackendConformance(execBackend, catalogUri, tempDir); err != nil {
+		t.Fatalf("Exec backend is not conformant: %v", err)
+	}
+
+	if err = execBackend.DeleteFile(catalogUri + ".nonexistent"); err == nil {
+		t.Fatalf("Expected an error from the helper when deleting a nonexistent file")
+	}
+
+	requestWriter.Close()
+	if err = <-served; err != nil {
+		t.Fatalf("ServeExecBackend() returned an error: %v", err)
+	}
+}
+
+func TestServeExecBackendRequiresSetManager(t *testing.T) {
+	requestReader, requestWriter := io.Pipe()
+	responseReader, responseWriter := io.Pipe()
+	go ServeExecBackend(&CaryatidLocalFileBackend{}, requestReader, responseWriter)
+
+	execBackend := &CaryatidExecBackend{scheme: "file"}
+	execBackend.stdin = requestWriter
+	execBackend.requests = json.NewEncoder(requestWriter)
+	execBackend.responses = json.NewDecoder(responseReader)
+	if _, err := execBackend.GetCatalogBytes(); err == nil {
+		t.Fatalf("Expected an error calling GetCatalogBytes() before SetManager()")
+	}
+	requestWriter.Close()
+}
+
+func TestNewBackendExecFallback(t *testing.T) {
+	if _, err := NewBackend("caryatid-no-such-helper"); err == nil {
+		t.Fatalf("Expected an error getting a backend with no registered factory and no helper")
+	}
+}
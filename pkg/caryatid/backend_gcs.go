@@ -0,0 +1,817 @@
+/*
+The Google Cloud Storage backend, for dealing with a Vagrant catalog in a GCS bucket
+
+It uses the GCS JSON API directly, so it also works with emulators like fake-gcs-server
+*/
+
+package caryatid
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mrled/caryatid/internal/util"
+)
+
+// The GCS endpoint used unless another is configured
+const DefaultGcsEndpoint = "https://storage.googleapis.com"
+
+// The longest that GCS accepts a signed URL for
+const MaxGcsPresignExpiry = 7 * 24 * time.Hour
+
+// The OAuth scope the backend asks for, which allows reading, writing, and deleting objects
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// Settings for connecting to GCS or an emulator like fake-gcs-server
+// Each may also be set with a query parameter in the catalog URI,
+// like gs://bucket/catalog.json?endpoint=http://localhost:4443&credentials=/path/to/key.json&presign=168h
+type GcsSettings struct {
+	// The URL of the GCS JSON API; the "endpoint" query parameter
+	// If empty, the STORAGE_EMULATOR_HOST environment variable is used if set, like the Google Cloud SDKs do,
+	// and DefaultGcsEndpoint otherwise
+	Endpoint string
+
+	// A service account key or authorized user credentials file; the "credentials" query parameter
+	// If empty, the GOOGLE_APPLICATION_CREDENTIALS environment variable is used if set,
+	// and the gcloud application default credentials file otherwise, if it exists
+	CredentialsFile string
+
+	// If set, write signed HTTPS URLs that expire after this long into the catalog, instead of gs:// URIs,
+	// so Vagrant can download boxes from a private bucket; the "presign" query parameter, like presign=168h
+	// Signing URLs requires a service account key, and GCS does not accept signed URLs that last longer than MaxGcsPresignExpiry
+	PresignExpiry time.Duration
+}
+
+// Fill in any settings that are not already set from the query parameters of a gs:// URI
+func (settings *GcsSettings) mergeQuery(query url.Values) (err error) {
+	if settings.Endpoint == "" {
+		settings.Endpoint = query.Get("endpoint")
+	}
+	if settings.CredentialsFile == "" {
+		settings.CredentialsFile = query.Get("credentials")
+	}
+	if presign := query.Get("presign"); settings.PresignExpiry == 0 && presign != "" {
+		if settings.PresignExpiry, err = time.ParseDuration(presign); err != nil {
+			err = fmt.Errorf("Invalid value '%v' for the GCS presign setting; expected a duration like 168h", presign)
+			return
+		}
+	}
+	if settings.PresignExpiry < 0 || settings.PresignExpiry > MaxGcsPresignExpiry {
+		err = fmt.Errorf("Invalid GCS presign expiry '%v'; it must be no longer than %v", settings.PresignExpiry, MaxGcsPresignExpiry)
+		return
+	}
+	return
+}
+
+// The fields of a Google credentials file that the backend uses
+// Service account keys have a private key to sign with; authorized user credentials, like gcloud's, have a refresh token
+type gcsCredentials struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	TokenUri     string `json:"token_uri"`
+	ClientId     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+
+	privateKey *rsa.PrivateKey
+}
+
+// Return the directory the gcloud command keeps its configuration in,
+// where 'gcloud auth application-default login' saves application default credentials
+func gcloudConfigDir() (configDir string, err error) {
+	var home string
+	if configDir = os.Getenv("CLOUDSDK_CONFIG"); configDir != "" {
+		return
+	}
+	if runtime.GOOS == "windows" {
+		if configDir = os.Getenv("APPDATA"); configDir == "" {
+			return "", fmt.Errorf("%%APPDATA%% is not set")
+		}
+		return filepath.Join(configDir, "gcloud"), nil
+	}
+	if home, err = util.HomeDir(); err != nil {
+		return
+	}
+	return filepath.Join(home, ".config", "gcloud"), nil
+}
+
+// Read a credentials file, parsing its private key if it is a service account key
+func readGcsCredentials(credentialsFile string) (credentials *gcsCredentials, err error) {
+	var (
+		credentialsBytes []byte
+		block            *pem.Block
+		key              interface{}
+	)
+
+	if credentialsBytes, err = ioutil.ReadFile(credentialsFile); err != nil {
+		return
+	}
+	credentials = new(gcsCredentials)
+	if err = json.Unmarshal(credentialsBytes, credentials); err != nil {
+		return nil, fmt.Errorf("Could not parse credentials file '%v': %v", credentialsFile, err)
+	}
+
+	switch credentials.Type {
+	case "service_account":
+		if block, _ = pem.Decode([]byte(credentials.PrivateKey)); block == nil {
+			return nil, fmt.Errorf("No private key in service account key file '%v'", credentialsFile)
+		}
+		if key, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+			if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+				return nil, fmt.Errorf("Could not parse the private key in '%v': %v", credentialsFile, err)
+			}
+		}
+		var ok bool
+		if credentials.privateKey, ok = key.(*rsa.PrivateKey); !ok {
+			return nil, fmt.Errorf("The private key in '%v' is not an RSA key", credentialsFile)
+		}
+		if credentials.TokenUri == "" {
+			credentials.TokenUri = "https://oauth2.googleapis.com/token"
+		}
+	case "authorized_user":
+		credentials.TokenUri = "https://oauth2.googleapis.com/token"
+	default:
+		return nil, fmt.Errorf("Unsupported credentials type '%v' in '%v'", credentials.Type, credentialsFile)
+	}
+	return
+}
+
+type CaryatidGcsBackend struct {
+	// Settings for connecting to GCS
+	// Any setting left empty here is taken from the query parameters of the catalog URI
+	Settings GcsSettings
+
+	// An OAuth access token, used instead of any credentials file if set
+	// Taken from the GOOGLE_OAUTH_ACCESS_TOKEN environment variable if not set,
+	// so the output of `gcloud auth print-access-token` can be used
+	Token string
+
+	// The HTTP client to make requests with; http.DefaultClient if nil
+	HttpClient *http.Client
+
+	Manager *BackendManager
+
+	CatalogLocation *caryatidGcsLocation
+
+	credentials *gcsCredentials
+
+	// An access token from the credentials or the metadata server, and when it expires
+	accessToken       string
+	accessTokenExpiry time.Time
+
+	// The lock this backend holds on the catalog, if any
+	heldLock *CatalogLock
+}
+
+func init() {
+	RegisterBackend("gs", func() CaryatidBackend { return &CaryatidGcsBackend{} })
+}
+
+type caryatidGcsLocation struct {
+	Bucket string
+	Object string
+}
+
+// Get the bucket and object name from a gs:// URI
+// Any query string is ignored, since it holds settings rather than part of the object name
+func uri2gcslocation(uri string) (loc *caryatidGcsLocation, err error) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "gs" || u.Host == "" {
+		err = fmt.Errorf("Invalid GCS URI '%v'", uri)
+		return
+	}
+
+	loc = new(caryatidGcsLocation)
+	loc.Bucket = u.Host
+	loc.Object = strings.TrimPrefix(u.Path, "/")
+	return
+}
+
+func (backend *CaryatidGcsBackend) SetManager(manager *BackendManager) (err error) {
+	var u *url.URL
+
+	backend.Manager = manager
+
+	if u, err = url.Parse(backend.Manager.CatalogUri); err != nil {
+		return
+	}
+	if err = backend.Settings.mergeQuery(u.Query()); err != nil {
+		return
+	}
+	if backend.CatalogLocation, err = uri2gcslocation(backend.Manager.CatalogUri); err != nil {
+		return
+	}
+
+	if backend.Settings.Endpoint == "" {
+		if emulatorHost := os.Getenv("STORAGE_EMULATOR_HOST"); emulatorHost != "" {
+			if !strings.Contains(emulatorHost, "://") {
+				emulatorHost = "http://" + emulatorHost
+			}
+			backend.Settings.Endpoint = emulatorHost
+		} else {
+			backend.Settings.Endpoint = DefaultGcsEndpoint
+		}
+	}
+	backend.Settings.Endpoint = strings.TrimSuffix(backend.Settings.Endpoint, "/")
+
+	if backend.Token == "" {
+		backend.Token = os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN")
+	}
+	credentialsFile := backend.Settings.CredentialsFile
+	if credentialsFile == "" {
+		credentialsFile = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if credentialsFile == "" {
+		if configDir, configErr := gcloudConfigDir(); configErr == nil {
+			defaultFile := filepath.Join(configDir, "application_default_credentials.json")
+			if _, statErr := os.Stat(defaultFile); statErr == nil {
+				credentialsFile = defaultFile
+			}
+		}
+	}
+	if credentialsFile != "" {
+		if backend.credentials, err = readGcsCredentials(credentialsFile); err != nil {
+			return
+		}
+	}
+	if backend.Settings.PresignExpiry != 0 && (backend.credentials == nil || backend.credentials.privateKey == nil) {
+		err = fmt.Errorf("Signing GCS URLs requires a service account key file")
+		return
+	}
+
+	if backend.HttpClient == nil {
+		backend.HttpClient = http.DefaultClient
+	}
+	return
+}
+
+func (backend *CaryatidGcsBackend) GetManager() (manager *BackendManager, err error) {
+	manager = backend.Manager
+	if manager == nil {
+		err = fmt.Errorf("The Manager property was not set")
+	}
+	return
+}
+
+// Return an access token to authorize requests with, or an empty string to send requests without one
+// Requests to an emulator are sent without a token unless there are credentials to get one with,
+// and requests to GCS fall back to the metadata server of the Google Cloud machine they are made from
+func (backend *CaryatidGcsBackend) authorization() (token string, err error) {
+	var (
+		resp   *http.Response
+		result struct {
+			AccessToken string `json:"access_token"`
+			ExpiresIn   int64  `json:"expires_in"`
+		}
+	)
+
+	if backend.Token != "" {
+		return backend.Token, nil
+	}
+	if backend.accessToken != "" && time.Now().Add(time.Minute).Before(backend.accessTokenExpiry) {
+		return backend.accessToken, nil
+	}
+
+	switch {
+	case backend.credentials != nil && backend.credentials.privateKey != nil:
+		var assertion string
+		if assertion, err = backend.credentials.jwtAssertion(time.Now()); err != nil {
+			return
+		}
+		resp, err = backend.HttpClient.PostForm(backend.credentials.TokenUri, url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {assertion},
+		})
+	case backend.credentials != nil:
+		resp, err = backend.HttpClient.PostForm(backend.credentials.TokenUri, url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {backend.credentials.ClientId},
+			"client_secret": {backend.credentials.ClientSecret},
+			"refresh_token": {backend.credentials.RefreshToken},
+		})
+	case backend.Settings.Endpoint != DefaultGcsEndpoint:
+		return "", nil
+	default:
+		metadataHost := os.Getenv("GCE_METADATA_HOST")
+		if metadataHost == "" {
+			metadataHost = "metadata.google.internal"
+		}
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://%v/computeMetadata/v1/instance/service-accounts/default/token", metadataHost), nil)
+		req.Header.Set("Metadata-Flavor", "Google")
+		if resp, err = backend.HttpClient.Do(req); err != nil {
+			err = fmt.Errorf("No GCS credentials were configured, and the metadata server could not be reached: %v", err)
+		}
+	}
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("Could not get a GCS access token; status '%v': %v", resp.Status, strings.TrimSpace(string(body)))
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return
+	}
+	backend.accessToken = result.AccessToken
+	backend.accessTokenExpiry = time.Now().Add(time.Duration(result.ExpiresIn) * time.Second)
+	return backend.accessToken, nil
+}
+
+// Return a signed JWT that a service account exchanges for an access token
+func (credentials *gcsCredentials) jwtAssertion(now time.Time) (assertion string, err error) {
+	var header, claims []byte
+	if header, err = json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"}); err != nil {
+		return
+	}
+	if claims, err = json.Marshal(map[string]interface{}{
+		"iss":   credentials.ClientEmail,
+		"scope": gcsScope,
+		"aud":   credentials.TokenUri,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}); err != nil {
+		return
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, credentials.privateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return
+	}
+	assertion = unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+	return
+}
+
+// Return the JSON API URL for an object, followed by any path segments after it
+func (backend *CaryatidGcsBackend) objectUrl(loc *caryatidGcsLocation, suffix string) string {
+	return fmt.Sprintf("%v/storage/v1/b/%v/o/%v%v", backend.Settings.Endpoint, url.PathEscape(loc.Bucket), url.PathEscape(loc.Object), suffix)
+}
+
+// Make an authorized request to the JSON API
+// For any unsuccessful status, return an error along with the status,
+// and for a successful one, decode the JSON response into result if it is not nil
+func (backend *CaryatidGcsBackend) call(method string, requestUrl string, body io.Reader, contentLength int64, contentType string, result interface{}) (status int, err error) {
+	resp, err := backend.request(method, requestUrl, body, contentLength, contentType)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	status = resp.StatusCode
+	if status < 200 || status >= 300 {
+		var apiError struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		responseBody, _ := ioutil.ReadAll(resp.Body)
+		message := strings.TrimSpace(string(responseBody))
+		if json.Unmarshal(responseBody, &apiError) == nil && apiError.Error.Message != "" {
+			message = apiError.Error.Message
+		}
+		err = fmt.Errorf("%v '%v' failed with status '%v': %v", method, requestUrl, resp.Status, message)
+		return
+	}
+	if result != nil {
+		err = json.NewDecoder(resp.Body).Decode(result)
+	} else {
+		io.Copy(ioutil.Discard, resp.Body)
+	}
+	return
+}
+
+// Make an authorized request, returning the response whatever its status
+func (backend *CaryatidGcsBackend) request(method string, requestUrl string, body io.Reader, contentLength int64, contentType string) (resp *http.Response, err error) {
+	var token string
+
+	req, err := http.NewRequest(method, requestUrl, body)
+	if err != nil {
+		return
+	}
+	if body != nil {
+		req.ContentLength = contentLength
+		req.Header.Set("Content-Type", contentType)
+	}
+	if token, err = backend.authorization(); err != nil {
+		return
+	} else if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return backend.HttpClient.Do(req)
+}
+
+// Get an object along with its generation, which is used as its version
+// If the object does not exist, return nil contents and an empty version
+func (backend *CaryatidGcsBackend) getObjectVersion(object string) (contents []byte, version string, err error) {
+	loc := &caryatidGcsLocation{Bucket: backend.CatalogLocation.Bucket, Object: object}
+	resp, err := backend.request("GET", backend.objectUrl(loc, "?alt=media"), nil, 0, "")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		if status, bucketErr := backend.call("GET", fmt.Sprintf("%v/storage/v1/b/%v", backend.Settings.Endpoint, url.PathEscape(loc.Bucket)), nil, 0, "", nil); status == http.StatusNotFound {
+			err = fmt.Errorf("Bucket '%v' does not exist: %v", loc.Bucket, bucketErr)
+		}
+		return
+	} else if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("GET 'gs://%v/%v' failed with status '%v'", loc.Bucket, loc.Object, resp.Status)
+		return
+	}
+
+	if contents, err = ioutil.ReadAll(resp.Body); err != nil {
+		return
+	}
+	if version = resp.Header.Get("X-Goog-Generation"); version == "" {
+		err = fmt.Errorf("GCS did not return the generation of 'gs://%v/%v'", loc.Bucket, loc.Object)
+	}
+	return
+}
+
+// Upload an object, returning its new generation
+// If ifGeneration is not empty, GCS itself rejects the write unless the object is at that generation,
+// where generation "0" means that the object must not exist yet
+func (backend *CaryatidGcsBackend) putObject(loc *caryatidGcsLocation, body io.Reader, contentLength int64, contentType string, ifGeneration string) (status int, generation string, err error) {
+	var result struct {
+		Generation string `json:"generation"`
+	}
+	query := url.Values{"uploadType": {"media"}, "name": {loc.Object}}
+	if ifGeneration != "" {
+		query.Set("ifGenerationMatch", ifGeneration)
+	}
+	uploadUrl := fmt.Sprintf("%v/upload/storage/v1/b/%v/o?%v", backend.Settings.Endpoint, url.PathEscape(loc.Bucket), query.Encode())
+	status, err = backend.call("POST", uploadUrl, body, contentLength, contentType, &result)
+	generation = result.Generation
+	return
+}
+
+// Upload the catalog or its lease, but only if it is at a version from getObjectVersion()
+// An empty version means that the object must not exist yet
+func (backend *CaryatidGcsBackend) putObjectIfVersion(object string, contents []byte, version string) (err error) {
+	var status int
+	if version == "" {
+		version = "0"
+	}
+	loc := &caryatidGcsLocation{Bucket: backend.CatalogLocation.Bucket, Object: object}
+	status, _, err = backend.putObject(loc, bytes.NewReader(contents), int64(len(contents)), "application/json", version)
+	if status == http.StatusPreconditionFailed {
+		return &CatalogConflictError{CatalogUri: fmt.Sprintf("gs://%v/%v", loc.Bucket, loc.Object), Expected: version}
+	}
+	return
+}
+
+func (backend *CaryatidGcsBackend) GetCatalogBytes() (catalogBytes []byte, err error) {
+	catalogBytes, _, err = backend.GetCatalogBytesVersion()
+	return
+}
+
+func (backend *CaryatidGcsBackend) SetCatalogBytes(serializedCatalog []byte) (err error) {
+	_, _, err = backend.putObject(backend.CatalogLocation, bytes.NewReader(serializedCatalog), int64(len(serializedCatalog)), "application/json", "")
+	if err != nil {
+		log.Println("CaryatidGcsBackend.SetCatalogBytes(): Error trying to upload catalog: ", err)
+	}
+	return
+}
+
+func (backend *CaryatidGcsBackend) GetCatalogBytesVersion() (catalogBytes []byte, version string, err error) {
+	catalogBytes, version, err = backend.getObjectVersion(backend.CatalogLocation.Object)
+	if err != nil {
+		log.Printf("CaryatidGcsBackend.GetCatalogBytesVersion(): Could not download from GCS: %v", err)
+	} else if catalogBytes == nil {
+		log.Printf("No file at '%v'; starting with empty catalog\n", backend.Manager.CatalogUri)
+		catalogBytes = []byte("{}")
+	}
+	return
+}
+
+func (backend *CaryatidGcsBackend) SetCatalogBytesIfVersion(serializedCatalog []byte, version string) (err error) {
+	err = backend.putObjectIfVersion(backend.CatalogLocation.Object, serializedCatalog, version)
+	if err != nil && !IsCatalogConflict(err) {
+		log.Println("CaryatidGcsBackend.SetCatalogBytesIfVersion(): Error trying to upload catalog: ", err)
+	}
+	return
+}
+
+// The GCS backend keeps its lock in a lease object next to the catalog, like gs://bucket/catalog.json.lock
+type gcsLeaseStore struct {
+	backend *CaryatidGcsBackend
+}
+
+func (lease gcsLeaseStore) key() string {
+	return lease.backend.CatalogLocation.Object + ".lock"
+}
+
+func (lease gcsLeaseStore) readLease() ([]byte, string, error) {
+	return lease.backend.getObjectVersion(lease.key())
+}
+
+func (lease gcsLeaseStore) writeLease(leaseBytes []byte, version string) error {
+	return lease.backend.putObjectIfVersion(lease.key(), leaseBytes, version)
+}
+
+func (lease gcsLeaseStore) deleteLease() error {
+	return lease.backend.DeleteFile(fmt.Sprintf("gs://%v/%v", lease.backend.CatalogLocation.Bucket, lease.key()))
+}
+
+func (backend *CaryatidGcsBackend) Lock(lock CatalogLock) (err error) {
+	if err = acquireLease(gcsLeaseStore{backend}, backend.Manager.CatalogUri, lock); err == nil {
+		backend.heldLock = &lock
+	}
+	return
+}
+
+func (backend *CaryatidGcsBackend) Unlock() (err error) {
+	if backend.heldLock == nil {
+		return fmt.Errorf("Not holding the lock on '%v'", backend.Manager.CatalogUri)
+	}
+	if err = releaseLease(gcsLeaseStore{backend}, backend.Manager.CatalogUri, *backend.heldLock); err == nil {
+		backend.heldLock = nil
+	}
+	return
+}
+
+func (backend *CaryatidGcsBackend) LockStatus() (lock *CatalogLock, err error) {
+	lock, _, err = leaseStatus(gcsLeaseStore{backend})
+	return
+}
+
+func (backend *CaryatidGcsBackend) BreakLock() (err error) {
+	return gcsLeaseStore{backend}.deleteLease()
+}
+
+func (backend *CaryatidGcsBackend) CopyBoxFile(path string, boxName string, boxVersion string, boxProvider string) (err error) {
+	var boxUri string
+	if boxUri, err = BoxUriFromCatalogUri(backend.Manager.CatalogUri, boxName, boxVersion, boxProvider); err != nil {
+		return
+	}
+	return backend.UploadFile(path, boxUri)
+}
+
+func (backend *CaryatidGcsBackend) UploadFile(path string, uri string) (err error) {
+	var (
+		fileLoc     *caryatidGcsLocation
+		fileHandler *os.File
+		fileInfo    os.FileInfo
+	)
+
+	if fileLoc, err = uri2gcslocation(uri); err != nil {
+		return
+	}
+	if fileHandler, err = os.Open(path); err != nil {
+		return
+	}
+	defer fileHandler.Close()
+	if fileInfo, err = fileHandler.Stat(); err != nil {
+		return
+	}
+
+	_, _, err = backend.putObject(fileLoc, fileHandler, fileInfo.Size(), "application/octet-stream", "")
+	return
+}
+
+func (backend *CaryatidGcsBackend) FileSize(uri string) (size int64, exists bool, err error) {
+	var (
+		fileLoc *caryatidGcsLocation
+		status  int
+		result  struct {
+			Size string `json:"size"`
+		}
+	)
+
+	if fileLoc, err = uri2gcslocation(uri); err != nil {
+		return
+	}
+	status, err = backend.call("GET", backend.objectUrl(fileLoc, ""), nil, 0, "", &result)
+	if status == http.StatusNotFound {
+		return 0, false, nil
+	} else if err != nil {
+		return
+	}
+	size, err = strconv.ParseInt(result.Size, 10, 64)
+	return size, true, err
+}
+
+func (backend *CaryatidGcsBackend) DownloadFile(uri string, localPath string) (err error) {
+	var (
+		fileLoc   *caryatidGcsLocation
+		resp      *http.Response
+		localFile *os.File
+	)
+
+	if fileLoc, err = uri2gcslocation(uri); err != nil {
+		return
+	}
+	if resp, err = backend.request("GET", backend.objectUrl(fileLoc, "?alt=media"), nil, 0, ""); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET '%v' failed with status '%v'", uri, resp.Status)
+	}
+
+	if localFile, err = os.Create(localPath); err != nil {
+		return
+	}
+	if _, err = io.Copy(localFile, resp.Body); err != nil {
+		localFile.Close()
+		os.Remove(localPath)
+		return
+	}
+	return localFile.Close()
+}
+
+func (backend *CaryatidGcsBackend) ListFiles(dirUri string) (files []BackendFile, err error) {
+	var (
+		dirLoc *caryatidGcsLocation
+		page   struct {
+			Items []struct {
+				Name string `json:"name"`
+				Size string `json:"size"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+	)
+
+	if dirLoc, err = uri2gcslocation(dirUri); err != nil {
+		return
+	}
+	query := url.Values{"prefix": {strings.TrimSuffix(dirLoc.Object, "/") + "/"}}
+	for {
+		page.Items, page.NextPageToken = nil, ""
+		listUrl := fmt.Sprintf("%v/storage/v1/b/%v/o?%v", backend.Settings.Endpoint, url.PathEscape(dirLoc.Bucket), query.Encode())
+		if _, err = backend.call("GET", listUrl, nil, 0, "", &page); err != nil {
+			return
+		}
+		for _, object := range page.Items {
+			size, _ := strconv.ParseInt(object.Size, 10, 64)
+			files = append(files, BackendFile{Uri: fmt.Sprintf("gs://%v/%v", dirLoc.Bucket, object.Name), Size: size})
+		}
+		if page.NextPageToken == "" {
+			return
+		}
+		query.Set("pageToken", page.NextPageToken)
+	}
+}
+
+// GCS cannot rename objects, so rewrite the object to its new name and delete the old one
+// Large objects take several rewrite requests, each continuing where the last one left off
+func (backend *CaryatidGcsBackend) MoveFile(fromUri string, toUri string) (err error) {
+	var (
+		fromLoc *caryatidGcsLocation
+		toLoc   *caryatidGcsLocation
+		result  struct {
+			Done         bool   `json:"done"`
+			RewriteToken string `json:"rewriteToken"`
+		}
+	)
+
+	if fromLoc, err = uri2gcslocation(fromUri); err != nil {
+		return
+	}
+	if toLoc, err = uri2gcslocation(toUri); err != nil {
+		return
+	}
+
+	rewriteUrl := backend.objectUrl(fromLoc, fmt.Sprintf("/rewriteTo/b/%v/o/%v", url.PathEscape(toLoc.Bucket), url.PathEscape(toLoc.Object)))
+	for query := ""; ; query = "?rewriteToken=" + url.QueryEscape(result.RewriteToken) {
+		if _, err = backend.call("POST", rewriteUrl+query, nil, 0, "", &result); err != nil {
+			return
+		}
+		if result.Done {
+			break
+		}
+	}
+
+	return backend.DeleteFile(fromUri)
+}
+
+// Delete an object; like S3, deleting an object that doesn't exist is not an error
+func (backend *CaryatidGcsBackend) DeleteFile(uri string) (err error) {
+	var (
+		fileLoc *caryatidGcsLocation
+		status  int
+	)
+
+	if fileLoc, err = uri2gcslocation(uri); err != nil {
+		return
+	}
+	if status, err = backend.call("DELETE", backend.objectUrl(fileLoc, ""), nil, 0, "", nil); status == http.StatusNotFound {
+		err = nil
+	}
+	return
+}
+
+// Escape a string for a V4 signed URL, which escapes everything but unreserved characters and, in paths, slashes
+func gcsSigningEscape(value string, keepSlashes bool) string {
+	var escaped bytes.Buffer
+	for _, b := range []byte(value) {
+		if ('A' <= b && b <= 'Z') || ('a' <= b && b <= 'z') || ('0' <= b && b <= '9') || b == '-' || b == '.' || b == '_' || b == '~' || (keepSlashes && b == '/') {
+			escaped.WriteByte(b)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+// Return a V4 signed URL that downloads an object from the endpoint until the expiry passes
+func (backend *CaryatidGcsBackend) signedUrl(loc *caryatidGcsLocation, now time.Time, expiry time.Duration) (signedUrl string, err error) {
+	var (
+		endpoint *url.URL
+		params   []string
+	)
+
+	if endpoint, err = url.Parse(backend.Settings.Endpoint); err != nil {
+		return
+	}
+	now = now.UTC()
+	credentialScope := fmt.Sprintf("%v/auto/storage/goog4_request", now.Format("20060102"))
+	canonicalPath := "/" + gcsSigningEscape(loc.Bucket+"/"+loc.Object, true)
+	for name, value := range map[string]string{
+		"X-Goog-Algorithm":     "GOOG4-RSA-SHA256",
+		"X-Goog-Credential":    backend.credentials.ClientEmail + "/" + credentialScope,
+		"X-Goog-Date":          now.Format("20060102T150405Z"),
+		"X-Goog-Expires":       strconv.FormatInt(int64(expiry/time.Second), 10),
+		"X-Goog-SignedHeaders": "host",
+	} {
+		params = append(params, gcsSigningEscape(name, false)+"="+gcsSigningEscape(value, false))
+	}
+	sort.Strings(params)
+	canonicalQuery := strings.Join(params, "&")
+
+	canonicalRequest := strings.Join([]string{"GET", canonicalPath, canonicalQuery, "host:" + endpoint.Host, "", "host", "UNSIGNED-PAYLOAD"}, "\n")
+	canonicalRequestDigest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"GOOG4-RSA-SHA256", now.Format("20060102T150405Z"), credentialScope, hex.EncodeToString(canonicalRequestDigest[:])}, "\n")
+	digest := sha256.Sum256([]byte(stringToSign))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, backend.credentials.privateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return
+	}
+
+	signedUrl = fmt.Sprintf("%v://%v%v?%v&X-Goog-Signature=%v", endpoint.Scheme, endpoint.Host, canonicalPath, canonicalQuery, hex.EncodeToString(signature))
+	return
+}
+
+// FrontendUri returns a signed HTTPS URL for a gs:// URI if signed URLs are enabled, and the URI unchanged otherwise
+func (backend *CaryatidGcsBackend) FrontendUri(storageUri string) (frontendUri string, err error) {
+	var fileLoc *caryatidGcsLocation
+
+	if backend.Settings.PresignExpiry == 0 {
+		return storageUri, nil
+	}
+	if fileLoc, err = uri2gcslocation(storageUri); err != nil {
+		return
+	}
+	return backend.signedUrl(fileLoc, time.Now(), backend.Settings.PresignExpiry)
+}
+
+// StorageUri converts an HTTPS URL for an object in the catalog's bucket, like a signed URL, back to a gs:// URI
+// This works whether or not signed URLs are enabled, so catalogs with signed URLs can still be managed after turning them off
+func (backend *CaryatidGcsBackend) StorageUri(frontendUri string) (storageUri string, err error) {
+	var (
+		u        *url.URL
+		endpoint *url.URL
+	)
+
+	if u, err = url.Parse(frontendUri); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return frontendUri, err
+	}
+	if endpoint, err = url.Parse(backend.Settings.Endpoint); err != nil {
+		return
+	}
+	bucketPath := "/" + backend.CatalogLocation.Bucket + "/"
+	if u.Scheme != endpoint.Scheme || u.Host != endpoint.Host || !strings.HasPrefix(u.Path, bucketPath) {
+		return frontendUri, nil
+	}
+	storageUri = fmt.Sprintf("gs://%v/%v", backend.CatalogLocation.Bucket, strings.TrimPrefix(u.Path, bucketPath))
+	return
+}
+
+func (backend *CaryatidGcsBackend) Scheme() string {
+	return "gs"
+}
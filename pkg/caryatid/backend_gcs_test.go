@@ -0,0 +1,380 @@
+package caryatid
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An object stored in a testGcsServer
+type testGcsObject struct {
+	Data       []byte
+	Generation int64
+}
+
+// A minimal in-process server for the parts of the GCS JSON API that the GCS backend uses,
+// along with an OAuth token endpoint for a single service account and V4 signed URL downloads
+type testGcsServer struct {
+	*httptest.Server
+	Bucket  string
+	Objects map[string]testGcsObject
+	Key     *rsa.PrivateKey
+	lock    sync.Mutex
+
+	generation int64
+}
+
+func newTestGcsServer(t *testing.T, bucket string) (server *testGcsServer) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating service account key: %v", err)
+	}
+	server = &testGcsServer{Bucket: bucket, Objects: map[string]testGcsObject{}, Key: key}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.handle))
+	return
+}
+
+// Write a service account key file for the server's service account to a directory, and return its path
+func (server *testGcsServer) writeCredentials(t *testing.T, dir string) string {
+	keyBytes := x509.MarshalPKCS1PrivateKey(server.Key)
+	credentials, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "caryatid@test-project.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: keyBytes})),
+		"token_uri":    server.URL + "/token",
+	})
+	credentialsFile := filepath.Join(dir, "credentials.json")
+	if err := ioutil.WriteFile(credentialsFile, credentials, 0600); err != nil {
+		t.Fatalf("Error writing credentials file: %v", err)
+	}
+	return credentialsFile
+}
+
+func (server *testGcsServer) writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]interface{}{"code": status, "message": message}})
+}
+
+// Check that a JWT assertion is signed by the service account's key
+func (server *testGcsServer) verifyAssertion(assertion string) bool {
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	return rsa.VerifyPKCS1v15(&server.Key.PublicKey, crypto.SHA256, digest[:], signature) == nil
+}
+
+// Check the signature of a V4 signed URL, recomputing it from the request as received
+func (server *testGcsServer) verifySignedUrl(r *http.Request) bool {
+	var params []string
+	for name, values := range r.URL.Query() {
+		if name != "X-Goog-Signature" {
+			params = append(params, gcsSigningEscape(name, false)+"="+gcsSigningEscape(values[0], false))
+		}
+	}
+	sort.Strings(params)
+	canonicalRequest := strings.Join([]string{"GET", r.URL.EscapedPath(), strings.Join(params, "&"), "host:" + r.Host, "", "host", "UNSIGNED-PAYLOAD"}, "\n")
+	canonicalRequestDigest := sha256.Sum256([]byte(canonicalRequest))
+	credential := strings.SplitN(r.URL.Query().Get("X-Goog-Credential"), "/", 2)
+	stringToSign := strings.Join([]string{"GOOG4-RSA-SHA256", r.URL.Query().Get("X-Goog-Date"), credential[len(credential)-1], hex.EncodeToString(canonicalRequestDigest[:])}, "\n")
+	digest := sha256.Sum256([]byte(stringToSign))
+	signature, _ := hex.DecodeString(r.URL.Query().Get("X-Goog-Signature"))
+	return rsa.VerifyPKCS1v15(&server.Key.PublicKey, crypto.SHA256, digest[:], signature) == nil
+}
+
+func (server *testGcsServer) handle(w http.ResponseWriter, r *http.Request) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	if r.URL.Path == "/token" {
+		if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || !server.verifyAssertion(r.FormValue("assertion")) {
+			server.writeError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "gcs-test-token", "expires_in": 3600})
+		return
+	}
+
+	// Signed URL downloads, like https://storage.googleapis.com/bucket/object?X-Goog-Signature=...
+	if r.URL.Query().Get("X-Goog-Signature") != "" {
+		object, exists := server.Objects[strings.TrimPrefix(r.URL.Path, "/"+server.Bucket+"/")]
+		if !server.verifySignedUrl(r) {
+			server.writeError(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		} else if !exists {
+			server.writeError(w, http.StatusNotFound, "NoSuchKey")
+		} else {
+			w.Write(object.Data)
+		}
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer gcs-test-token" {
+		server.writeError(w, http.StatusUnauthorized, "Anonymous caller does not have storage.objects.get access")
+		return
+	}
+
+	// Split paths like /storage/v1/b/bucket/o/some%2Fobject/rewriteTo/b/bucket/o/other%2Fobject into unescaped segments
+	var segments []string
+	for _, segment := range strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/") {
+		segment, _ = url.PathUnescape(segment)
+		segments = append(segments, segment)
+	}
+	upload := segments[0] == "upload"
+	if upload {
+		segments = segments[1:]
+	}
+	if len(segments) < 4 || segments[0] != "storage" || segments[1] != "v1" || segments[2] != "b" {
+		server.writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	if segments[3] != server.Bucket {
+		server.writeError(w, http.StatusNotFound, "The specified bucket does not exist.")
+		return
+	}
+	segments = segments[4:]
+
+	switch {
+	case len(segments) == 0 && r.Method == "GET":
+		json.NewEncoder(w).Encode(map[string]string{"name": server.Bucket})
+
+	case upload && len(segments) == 1 && r.Method == "POST":
+		name := r.URL.Query().Get("name")
+		if ifGeneration := r.URL.Query().Get("ifGenerationMatch"); ifGeneration != "" && ifGeneration != strconv.FormatInt(server.Objects[name].Generation, 10) {
+			server.writeError(w, http.StatusPreconditionFailed, "At least one of the pre-conditions you specified did not hold.")
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		server.generation++
+		server.Objects[name] = testGcsObject{Data: data, Generation: server.generation}
+		server.writeObject(w, name)
+
+	// Lists come two objects to a page, to exercise paging
+	case len(segments) == 1 && r.Method == "GET":
+		var names []string
+		for name := range server.Objects {
+			if strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		start, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+		page := map[string]interface{}{"kind": "storage#objects"}
+		var items []map[string]string
+		for i := start; i < len(names) && i < start+2; i++ {
+			items = append(items, map[string]string{"name": names[i], "size": strconv.Itoa(len(server.Objects[names[i]].Data))})
+		}
+		page["items"] = items
+		if start+2 < len(names) {
+			page["nextPageToken"] = strconv.Itoa(start + 2)
+		}
+		json.NewEncoder(w).Encode(page)
+
+	case len(segments) == 2:
+		object, exists := server.Objects[segments[1]]
+		if !exists {
+			server.writeError(w, http.StatusNotFound, fmt.Sprintf("No such object: %v/%v", server.Bucket, segments[1]))
+			return
+		}
+		switch {
+		case r.Method == "DELETE":
+			delete(server.Objects, segments[1])
+			w.WriteHeader(http.StatusNoContent)
+		case r.URL.Query().Get("alt") == "media":
+			w.Header().Set("X-Goog-Generation", strconv.FormatInt(object.Generation, 10))
+			w.Write(object.Data)
+		default:
+			server.writeObject(w, segments[1])
+		}
+
+	// Rewrites take two requests, to exercise rewrite tokens
+	case len(segments) == 7 && segments[2] == "rewriteTo" && r.Method == "POST":
+		object, exists := server.Objects[segments[1]]
+		if !exists {
+			server.writeError(w, http.StatusNotFound, fmt.Sprintf("No such object: %v/%v", server.Bucket, segments[1]))
+			return
+		}
+		if r.URL.Query().Get("rewriteToken") != "continue" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"done": false, "rewriteToken": "continue"})
+			return
+		}
+		server.generation++
+		server.Objects[segments[6]] = testGcsObject{Data: object.Data, Generation: server.generation}
+		json.NewEncoder(w).Encode(map[string]interface{}{"done": true})
+
+	default:
+		server.writeError(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+// Respond with the metadata of an object
+func (server *testGcsServer) writeObject(w http.ResponseWriter, name string) {
+	object := server.Objects[name]
+	json.NewEncoder(w).Encode(map[string]string{
+		"bucket":     server.Bucket,
+		"name":       name,
+		"size":       strconv.Itoa(len(object.Data)),
+		"generation": strconv.FormatInt(object.Generation, 10),
+	})
+}
+
+// Keep the backend from finding any real Google credentials in the environment
+// The returned function restores the environment
+func setTestGcsEnvironment(t *testing.T) (restore func()) {
+	homeDir, err := ioutil.TempDir("", "caryatid-gcs-home")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	restoreEnvironment := setTestEnvironment(map[string]string{
+		"GOOGLE_APPLICATION_CREDENTIALS": "",
+		"GOOGLE_OAUTH_ACCESS_TOKEN":      "",
+		"STORAGE_EMULATOR_HOST":          "",
+		"CLOUDSDK_CONFIG":                "",
+		"HOME":                           homeDir,
+		"APPDATA":                        homeDir,
+	})
+	return func() {
+		restoreEnvironment()
+		os.RemoveAll(homeDir)
+	}
+}
+
+func TestCaryatidGcsBackend_ImplementsCaryatidBackend(t *testing.T) {
+	var _ CaryatidBackend = new(CaryatidGcsBackend)
+	var _ CaryatidVersionedBackend = new(CaryatidGcsBackend)
+	var _ CaryatidLockingBackend = new(CaryatidGcsBackend)
+	var _ CaryatidStagingBackend = new(CaryatidGcsBackend)
+	var _ CaryatidListingBackend = new(CaryatidGcsBackend)
+	var _ CaryatidDownloadingBackend = new(CaryatidGcsBackend)
+	var _ CaryatidFrontendBackend = new(CaryatidGcsBackend)
+}
+
+func TestCaryatidGcsBackendConformance(t *testing.T) {
+	defer setTestGcsEnvironment(t)()
+	server := newTestGcsServer(t, "test-bucket")
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "caryatid-gcs-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	query := url.Values{"endpoint": {server.URL}, "credentials": {server.writeCredentials(t, tempDir)}}
+	catalogUri := fmt.Sprintf("gs://test-bucket/some/path/catalog.json?%v", query.Encode())
+	if err = CheckBackendConformance(&CaryatidGcsBackend{}, catalogUri, tempDir); err != nil {
+		t.Fatalf("GCS backend is not conformant: %v", err)
+	}
+	if _, exists := server.Objects["some/path/catalog.json"]; !exists {
+		t.Fatalf("Expected the catalog at 'some/path/catalog.json' on the fake GCS server, but found %v", server.Objects)
+	}
+}
+
+func TestCaryatidGcsBackendSignedUrls(t *testing.T) {
+	defer setTestGcsEnvironment(t)()
+	server := newTestGcsServer(t, "test-bucket")
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "caryatid-gcs-signed-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var (
+		credentialsFile                 = server.writeCredentials(t, tempDir)
+		query                           = url.Values{"endpoint": {server.URL}, "credentials": {credentialsFile}, "presign": {"1h"}}
+		catalogUri                      = fmt.Sprintf("gs://test-bucket/vagrant/catalog.json?%v", query.Encode())
+		boxPath                         = filepath.Join(tempDir, "test.box")
+		backend         CaryatidBackend = &CaryatidGcsBackend{}
+		manager                         = NewBackendManager(catalogUri, &backend)
+	)
+	if err = CreateTestBoxFile(boxPath, "virtualbox", true); err != nil {
+		t.Fatalf("Error creating test box: %v", err)
+	}
+
+	if err = manager.AddBox(boxPath, "SignedBox", "A box with a signed URL", "1.0.0", "virtualbox", "sha1", "0xDECAFBAD"); err != nil {
+		t.Fatalf("Error adding box: %v", err)
+	}
+	catalog, _ := manager.GetCatalog()
+	boxUrl := catalog.BoxReferences()[0].Uri
+	if !strings.HasPrefix(boxUrl, server.URL+"/test-bucket/vagrant/SignedBox/SignedBox_1.0.0_virtualbox.box?") {
+		t.Fatalf("Expected the catalog to refer to a signed URL, but got '%v'", boxUrl)
+	}
+
+	// Vagrant downloads the box with the signed URL, without credentials
+	resp, err := http.Get(boxUrl)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Error downloading box from '%v': %v %v", boxUrl, resp, err)
+	}
+	downloaded, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if original, _ := ioutil.ReadFile(boxPath); string(downloaded) != string(original) {
+		t.Fatalf("Downloaded box from '%v' does not match the box that was added", boxUrl)
+	}
+	if resp, err = http.Get(strings.Replace(boxUrl, "virtualbox.box", "vmware.box", 1)); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected a URL with a signature for another object to be refused, but got %v %v", resp, err)
+	}
+	resp.Body.Close()
+
+	// Signed URLs are still managed after turning them off
+	query.Del("presign")
+	var unsigned CaryatidBackend = &CaryatidGcsBackend{}
+	if err = NewBackendManager(fmt.Sprintf("gs://test-bucket/vagrant/catalog.json?%v", query.Encode()), &unsigned).DeleteBox(CatalogQueryParams{Version: "1.0.0"}); err != nil {
+		t.Fatalf("Error deleting box: %v", err)
+	}
+	if _, exists := server.Objects["vagrant/SignedBox/SignedBox_1.0.0_virtualbox.box"]; exists {
+		t.Fatalf("Expected the box to be deleted from the fake GCS server, but found %v", server.Objects)
+	}
+
+	var invalid CaryatidBackend = &CaryatidGcsBackend{}
+	if err = invalid.SetManager(&BackendManager{CatalogUri: fmt.Sprintf("gs://test-bucket/catalog.json?endpoint=%v&presign=1h", url.QueryEscape(server.URL))}); err == nil {
+		t.Fatalf("Expected signed URLs without a service account key to fail")
+	}
+	if err = invalid.SetManager(&BackendManager{CatalogUri: "gs://test-bucket/catalog.json?presign=720h"}); err == nil {
+		t.Fatalf("Expected signed URLs that last longer than %v to fail", MaxGcsPresignExpiry)
+	}
+}
+
+// Run the conformance tests against fake-gcs-server if CARYATID_TEST_GCS_EMULATOR is set to its URL,
+// like http://localhost:4443, and it has a 'caryatid-test' bucket
+// Emulators don't check credentials, so none are configured
+func TestCaryatidGcsBackendEmulator(t *testing.T) {
+	emulatorUrl := os.Getenv("CARYATID_TEST_GCS_EMULATOR")
+	if emulatorUrl == "" {
+		t.Skip("CARYATID_TEST_GCS_EMULATOR is not set")
+	}
+	defer setTestGcsEnvironment(t)()
+
+	tempDir, err := ioutil.TempDir("", "caryatid-gcs-emulator-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	catalogUri := fmt.Sprintf("gs://caryatid-test/%v/catalog.json?endpoint=%v", time.Now().UnixNano(), url.QueryEscape(emulatorUrl))
+	if err = CheckBackendConformance(&CaryatidGcsBackend{}, catalogUri, tempDir); err != nil {
+		t.Fatalf("GCS backend is not conformant with the emulator at '%v': %v", emulatorUrl, err)
+	}
+}
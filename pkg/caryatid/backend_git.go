@@ -0,0 +1,446 @@
+/*
+The git backend, for keeping a Vagrant catalog in a git repository, so that every change to it is a commit
+
+Catalog URIs name the repository, with the path of the catalog inside it as the fragment:
+
+	git+file:///srv/git/catalogs.git?boxes=s3://bucket/boxes#vagrant/testbox.json
+	git+ssh://git@git.example.com/catalogs.git?boxes=file:///srv/boxes&branch=main#testbox.json
+
+Binaries don't belong in git, so box files are stored through another backend,
+in the directory given by the "boxes" query parameter, which is required
+Box paths are relative to that directory, as if the catalog were stored there too
+A "boxes" URI that has a query of its own must be percent-encoded
+
+Other query parameters:
+
+	branch    The branch to commit to; defaults to the remote repository's default branch
+	worktree  A local clone of the repository to commit in; defaults to one kept in the user's cache directory
+	push      Set to false to commit without pushing, leaving commits in worktree, which must then be set
+
+Each change to the catalog is committed with a message describing the boxes added or deleted, and pushed
+Before reading the catalog, the clone is reset to the remote branch, discarding anything that was not pushed
+Several catalogs and processes may share a clone, so each read or change of the catalog holds an OS file lock
+on a file next to the clone, like worktree.lock, from resetting the clone until the change is pushed
+The catalog's version is the commit it was read at,
+so a push that is rejected because someone else pushed first is a catalog conflict, and the change is retried
+*/
+
+package caryatid
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mrled/caryatid/internal/util"
+)
+
+type CaryatidGitBackend struct {
+	// The URL git fetches from and pushes to, like file:///srv/git/catalogs.git
+	RepoUrl string
+
+	// The path of the catalog within the repository
+	CatalogPath string
+
+	// The branch to commit to
+	Branch string
+
+	// A local clone of RepoUrl
+	WorkTree string
+
+	// Commit without pushing
+	NoPush bool
+
+	// The URI of the directory box files are stored in
+	BoxesUri string
+
+	// The backend that stores box files, created from BoxesUri
+	Boxes CaryatidBackend
+
+	Manager *BackendManager
+
+	scheme          string
+	boxesCatalogUri string
+	cloned          bool
+}
+
+func init() {
+	for _, scheme := range []string{"git+file", "git+ssh", "git+http", "git+https"} {
+		RegisterBackend(scheme, func() CaryatidBackend { return &CaryatidGitBackend{} })
+	}
+}
+
+func (backend *CaryatidGitBackend) SetManager(manager *BackendManager) (err error) {
+	var (
+		u        *url.URL
+		boxesUri *url.URL
+	)
+	backend.Manager = manager
+
+	if u, err = url.Parse(manager.CatalogUri); err != nil {
+		return
+	}
+	if !strings.HasPrefix(u.Scheme, "git+") {
+		err = fmt.Errorf("The git backend does not handle URIs like '%v'", manager.CatalogUri)
+		return
+	}
+	backend.scheme = u.Scheme
+	query := u.Query()
+
+	backend.CatalogPath = u.Fragment
+	if backend.CatalogPath == "" || path.IsAbs(backend.CatalogPath) || path.Clean(backend.CatalogPath) != backend.CatalogPath || strings.HasPrefix(backend.CatalogPath, "../") {
+		err = fmt.Errorf("Catalog URI '%v' must end with the path of the catalog inside the repository, like '#vagrant/catalog.json'", manager.CatalogUri)
+		return
+	}
+
+	repo := *u
+	repo.Scheme = strings.TrimPrefix(u.Scheme, "git+")
+	repo.RawQuery = ""
+	repo.Fragment = ""
+	backend.RepoUrl = repo.String()
+
+	backend.Branch = query.Get("branch")
+	backend.WorkTree = query.Get("worktree")
+	if push := query.Get("push"); push != "" {
+		var doPush bool
+		if doPush, err = strconv.ParseBool(push); err != nil {
+			err = fmt.Errorf("Invalid value '%v' for the push parameter in '%v': %v", push, manager.CatalogUri, err)
+			return
+		}
+		backend.NoPush = !doPush
+	}
+	if backend.NoPush && backend.WorkTree == "" {
+		err = fmt.Errorf("Catalog URI '%v' sets push=false, so it must also set worktree to keep its commits in", manager.CatalogUri)
+		return
+	}
+	if backend.WorkTree == "" {
+		var cacheDir string
+		if cacheDir, err = util.CacheDir(); err != nil {
+			return
+		}
+		backend.WorkTree = filepath.Join(cacheDir, "caryatid", "git", fmt.Sprintf("%x", sha1.Sum([]byte(backend.RepoUrl))))
+	}
+
+	backend.BoxesUri = query.Get("boxes")
+	if backend.BoxesUri == "" {
+		err = fmt.Errorf("Catalog URI '%v' must set boxes to the URI of a directory to store box files in, since they don't belong in git", manager.CatalogUri)
+		return
+	}
+	if boxesUri, err = url.Parse(backend.BoxesUri); err != nil {
+		return
+	}
+	boxesUri.Path = strings.TrimSuffix(boxesUri.Path, "/") + "/" + path.Base(backend.CatalogPath)
+	backend.boxesCatalogUri = boxesUri.String()
+	if backend.Boxes, err = NewBackendFromUri(backend.boxesCatalogUri); err != nil {
+		return
+	}
+	NewBackendManager(backend.boxesCatalogUri, &backend.Boxes)
+	return
+}
+
+func (backend *CaryatidGitBackend) GetManager() (manager *BackendManager, err error) {
+	manager = backend.Manager
+	if manager == nil {
+		err = fmt.Errorf("The Manager property was not set")
+	}
+	return
+}
+
+// Run git with args in the work tree, returning what it wrote to stdout
+func (backend *CaryatidGitBackend) git(args ...string) (output string, err error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Dir = backend.WorkTree
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		err = fmt.Errorf("'git %v' failed: %v: %v", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+		return
+	}
+	output = strings.TrimSpace(stdout.String())
+	return
+}
+
+// Clone the repository into the work tree if it isn't there already, and check out the branch
+func (backend *CaryatidGitBackend) clone() (err error) {
+	if backend.cloned {
+		return
+	}
+
+	if _, statErr := os.Stat(filepath.Join(backend.WorkTree, ".git")); os.IsNotExist(statErr) {
+		if err = os.MkdirAll(backend.WorkTree, 0777); err != nil {
+			return
+		}
+		if _, err = backend.git("clone", "--quiet", backend.RepoUrl, "."); err != nil {
+			log.Printf("CaryatidGitBackend.clone(): Error cloning '%v' to '%v': %v\n", backend.RepoUrl, backend.WorkTree, err)
+			return
+		}
+	}
+
+	if backend.Branch == "" {
+		if backend.Branch, err = backend.remoteDefaultBranch(); err != nil {
+			return
+		}
+	}
+	if current, _ := backend.git("symbolic-ref", "--short", "HEAD"); current != backend.Branch {
+		if _, headErr := backend.git("rev-parse", "--verify", "--quiet", "HEAD"); headErr != nil {
+			// A repository with no commits yet has no branch to switch from
+			_, err = backend.git("symbolic-ref", "HEAD", "refs/heads/"+backend.Branch)
+		} else if _, branchErr := backend.git("rev-parse", "--verify", "--quiet", "refs/heads/"+backend.Branch); branchErr == nil {
+			_, err = backend.git("checkout", "--quiet", backend.Branch)
+		} else {
+			_, err = backend.git("checkout", "--quiet", "-b", backend.Branch)
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	backend.cloned = true
+	return
+}
+
+// Return the branch the remote's HEAD points to
+// The clone may be shared with catalogs on other branches, so the branch it has checked out is no guide,
+// except when the remote has no commits yet, in which case a fresh clone has the only branch there is to go on
+func (backend *CaryatidGitBackend) remoteDefaultBranch() (branch string, err error) {
+	var output string
+	if output, err = backend.git("ls-remote", "--symref", "origin", "HEAD"); err != nil {
+		log.Printf("CaryatidGitBackend.remoteDefaultBranch(): Error finding the default branch of '%v': %v\n", backend.RepoUrl, err)
+		return
+	}
+	for _, line := range strings.Split(output, "\n") {
+		// Like "ref: refs/heads/master HEAD", with a tab before HEAD
+		if fields := strings.Fields(line); len(fields) == 3 && fields[0] == "ref:" && fields[2] == "HEAD" {
+			return strings.TrimPrefix(fields[1], "refs/heads/"), nil
+		}
+	}
+	return backend.git("symbolic-ref", "--short", "HEAD")
+}
+
+// Take an OS file lock on a file next to the work tree, so that only one backend at a time uses it,
+// even if they are in different processes
+// The file is not in the work tree, since git will only clone into an empty directory
+func (backend *CaryatidGitBackend) lockWorkTree() (unlock func(), err error) {
+	lockPath := filepath.Clean(backend.WorkTree) + ".lock"
+	if err = os.MkdirAll(filepath.Dir(lockPath), 0777); err != nil {
+		return
+	}
+	return acquireLocalWriteLock(lockPath)
+}
+
+// Bring the work tree up to date with the remote branch, discarding anything that was not pushed
+// Without pushing, the work tree is the only copy, so it is left alone
+func (backend *CaryatidGitBackend) sync() (err error) {
+	if err = backend.clone(); err != nil || backend.NoPush {
+		return
+	}
+	if _, err = backend.git("fetch", "--quiet", "origin"); err != nil {
+		log.Printf("CaryatidGitBackend.sync(): Error fetching '%v': %v\n", backend.RepoUrl, err)
+		return
+	}
+	remoteBranch := "refs/remotes/origin/" + backend.Branch
+	if _, branchErr := backend.git("rev-parse", "--verify", "--quiet", remoteBranch); branchErr != nil {
+		// The branch doesn't exist on the remote yet, and will be created by the first push
+		return
+	}
+	_, err = backend.git("checkout", "--quiet", "--force", "-B", backend.Branch, remoteBranch)
+	return
+}
+
+// Return the commit the work tree has checked out, or an empty string if there are no commits yet
+func (backend *CaryatidGitBackend) head() string {
+	commit, _ := backend.git("rev-parse", "--verify", "--quiet", "HEAD")
+	return commit
+}
+
+// Read the catalog from the work tree as it is now
+func (backend *CaryatidGitBackend) readCatalog() (catalogBytes []byte, err error) {
+	catalogBytes, err = ioutil.ReadFile(filepath.Join(backend.WorkTree, filepath.FromSlash(backend.CatalogPath)))
+	if os.IsNotExist(err) {
+		log.Printf("No catalog at '%v' in '%v'; starting with empty catalog\n", backend.CatalogPath, backend.RepoUrl)
+		catalogBytes = []byte("{}")
+		err = nil
+	}
+	return
+}
+
+func (backend *CaryatidGitBackend) GetCatalogBytes() (catalogBytes []byte, err error) {
+	catalogBytes, _, err = backend.GetCatalogBytesVersion()
+	return
+}
+
+func (backend *CaryatidGitBackend) GetCatalogBytesVersion() (catalogBytes []byte, version string, err error) {
+	unlock, err := backend.lockWorkTree()
+	if err != nil {
+		return
+	}
+	defer unlock()
+	if err = backend.sync(); err != nil {
+		return
+	}
+	version = backend.head()
+	catalogBytes, err = backend.readCatalog()
+	return
+}
+
+func (backend *CaryatidGitBackend) SetCatalogBytes(serializedCatalog []byte) (err error) {
+	unlock, err := backend.lockWorkTree()
+	if err != nil {
+		return
+	}
+	defer unlock()
+	if err = backend.sync(); err != nil {
+		return
+	}
+	return backend.commitCatalog(serializedCatalog)
+}
+
+func (backend *CaryatidGitBackend) SetCatalogBytesIfVersion(serializedCatalog []byte, version string) (err error) {
+	unlock, err := backend.lockWorkTree()
+	if err != nil {
+		return
+	}
+	defer unlock()
+	if err = backend.sync(); err != nil {
+		return
+	}
+	if actual := backend.head(); actual != version {
+		return &CatalogConflictError{CatalogUri: backend.Manager.CatalogUri, Expected: version, Actual: actual}
+	}
+	return backend.commitCatalog(serializedCatalog)
+}
+
+// Commit the catalog on top of the work tree's current commit, and push it
+func (backend *CaryatidGitBackend) commitCatalog(serializedCatalog []byte) (err error) {
+	var (
+		oldBytes    []byte
+		parent      = backend.head()
+		catalogPath = filepath.Join(backend.WorkTree, filepath.FromSlash(backend.CatalogPath))
+	)
+
+	if oldBytes, err = backend.readCatalog(); err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(catalogPath), 0777); err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(catalogPath, serializedCatalog, 0666); err != nil {
+		return
+	}
+	if _, err = backend.git("add", "--", backend.CatalogPath); err != nil {
+		return
+	}
+	if _, diffErr := backend.git("diff", "--cached", "--quiet", "--", backend.CatalogPath); diffErr == nil {
+		log.Printf("CaryatidGitBackend.commitCatalog(): Catalog '%v' is unchanged; not committing\n", backend.CatalogPath)
+		return
+	}
+
+	commitArgs := []string{"commit", "--quiet", "-m", describeCatalogChange(oldBytes, serializedCatalog), "--", backend.CatalogPath}
+	if email, _ := backend.git("config", "user.email"); email == "" {
+		// Commit anyway on build machines where nobody has configured git
+		commitArgs = append([]string{"-c", "user.name=Caryatid", "-c", "user.email=caryatid@localhost"}, commitArgs...)
+	}
+	if _, err = backend.git(commitArgs...); err != nil {
+		log.Printf("CaryatidGitBackend.commitCatalog(): Error committing catalog: %v\n", err)
+		return
+	}
+	if backend.NoPush {
+		return
+	}
+
+	if _, err = backend.git("push", "--quiet", "origin", "HEAD:refs/heads/"+backend.Branch); err != nil {
+		if isNonFastForward(err) {
+			// Someone else pushed since the catalog was read; the next sync() discards this commit
+			log.Printf("CaryatidGitBackend.commitCatalog(): Push to '%v' was rejected: %v\n", backend.RepoUrl, err)
+			conflict := &CatalogConflictError{CatalogUri: backend.Manager.CatalogUri, Expected: parent}
+			if remote, lsErr := backend.git("ls-remote", "origin", "refs/heads/"+backend.Branch); lsErr != nil {
+				log.Printf("CaryatidGitBackend.commitCatalog(): Error finding the commit that '%v' is at now: %v\n", backend.Branch, lsErr)
+			} else if fields := strings.Fields(remote); len(fields) > 0 {
+				conflict.Actual = fields[0]
+			}
+			return conflict
+		}
+		log.Printf("CaryatidGitBackend.commitCatalog(): Error pushing to '%v': %v\n", backend.RepoUrl, err)
+	}
+	return
+}
+
+// Return whether a push failed because the branch has commits that were not fetched,
+// rather than for some other reason, like a hook on the server declining it
+func isNonFastForward(pushErr error) bool {
+	message := pushErr.Error()
+	return strings.Contains(message, "[rejected]") && (strings.Contains(message, "non-fast-forward") || strings.Contains(message, "fetch first"))
+}
+
+// Return a commit message that describes the difference between two serialized catalogs
+func describeCatalogChange(oldBytes []byte, newBytes []byte) string {
+	var oldCatalog, newCatalog Catalog
+	json.Unmarshal(oldBytes, &oldCatalog)
+	json.Unmarshal(newBytes, &newCatalog)
+
+	name := newCatalog.Name
+	if name == "" {
+		name = oldCatalog.Name
+	}
+
+	// Boxes in the first list but not the second
+	missingFrom := func(refs BoxReferenceList, others BoxReferenceList) (boxes []string) {
+		for _, ref := range refs {
+			found := false
+			for _, other := range others {
+				if ref.Version == other.Version && ref.ProviderName == other.ProviderName {
+					found = true
+					break
+				}
+			}
+			if !found {
+				boxes = append(boxes, fmt.Sprintf("%v %v", ref.Version, ref.ProviderName))
+			}
+		}
+		return
+	}
+	added := missingFrom(newCatalog.BoxReferences(), oldCatalog.BoxReferences())
+	deleted := missingFrom(oldCatalog.BoxReferences(), newCatalog.BoxReferences())
+
+	var changes []string
+	if len(added) > 0 {
+		changes = append(changes, fmt.Sprintf("Add %v %v", name, strings.Join(added, ", ")))
+	}
+	if len(deleted) > 0 {
+		changes = append(changes, fmt.Sprintf("Delete %v %v", name, strings.Join(deleted, ", ")))
+	}
+	if len(changes) == 0 {
+		return fmt.Sprintf("Update %v catalog", name)
+	}
+	return strings.Join(changes, "; ")
+}
+
+func (backend *CaryatidGitBackend) CopyBoxFile(localPath string, boxName string, boxVersion string, boxProvider string) (err error) {
+	return backend.Boxes.CopyBoxFile(localPath, boxName, boxVersion, boxProvider)
+}
+
+func (backend *CaryatidGitBackend) DeleteFile(uri string) (err error) {
+	return backend.Boxes.DeleteFile(uri)
+}
+
+func (backend *CaryatidGitBackend) BoxDelegate() (CaryatidBackend, string) {
+	return backend.Boxes, backend.boxesCatalogUri
+}
+
+func (backend *CaryatidGitBackend) Scheme() string {
+	if backend.scheme == "" {
+		return "git+file"
+	}
+	return backend.scheme
+}
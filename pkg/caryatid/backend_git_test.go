@@ -0,0 +1,253 @@
+package caryatid
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Create a bare repository in tempDir and return a catalog URI for it,
+// with boxes in tempDir/boxes and its own clone in tempDir/worktreeName
+func newTestGitCatalogUri(t *testing.T, tempDir string, worktreeName string) string {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	repoPath := filepath.Join(tempDir, "catalogs.git")
+	if _, err := os.Stat(repoPath); os.IsNotExist(err) {
+		if output, err := exec.Command("git", "init", "--quiet", "--bare", repoPath).CombinedOutput(); err != nil {
+			t.Fatalf("Error creating bare repository: %v: %v", err, string(output))
+		}
+	}
+	query := url.Values{}
+	query.Set("boxes", fmt.Sprintf("file://%v", filepath.ToSlash(filepath.Join(tempDir, "boxes"))))
+	query.Set("worktree", filepath.Join(tempDir, worktreeName))
+	return fmt.Sprintf("git+file://%v?%v#vagrant/GitBox.json", filepath.ToSlash(repoPath), query.Encode())
+}
+
+// Return the subject of every commit in a repository, newest first
+func gitCommitSubjects(t *testing.T, repoPath string) []string {
+	output, err := exec.Command("git", "--git-dir", repoPath, "log", "--format=%s").Output()
+	if err != nil {
+		t.Fatalf("Error reading git log: %v", err)
+	}
+	return strings.Split(strings.TrimSpace(string(output)), "\n")
+}
+
+func TestCaryatidGitBackend(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "caryatid-git-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	catalogUri := newTestGitCatalogUri(t, tempDir, "conformance")
+	if err = CheckBackendConformance(&CaryatidGitBackend{}, catalogUri, tempDir); err != nil {
+		t.Fatalf("Git backend is not conformant: %v", err)
+	}
+}
+
+func TestCaryatidGitBackendCommits(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "caryatid-git-commits-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var (
+		repoPath                     = filepath.Join(tempDir, "catalogs.git")
+		boxPath                      = filepath.Join(tempDir, "test.box")
+		boxFile                      = filepath.Join(tempDir, "boxes", "GitBox", "GitBox_1.0.0_virtualbox.box")
+		backend      CaryatidBackend = &CaryatidGitBackend{}
+		manager                      = NewBackendManager(newTestGitCatalogUri(t, tempDir, "first"), &backend)
+		other        CaryatidBackend = &CaryatidGitBackend{}
+		otherManager                 = NewBackendManager(newTestGitCatalogUri(t, tempDir, "second"), &other)
+	)
+	if err = CreateTestBoxFile(boxPath, "virtualbox", true); err != nil {
+		t.Fatalf("Error creating test box: %v", err)
+	}
+
+	if err = manager.AddBox(boxPath, "GitBox", "A box in git", "1.0.0", "virtualbox", "sha1", "0xDECAFBAD"); err != nil {
+		t.Fatalf("Error adding box: %v", err)
+	}
+	if _, err = os.Stat(boxFile); err != nil {
+		t.Fatalf("Expected box to be stored through the delegate at '%v', but got error %v", boxFile, err)
+	}
+	if catalog, _ := otherManager.GetCatalog(); len(catalog.BoxReferences()) != 1 || !strings.HasPrefix(catalog.BoxReferences()[0].Uri, "file://") {
+		t.Fatalf("Expected a second clone to see the pushed catalog with a box in the delegate, but got:\n%v", catalog.DisplayString())
+	}
+
+	// Someone else pushes after the catalog was read
+	_, version, err := other.(CaryatidVersionedBackend).GetCatalogBytesVersion()
+	if err != nil {
+		t.Fatalf("Error getting catalog version: %v", err)
+	}
+	if err = manager.AddBox(boxPath, "GitBox", "A box in git", "1.1.0", "virtualbox", "sha1", "0xDECAFBAD"); err != nil {
+		t.Fatalf("Error adding second box: %v", err)
+	}
+	if err = other.(CaryatidVersionedBackend).SetCatalogBytesIfVersion([]byte(`{}`), version); !IsCatalogConflict(err) {
+		t.Fatalf("Expected a catalog conflict after someone else pushed, but got error %v", err)
+	}
+
+	if err = otherManager.DeleteBox(CatalogQueryParams{Version: "1.0.0"}); err != nil {
+		t.Fatalf("Error deleting box: %v", err)
+	}
+	if _, err = os.Stat(boxFile); !os.IsNotExist(err) {
+		t.Fatalf("Expected deleted box to be removed from the delegate, but got error %v", err)
+	}
+
+	expected := []string{"Delete GitBox 1.0.0 virtualbox", "Add GitBox 1.1.0 virtualbox", "Add GitBox 1.0.0 virtualbox"}
+	if subjects := gitCommitSubjects(t, repoPath); strings.Join(subjects, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Expected commits %v, but got %v", expected, subjects)
+	}
+}
+
+func TestCaryatidGitBackendSharedWorkTree(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "caryatid-git-shared-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var (
+		repoPath = filepath.Join(tempDir, "catalogs.git")
+		boxPath  = filepath.Join(tempDir, "test.box")
+		versions = [][]string{{"1.0.0", "1.1.0", "1.2.0"}, {"2.0.0", "2.1.0", "2.2.0"}}
+		errs     = make([]error, len(versions))
+		wait     sync.WaitGroup
+	)
+	if err = CreateTestBoxFile(boxPath, "virtualbox", true); err != nil {
+		t.Fatalf("Error creating test box: %v", err)
+	}
+
+	// Two backends, as if in two processes, add boxes at the same time through the same clone
+	for i := range versions {
+		var backend CaryatidBackend = &CaryatidGitBackend{}
+		manager := NewBackendManager(newTestGitCatalogUri(t, tempDir, "shared"), &backend)
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			for _, version := range versions[i] {
+				if errs[i] = manager.AddBox(boxPath, "GitBox", "A box in git", version, "virtualbox", "sha1", "0xDECAFBAD"); errs[i] != nil {
+					return
+				}
+			}
+		}(i)
+	}
+	wait.Wait()
+	for _, err = range errs {
+		if err != nil {
+			t.Fatalf("Error adding box through a shared clone: %v", err)
+		}
+	}
+
+	var expected []string
+	for _, list := range versions {
+		for _, version := range list {
+			expected = append(expected, fmt.Sprintf("Add GitBox %v virtualbox", version))
+		}
+	}
+	subjects := gitCommitSubjects(t, repoPath)
+	sort.Strings(expected)
+	sort.Strings(subjects)
+	if strings.Join(subjects, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Expected one commit for each box, %v, but got %v", expected, subjects)
+	}
+	var backend CaryatidBackend = &CaryatidGitBackend{}
+	if catalog, _ := NewBackendManager(newTestGitCatalogUri(t, tempDir, "check"), &backend).GetCatalog(); len(catalog.BoxReferences()) != len(expected) {
+		t.Fatalf("Expected %v boxes in the catalog, but got:\n%v", len(expected), catalog.DisplayString())
+	}
+}
+
+func TestCaryatidGitBackendDefaultBranch(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "caryatid-git-branch-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var (
+		repoPath                     = filepath.Join(tempDir, "catalogs.git")
+		catalogUri                   = newTestGitCatalogUri(t, tempDir, "shared")
+		releaseUri                   = strings.Replace(catalogUri, "#", "&branch=release#", 1)
+		first        CaryatidBackend = &CaryatidGitBackend{}
+		release      CaryatidBackend = &CaryatidGitBackend{}
+		second       CaryatidBackend = &CaryatidGitBackend{}
+		secondGit                    = second.(*CaryatidGitBackend)
+		countCommits                 = func(branch string) int {
+			output, err := exec.Command("git", "--git-dir", repoPath, "rev-list", "--count", branch).Output()
+			if err != nil {
+				t.Fatalf("Error counting commits on '%v': %v", branch, err)
+			}
+			count := 0
+			fmt.Sscan(string(output), &count)
+			return count
+		}
+	)
+	if err = NewBackendManager(catalogUri, &first).SaveCatalog(Catalog{Name: "GitBox"}); err != nil {
+		t.Fatalf("Error saving catalog: %v", err)
+	}
+	defaultBranch, err := exec.Command("git", "--git-dir", repoPath, "symbolic-ref", "--short", "HEAD").Output()
+	if err != nil {
+		t.Fatalf("Error reading the default branch: %v", err)
+	}
+
+	// A catalog on another branch leaves that branch checked out in the shared clone
+	if err = NewBackendManager(releaseUri, &release).SaveCatalog(Catalog{Name: "GitBox", Description: "release"}); err != nil {
+		t.Fatalf("Error saving catalog on the release branch: %v", err)
+	}
+	if err = NewBackendManager(catalogUri, &second).SaveCatalog(Catalog{Name: "GitBox", Description: "default"}); err != nil {
+		t.Fatalf("Error saving catalog: %v", err)
+	}
+	if expected := strings.TrimSpace(string(defaultBranch)); secondGit.Branch != expected {
+		t.Fatalf("Expected a catalog URI without a branch to use the remote's default branch '%v', but got '%v'", expected, secondGit.Branch)
+	}
+	if commits := countCommits("HEAD"); commits != 2 {
+		t.Fatalf("Expected 2 commits on the default branch, but got %v", commits)
+	}
+	if commits := countCommits("release"); commits != 2 {
+		t.Fatalf("Expected 2 commits on the release branch, but got %v", commits)
+	}
+}
+
+func TestCaryatidGitBackendPushRejected(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "caryatid-git-rejected-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var (
+		backend CaryatidBackend = &CaryatidGitBackend{}
+		manager                 = NewBackendManager(newTestGitCatalogUri(t, tempDir, "worktree"), &backend)
+		hook                    = filepath.Join(tempDir, "catalogs.git", "hooks", "pre-receive")
+	)
+	if err = manager.SaveCatalog(Catalog{Name: "GitBox"}); err != nil {
+		t.Fatalf("Error saving catalog: %v", err)
+	}
+
+	// A hook that declines the push is an error, but not one that retrying with a fresh catalog can fix
+	if err = ioutil.WriteFile(hook, []byte("#!/bin/sh\necho 'catalog changes need review' >&2\nexit 1\n"), 0755); err != nil {
+		t.Fatalf("Error writing hook: %v", err)
+	}
+	if err = manager.SaveCatalog(Catalog{Name: "GitBox", Description: "declined"}); err == nil || IsCatalogConflict(err) {
+		t.Fatalf("Expected a push declined by a hook to fail without a catalog conflict, but got error %v", err)
+	}
+
+	for message, expected := range map[string]bool{
+		" ! [rejected]        HEAD -> master (fetch first)":                               true,
+		" ! [rejected]        HEAD -> master (non-fast-forward)":                          true,
+		" ! [remote rejected] HEAD -> master (pre-receive hook declined)":                 false,
+		"fatal: unable to access 'https://example.com/repo.git/': Could not resolve host": false,
+	} {
+		if actual := isNonFastForward(fmt.Errorf("'git push' failed: exit status 1: %v", message)); actual != expected {
+			t.Fatalf("Expected isNonFastForward() to be %v for '%v'", expected, message)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package caryatid
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCaryatidHttpBackend_ImplementsCaryatidBackend(t *testing.T) {
+	var _ CaryatidBackend = new(CaryatidHttpBackend)
+}
+
+func TestCaryatidHttpBackend(t *testing.T) {
+	var (
+		err          error
+		catalog      Catalog
+		catalogBytes = `{"name":"TestHttpBox","description":"a box","versions":[{"version":"1.0.0","providers":[{"name":"virtualbox","url":"https://example.com/TestHttpBox.box","checksum_type":"sha1","checksum":"0xDECAFBAD"}]}]}`
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3kr1t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/boxes/TestHttpBox.json" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, catalogBytes)
+	}))
+	defer server.Close()
+
+	catalogUri := fmt.Sprintf("%v/boxes/TestHttpBox.json", server.URL)
+	backend, err := NewBackendFromUri(catalogUri)
+	if err != nil {
+		t.Fatalf("Error getting backend: %v", err)
+	}
+	backend.(*CaryatidHttpBackend).Token = "s3kr1t"
+	manager := NewBackendManager(catalogUri, &backend)
+
+	if catalog, err = manager.GetCatalog(); err != nil {
+		t.Fatalf("Error getting catalog: %v", err)
+	}
+	if catalog.Name != "TestHttpBox" || len(catalog.Versions) != 1 {
+		t.Fatalf("Unexpected catalog:\n%v", catalog.DisplayString())
+	}
+
+	readOnlyErrors := []error{
+		backend.SetCatalogBytes([]byte("{}")),
+		backend.CopyBoxFile("/tmp/example.box", "TestHttpBox", "1.0.0", "virtualbox"),
+		backend.DeleteFile("https://example.com/TestHttpBox.box"),
+		manager.DeleteBox(CatalogQueryParams{Version: "1.0.0"}),
+	}
+	for idx, err := range readOnlyErrors {
+		if err == nil || !strings.Contains(err.Error(), "read-only") {
+			t.Fatalf("Expected a read-only error for mutating operation %v, but got '%v'", idx, err)
+		}
+	}
+
+	missingUri := fmt.Sprintf("%v/boxes/Missing.json", server.URL)
+	var missingBackend CaryatidBackend = &CaryatidHttpBackend{Token: "s3kr1t"}
+	NewBackendManager(missingUri, &missingBackend)
+	if _, err = missingBackend.GetCatalogBytes(); err == nil {
+		t.Fatalf("Expected an error getting a catalog that does not exist")
+	}
+}
+
+func TestCaryatidHttpBackendMirror(t *testing.T) {
+	var (
+		err    error
+		report MigrationReport
+		boxes  = map[string]string{
+			"/TestHttpBox_1.0.0_virtualbox.box": "old virtualbox box",
+			"/TestHttpBox_2.0.0_virtualbox.box": "new virtualbox box",
+			"/TestHttpBox_2.0.0_hyperv.box":     "new hyperv box",
+		}
+	)
+
+	// Boxes are on a different host than the catalog, like a CDN, and must not be sent the catalog's credentials
+	boxServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contents, ok := boxes[r.URL.Path]
+		if r.Header.Get("Authorization") != "" || !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, contents)
+	}))
+	defer boxServer.Close()
+
+	provider := func(name string, version string, checksum string) string {
+		return fmt.Sprintf(`{"name":"%v","url":"%v/TestHttpBox_%v_%v.box","checksum_type":"SHA256","checksum":"%v"}`, name, boxServer.URL, version, name, checksum)
+	}
+	sha256sum := func(contents string) string {
+		return fmt.Sprintf("%X", sha256.Sum256([]byte(contents)))
+	}
+	catalogBytes := fmt.Sprintf(`{"name":"TestHttpBox","description":"a box","versions":[{"version":"1.0.0","providers":[%v]},{"version":"2.0.0","providers":[%v,%v]}]}`,
+		provider("virtualbox", "1.0.0", sha256sum(boxes["/TestHttpBox_1.0.0_virtualbox.box"])),
+		provider("virtualbox", "2.0.0", sha256sum(boxes["/TestHttpBox_2.0.0_virtualbox.box"])),
+		provider("hyperv", "2.0.0", sha256sum("a different hyperv box")))
+	catalogServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3kr1t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, catalogBytes)
+	}))
+	defer catalogServer.Close()
+
+	var fromBackend CaryatidBackend = &CaryatidHttpBackend{Token: "s3kr1t"}
+	from := NewBackendManager(catalogServer.URL+"/TestHttpBox.json", &fromBackend)
+	toStore := NewMemoryStore()
+	var toBackend CaryatidBackend = &CaryatidMemoryBackend{Store: toStore}
+	to := NewBackendManager("mem://mirror/TestHttpBox.json", &toBackend)
+
+	if report, err = MigrateCatalog(from, to, CatalogQueryParams{Version: ">=2.0.0", Provider: "virtualbox"}, true); err != nil {
+		t.Fatalf("Error mirroring HTTP catalog: %v", err)
+	}
+	if len(report.Copied) != 1 || report.Copied[0].Uri != "mem://mirror/TestHttpBox/TestHttpBox_2.0.0_virtualbox.box" {
+		t.Fatalf("Expected to copy only version 2.0.0 of the virtualbox box, but got report %v", report)
+	}
+	if contents, _ := toStore.ReadFile(report.Copied[0].Uri); string(contents) != boxes["/TestHttpBox_2.0.0_virtualbox.box"] {
+		t.Fatalf("Expected the box to be copied, but got '%s'", contents)
+	}
+
+	// The hyperv box doesn't match its checksum, so it is not mirrored
+	if _, err = MigrateCatalog(from, to, CatalogQueryParams{Provider: "hyperv"}, true); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("Expected mirroring a box with the wrong checksum to fail, but got error %v", err)
+	}
+	if catalog, _ := to.GetCatalog(); len(catalog.BoxReferences()) != 1 {
+		t.Fatalf("Expected the failed mirror to leave the catalog alone, but got:\n%v", catalog.DisplayString())
+	}
+}
@@ -0,0 +1,274 @@
+package caryatid
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A fake of a raw repository in an artifact manager, which anyone may read but only a deployer may write
+// Like Artifactory, it rejects uploads whose X-Checksum-Sha1 header doesn't match
+type testRawRepository struct {
+	lock      sync.Mutex
+	files     map[string][]byte
+	checksum  map[string]string
+	forbidden map[string]bool
+	failures  int
+	server    *httptest.Server
+
+	// Answer HEAD requests without a Content-Length, like some servers do
+	omitContentLength bool
+}
+
+func newTestRawRepository() (repo *testRawRepository) {
+	repo = &testRawRepository{files: map[string][]byte{}, checksum: map[string]string{}, forbidden: map[string]bool{}}
+	repo.server = httptest.NewServer(repo)
+	return
+}
+
+func (repo *testRawRepository) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if repo.failures > 0 {
+		repo.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if username, password, ok := r.BasicAuth(); r.Method != "GET" && r.Method != "HEAD" && (!ok || username != "deployer" || password != "secret") {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	data, exists := repo.files[r.URL.Path]
+	switch r.Method {
+	case "GET":
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case "HEAD":
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !repo.omitContentLength {
+			w.Header().Set("Content-Length", fmt.Sprintf("%v", len(data)))
+		}
+	case "PUT":
+		if repo.forbidden[r.URL.Path] {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		data, _ = ioutil.ReadAll(r.Body)
+		checksum := fmt.Sprintf("%x", sha1.Sum(data))
+		if header := r.Header.Get("X-Checksum-Sha1"); header != "" && header != checksum {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		repo.files[r.URL.Path] = data
+		repo.checksum[r.URL.Path] = r.Header.Get("X-Checksum-Sha1")
+		w.WriteHeader(http.StatusCreated)
+	case "DELETE":
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(repo.files, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestCaryatidHttpPutBackend_ImplementsCaryatidBackend(t *testing.T) {
+	var _ CaryatidBackend = new(CaryatidHttpPutBackend)
+	var _ CaryatidFrontendBackend = new(CaryatidHttpPutBackend)
+	var _ CaryatidUploadingBackend = new(CaryatidHttpPutBackend)
+	var _ CaryatidDownloadingBackend = new(CaryatidHttpPutBackend)
+}
+
+func TestCaryatidHttpPutBackend(t *testing.T) {
+	repo := newTestRawRepository()
+	defer repo.server.Close()
+
+	tempDir, err := ioutil.TempDir("", "caryatid-httpput-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	catalogUri := fmt.Sprintf("http+put://deployer:secret@%v/repository/raw/ConformanceBox.json?checksum_header=X-Checksum-Sha1:sha1", repo.server.Listener.Addr())
+	if err = CheckBackendConformance(&CaryatidHttpPutBackend{RetryDelay: time.Millisecond}, catalogUri, tempDir); err != nil {
+		t.Fatalf("HTTP PUT backend is not conformant: %v", err)
+	}
+}
+
+func TestCaryatidHttpPutBackendUploads(t *testing.T) {
+	repo := newTestRawRepository()
+	defer repo.server.Close()
+
+	tempDir, err := ioutil.TempDir("", "caryatid-httpput-uploads-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var (
+		catalogUri                 = fmt.Sprintf("http+put://%v/repository/raw/vagrant/testbox.json?checksum_header=X-Checksum-Sha1:sha1", repo.server.Listener.Addr())
+		boxPath                    = filepath.Join(tempDir, "test.box")
+		backend    CaryatidBackend = &CaryatidHttpPutBackend{Username: "deployer", Password: "secret", RetryDelay: time.Millisecond}
+		manager                    = NewBackendManager(catalogUri, &backend)
+	)
+	if err = CreateTestBoxFile(boxPath, "virtualbox", true); err != nil {
+		t.Fatalf("Error creating test box: %v", err)
+	}
+
+	invalid := &CaryatidHttpPutBackend{}
+	if err = invalid.SetManager(&BackendManager{CatalogUri: catalogUri + "&checksum_header=X-Checksum:crc32"}); err == nil {
+		t.Fatalf("Expected an unsupported checksum type to fail")
+	}
+
+	// The server fails twice before the upload goes through
+	repo.failures = 2
+	if err = manager.AddBox(boxPath, "testbox", "Test box", "1.0.0", "virtualbox", "sha1", "0xDECAFBAD"); err != nil {
+		t.Fatalf("Error adding box: %v", err)
+	}
+	boxFilePath := "/repository/raw/vagrant/testbox/testbox_1.0.0_virtualbox.box"
+	original, _ := ioutil.ReadFile(boxPath)
+	if expected := fmt.Sprintf("%x", sha1.Sum(original)); repo.checksum[boxFilePath] != expected {
+		t.Fatalf("Expected the box to be uploaded with X-Checksum-Sha1 '%v', but got '%v'", expected, repo.checksum[boxFilePath])
+	}
+
+	// Vagrant downloads the box from the same server, without credentials
+	catalog, _ := manager.GetCatalog()
+	boxUrl := catalog.BoxReferences()[0].Uri
+	if expected := repo.server.URL + boxFilePath; boxUrl != expected {
+		t.Fatalf("Expected the catalog to refer to '%v', but got '%v'", expected, boxUrl)
+	}
+	resp, err := http.Get(boxUrl)
+	if err != nil {
+		t.Fatalf("Error downloading box: %v", err)
+	}
+	downloaded, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(downloaded) != string(original) {
+		t.Fatalf("Downloaded box from '%v' does not match the box that was added", boxUrl)
+	}
+
+	// The server fails more times than the backend retries
+	repo.failures = DefaultHttpPutRetries + 1
+	if err = manager.DeleteBox(CatalogQueryParams{Version: "1.0.0"}); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("Expected deleting to fail after running out of retries, but got error %v", err)
+	}
+	repo.failures = 0
+
+	var anonymousBackend CaryatidBackend = &CaryatidHttpPutBackend{RetryDelay: time.Millisecond}
+	os.Unsetenv("CARYATID_HTTP_PUT_USERNAME")
+	os.Unsetenv("CARYATID_HTTP_PUT_TOKEN")
+	if err = NewBackendManager(catalogUri, &anonymousBackend).DeleteBox(CatalogQueryParams{Version: "1.0.0"}); err == nil {
+		t.Fatalf("Expected deleting without credentials to fail")
+	}
+	if err = manager.DeleteBox(CatalogQueryParams{Version: "1.0.0"}); err != nil {
+		t.Fatalf("Error deleting box: %v", err)
+	}
+	if _, ok := repo.files[boxFilePath]; ok {
+		t.Fatalf("Expected box at '%v' to be deleted", boxFilePath)
+	}
+}
+
+func TestCaryatidHttpPutBackendFailedCatalogSave(t *testing.T) {
+	repo := newTestRawRepository()
+	defer repo.server.Close()
+
+	tempDir, err := ioutil.TempDir("", "caryatid-httpput-rollback-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var (
+		catalogUri                     = fmt.Sprintf("http+put://%v/repository/raw/vagrant/testbox.json", repo.server.Listener.Addr())
+		catalogPath                    = "/repository/raw/vagrant/testbox.json"
+		boxPath                        = filepath.Join(tempDir, "test.box")
+		boxFilePath                    = "/repository/raw/vagrant/testbox/testbox_1.0.0_virtualbox.box"
+		newBoxFilePath                 = "/repository/raw/vagrant/testbox/testbox_1.1.0_virtualbox.box"
+		backend        CaryatidBackend = &CaryatidHttpPutBackend{Username: "deployer", Password: "secret", RetryDelay: time.Millisecond}
+		manager                        = NewBackendManager(catalogUri, &backend)
+	)
+	if err = CreateTestBoxFile(boxPath, "virtualbox", true); err != nil {
+		t.Fatalf("Error creating test box: %v", err)
+	}
+	if err = manager.AddBox(boxPath, "testbox", "Test box", "1.0.0", "virtualbox", "sha1", "0xDECAFBAD"); err != nil {
+		t.Fatalf("Error adding box: %v", err)
+	}
+	original := repo.files[boxFilePath]
+
+	// Without staging, the backend cannot restore a box that it replaced, so adding the same box again must not touch it
+	repo.forbidden[catalogPath] = true
+	if err = manager.AddBox(boxPath, "testbox", "Test box", "1.0.0", "virtualbox", "sha1", "0xDECAFBAD"); err == nil {
+		t.Fatalf("Expected adding a box that already exists to fail")
+	}
+	if data, ok := repo.files[boxFilePath]; !ok || string(data) != string(original) {
+		t.Fatalf("Expected the box at '%v' to be left alone after a failed add", boxFilePath)
+	}
+	catalog, _ := manager.GetCatalog()
+	if refs := catalog.BoxReferences(); len(refs) != 1 {
+		t.Fatalf("Expected the catalog to still have one box, but got %v", refs)
+	}
+
+	// A new box is removed again when the catalog cannot be saved
+	if err = manager.AddBox(boxPath, "testbox", "Test box", "1.1.0", "virtualbox", "sha1", "0xDECAFBAD"); err == nil {
+		t.Fatalf("Expected adding a box to fail when the catalog cannot be saved")
+	}
+	if _, ok := repo.files[newBoxFilePath]; ok {
+		t.Fatalf("Expected the box at '%v' to be removed after the catalog could not be saved", newBoxFilePath)
+	}
+	if _, ok := repo.files[boxFilePath]; !ok {
+		t.Fatalf("Expected the box at '%v' to survive a failed add of another box", boxFilePath)
+	}
+}
+
+func TestCaryatidHttpPutBackendNoContentLength(t *testing.T) {
+	repo := newTestRawRepository()
+	defer repo.server.Close()
+	repo.omitContentLength = true
+
+	tempDir, err := ioutil.TempDir("", "caryatid-httpput-no-content-length-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var (
+		catalogUri                      = fmt.Sprintf("http+put://%v/repository/raw/vagrant/testbox.json", repo.server.Listener.Addr())
+		boxUri                          = fmt.Sprintf("http+put://%v/repository/raw/vagrant/testbox/testbox_1.0.0_virtualbox.box", repo.server.Listener.Addr())
+		boxPath                         = filepath.Join(tempDir, "test.box")
+		backend                         = &CaryatidHttpPutBackend{Username: "deployer", Password: "secret", RetryDelay: time.Millisecond}
+		caryatidBackend CaryatidBackend = backend
+		manager                         = NewBackendManager(catalogUri, &caryatidBackend)
+	)
+	if err = CreateTestBoxFile(boxPath, "virtualbox", true); err != nil {
+		t.Fatalf("Error creating test box: %v", err)
+	}
+	if err = manager.AddBox(boxPath, "testbox", "Test box", "1.0.0", "virtualbox", "sha1", "0xDECAFBAD"); err != nil {
+		t.Fatalf("Error adding box: %v", err)
+	}
+
+	// The size is unknown, but the box still exists, so it is not replaced
+	if size, exists, err := backend.FileSize(boxUri); err != nil || !exists || size != -1 {
+		t.Fatalf("Expected '%v' to exist with an unknown size, but got size %v, exists %v, error %v", boxUri, size, exists, err)
+	}
+	if err = manager.AddBox(boxPath, "testbox", "Test box", "1.0.0", "virtualbox", "sha1", "0xDECAFBAD"); err == nil {
+		t.Fatalf("Expected adding a box that already exists to fail")
+	}
+}
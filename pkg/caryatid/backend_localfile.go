@@ -5,7 +5,10 @@ The localfile backend, for dealing with a Vagrant catalog on a local filesystem
 package caryatid
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/url"
@@ -13,6 +16,8 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"strings"
+	"time"
 
 	"github.com/mrled/caryatid/internal/util"
 )
@@ -21,6 +26,13 @@ type CaryatidLocalFileBackend struct {
 	VagrantCatalogRootPath string
 	VagrantCatalogPath     string
 	Manager                *BackendManager
+
+	// The open lock file while this backend holds the lock on the catalog
+	lockFile *os.File
+}
+
+func init() {
+	RegisterBackend("file", func() CaryatidBackend { return &CaryatidLocalFileBackend{} })
 }
 
 func (backend *CaryatidLocalFileBackend) SetManager(manager *BackendManager) (err error) {
@@ -65,7 +77,8 @@ func (backend *CaryatidLocalFileBackend) SetCatalogBytes(serializedCatalog []byt
 		return
 	}
 
-	err = ioutil.WriteFile(backend.VagrantCatalogPath, serializedCatalog, 0666)
+	// Write atomically, so that a Vagrant client or web server never reads a partially written catalog
+	err = util.WriteFileAtomic(backend.VagrantCatalogPath, serializedCatalog, 0666)
 	if err != nil {
 		log.Println("Error trying to write catalog: ", err)
 		return
@@ -74,6 +87,227 @@ func (backend *CaryatidLocalFileBackend) SetCatalogBytes(serializedCatalog []byt
 	return
 }
 
+func (backend *CaryatidLocalFileBackend) GetCatalogBytesVersion() (catalogBytes []byte, version string, err error) {
+	catalogBytes, err = ioutil.ReadFile(backend.VagrantCatalogPath)
+	if os.IsNotExist(err) {
+		log.Printf("No file at '%v'; starting with empty catalog\n", backend.VagrantCatalogPath)
+		catalogBytes = []byte("{}")
+		err = nil
+		return
+	} else if err != nil {
+		log.Printf("Error trying to read catalog: %v\n", err)
+		return
+	}
+	version = catalogContentVersion(catalogBytes)
+	return
+}
+
+// Save the catalog, but only if its contents have not changed since they were read
+// Other processes are kept from writing the catalog between the check and the write with an OS file lock on a ".write-lock" file next to it
+func (backend *CaryatidLocalFileBackend) SetCatalogBytesIfVersion(serializedCatalog []byte, version string) (err error) {
+	var (
+		currentBytes   []byte
+		currentVersion string
+	)
+
+	if err = os.MkdirAll(backend.VagrantCatalogRootPath, 0777); err != nil {
+		log.Printf("Error trying to create the catalog root path at '%v': %v\n", backend.VagrantCatalogRootPath, err)
+		return
+	}
+
+	unlock, err := acquireLocalWriteLock(backend.VagrantCatalogPath + ".write-lock")
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	currentBytes, err = ioutil.ReadFile(backend.VagrantCatalogPath)
+	if err == nil {
+		currentVersion = catalogContentVersion(currentBytes)
+	} else if os.IsNotExist(err) {
+		err = nil
+	} else {
+		log.Printf("Error trying to read catalog: %v\n", err)
+		return
+	}
+	if currentVersion != version {
+		return &CatalogConflictError{CatalogUri: backend.Manager.CatalogUri, Expected: version, Actual: currentVersion}
+	}
+
+	return backend.SetCatalogBytes(serializedCatalog)
+}
+
+// How long to wait for another process to release a local write lock
+const localWriteLockTimeout = 30 * time.Second
+
+// Take an OS file lock on a lock file that only one process can hold at a time,
+// waiting for any other process holding it to release it
+// The OS releases the lock if the process exits, so a killed process never leaves the lock held
+// Returns a function that releases the lock
+func acquireLocalWriteLock(lockPath string) (unlock func(), err error) {
+	var (
+		lockFile *os.File
+		locked   bool
+	)
+	if lockFile, err = os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0666); err != nil {
+		log.Printf("Error trying to open lock file '%v': %v\n", lockPath, err)
+		return
+	}
+	deadline := time.Now().Add(localWriteLockTimeout)
+	for {
+		if locked, err = tryLockFile(lockFile); err != nil {
+			lockFile.Close()
+			return
+		} else if locked {
+			break
+		} else if time.Now().After(deadline) {
+			lockFile.Close()
+			err = fmt.Errorf("Timed out waiting for another process to release lock file '%v'", lockPath)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	unlock = func() {
+		if unlockErr := unlockFile(lockFile); unlockErr != nil {
+			log.Printf("Error trying to release lock file '%v': %v\n", lockPath, unlockErr)
+		}
+		lockFile.Close()
+	}
+	return
+}
+
+// The path to the file that holds the advisory lock on the catalog
+func (backend *CaryatidLocalFileBackend) lockPath() string {
+	return backend.VagrantCatalogPath + ".lock"
+}
+
+// Read the lock from an open lock file
+func readLockFile(lockFile *os.File) (lock *CatalogLock, err error) {
+	var lockBytes []byte
+	if _, err = lockFile.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	if lockBytes, err = ioutil.ReadAll(lockFile); err != nil {
+		return
+	}
+	lock = new(CatalogLock)
+	if err = json.Unmarshal(lockBytes, lock); err != nil {
+		// The holder has locked the file but not yet written its details
+		lock = &CatalogLock{Owner: "unknown"}
+		err = nil
+	}
+	return
+}
+
+// Take the lock on the catalog with an OS file lock on a ".lock" file next to it
+// The OS releases the file lock if the process exits, so the lock's Expires time is only informational
+func (backend *CaryatidLocalFileBackend) Lock(lock CatalogLock) (err error) {
+	var (
+		lockFile *os.File
+		locked   bool
+		lockInfo os.FileInfo
+		pathInfo os.FileInfo
+		lockJson []byte
+	)
+
+	if backend.lockFile != nil {
+		return fmt.Errorf("Already holding the lock on '%v'", backend.VagrantCatalogPath)
+	}
+	if lockJson, err = json.Marshal(lock); err != nil {
+		return
+	}
+	if err = os.MkdirAll(backend.VagrantCatalogRootPath, 0777); err != nil {
+		log.Printf("Error trying to create the catalog root path at '%v': %v\n", backend.VagrantCatalogRootPath, err)
+		return
+	}
+
+	for {
+		if lockFile, err = os.OpenFile(backend.lockPath(), os.O_RDWR|os.O_CREATE, 0666); err != nil {
+			return
+		}
+		if locked, err = tryLockFile(lockFile); err != nil || !locked {
+			defer lockFile.Close()
+			if err == nil {
+				var current *CatalogLock
+				if current, err = readLockFile(lockFile); err == nil {
+					err = &CatalogLockedError{CatalogUri: backend.Manager.CatalogUri, Lock: *current}
+				}
+			}
+			return
+		}
+
+		// If the lock was broken after we opened the file, we hold a lock on a file that no longer exists; try again
+		lockInfo, err = lockFile.Stat()
+		if err == nil {
+			pathInfo, err = os.Stat(backend.lockPath())
+		}
+		if err == nil && os.SameFile(lockInfo, pathInfo) {
+			break
+		}
+		unlockFile(lockFile)
+		lockFile.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return
+		}
+	}
+
+	if err = lockFile.Truncate(0); err == nil {
+		if _, err = lockFile.WriteAt(lockJson, 0); err == nil {
+			err = lockFile.Sync()
+		}
+	}
+	if err != nil {
+		unlockFile(lockFile)
+		lockFile.Close()
+		return
+	}
+	backend.lockFile = lockFile
+	return
+}
+
+func (backend *CaryatidLocalFileBackend) Unlock() (err error) {
+	if backend.lockFile == nil {
+		return fmt.Errorf("Not holding the lock on '%v'", backend.VagrantCatalogPath)
+	}
+	backend.lockFile.Truncate(0)
+	err = unlockFile(backend.lockFile)
+	backend.lockFile.Close()
+	backend.lockFile = nil
+	return
+}
+
+func (backend *CaryatidLocalFileBackend) LockStatus() (lock *CatalogLock, err error) {
+	var (
+		lockFile *os.File
+		locked   bool
+	)
+	lockFile, err = os.OpenFile(backend.lockPath(), os.O_RDWR, 0666)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+	defer lockFile.Close()
+
+	if locked, err = tryLockFile(lockFile); err != nil {
+		return
+	} else if locked {
+		// Nobody else holds the lock
+		unlockFile(lockFile)
+		return
+	}
+	return readLockFile(lockFile)
+}
+
+// Remove the lock file
+// A process that still holds an OS file lock on the removed file no longer keeps anyone else from taking the lock
+func (backend *CaryatidLocalFileBackend) BreakLock() (err error) {
+	if err = os.Remove(backend.lockPath()); os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
+
 func (backend *CaryatidLocalFileBackend) CopyBoxFile(localPath string, boxName string, boxVersion string, boxProvider string) (err error) {
 	var boxUri string
 
@@ -82,8 +316,26 @@ func (backend *CaryatidLocalFileBackend) CopyBoxFile(localPath string, boxName s
 		fmt.Printf("Error trying to determine box URI: %v\n", err)
 		return
 	}
+	return backend.UploadFile(localPath, boxUri)
+}
 
-	remoteBoxPath, err := getValidLocalPath(boxUri)
+func (backend *CaryatidLocalFileBackend) UploadFile(localPath string, uri string) (err error) {
+	var (
+		localFile *os.File
+		localInfo os.FileInfo
+	)
+	if localFile, err = os.Open(localPath); err != nil {
+		return
+	}
+	defer localFile.Close()
+	if localInfo, err = localFile.Stat(); err != nil {
+		return
+	}
+	return backend.PutBox(context.Background(), uri, localFile, localInfo.Size())
+}
+
+func (backend *CaryatidLocalFileBackend) PutBox(ctx context.Context, uri string, reader io.Reader, size int64) (err error) {
+	remoteBoxPath, err := getValidLocalPath(uri)
 	if err != nil {
 		fmt.Printf("Error trying to parse local artifact path from URI: %v\n", err)
 		return
@@ -97,15 +349,86 @@ func (backend *CaryatidLocalFileBackend) CopyBoxFile(localPath string, boxName s
 	}
 	log.Printf("Successfully created directory at %v\n", remoteBoxParentPath)
 
-	written, err := util.CopyFile(localPath, remoteBoxPath)
+	written, err := util.CopyReaderAtomic(contextReader{ctx, reader}, remoteBoxPath)
 	if err != nil {
-		log.Printf("Error trying to copy '%v' to '%v' file: %v\n", localPath, remoteBoxPath, err)
+		log.Printf("Error trying to write '%v' file: %v\n", remoteBoxPath, err)
 		return
 	}
-	log.Printf("Copied %v bytes from original path at '%v' to new location at '%v'\n", written, localPath, remoteBoxPath)
+	log.Printf("Wrote %v bytes to new location at '%v'\n", written, remoteBoxPath)
 	return
 }
 
+func (backend *CaryatidLocalFileBackend) OpenBox(ctx context.Context, uri string) (reader io.ReadCloser, err error) {
+	var localPath string
+	if localPath, err = getValidLocalPath(uri); err != nil {
+		return
+	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	return os.Open(localPath)
+}
+
+func (backend *CaryatidLocalFileBackend) FileSize(uri string) (size int64, exists bool, err error) {
+	var (
+		localPath string
+		info      os.FileInfo
+	)
+	if localPath, err = getValidLocalPath(uri); err != nil {
+		return
+	}
+	if info, err = os.Stat(localPath); os.IsNotExist(err) {
+		return 0, false, nil
+	} else if err != nil {
+		return
+	}
+	return info.Size(), true, nil
+}
+
+func (backend *CaryatidLocalFileBackend) DownloadFile(uri string, localPath string) (err error) {
+	var reader io.ReadCloser
+	if reader, err = backend.OpenBox(context.Background(), uri); err != nil {
+		return
+	}
+	defer reader.Close()
+	_, err = util.CopyReaderAtomic(reader, localPath)
+	return
+}
+
+func (backend *CaryatidLocalFileBackend) ListFiles(dirUri string) (files []BackendFile, err error) {
+	var dirPath string
+	if dirPath, err = getValidLocalPath(dirUri); err != nil {
+		return
+	}
+	err = filepath.Walk(dirPath, func(filePath string, info os.FileInfo, walkErr error) error {
+		if os.IsNotExist(walkErr) && filePath == dirPath {
+			return filepath.SkipDir
+		} else if walkErr != nil {
+			return walkErr
+		} else if info.IsDir() {
+			return nil
+		}
+		relPath, relErr := filepath.Rel(dirPath, filePath)
+		if relErr != nil {
+			return relErr
+		}
+		files = append(files, BackendFile{Uri: strings.TrimSuffix(dirUri, "/") + "/" + filepath.ToSlash(relPath), Size: info.Size()})
+		return nil
+	})
+	return
+}
+
+func (backend *CaryatidLocalFileBackend) MoveFile(fromUri string, toUri string) (err error) {
+	var fromPath, toPath string
+	if fromPath, err = getValidLocalPath(fromUri); err != nil {
+		return
+	}
+	if toPath, err = getValidLocalPath(toUri); err != nil {
+		return
+	}
+	return os.Rename(fromPath, toPath)
+}
+
 func (backend *CaryatidLocalFileBackend) DeleteFile(uri string) (err error) {
 	var (
 		u    *url.URL
@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package caryatid
+
+import (
+	"os"
+	"syscall"
+)
+
+// Try to take an exclusive OS file lock on an open file without waiting
+// Returns false if another open file holds the lock
+func tryLockFile(file *os.File) (locked bool, err error) {
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Release an OS file lock taken with tryLockFile()
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
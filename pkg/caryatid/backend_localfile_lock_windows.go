@@ -0,0 +1,28 @@
+package caryatid
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// Windows file locks keep other processes from reading the locked bytes,
+// so lock a single byte far past the end of the lock file rather than its contents
+var lockFileOverlapped = windows.Overlapped{OffsetHigh: 1}
+
+// Try to take an exclusive OS file lock on an open file without waiting
+// Returns false if another open file holds the lock
+func tryLockFile(file *os.File) (locked bool, err error) {
+	overlapped := lockFileOverlapped
+	err = windows.LockFileEx(windows.Handle(file.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, &overlapped)
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Release an OS file lock taken with tryLockFile()
+func unlockFile(file *os.File) error {
+	overlapped := lockFileOverlapped
+	return windows.UnlockFileEx(windows.Handle(file.Fd()), 0, 1, 0, &overlapped)
+}
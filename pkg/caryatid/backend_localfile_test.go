@@ -1,9 +1,140 @@
 package caryatid
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
 	"testing"
+	"time"
 )
 
 func TestCaryatidLocalFileBackend(t *testing.T) {
-	t.Logf("NOT IMPLEMENTED\n")
+	tempDir, err := ioutil.TempDir("", "caryatid-localfile-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	catalogUri := fmt.Sprintf("file://%v", filepath.ToSlash(filepath.Join(tempDir, "LocalFileBox.json")))
+	if err = CheckBackendConformance(&CaryatidLocalFileBackend{}, catalogUri, tempDir); err != nil {
+		t.Fatalf("Local file backend is not conformant: %v", err)
+	}
+}
+
+func TestCaryatidLocalFileBackendLock(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "caryatid-localfile-lock-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	catalogUri := fmt.Sprintf("file://%v", filepath.ToSlash(filepath.Join(tempDir, "LockBox.json")))
+	var holderBackend CaryatidBackend = &CaryatidLocalFileBackend{}
+	holder := NewBackendManager(catalogUri, &holderBackend)
+	var otherBackend CaryatidBackend = &CaryatidLocalFileBackend{}
+	other := NewBackendManager(catalogUri, &otherBackend)
+
+	if err = holder.Lock("holder", time.Minute); err != nil {
+		t.Fatalf("Error taking lock: %v", err)
+	}
+	err = other.Lock("other", time.Minute)
+	if lockedErr, ok := err.(*CatalogLockedError); !ok || lockedErr.Lock.Owner != "holder" {
+		t.Fatalf("Expected taking a held lock to fail with the holder's details, but got: %v", err)
+	}
+	if err = other.BreakLock(); err != nil {
+		t.Fatalf("Error breaking lock: %v", err)
+	}
+	if err = other.Lock("other", time.Minute); err != nil {
+		t.Fatalf("Error taking a broken lock: %v", err)
+	}
+	if err = holder.Unlock(); err != nil {
+		t.Fatalf("Error releasing a broken lock: %v", err)
+	}
+	if current, err := holder.LockStatus(); err != nil || current == nil || current.Owner != "other" {
+		t.Fatalf("Expected the lock to be held by 'other', but got '%v' and error '%v'", current, err)
+	}
+}
+
+func TestCaryatidLocalFileBackendWriteLock(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "caryatid-localfile-write-lock-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	catalogPath := filepath.Join(tempDir, "WriteLockBox.json")
+	catalogUri := fmt.Sprintf("file://%v", filepath.ToSlash(catalogPath))
+	var backend CaryatidBackend = &CaryatidLocalFileBackend{}
+	manager := NewBackendManager(catalogUri, &backend)
+
+	// A lock file left behind by a process that was killed does not hold the lock
+	if err = ioutil.WriteFile(catalogPath+".write-lock", nil, 0666); err != nil {
+		t.Fatalf("Error writing stale lock file: %v", err)
+	}
+	err = manager.UpdateCatalog(func(catalog *Catalog) error {
+		catalog.Name = "WriteLockBox"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error updating catalog with a stale lock file: %v", err)
+	}
+
+	// Writes wait for whoever holds the lock to release it
+	unlock, err := acquireLocalWriteLock(catalogPath + ".write-lock")
+	if err != nil {
+		t.Fatalf("Error taking write lock: %v", err)
+	}
+	released := make(chan struct{})
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		close(released)
+		unlock()
+	}()
+	err = manager.UpdateCatalog(func(catalog *Catalog) error {
+		catalog.Description = "updated"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error updating catalog: %v", err)
+	}
+	select {
+	case <-released:
+	default:
+		t.Fatalf("Expected updating the catalog to wait for the write lock")
+	}
+}
+
+func TestCaryatidLocalFileBackendAtomicWrite(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "caryatid-localfile-atomic-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	catalogPath := filepath.Join(tempDir, "AtomicBox.json")
+	catalogUri := fmt.Sprintf("file://%v", filepath.ToSlash(catalogPath))
+	var backend CaryatidBackend = &CaryatidLocalFileBackend{}
+	NewBackendManager(catalogUri, &backend)
+
+	if err = backend.SetCatalogBytes([]byte(`{"name":"AtomicBox"}`)); err != nil {
+		t.Fatalf("Error writing catalog: %v", err)
+	}
+	if err = os.Chmod(catalogPath, 0640); err != nil {
+		t.Fatalf("Error changing catalog permissions: %v", err)
+	}
+	if err = backend.SetCatalogBytes([]byte(`{"name":"AtomicBox","description":"changed"}`)); err != nil {
+		t.Fatalf("Error rewriting catalog: %v", err)
+	}
+
+	if contents, _ := ioutil.ReadFile(catalogPath); string(contents) != `{"name":"AtomicBox","description":"changed"}` {
+		t.Fatalf("Unexpected catalog contents: %v", string(contents))
+	}
+	if info, _ := os.Stat(catalogPath); runtime.GOOS != "windows" && info.Mode().Perm() != 0640 {
+		t.Fatalf("Expected rewriting the catalog to keep its permissions of 0640, but they were %v", info.Mode().Perm())
+	}
+	if entries, _ := ioutil.ReadDir(tempDir); len(entries) != 1 {
+		t.Fatalf("Expected only the catalog in '%v', but found %v entries; were temporary files left behind?", tempDir, len(entries))
+	}
 }
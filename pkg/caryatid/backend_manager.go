@@ -1,20 +1,36 @@
 package caryatid
 
 import (
+	"context"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash"
+	"io"
 	"log"
+	"math/rand"
 	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mrled/caryatid/internal/util"
 )
 
+// NewBackend returns a new, unconfigured backend registered for a URI scheme
+// If no backend is registered, but a "caryatid-backend-<name>" helper is in $PATH, return an exec backend for it
+// See also RegisterBackend() and CaryatidExecBackend
 func NewBackend(name string) (backend CaryatidBackend, err error) {
-	switch name {
-	case "file":
-		backend = &CaryatidLocalFileBackend{}
-	case "s3":
-		backend = &CaryatidS3Backend{}
-	default:
-		err = fmt.Errorf("No known backend with name '%v'", name)
+	backendRegistryLock.RLock()
+	factory, ok := backendRegistry[name]
+	backendRegistryLock.RUnlock()
+
+	if ok {
+		backend = factory()
+	} else if helperPath, lookErr := findExecBackend(name); lookErr == nil {
+		backend = &CaryatidExecBackend{ExecutablePath: helperPath, scheme: name}
+	} else {
+		err = fmt.Errorf("No known backend with name '%v', and no '%v%v' helper in $PATH", name, ExecBackendPrefix, name)
 	}
 	return
 }
@@ -33,25 +49,97 @@ func NewBackendFromUri(uri string) (backend CaryatidBackend, err error) {
 type BackendManager struct {
 	CatalogUri string
 	Backend    CaryatidBackend
+
+	// An optional base URI that Vagrant clients download boxes from, such as https://cdn.example.com/boxes
+	// Boxes are still written through the Backend, next to the catalog,
+	// but box URLs in the catalog are recorded relative to this URI instead of the catalog URI
+	PublicBaseUri string
+
+	// Where new boxes are written, relative to the catalog's directory, as a template using the fields of BoxPathParams
+	// DefaultBoxPathTemplate if empty
+	BoxPathTemplate string
+
+	// The number of times to retry a change to the catalog when someone else changed it first
+	// Only used when the Backend is a CaryatidVersionedBackend
+	ConflictRetries int
+
+	// The lock this manager holds on the catalog, if any
+	lock *CatalogLock
 }
 
+// The default value of BackendManager.ConflictRetries
+const DefaultConflictRetries = 5
+
 // TODO: Should this also just call NewBackendFromUri()? Why split them out?
 func NewBackendManager(catalogUri string, backend *CaryatidBackend) (bm *BackendManager) {
 	bm = &BackendManager{
-		catalogUri,
-		*backend,
+		CatalogUri:      catalogUri,
+		Backend:         *backend,
+		ConflictRetries: DefaultConflictRetries,
 	}
 	bm.Backend.SetManager(bm)
 	return
 }
 
+// Return the backend that box files are stored in, and the catalog URI that box paths are relative to
+// These are the manager's own Backend and CatalogUri, unless the Backend delegates box storage to another backend
+func (bm *BackendManager) boxStorage() (backend CaryatidBackend, catalogUri string) {
+	if delegating, ok := bm.Backend.(CaryatidDelegatingBackend); ok {
+		return delegating.BoxDelegate()
+	}
+	return bm.Backend, bm.CatalogUri
+}
+
+// FrontendUri returns the URI that Vagrant clients should use for a file stored at a backend URI
+// If PublicBaseUri is set, it takes precedence over any translation the backend itself does
+func (bm *BackendManager) FrontendUri(storageUri string) (frontendUri string, err error) {
+	backend, catalogUri := bm.boxStorage()
+	if bm.PublicBaseUri != "" {
+		var catalogParentUri string
+		if catalogParentUri, err = CatalogParentUri(catalogUri); err != nil {
+			return
+		}
+		if !strings.HasPrefix(storageUri, catalogParentUri+"/") {
+			err = fmt.Errorf("URI '%v' is not under the catalog's parent '%v', so it has no public URI", storageUri, catalogParentUri)
+			return
+		}
+		frontendUri = strings.TrimSuffix(bm.PublicBaseUri, "/") + storageUri[len(catalogParentUri):]
+		return
+	}
+	if frontend, ok := backend.(CaryatidFrontendBackend); ok {
+		return frontend.FrontendUri(storageUri)
+	}
+	return storageUri, nil
+}
+
+// StorageUri returns the backend URI for a file that Vagrant clients download from a frontend URI
+func (bm *BackendManager) StorageUri(frontendUri string) (storageUri string, err error) {
+	backend, catalogUri := bm.boxStorage()
+	publicBaseUri := strings.TrimSuffix(bm.PublicBaseUri, "/")
+	if publicBaseUri != "" && strings.HasPrefix(frontendUri, publicBaseUri+"/") {
+		var catalogParentUri string
+		if catalogParentUri, err = CatalogParentUri(catalogUri); err != nil {
+			return
+		}
+		storageUri = catalogParentUri + frontendUri[len(publicBaseUri):]
+		return
+	}
+	if frontend, ok := backend.(CaryatidFrontendBackend); ok {
+		return frontend.StorageUri(frontendUri)
+	}
+	return frontendUri, nil
+}
+
 func (bm *BackendManager) GetCatalog() (catalog Catalog, err error) {
 	catalogBytes, err := bm.Backend.GetCatalogBytes()
 	if err != nil {
 		log.Printf("Error trying to get catalog bytes: %v\n", err)
 		return
 	}
+	return unmarshalCatalog(catalogBytes)
+}
 
+func unmarshalCatalog(catalogBytes []byte) (catalog Catalog, err error) {
 	err = json.Unmarshal(catalogBytes, &catalog)
 	if err != nil {
 		log.Printf("Error unmashalling catalog: %v\ncatalogbytes:\n%v\n", err, catalogBytes)
@@ -74,58 +162,503 @@ func (bm *BackendManager) SaveCatalog(catalog Catalog) (err error) {
 	return
 }
 
-func (bm *BackendManager) AddBox(localPath string, name string, description string, version string, provider string, checksumType string, checksum string) (err error) {
+// UpdateCatalog reads the catalog, passes it to a function that changes it, and saves the result
+// If the Backend is a CaryatidVersionedBackend, the catalog is only saved if nobody else changed it in the meantime;
+// when someone did, the change is applied again to their catalog, up to ConflictRetries times,
+// after which a *CatalogConflictError is returned
+func (bm *BackendManager) UpdateCatalog(change func(*Catalog) error) (err error) {
+	var (
+		catalog      Catalog
+		catalogBytes []byte
+		version      string
+	)
+
+	if err = bm.checkLock(); err != nil {
+		return
+	}
 
-	catalog, err := bm.GetCatalog()
+	versioned, ok := bm.Backend.(CaryatidVersionedBackend)
+	if !ok {
+		if catalog, err = bm.GetCatalog(); err != nil {
+			return
+		}
+		if err = change(&catalog); err != nil {
+			return
+		}
+		return bm.SaveCatalog(catalog)
+	}
+
+	for attempt := 0; ; attempt++ {
+		if catalogBytes, version, err = versioned.GetCatalogBytesVersion(); err != nil {
+			log.Printf("Error trying to get catalog bytes: %v\n", err)
+			return
+		}
+		if catalog, err = unmarshalCatalog(catalogBytes); err != nil {
+			return
+		}
+		if err = change(&catalog); err != nil {
+			return
+		}
+		if catalogBytes, err = json.MarshalIndent(catalog, "", "  "); err != nil {
+			log.Println("Error trying to marshal catalog: ", err)
+			return
+		}
+
+		err = versioned.SetCatalogBytesIfVersion(catalogBytes, version)
+		if !IsCatalogConflict(err) || attempt >= bm.ConflictRetries {
+			return
+		}
+		log.Printf("Catalog '%v' was changed by someone else; retrying (%v of %v)\n", bm.CatalogUri, attempt+1, bm.ConflictRetries)
+		time.Sleep(time.Duration(rand.Intn(100*(attempt+1))) * time.Millisecond)
+	}
+}
+
+// Return the Backend as a CaryatidLockingBackend, or an error if it doesn't support locking
+func (bm *BackendManager) lockingBackend() (locking CaryatidLockingBackend, err error) {
+	locking, ok := bm.Backend.(CaryatidLockingBackend)
+	if !ok {
+		err = fmt.Errorf("The '%v' backend does not support locking", bm.Backend.Scheme())
+	}
+	return
+}
+
+// Return a *CatalogLockedError if someone other than this manager holds an unexpired lock on the catalog
+func (bm *BackendManager) checkLock() (err error) {
+	var current *CatalogLock
+	locking, ok := bm.Backend.(CaryatidLockingBackend)
+	if !ok || bm.lock != nil {
+		return
+	}
+	if current, err = locking.LockStatus(); err != nil {
+		log.Printf("Error checking whether the catalog is locked: %v\n", err)
+		return
+	}
+	if current != nil && !current.Expired() {
+		err = &CatalogLockedError{CatalogUri: bm.CatalogUri, Lock: *current}
+	}
+	return
+}
+
+// Lock takes the advisory lock on the catalog until Unlock() is called, or until ttl has passed
+// If owner is empty, the name of the current user is used; if ttl is zero, the lock never expires
+// While the lock is held, other managers refuse to change the catalog
+func (bm *BackendManager) Lock(owner string, ttl time.Duration) (err error) {
+	var locking CaryatidLockingBackend
+	if locking, err = bm.lockingBackend(); err != nil {
+		return
+	}
+	if bm.lock != nil {
+		return fmt.Errorf("This manager already holds the lock on '%v'", bm.CatalogUri)
+	}
+	lock := NewCatalogLock(owner, ttl)
+	if err = locking.Lock(lock); err != nil {
+		return
+	}
+	bm.lock = &lock
+	return
+}
+
+// Unlock releases a lock taken with Lock()
+func (bm *BackendManager) Unlock() (err error) {
+	var locking CaryatidLockingBackend
+	if locking, err = bm.lockingBackend(); err != nil {
+		return
+	}
+	if bm.lock == nil {
+		return fmt.Errorf("This manager does not hold the lock on '%v'", bm.CatalogUri)
+	}
+	if err = locking.Unlock(); err != nil {
+		return
+	}
+	bm.lock = nil
+	return
+}
+
+// LockStatus returns the lock currently held on the catalog by anyone, or nil if it is not locked
+func (bm *BackendManager) LockStatus() (lock *CatalogLock, err error) {
+	var locking CaryatidLockingBackend
+	if locking, err = bm.lockingBackend(); err != nil {
+		return
+	}
+	return locking.LockStatus()
+}
+
+// BreakLock removes any lock on the catalog, no matter who holds it
+func (bm *BackendManager) BreakLock() (err error) {
+	var locking CaryatidLockingBackend
+	if locking, err = bm.lockingBackend(); err != nil {
+		return
+	}
+	return locking.BreakLock()
+}
+
+// AddBox copies a box file to the backend and then adds it to the catalog
+// The catalog is only changed once the box is in place, so a failed upload never leaves clients with a broken catalog
+// If the Backend is a CaryatidStagingBackend, the box is uploaded to a staging location and verified before it replaces any existing box,
+// and if the catalog cannot be saved, the existing box is restored
+func (bm *BackendManager) AddBox(localPath string, name string, description string, version string, provider string, checksumType string, checksum string) (err error) {
 	if _, err = NewComparableVersion(version); err != nil {
 		log.Printf("AddBox(): Invalid version '%v'\n", version)
+		return
+	}
+	if err = bm.checkLock(); err != nil {
+		return
+	}
+
+	params, err := bm.boxPathParams(localPath, name, version, provider, checksumType, checksum)
+	if err != nil {
+		log.Printf("AddBox(): Error reading box file: %v\n", err)
+		return
+	}
+	_, boxCatalogUri := bm.boxStorage()
+	storageUri, err := BoxUriFromTemplate(boxCatalogUri, bm.BoxPathTemplate, params)
+	if err != nil {
+		log.Printf("AddBox(): Error determining box URI: %v\n", err)
+		return
+	}
+
+	commit, rollback, err := bm.storeBoxFile(localPath, storageUri, params)
+	if err != nil {
+		log.Printf("AddBox(): Error storing box file: %v\n", err)
+		return
+	}
+	return bm.addStoredBox(storageUri, commit, rollback, name, description, version, provider, checksumType, checksum)
+}
+
+// AddBoxFromReader stores a box read from a stream and then adds it to the catalog, like AddBox does for a local file
+// This is for boxes that are not on the local disk, such as a box streamed from another build host or produced in a pipe
+// The size is the number of bytes the reader will return, or -1 if it is not known in advance
+// If the checksum is empty, it is calculated as the box is stored; otherwise the stored box must match it
+// Requires the backend that stores boxes to be a CaryatidStreamingBackend,
+// and a BoxPathTemplate that does not use {{.Arch}}, since the box's architecture can only be read from the box itself
+func (bm *BackendManager) AddBoxFromReader(ctx context.Context, reader io.Reader, size int64, name string, description string, version string, provider string, checksumType string, checksum string) (err error) {
+	var (
+		hasher     hash.Hash
+		storageUri string
+	)
+
+	if _, err = NewComparableVersion(version); err != nil {
+		log.Printf("AddBoxFromReader(): Invalid version '%v'\n", version)
+		return
+	}
+	if err = bm.checkLock(); err != nil {
+		return
+	}
+
+	backend, boxCatalogUri := bm.boxStorage()
+	streaming, ok := backend.(CaryatidStreamingBackend)
+	if !ok {
+		err = fmt.Errorf("The '%v' backend cannot store boxes from a stream", backend.Scheme())
+		return
+	}
+	if boxPathUses(bm.BoxPathTemplate, "Arch") {
+		err = fmt.Errorf("The box path template '%v' uses {{.Arch}}, which cannot be determined for a box that is being streamed", bm.BoxPathTemplate)
+		return
+	}
+	if checksum == "" && boxPathUses(bm.BoxPathTemplate, "Checksum") {
+		err = fmt.Errorf("The box path template '%v' uses {{.Checksum}}, so the checksum of a box that is being streamed must be passed in", bm.BoxPathTemplate)
+		return
+	}
+	if hasher, err = util.NewHasher(checksumType); err != nil {
+		return
 	}
+
+	params := BoxPathParams{Name: name, Version: version, Provider: provider, ChecksumType: checksumType, Checksum: checksum}
+	if storageUri, err = BoxUriFromTemplate(boxCatalogUri, bm.BoxPathTemplate, params); err != nil {
+		log.Printf("AddBoxFromReader(): Error determining box URI: %v\n", err)
+		return
+	}
+
+	upload := func(uri string) (written int64, err error) {
+		counter := &countingWriter{}
+		if err = streaming.PutBox(ctx, uri, io.TeeReader(reader, io.MultiWriter(hasher, counter)), size); err != nil {
+			return
+		}
+		written = counter.written
+		if size >= 0 && written != size {
+			err = fmt.Errorf("Expected to store a box of %v bytes at '%v', but the stream had %v bytes", size, uri, written)
+			return
+		}
+		if sum := hex.EncodeToString(hasher.Sum(nil)); checksum == "" {
+			checksum = sum
+		} else if !strings.EqualFold(sum, checksum) {
+			err = fmt.Errorf("The %v checksum of the box stored at '%v' is '%v', but expected '%v'", checksumType, uri, sum, checksum)
+		}
+		return
+	}
+
+	commit, rollback, err := bm.storeBox(storageUri, upload)
+	if err != nil {
+		log.Printf("AddBoxFromReader(): Error storing box: %v\n", err)
+		return
+	}
+	return bm.addStoredBox(storageUri, commit, rollback, name, description, version, provider, checksumType, checksum)
+}
+
+// Counts the bytes written to it, and throws them away
+type countingWriter struct {
+	written int64
+}
+
+func (writer *countingWriter) Write(p []byte) (int, error) {
+	writer.written += int64(len(p))
+	return len(p), nil
+}
+
+// Add a box that has been stored at storageUri to the catalog
+// Calls commit if the catalog is saved, and rollback if it is not
+func (bm *BackendManager) addStoredBox(storageUri string, commit func(), rollback func(), name string, description string, version string, provider string, checksumType string, checksum string) (err error) {
+	// Some backends, like OCI registries, only know where clients can download a box once it is stored
+	boxUri, err := bm.FrontendUri(storageUri)
 	if err != nil {
-		log.Printf("AddBox(): Error retrieving catalog from backend: %v\n", err)
+		log.Printf("Error determining frontend URI for box: %v\n", err)
+		rollback()
 		return
 	}
 
-	err = catalog.AddBox(bm.CatalogUri, name, description, version, provider, checksumType, checksum)
+	err = bm.UpdateCatalog(func(catalog *Catalog) error {
+		return catalog.AddBoxUri(boxUri, name, description, version, provider, checksumType, checksum)
+	})
 	if err != nil {
-		log.Printf("AddBox(): Error adding box to catalog metadata object: %v\n", err)
+		log.Printf("Error saving catalog: %v\n", err)
+		rollback()
 		return
 	}
-	if err = bm.SaveCatalog(catalog); err != nil {
-		log.Printf("AddBox(): Error saving catalog: %v\n", err)
+	commit()
+	return
+}
+
+// Return the fields for the box path template for a local box file
+// The box's architecture is only read from its metadata.json if the template uses it
+func (bm *BackendManager) boxPathParams(localPath string, name string, version string, provider string, checksumType string, checksum string) (params BoxPathParams, err error) {
+	params = BoxPathParams{Name: name, Version: version, Provider: provider, ChecksumType: checksumType, Checksum: checksum}
+	if boxPathUses(bm.BoxPathTemplate, "Arch") {
+		params.Arch, err = DetermineArchitecture(localPath)
+	}
+	return
+}
+
+// Store a box at a URI given by the box path template
+// Staging backends publish the box with publishBox;
+// other backends upload it directly if they can, or copy it to the default path if that is where it belongs,
+// as long as that does not replace an existing box
+// Returns functions to call once the catalog is saved, or if it could not be
+func (bm *BackendManager) storeBoxFile(localPath string, storageUri string, params BoxPathParams) (commit func(), rollback func(), err error) {
+	backend, _ := bm.boxStorage()
+	if staging, ok := backend.(CaryatidStagingBackend); ok {
+		return bm.publishBox(staging, storageUri, func(uri string) (size int64, err error) {
+			var localInfo os.FileInfo
+			if localInfo, err = os.Stat(localPath); err != nil {
+				return
+			}
+			return localInfo.Size(), staging.UploadFile(localPath, uri)
+		})
+	}
+
+	uploading, isUploading := backend.(CaryatidUploadingBackend)
+	if !isUploading && bm.BoxPathTemplate != "" && bm.BoxPathTemplate != DefaultBoxPathTemplate {
+		err = fmt.Errorf("The '%v' backend can only store boxes at the default path, '%v'", backend.Scheme(), DefaultBoxPathTemplate)
 		return
 	}
-	if err = bm.Backend.CopyBoxFile(localPath, name, version, provider); err != nil {
-		log.Printf("AddBox(): Error copying box file: %v\n", err)
+	if commit, rollback, err = bm.prepareDirectStore(storageUri); err != nil {
 		return
 	}
+	if isUploading {
+		err = uploading.UploadFile(localPath, storageUri)
+	} else {
+		err = backend.CopyBoxFile(localPath, params.Name, params.Version, params.Provider)
+	}
 	return
 }
 
-func (bm *BackendManager) DeleteBox(params CatalogQueryParams) (err error) {
+// Store a box at a URI with upload, which writes the box to the URI it is passed and returns how many bytes it wrote
+// Staging backends publish the box with publishBox; other backends have it written directly to storageUri,
+// as long as that does not replace an existing box, and remove it again if it could not be written correctly
+// Returns functions to call once the catalog is saved, or if it could not be
+func (bm *BackendManager) storeBox(storageUri string, upload func(uri string) (int64, error)) (commit func(), rollback func(), err error) {
+	backend, _ := bm.boxStorage()
+	if staging, ok := backend.(CaryatidStagingBackend); ok {
+		return bm.publishBox(staging, storageUri, upload)
+	}
+	if commit, rollback, err = bm.prepareDirectStore(storageUri); err != nil {
+		return
+	}
+	if _, err = upload(storageUri); err != nil {
+		rollback()
+	}
+	return
+}
+
+// Return functions to call once the catalog is saved, or if it could not be, for a box that will be written directly to storageUri
+// Without staging, a box that is replaced cannot be restored if the catalog cannot be saved,
+// so this refuses to replace a box that is already at storageUri, and the rollback deletes only the new box
+// Whether a box exists comes from the backend if it is a CaryatidSizingBackend, and from the catalog otherwise
+func (bm *BackendManager) prepareDirectStore(storageUri string) (commit func(), rollback func(), err error) {
+	var exists bool
+
+	backend, _ := bm.boxStorage()
+	if sizing, ok := backend.(CaryatidSizingBackend); ok {
+		_, exists, err = sizing.FileSize(storageUri)
+	} else {
+		exists, err = bm.catalogReferences(storageUri)
+	}
+	if err != nil {
+		return
+	} else if exists {
+		err = fmt.Errorf("A box already exists at '%v', and the '%v' backend cannot replace it safely; delete it first", storageUri, backend.Scheme())
+		return
+	}
+
+	commit = func() {}
+	rollback = func() {
+		if deleteErr := backend.DeleteFile(storageUri); deleteErr != nil {
+			log.Printf("Error removing '%v': %v\n", storageUri, deleteErr)
+		}
+	}
+	return
+}
+
+// Return whether any box in the catalog is stored at storageUri
+func (bm *BackendManager) catalogReferences(storageUri string) (referenced bool, err error) {
 	var (
-		catalog       Catalog
-		deleteCatalog Catalog
-		refs          BoxReferenceList
+		catalog Catalog
+		refUri  string
 	)
-
 	if catalog, err = bm.GetCatalog(); err != nil {
-		log.Printf("DeleteBox(): Error retrieving catalog from backend: %v\n", err)
 		return
 	}
-	if deleteCatalog, err = catalog.QueryCatalog(params); err != nil {
-		log.Printf("DeleteBox(): Error querying catalog: %v\n", err)
+	for _, ref := range catalog.BoxReferences() {
+		if refUri, err = bm.StorageUri(ref.Uri); err != nil {
+			return
+		}
+		if refUri == storageUri {
+			return true, nil
+		}
+	}
+	return
+}
+
+// Upload a box to a staging URI next to its final location, verify its size, and move it into place
+// The box is written by upload, which writes the box to the URI it is passed and returns how many bytes it wrote
+// Any box already at the final location is moved aside first
+// On success, returns a function to call once the catalog is saved, and one that restores the previous state of the backend otherwise
+// On failure, the previous state has already been restored
+func (bm *BackendManager) publishBox(staging CaryatidStagingBackend, storageUri string, upload func(uri string) (int64, error)) (commit func(), rollback func(), err error) {
+	var (
+		uploadedSize int64
+		stagedSize   int64
+		exists       bool
+		stagingUri   = storageUri + ".staging"
+		previousUri  = storageUri + ".previous"
+	)
+
+	backend, _ := bm.boxStorage()
+	// Log failures to clean up rather than returning them, since they would hide the error that caused the cleanup
+	cleanup := func(uri string) {
+		if cleanupErr := backend.DeleteFile(uri); cleanupErr != nil {
+			log.Printf("Error removing '%v': %v\n", uri, cleanupErr)
+		}
+	}
+	restore := func(from string, to string) {
+		if restoreErr := staging.MoveFile(from, to); restoreErr != nil {
+			log.Printf("Error restoring '%v' from '%v': %v\n", to, from, restoreErr)
+		}
+	}
+
+	if uploadedSize, err = upload(stagingUri); err != nil {
+		if _, exists, _ = staging.FileSize(stagingUri); exists {
+			cleanup(stagingUri)
+		}
+		return
+	}
+	if stagedSize, exists, err = staging.FileSize(stagingUri); err == nil && (!exists || stagedSize != uploadedSize) {
+		err = fmt.Errorf("Staged box at '%v' is %v bytes, but %v bytes were uploaded", stagingUri, stagedSize, uploadedSize)
+	}
+	if err != nil {
+		cleanup(stagingUri)
 		return
 	}
 
-	refs = deleteCatalog.BoxReferences()
-	catalog = catalog.DeleteReferences(refs)
-	if err = bm.SaveCatalog(catalog); err != nil {
+	if _, exists, err = staging.FileSize(storageUri); err != nil {
+		cleanup(stagingUri)
+		return
+	} else if exists {
+		if err = staging.MoveFile(storageUri, previousUri); err != nil {
+			cleanup(stagingUri)
+			return
+		}
+	}
+	if err = staging.MoveFile(stagingUri, storageUri); err != nil {
+		cleanup(stagingUri)
+		if exists {
+			restore(previousUri, storageUri)
+		}
+		return
+	}
+	log.Printf("Published box at '%v'\n", storageUri)
+
+	if exists {
+		commit = func() { cleanup(previousUri) }
+		rollback = func() { restore(previousUri, storageUri) }
+	} else {
+		commit = func() {}
+		rollback = func() { cleanup(storageUri) }
+	}
+	return
+}
+
+// DeleteBox removes the boxes matching params from the catalog, and then deletes their files
+// With a content-addressed BoxPathTemplate, several boxes can share a file;
+// a file is only deleted once no box left in the catalog refers to it
+func (bm *BackendManager) DeleteBox(params CatalogQueryParams) (err error) {
+	var (
+		refs        BoxReferenceList
+		storageUri  string
+		storageUris []string
+		keep        map[string]bool
+		deleting    = map[string]bool{}
+	)
+
+	err = bm.UpdateCatalog(func(catalog *Catalog) (err error) {
+		var deleteCatalog Catalog
+		if deleteCatalog, err = catalog.QueryCatalog(params); err != nil {
+			log.Printf("DeleteBox(): Error querying catalog: %v\n", err)
+			return
+		}
+		refs = deleteCatalog.BoxReferences()
+		*catalog = catalog.DeleteReferences(refs)
+		keep = map[string]bool{}
+		for _, ref := range catalog.BoxReferences() {
+			if storageUri, err = bm.StorageUri(ref.Uri); err != nil {
+				log.Printf("DeleteBox(): Error determining backend URI for '%v': %v\n", ref.Uri, err)
+				return
+			}
+			keep[storageUri] = true
+		}
+		return
+	})
+	if err != nil {
 		log.Printf("DeleteBox(): Error saving catalog: %v\n", err)
 		return
 	}
 
 	for _, ref := range refs {
-		if err = bm.Backend.DeleteFile(ref.Uri); err != nil {
+		if storageUri, err = bm.StorageUri(ref.Uri); err != nil {
+			log.Printf("DeleteBox(): Error determining backend URI for '%v': %v\n", ref.Uri, err)
+			return
+		}
+		if keep[storageUri] {
+			log.Printf("DeleteBox(): Keeping '%v', which other boxes in the catalog still refer to\n", storageUri)
+			continue
+		} else if !deleting[storageUri] {
+			deleting[storageUri] = true
+			storageUris = append(storageUris, storageUri)
+		}
+	}
+
+	backend, _ := bm.boxStorage()
+	for _, storageUri = range storageUris {
+		if err = backend.DeleteFile(storageUri); err != nil {
 			log.Printf("DeleteBox(): Error copying box file: %v\n", err)
 			return
 		}
@@ -133,3 +666,36 @@ func (bm *BackendManager) DeleteBox(params CatalogQueryParams) (err error) {
 
 	return
 }
+
+// RefreshUris derives the URI of every box in the catalog from its storage URI again,
+// and returns how many of them changed
+// Backends whose frontend URIs expire, like presigned S3 URLs, use this to keep the catalog usable
+func (bm *BackendManager) RefreshUris() (refreshed int, err error) {
+	err = bm.UpdateCatalog(func(catalog *Catalog) (err error) {
+		var storageUri, frontendUri string
+
+		refreshed = 0
+		for vIdx := range catalog.Versions {
+			for pIdx := range catalog.Versions[vIdx].Providers {
+				provider := &catalog.Versions[vIdx].Providers[pIdx]
+				if storageUri, err = bm.StorageUri(provider.Url); err != nil {
+					log.Printf("RefreshUris(): Error determining backend URI for '%v': %v\n", provider.Url, err)
+					return
+				}
+				if frontendUri, err = bm.FrontendUri(storageUri); err != nil {
+					log.Printf("RefreshUris(): Error determining frontend URI for '%v': %v\n", storageUri, err)
+					return
+				}
+				if frontendUri != provider.Url {
+					provider.Url = frontendUri
+					refreshed += 1
+				}
+			}
+		}
+		return
+	})
+	if err != nil {
+		log.Printf("RefreshUris(): Error saving catalog: %v\n", err)
+	}
+	return
+}
@@ -1,13 +1,26 @@
 package caryatid
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha1"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/mrled/caryatid/internal/util"
 )
 
 type CaryatidTestBackend struct {
 	Manager     *BackendManager
 	CatalogData []byte
+	DeletedUris []string
 }
 
 func (cb *CaryatidTestBackend) SetManager(manager *BackendManager) (err error) {
@@ -41,6 +54,7 @@ func (cb *CaryatidTestBackend) CopyBoxFile(path string, boxName string, boxVersi
 }
 
 func (bc *CaryatidTestBackend) DeleteFile(uri string) error {
+	bc.DeletedUris = append(bc.DeletedUris, uri)
 	return nil
 }
 
@@ -93,3 +107,639 @@ func TestBackendManagerConfigure(t *testing.T) {
 		t.Fatal(fmt.Sprintf("Backend Manager property not set properly; value was '%v'; error was '%v'", backendManager, err))
 	}
 }
+
+func TestBackendManagerPublicBaseUri(t *testing.T) {
+	var (
+		err         error
+		catalog     Catalog
+		testBackend                 = &CaryatidTestBackend{}
+		backend     CaryatidBackend = testBackend
+	)
+
+	manager := NewBackendManager("s3://bucket/boxes/catalog.json", &backend)
+	manager.PublicBaseUri = "https://cdn.example.com/vagrant/"
+
+	if err = manager.AddBox("/tmp/example.box", "ExampleBox", "desc", "1.0.0", "virtualbox", "sha1", "0xDECAFBAD"); err != nil {
+		t.Fatalf("Error adding box: %v", err)
+	}
+	if catalog, err = manager.GetCatalog(); err != nil {
+		t.Fatalf("Error getting catalog: %v", err)
+	}
+	expectedUrl := "https://cdn.example.com/vagrant/ExampleBox/ExampleBox_1.0.0_virtualbox.box"
+	if refs := catalog.BoxReferences(); len(refs) != 1 || refs[0].Uri != expectedUrl {
+		t.Fatalf("Expected box URL '%v' but catalog was:\n%v", expectedUrl, catalog.DisplayString())
+	}
+
+	if err = manager.DeleteBox(CatalogQueryParams{Version: "1.0.0"}); err != nil {
+		t.Fatalf("Error deleting box: %v", err)
+	}
+	expectedUri := "s3://bucket/boxes/ExampleBox/ExampleBox_1.0.0_virtualbox.box"
+	if len(testBackend.DeletedUris) != 1 || testBackend.DeletedUris[0] != expectedUri {
+		t.Fatalf("Expected backend to delete '%v' but it deleted %v", expectedUri, testBackend.DeletedUris)
+	}
+}
+
+// A memory backend that lets something else change the catalog just before each conditional write
+type caryatidInterferingBackend struct {
+	*CaryatidMemoryBackend
+	interfere func()
+}
+
+func (backend *caryatidInterferingBackend) SetCatalogBytesIfVersion(serializedCatalog []byte, version string) error {
+	if backend.interfere != nil {
+		backend.interfere()
+	}
+	return backend.CaryatidMemoryBackend.SetCatalogBytesIfVersion(serializedCatalog, version)
+}
+
+func TestBackendManagerUpdateCatalogConflict(t *testing.T) {
+	var (
+		err        error
+		catalog    Catalog
+		catalogUri = "mem://conflict/ConflictBox.json"
+		store      = NewMemoryStore()
+	)
+
+	var otherBackend CaryatidBackend = &CaryatidMemoryBackend{Store: store}
+	otherManager := NewBackendManager(catalogUri, &otherBackend)
+	interferingBackend := &caryatidInterferingBackend{CaryatidMemoryBackend: &CaryatidMemoryBackend{Store: store}}
+	var backend CaryatidBackend = interferingBackend
+	manager := NewBackendManager(catalogUri, &backend)
+
+	// Another process adds a box once, after this manager has read the catalog but before it saves it
+	interferingBackend.interfere = func() {
+		interferingBackend.interfere = nil
+		if err := otherManager.UpdateCatalog(func(catalog *Catalog) error {
+			return catalog.AddBox(catalogUri, "ConflictBox", "desc", "1.0.0", "hyperv", "sha1", "0xDECAFBAD")
+		}); err != nil {
+			t.Fatalf("Error adding box from the other manager: %v", err)
+		}
+	}
+	err = manager.UpdateCatalog(func(catalog *Catalog) error {
+		return catalog.AddBox(catalogUri, "ConflictBox", "desc", "1.0.0", "virtualbox", "sha1", "0xDECAFBAD")
+	})
+	if err != nil {
+		t.Fatalf("Error adding box: %v", err)
+	}
+	if catalog, err = manager.GetCatalog(); err != nil {
+		t.Fatalf("Error getting catalog: %v", err)
+	}
+	if refs := catalog.BoxReferences(); len(refs) != 2 {
+		t.Fatalf("Expected both boxes to be in the catalog, but it was:\n%v", catalog.DisplayString())
+	}
+
+	// Another process changes the catalog before every save, so this manager gives up
+	interferingBackend.interfere = func() {
+		store.WriteFile(catalogUri, []byte(fmt.Sprintf(`{"name":"ConflictBox","description":"%v"}`, len(store.Operations()))))
+	}
+	manager.ConflictRetries = 2
+	err = manager.UpdateCatalog(func(catalog *Catalog) error {
+		catalog.Description = "changed"
+		return nil
+	})
+	if !IsCatalogConflict(err) {
+		t.Fatalf("Expected a conflict error, but got: %v", err)
+	}
+}
+
+func TestBackendManagerLock(t *testing.T) {
+	var (
+		err        error
+		catalogUri = "mem://lock/LockBox.json"
+		store      = NewMemoryStore()
+	)
+
+	var holderBackend CaryatidBackend = &CaryatidMemoryBackend{Store: store}
+	holder := NewBackendManager(catalogUri, &holderBackend)
+	var otherBackend CaryatidBackend = &CaryatidMemoryBackend{Store: store}
+	other := NewBackendManager(catalogUri, &otherBackend)
+	addBox := func(manager *BackendManager, provider string) error {
+		return manager.UpdateCatalog(func(catalog *Catalog) error {
+			return catalog.AddBox(catalogUri, "LockBox", "desc", "1.0.0", provider, "sha1", "0xDECAFBAD")
+		})
+	}
+
+	if err = holder.Lock("holder", time.Minute); err != nil {
+		t.Fatalf("Error taking lock: %v", err)
+	}
+	if err = other.Lock("other", time.Minute); !IsCatalogLocked(err) {
+		t.Fatalf("Expected taking a held lock to fail, but got: %v", err)
+	}
+	if err = addBox(other, "virtualbox"); !IsCatalogLocked(err) {
+		t.Fatalf("Expected changing a catalog locked by someone else to fail, but got: %v", err)
+	}
+	if err = addBox(holder, "hyperv"); err != nil {
+		t.Fatalf("Error changing a catalog while holding its lock: %v", err)
+	}
+	if err = holder.Unlock(); err != nil {
+		t.Fatalf("Error releasing lock: %v", err)
+	}
+	if err = addBox(other, "virtualbox"); err != nil {
+		t.Fatalf("Error changing a catalog after its lock was released: %v", err)
+	}
+
+	// A lock that has expired doesn't keep anyone else out
+	if err = holder.Lock("holder", time.Nanosecond); err != nil {
+		t.Fatalf("Error taking lock: %v", err)
+	}
+	time.Sleep(time.Millisecond)
+	if err = other.Lock("other", time.Minute); err != nil {
+		t.Fatalf("Error taking an expired lock: %v", err)
+	}
+	if err = holder.Unlock(); !IsCatalogLocked(err) {
+		t.Fatalf("Expected releasing a lock taken over by someone else to fail, but got: %v", err)
+	}
+
+	var current *CatalogLock
+	if err = other.BreakLock(); err != nil {
+		t.Fatalf("Error breaking lock: %v", err)
+	}
+	if current, err = holder.LockStatus(); err != nil || current != nil {
+		t.Fatalf("Expected no lock after breaking it, but got '%v' and error '%v'", current, err)
+	}
+}
+
+// A memory backend that can be told to fail partway through an upload, or when saving the catalog
+type caryatidFailingBackend struct {
+	*CaryatidMemoryBackend
+	failUpload bool
+	failSave   bool
+}
+
+func (backend *caryatidFailingBackend) UploadFile(localPath string, uri string) error {
+	if backend.failUpload {
+		backend.Store.WriteFile(uri, []byte("partial"))
+		return fmt.Errorf("Simulated upload failure")
+	}
+	return backend.CaryatidMemoryBackend.UploadFile(localPath, uri)
+}
+
+func (backend *caryatidFailingBackend) SetCatalogBytesIfVersion(serializedCatalog []byte, version string) error {
+	if backend.failSave {
+		return fmt.Errorf("Simulated save failure")
+	}
+	return backend.CaryatidMemoryBackend.SetCatalogBytesIfVersion(serializedCatalog, version)
+}
+
+func TestBackendManagerAddBoxRollback(t *testing.T) {
+	var (
+		catalogUri = "mem://rollback/RollbackBox.json"
+		boxUri     = "mem://rollback/RollbackBox/RollbackBox_1.0.0_virtualbox.box"
+		store      = NewMemoryStore()
+	)
+
+	tempDir, err := ioutil.TempDir("", "caryatid-rollback-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	boxPath := filepath.Join(tempDir, "input.box")
+	if err = CreateTestBoxFile(boxPath, "virtualbox", true); err != nil {
+		t.Fatalf("Error creating test box file: %v", err)
+	}
+
+	failingBackend := &caryatidFailingBackend{CaryatidMemoryBackend: &CaryatidMemoryBackend{Store: store}}
+	var backend CaryatidBackend = failingBackend
+	manager := NewBackendManager(catalogUri, &backend)
+	addBox := func() error {
+		return manager.AddBox(boxPath, "RollbackBox", "desc", "1.0.0", "virtualbox", "sha1", "0xDECAFBAD")
+	}
+
+	failingBackend.failUpload = true
+	if err = addBox(); err == nil {
+		t.Fatalf("Expected AddBox() to fail when the upload fails")
+	}
+	if files := store.Files(); len(files) != 0 {
+		t.Fatalf("Expected a failed upload to leave nothing behind, but found %v", files)
+	}
+
+	failingBackend.failUpload = false
+	failingBackend.failSave = true
+	if err = addBox(); err == nil {
+		t.Fatalf("Expected AddBox() to fail when saving the catalog fails")
+	}
+	if files := store.Files(); len(files) != 0 {
+		t.Fatalf("Expected a failed catalog save to remove the new box, but found %v", files)
+	}
+
+	// Replacing a box that is already in the catalog restores the old box if the catalog can't be saved
+	failingBackend.failSave = false
+	if err = addBox(); err != nil {
+		t.Fatalf("Error adding box: %v", err)
+	}
+	store.WriteFile(boxUri, []byte("original box"))
+	failingBackend.failSave = true
+	if err = addBox(); err == nil {
+		t.Fatalf("Expected AddBox() to fail when saving the catalog fails")
+	}
+	if contents, _ := store.ReadFile(boxUri); string(contents) != "original box" {
+		t.Fatalf("Expected the original box to be restored, but it contained '%v'", string(contents))
+	}
+	if files := store.Files(); len(files) != 2 {
+		t.Fatalf("Expected only the catalog and the original box, but found %v", files)
+	}
+}
+
+func TestBackendManagerAddBoxFromReader(t *testing.T) {
+	var (
+		catalogUri = "mem://streaming/StreamedBox.json"
+		store      = NewMemoryStore()
+		contents   = []byte("a box produced in a pipe")
+		checksum   = fmt.Sprintf("%x", sha1.Sum(contents))
+		ctx        = context.Background()
+	)
+
+	var testBackend CaryatidBackend = &CaryatidTestBackend{}
+	testManager := NewBackendManager("uri:///tmp/StreamedBox.json", &testBackend)
+	if err := testManager.AddBoxFromReader(ctx, bytes.NewReader(contents), -1, "StreamedBox", "desc", "1.0.0", "virtualbox", "sha1", ""); err == nil {
+		t.Fatalf("Expected AddBoxFromReader() to fail for a backend that cannot store streams")
+	}
+
+	var backend CaryatidBackend = &CaryatidMemoryBackend{Store: store}
+	manager := NewBackendManager(catalogUri, &backend)
+
+	if err := manager.AddBoxFromReader(ctx, bytes.NewReader(contents), int64(len(contents))+1, "StreamedBox", "desc", "1.0.0", "virtualbox", "sha1", ""); err == nil {
+		t.Fatalf("Expected AddBoxFromReader() to fail when the stream is shorter than its size")
+	}
+	if err := manager.AddBoxFromReader(ctx, bytes.NewReader(contents), -1, "StreamedBox", "desc", "1.0.0", "virtualbox", "sha1", "0xDECAFBAD"); err == nil {
+		t.Fatalf("Expected AddBoxFromReader() to fail when the stream does not match its checksum")
+	}
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := manager.AddBoxFromReader(canceled, bytes.NewReader(contents), -1, "StreamedBox", "desc", "1.0.0", "virtualbox", "sha1", ""); err == nil {
+		t.Fatalf("Expected AddBoxFromReader() to fail when its context is canceled")
+	}
+	if files := store.Files(); len(files) != 0 {
+		t.Fatalf("Expected failed streams to leave nothing behind, but found %v", files)
+	}
+
+	manager.BoxPathTemplate = "{{.Arch}}/{{.Name}}.box"
+	if err := manager.AddBoxFromReader(ctx, bytes.NewReader(contents), -1, "StreamedBox", "desc", "1.0.0", "virtualbox", "sha1", ""); err == nil {
+		t.Fatalf("Expected AddBoxFromReader() to fail for a box path template that uses the box's architecture")
+	}
+
+	// A stream from a pipe has no size, and its checksum is calculated as it is stored
+	manager.BoxPathTemplate = "{{.Name}}/{{.Version}}/{{.Provider}}.box"
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		pipeWriter.Write(contents[:10])
+		pipeWriter.Write(contents[10:])
+		pipeWriter.Close()
+	}()
+	if err := manager.AddBoxFromReader(ctx, pipeReader, -1, "StreamedBox", "desc", "1.0.0", "virtualbox", "sha1", ""); err != nil {
+		t.Fatalf("Error adding a box from a pipe: %v", err)
+	}
+	if stored, _ := store.ReadFile("mem://streaming/StreamedBox/1.0.0/virtualbox.box"); string(stored) != string(contents) {
+		t.Fatalf("Expected the streamed box to be stored, but found '%v' in %v", string(stored), store.Files())
+	}
+
+	manager.BoxPathTemplate = "blobs/{{.Checksum}}.box"
+	if err := manager.AddBoxFromReader(ctx, bytes.NewReader(contents), int64(len(contents)), "StreamedBox", "desc", "1.0.1", "virtualbox", "sha1", strings.ToUpper(checksum)); err != nil {
+		t.Fatalf("Error adding a box from a stream with a known checksum: %v", err)
+	}
+	if _, exists := store.ReadFile("mem://streaming/blobs/" + strings.ToUpper(checksum) + ".box"); !exists {
+		t.Fatalf("Expected the streamed box to be stored under its checksum, but found %v", store.Files())
+	}
+
+	catalog, err := manager.GetCatalog()
+	if err != nil {
+		t.Fatalf("Error getting catalog: %v", err)
+	}
+	for _, version := range catalog.Versions {
+		if len(version.Providers) != 1 || !strings.EqualFold(version.Providers[0].Checksum, checksum) || version.Providers[0].ChecksumType != "sha1" {
+			t.Fatalf("Expected every box to have its sha1 checksum, but the catalog is:\n%v", catalog.DisplayString())
+		}
+	}
+	if len(catalog.Versions) != 2 {
+		t.Fatalf("Expected two versions in the catalog, but it is:\n%v", catalog.DisplayString())
+	}
+}
+
+func TestBackendManagerDeleteBoxSharedFile(t *testing.T) {
+	var (
+		catalogUri = "mem://shared/SharedBox.json"
+		blobUri    = "mem://shared/blobs/0xDECAFBAD.box"
+		store      = NewMemoryStore()
+	)
+
+	tempDir, err := ioutil.TempDir("", "caryatid-shared-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	boxPath := filepath.Join(tempDir, "input.box")
+	if err = CreateTestBoxFile(boxPath, "virtualbox", true); err != nil {
+		t.Fatalf("Error creating test box file: %v", err)
+	}
+
+	var backend CaryatidBackend = &CaryatidMemoryBackend{Store: store}
+	manager := NewBackendManager(catalogUri, &backend)
+	manager.BoxPathTemplate = "blobs/{{.Checksum}}.box"
+	for _, version := range []string{"1.0.0", "1.1.0", "1.2.0"} {
+		if err = manager.AddBox(boxPath, "SharedBox", "desc", version, "virtualbox", "sha1", "0xDECAFBAD"); err != nil {
+			t.Fatalf("Error adding version %v: %v", version, err)
+		}
+	}
+
+	// The other versions still refer to the same file
+	if err = manager.DeleteBox(CatalogQueryParams{Version: "1.0.0"}); err != nil {
+		t.Fatalf("Error deleting box: %v", err)
+	}
+	if _, exists := store.ReadFile(blobUri); !exists {
+		t.Fatalf("Expected '%v' to be kept while other boxes refer to it, but found %v", blobUri, store.Files())
+	}
+
+	// Deleting every box that refers to the file deletes it, once
+	if err = manager.DeleteBox(CatalogQueryParams{Version: ">=1.1.0"}); err != nil {
+		t.Fatalf("Error deleting boxes: %v", err)
+	}
+	if _, exists := store.ReadFile(blobUri); exists {
+		t.Fatalf("Expected '%v' to be deleted once no box refers to it", blobUri)
+	}
+}
+
+// A frontend whose URIs carry a generation, like presigned URLs that are only good until they expire
+type caryatidExpiringFrontend struct {
+	generation int
+}
+
+func (frontend *caryatidExpiringFrontend) FrontendUri(storageUri string) (string, error) {
+	return fmt.Sprintf("%v?generation=%v", storageUri, frontend.generation), nil
+}
+
+func (frontend *caryatidExpiringFrontend) StorageUri(frontendUri string) (string, error) {
+	return strings.SplitN(frontendUri, "?", 2)[0], nil
+}
+
+func TestBackendManagerRefreshUris(t *testing.T) {
+	var (
+		err        error
+		catalog    Catalog
+		refreshed  int
+		catalogUri = "mem://refresh/RefreshBox.json"
+		frontend   = &caryatidExpiringFrontend{generation: 1}
+	)
+
+	var backend CaryatidBackend = &CaryatidMemoryBackend{Store: NewMemoryStore(), Frontend: frontend}
+	manager := NewBackendManager(catalogUri, &backend)
+	err = manager.UpdateCatalog(func(catalog *Catalog) (err error) {
+		for _, provider := range []string{"virtualbox", "hyperv"} {
+			boxUri, _ := manager.FrontendUri(fmt.Sprintf("mem://refresh/RefreshBox/RefreshBox_1.0.0_%v.box", provider))
+			if err = catalog.AddBoxUri(boxUri, "RefreshBox", "desc", "1.0.0", provider, "sha1", "0xDECAFBAD"); err != nil {
+				return
+			}
+		}
+		return
+	})
+	if err != nil {
+		t.Fatalf("Error adding boxes: %v", err)
+	}
+
+	if refreshed, err = manager.RefreshUris(); err != nil || refreshed != 0 {
+		t.Fatalf("Expected no URIs to change before they expire, but %v changed and got error '%v'", refreshed, err)
+	}
+
+	frontend.generation = 2
+	if refreshed, err = manager.RefreshUris(); err != nil || refreshed != 2 {
+		t.Fatalf("Expected 2 URIs to be refreshed, but %v were and got error '%v'", refreshed, err)
+	}
+	if catalog, err = manager.GetCatalog(); err != nil {
+		t.Fatalf("Error getting catalog: %v", err)
+	}
+	for _, ref := range catalog.BoxReferences() {
+		if !strings.HasSuffix(ref.Uri, "?generation=2") {
+			t.Fatalf("Expected every URI to be refreshed, but catalog was:\n%v", catalog.DisplayString())
+		}
+	}
+}
+
+func TestBackendManagerFsck(t *testing.T) {
+	var (
+		err        error
+		report     FsckReport
+		catalog    Catalog
+		catalogUri = "mem://fsck/FsckBox.json"
+		boxUri     = func(version string) string {
+			return fmt.Sprintf("mem://fsck/FsckBox/FsckBox_%v_virtualbox.box", version)
+		}
+		store = NewMemoryStore()
+	)
+
+	var backend CaryatidBackend = &CaryatidMemoryBackend{Store: store}
+	manager := NewBackendManager(catalogUri, &backend)
+	err = manager.UpdateCatalog(func(catalog *Catalog) (err error) {
+		for _, version := range []string{"1.0.0", "1.1.0", "1.2.0"} {
+			if err = catalog.AddBox(catalogUri, "FsckBox", "desc", version, "virtualbox", "sha1", "0xDECAFBAD"); err != nil {
+				return
+			}
+		}
+		return catalog.AddBoxUri("https://example.com/FsckBox.box", "FsckBox", "desc", "2.0.0", "virtualbox", "sha1", "0xDECAFBAD")
+	})
+	if err != nil {
+		t.Fatalf("Error saving catalog: %v", err)
+	}
+	store.WriteFile(boxUri("1.0.0"), []byte("box"))
+	store.WriteFile(boxUri("1.2.0"), []byte{})
+	store.WriteFile(boxUri("0.9.0"), []byte("old box"))
+	store.WriteFile(boxUri("1.3.0")+".staging", []byte("partial"))
+	store.WriteFile("mem://fsck/OtherBox/OtherBox_1.0.0_virtualbox.box", []byte("another catalog's box"))
+
+	if report, err = manager.Fsck(); err != nil {
+		t.Fatalf("Error checking catalog: %v", err)
+	}
+	expectedOrphans := []BackendFile{{Uri: boxUri("0.9.0"), Size: 7}, {Uri: boxUri("1.3.0") + ".staging", Size: 7}}
+	if fmt.Sprintf("%v", report.Orphans) != fmt.Sprintf("%v", expectedOrphans) {
+		t.Fatalf("Expected orphans %v but got %v", expectedOrphans, report.Orphans)
+	}
+	if len(report.Dangling) != 1 || report.Dangling[0].Version != "1.1.0" {
+		t.Fatalf("Expected only version 1.1.0 to be dangling, but got %v", report.Dangling)
+	}
+	if len(report.SizeMismatches) != 1 || report.SizeMismatches[0].Version != "1.2.0" {
+		t.Fatalf("Expected only version 1.2.0 to be empty, but got %v", report.SizeMismatches)
+	}
+	if len(report.Unchecked) != 1 || report.Unchecked[0].Version != "2.0.0" {
+		t.Fatalf("Expected only version 2.0.0 to be unchecked, but got %v", report.Unchecked)
+	}
+
+	// Nothing is fixed while some references can't be checked, since their files might be among the orphans
+	if _, err = manager.FsckFix("fsck-test"); err == nil {
+		t.Fatalf("Expected FsckFix() to refuse to fix a catalog with unchecked references")
+	}
+	if len(store.Files()) != 6 {
+		t.Fatalf("Expected FsckFix() to leave the store alone, but found %v", store.Files())
+	}
+
+	err = manager.UpdateCatalog(func(catalog *Catalog) (err error) {
+		*catalog = catalog.DeleteReferences(BoxReferenceList{report.Unchecked[0]})
+		return
+	})
+	if err != nil {
+		t.Fatalf("Error saving catalog: %v", err)
+	}
+	if _, err = manager.FsckFix("fsck-test"); err != nil {
+		t.Fatalf("Error fixing catalog: %v", err)
+	}
+
+	if catalog, err = manager.GetCatalog(); err != nil {
+		t.Fatalf("Error getting catalog: %v", err)
+	}
+	if refs := catalog.BoxReferences(); len(refs) != 2 || refs[0].Version != "1.0.0" || refs[1].Version != "1.2.0" {
+		t.Fatalf("Expected the dangling reference to be dropped, but catalog was:\n%v", catalog.DisplayString())
+	}
+	expectedFiles := []string{catalogUri, boxUri("1.0.0"), boxUri("1.2.0"), "mem://fsck/OtherBox/OtherBox_1.0.0_virtualbox.box"}
+	sort.Strings(expectedFiles)
+	if fmt.Sprintf("%v", store.Files()) != fmt.Sprintf("%v", expectedFiles) {
+		t.Fatalf("Expected files %v after fixing, but found %v", expectedFiles, store.Files())
+	}
+	if report, err = manager.Fsck(); err != nil || len(report.Orphans) != 0 || len(report.Dangling) != 0 {
+		t.Fatalf("Expected only the empty box to remain after fixing, but got error '%v' and:\n%v", err, report)
+	}
+}
+
+func TestBackendManagerRecoverCatalog(t *testing.T) {
+	var (
+		err        error
+		catalog    Catalog
+		skipped    []RecoverySkip
+		catalogUri = "mem://recover/RecoverBox.json"
+		store      = NewMemoryStore()
+		checksums  = map[string]string{}
+	)
+
+	tempDir, err := ioutil.TempDir("", "caryatid-recover-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	writeBox := func(fileName string, provider string) {
+		boxPath := filepath.Join(tempDir, fileName)
+		if err := CreateTestBoxFile(boxPath, provider, true); err != nil {
+			t.Fatalf("Error creating test box file: %v", err)
+		}
+		contents, _ := ioutil.ReadFile(boxPath)
+		checksums[fileName], _ = util.Sha1sum(boxPath)
+		store.WriteFile("mem://recover/RecoverBox/"+fileName, contents)
+	}
+	writeBox("RecoverBox_1.0.0_virtualbox.box", "virtualbox")
+	writeBox("RecoverBox_1.1.0_vmware_desktop.box", "vmware_desktop")
+	writeBox("RecoverBox_1.1.0_hyperv.box", "virtualbox")
+	writeBox("RecoverBox_latest_virtualbox.box", "virtualbox")
+	store.WriteFile("mem://recover/RecoverBox/RecoverBox_1.2.0_virtualbox.box.staging", []byte("partial"))
+	store.WriteFile(catalogUri, []byte(`{"name": "RecoverBox", "versions": [`))
+
+	var backend CaryatidBackend = &CaryatidMemoryBackend{Store: store}
+	manager := NewBackendManager(catalogUri, &backend)
+	if catalog, skipped, err = manager.RecoverCatalog("RecoverBox", "Recovered", true, false); err != nil {
+		t.Fatalf("Error recovering catalog: %v", err)
+	}
+
+	expected := Catalog{Name: "RecoverBox", Description: "Recovered"}
+	expected.AddBox(catalogUri, "RecoverBox", "Recovered", "1.0.0", "virtualbox", "sha1", checksums["RecoverBox_1.0.0_virtualbox.box"])
+	expected.AddBox(catalogUri, "RecoverBox", "Recovered", "1.1.0", "vmware_desktop", "sha1", checksums["RecoverBox_1.1.0_vmware_desktop.box"])
+	if !catalog.Equals(&expected) {
+		t.Fatalf("Expected recovered catalog:\n%v\nbut got:\n%v", expected.DisplayString(), catalog.DisplayString())
+	}
+	if saved, _ := manager.GetCatalog(); !saved.Equals(&expected) {
+		t.Fatalf("Expected the recovered catalog to be saved, but found:\n%v", saved.DisplayString())
+	}
+
+	skippedUris := []string{}
+	for _, skip := range skipped {
+		skippedUris = append(skippedUris, strings.TrimPrefix(skip.File.Uri, "mem://recover/RecoverBox/"))
+	}
+	expectedSkips := []string{"RecoverBox_1.1.0_hyperv.box", "RecoverBox_1.2.0_virtualbox.box.staging", "RecoverBox_latest_virtualbox.box"}
+	if fmt.Sprintf("%v", skippedUris) != fmt.Sprintf("%v", expectedSkips) {
+		t.Fatalf("Expected to skip %v, but skipped %v", expectedSkips, skipped)
+	}
+
+	// A catalog with boxes in it is only replaced when forced
+	if _, _, err = manager.RecoverCatalog("RecoverBox", "Recovered again", false, false); err == nil {
+		t.Fatalf("Expected recovering over a catalog with boxes to fail unless forced")
+	}
+	if catalog, _, err = manager.RecoverCatalog("RecoverBox", "Recovered again", false, true); err != nil {
+		t.Fatalf("Error recovering catalog with force: %v", err)
+	}
+	if refs := catalog.BoxReferences(); len(refs) != 3 {
+		t.Fatalf("Expected the mislabeled box to be recovered without checking providers, but catalog was:\n%v", catalog.DisplayString())
+	}
+}
+
+func TestMigrateCatalog(t *testing.T) {
+	var (
+		err         error
+		report      MigrationReport
+		fromStore                   = NewMemoryStore()
+		toStore                     = NewMemoryStore()
+		fromBackend CaryatidBackend = &CaryatidMemoryBackend{Store: fromStore}
+		toBackend   CaryatidBackend = &CaryatidMemoryBackend{Store: toStore}
+		from                        = NewBackendManager("mem://from/boxes/MigrateBox.json", &fromBackend)
+		to                          = NewBackendManager("mem://to/mirror/MigrateBox.json", &toBackend)
+	)
+
+	tempDir, err := ioutil.TempDir("", "caryatid-migrate-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	addBox := func(version string, provider string) {
+		boxPath := filepath.Join(tempDir, "input.box")
+		if err := ioutil.WriteFile(boxPath, []byte(version+provider), 0644); err != nil {
+			t.Fatalf("Error writing box file: %v", err)
+		}
+		checksum, _ := util.Checksum(boxPath, "sha256")
+		if err := from.AddBox(boxPath, "MigrateBox", "Migrated", version, provider, "sha256", checksum); err != nil {
+			t.Fatalf("Error adding box: %v", err)
+		}
+	}
+	addBox("1.0.0", "virtualbox")
+	addBox("1.0.0", "hyperv")
+
+	if report, err = MigrateCatalog(from, to, CatalogQueryParams{}, false); err != nil {
+		t.Fatalf("Error migrating catalog: %v", err)
+	}
+	if len(report.Copied) != 2 || len(report.Unchanged) != 0 {
+		t.Fatalf("Expected to copy 2 boxes, but got report %v", report)
+	}
+	fromCatalog, _ := from.GetCatalog()
+	toCatalog, _ := to.GetCatalog()
+	if !toCatalog.FuzzyEquals(&fromCatalog, CatalogFuzzyEqualsParams{SkipProviderUrl: true}) {
+		t.Fatalf("Expected migrated catalog to match:\n%v\nbut got:\n%v", fromCatalog.DisplayString(), toCatalog.DisplayString())
+	}
+	for _, ref := range toCatalog.BoxReferences() {
+		if !strings.HasPrefix(ref.Uri, "mem://to/mirror/MigrateBox/") {
+			t.Fatalf("Expected box URI to be rewritten for the destination, but got '%v'", ref.Uri)
+		}
+		if contents, exists := toStore.ReadFile(ref.Uri); !exists || string(contents) != ref.Version+ref.ProviderName {
+			t.Fatalf("Expected box at '%v' to be copied, but got '%s'", ref.Uri, contents)
+		}
+	}
+
+	if _, err = MigrateCatalog(from, to, CatalogQueryParams{}, false); err == nil {
+		t.Fatalf("Expected migrating into a catalog with boxes to fail")
+	}
+
+	// A mirror copies only the boxes the destination doesn't have
+	addBox("1.1.0", "virtualbox")
+	if report, err = MigrateCatalog(from, to, CatalogQueryParams{}, true); err != nil {
+		t.Fatalf("Error mirroring catalog: %v", err)
+	}
+	if len(report.Copied) != 1 || report.Copied[0].Version != "1.1.0" || len(report.Unchanged) != 2 {
+		t.Fatalf("Expected to copy only version 1.1.0, but got report %v", report)
+	}
+
+	// A box that doesn't match its checksum fails the mirror, and the boxes copied before it are removed again
+	addBox("1.2.0", "hyperv")
+	addBox("1.2.0", "virtualbox")
+	corruptUri := "mem://from/boxes/MigrateBox/MigrateBox_1.2.0_virtualbox.box"
+	fromStore.WriteFile(corruptUri, []byte("corrupted"))
+	before := toStore.Files()
+	if _, err = MigrateCatalog(from, to, CatalogQueryParams{}, true); err == nil || !strings.Contains(err.Error(), corruptUri) {
+		t.Fatalf("Expected mirroring a corrupted box to fail, but got error %v", err)
+	}
+	if after := toStore.Files(); fmt.Sprintf("%v", after) != fmt.Sprintf("%v", before) {
+		t.Fatalf("Expected a failed mirror to leave files %v, but found %v", before, after)
+	}
+	if saved, _ := to.GetCatalog(); len(saved.BoxReferences()) != 3 {
+		t.Fatalf("Expected a failed mirror to leave the catalog alone, but found:\n%v", saved.DisplayString())
+	}
+}
@@ -0,0 +1,483 @@
+/*
+The memory backend, for keeping a Vagrant catalog and its boxes in process memory
+
+Every mem:// backend with the same host name shares a MemoryStore,
+so a catalog at mem://test/catalog.json can be inspected with GetMemoryStore("test").
+This is intended for tests, and for dry runs that show what an operation would do without touching real storage.
+*/
+
+package caryatid
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mrled/caryatid/internal/util"
+)
+
+// An operation performed on a MemoryStore
+type MemoryStoreOperation struct {
+	// One of "write", "delete", or "move"
+	Action string
+	Uri    string
+	// The number of bytes written or moved; always 0 for a "delete"
+	Size int
+	// The URI a file was moved from; empty unless Action is "move"
+	FromUri string
+}
+
+func (op MemoryStoreOperation) String() string {
+	switch op.Action {
+	case "write":
+		return fmt.Sprintf("write %v (%v bytes)", op.Uri, op.Size)
+	case "move":
+		return fmt.Sprintf("move %v to %v", op.FromUri, op.Uri)
+	}
+	return fmt.Sprintf("%v %v", op.Action, op.Uri)
+}
+
+// A file in a MemoryStore
+// Files written with WriteFileSize() only have a size, and their contents are not kept
+type memoryFile struct {
+	contents  []byte
+	size      int64
+	discarded bool
+}
+
+// A MemoryStore holds files in memory, keyed by URI
+type MemoryStore struct {
+	files      map[string]memoryFile
+	operations []MemoryStoreOperation
+	lock       sync.Mutex
+}
+
+var (
+	memoryStores     = map[string]*MemoryStore{}
+	memoryStoresLock sync.Mutex
+)
+
+// NewMemoryStore returns a new, empty MemoryStore that is not shared with any mem:// URI
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{files: map[string]memoryFile{}}
+}
+
+// GetMemoryStore returns the MemoryStore shared by mem:// URIs with a given host name, creating it if necessary
+func GetMemoryStore(name string) *MemoryStore {
+	memoryStoresLock.Lock()
+	defer memoryStoresLock.Unlock()
+	store, ok := memoryStores[name]
+	if !ok {
+		store = NewMemoryStore()
+		memoryStores[name] = store
+	}
+	return store
+}
+
+// ReadFile returns a copy of the file at a URI, and whether it exists
+// A file written with WriteFileSize() exists, but has no contents
+func (store *MemoryStore) ReadFile(uri string) (contents []byte, exists bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	file, exists := store.files[uri]
+	if exists {
+		contents = append([]byte{}, file.contents...)
+	}
+	return
+}
+
+// FileSize returns the size of the file at a URI, and whether it exists
+func (store *MemoryStore) FileSize(uri string) (size int64, exists bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	file, exists := store.files[uri]
+	return file.size, exists
+}
+
+// WriteFile saves a copy of contents at a URI, replacing any file already there
+func (store *MemoryStore) WriteFile(uri string, contents []byte) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.files[uri] = memoryFile{contents: append([]byte{}, contents...), size: int64(len(contents))}
+	store.operations = append(store.operations, MemoryStoreOperation{Action: "write", Uri: uri, Size: len(contents)})
+}
+
+// WriteFileSize records a file of a given size at a URI, replacing any file already there, without keeping its contents
+func (store *MemoryStore) WriteFileSize(uri string, size int64) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.files[uri] = memoryFile{size: size, discarded: true}
+	store.operations = append(store.operations, MemoryStoreOperation{Action: "write", Uri: uri, Size: int(size)})
+}
+
+// Save a copy of contents at a URI, but only if the file there is at an expected version
+// The version of a file is catalogContentVersion() of its contents, or empty if it does not exist
+func (store *MemoryStore) writeFileIfVersion(uri string, contents []byte, version string) (actual string, ok bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if file, exists := store.files[uri]; exists {
+		actual = catalogContentVersion(file.contents)
+	}
+	if actual != version {
+		return
+	}
+	store.files[uri] = memoryFile{contents: append([]byte{}, contents...), size: int64(len(contents))}
+	store.operations = append(store.operations, MemoryStoreOperation{Action: "write", Uri: uri, Size: len(contents)})
+	ok = true
+	return
+}
+
+// DeleteFile removes the file at a URI
+func (store *MemoryStore) DeleteFile(uri string) (err error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if _, exists := store.files[uri]; !exists {
+		return fmt.Errorf("No file at '%v'", uri)
+	}
+	delete(store.files, uri)
+	store.operations = append(store.operations, MemoryStoreOperation{Action: "delete", Uri: uri})
+	return
+}
+
+// MoveFile moves the file at one URI to another, replacing any file already there
+func (store *MemoryStore) MoveFile(fromUri string, toUri string) (err error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	file, exists := store.files[fromUri]
+	if !exists {
+		return fmt.Errorf("No file at '%v'", fromUri)
+	}
+	delete(store.files, fromUri)
+	store.files[toUri] = file
+	store.operations = append(store.operations, MemoryStoreOperation{Action: "move", Uri: toUri, Size: int(file.size), FromUri: fromUri})
+	return
+}
+
+// Files returns a sorted list of the URIs of every file in the store
+func (store *MemoryStore) Files() (uris []string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for uri := range store.files {
+		uris = append(uris, uri)
+	}
+	sort.Strings(uris)
+	return
+}
+
+// Operations returns every write and delete performed on the store, in order
+func (store *MemoryStore) Operations() []MemoryStoreOperation {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return append([]MemoryStoreOperation{}, store.operations...)
+}
+
+// Reset removes every file from the store and clears its list of operations
+func (store *MemoryStore) Reset() {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.files = map[string]memoryFile{}
+	store.operations = nil
+}
+
+type CaryatidMemoryBackend struct {
+	// The store to keep files in
+	// If nil, SetManager uses the shared store named by the host in the catalog URI
+	Store *MemoryStore
+
+	// An optional backend to delegate FrontendUri() and StorageUri() to,
+	// so that a dry run records the same URIs in the catalog as the real backend would
+	Frontend CaryatidFrontendBackend
+
+	// If set, only the sizes of box files are kept, not their contents,
+	// so that a dry run of a large box does not need enough memory to hold it
+	DiscardBoxContents bool
+
+	Manager *BackendManager
+
+	// The lock this backend holds on the catalog, if any
+	heldLock *CatalogLock
+}
+
+func init() {
+	RegisterBackend("mem", func() CaryatidBackend { return &CaryatidMemoryBackend{} })
+}
+
+func (backend *CaryatidMemoryBackend) SetManager(manager *BackendManager) (err error) {
+	var u *url.URL
+
+	backend.Manager = manager
+	if backend.Store != nil {
+		return
+	}
+
+	if u, err = url.Parse(backend.Manager.CatalogUri); err != nil {
+		return
+	}
+	if u.Scheme != backend.Scheme() || u.Host == "" {
+		err = fmt.Errorf("Invalid memory URI '%v'; expected a URI like mem://name/catalog.json", backend.Manager.CatalogUri)
+		return
+	}
+	backend.Store = GetMemoryStore(u.Host)
+	return
+}
+
+func (backend *CaryatidMemoryBackend) GetManager() (manager *BackendManager, err error) {
+	manager = backend.Manager
+	if manager == nil {
+		err = fmt.Errorf("The Manager property was not set")
+	}
+	return
+}
+
+func (backend *CaryatidMemoryBackend) GetCatalogBytes() (catalogBytes []byte, err error) {
+	catalogBytes, exists := backend.Store.ReadFile(backend.Manager.CatalogUri)
+	if !exists {
+		log.Printf("No file at '%v'; starting with empty catalog\n", backend.Manager.CatalogUri)
+		catalogBytes = []byte("{}")
+	}
+	return
+}
+
+func (backend *CaryatidMemoryBackend) SetCatalogBytes(serializedCatalog []byte) (err error) {
+	backend.Store.WriteFile(backend.Manager.CatalogUri, serializedCatalog)
+	return
+}
+
+func (backend *CaryatidMemoryBackend) GetCatalogBytesVersion() (catalogBytes []byte, version string, err error) {
+	catalogBytes, exists := backend.Store.ReadFile(backend.Manager.CatalogUri)
+	if !exists {
+		log.Printf("No file at '%v'; starting with empty catalog\n", backend.Manager.CatalogUri)
+		catalogBytes = []byte("{}")
+		return
+	}
+	version = catalogContentVersion(catalogBytes)
+	return
+}
+
+func (backend *CaryatidMemoryBackend) SetCatalogBytesIfVersion(serializedCatalog []byte, version string) (err error) {
+	if actual, ok := backend.Store.writeFileIfVersion(backend.Manager.CatalogUri, serializedCatalog, version); !ok {
+		err = &CatalogConflictError{CatalogUri: backend.Manager.CatalogUri, Expected: version, Actual: actual}
+	}
+	return
+}
+
+// The memory backend keeps its lock in a ".lock" file next to the catalog
+type memoryLeaseStore struct {
+	store *MemoryStore
+	uri   string
+}
+
+func (lease memoryLeaseStore) readLease() (leaseBytes []byte, version string, err error) {
+	leaseBytes, _ = lease.store.ReadFile(lease.uri)
+	version = catalogContentVersion(leaseBytes)
+	return
+}
+
+func (lease memoryLeaseStore) writeLease(leaseBytes []byte, version string) (err error) {
+	if actual, ok := lease.store.writeFileIfVersion(lease.uri, leaseBytes, version); !ok {
+		err = &CatalogConflictError{CatalogUri: lease.uri, Expected: version, Actual: actual}
+	}
+	return
+}
+
+func (lease memoryLeaseStore) deleteLease() (err error) {
+	if _, exists := lease.store.ReadFile(lease.uri); exists {
+		err = lease.store.DeleteFile(lease.uri)
+	}
+	return
+}
+
+func (backend *CaryatidMemoryBackend) leaseStore() memoryLeaseStore {
+	return memoryLeaseStore{store: backend.Store, uri: backend.Manager.CatalogUri + ".lock"}
+}
+
+func (backend *CaryatidMemoryBackend) Lock(lock CatalogLock) (err error) {
+	if err = acquireLease(backend.leaseStore(), backend.Manager.CatalogUri, lock); err == nil {
+		backend.heldLock = &lock
+	}
+	return
+}
+
+func (backend *CaryatidMemoryBackend) Unlock() (err error) {
+	if backend.heldLock == nil {
+		return fmt.Errorf("Not holding the lock on '%v'", backend.Manager.CatalogUri)
+	}
+	if err = releaseLease(backend.leaseStore(), backend.Manager.CatalogUri, *backend.heldLock); err == nil {
+		backend.heldLock = nil
+	}
+	return
+}
+
+func (backend *CaryatidMemoryBackend) LockStatus() (lock *CatalogLock, err error) {
+	lock, _, err = leaseStatus(backend.leaseStore())
+	return
+}
+
+func (backend *CaryatidMemoryBackend) BreakLock() (err error) {
+	return backend.leaseStore().deleteLease()
+}
+
+func (backend *CaryatidMemoryBackend) CopyBoxFile(localPath string, boxName string, boxVersion string, boxProvider string) (err error) {
+	var boxUri string
+	if boxUri, err = BoxUriFromCatalogUri(backend.Manager.CatalogUri, boxName, boxVersion, boxProvider); err != nil {
+		return
+	}
+	return backend.UploadFile(localPath, boxUri)
+}
+
+func (backend *CaryatidMemoryBackend) UploadFile(localPath string, uri string) (err error) {
+	var localFile *os.File
+	if localFile, err = os.Open(localPath); err != nil {
+		return
+	}
+	defer localFile.Close()
+	return backend.PutBox(context.Background(), uri, localFile, -1)
+}
+
+func (backend *CaryatidMemoryBackend) PutBox(ctx context.Context, uri string, reader io.Reader, size int64) (err error) {
+	var (
+		contents []byte
+		written  int64
+	)
+	if backend.DiscardBoxContents {
+		if written, err = io.Copy(ioutil.Discard, contextReader{ctx, reader}); err != nil {
+			return
+		}
+		backend.Store.WriteFileSize(uri, written)
+		return
+	}
+	if contents, err = ioutil.ReadAll(contextReader{ctx, reader}); err != nil {
+		return
+	}
+	backend.Store.WriteFile(uri, contents)
+	return
+}
+
+func (backend *CaryatidMemoryBackend) OpenBox(ctx context.Context, uri string) (reader io.ReadCloser, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	backend.Store.lock.Lock()
+	file, exists := backend.Store.files[uri]
+	backend.Store.lock.Unlock()
+	if !exists {
+		return nil, fmt.Errorf("No file at '%v'", uri)
+	} else if file.discarded {
+		return nil, fmt.Errorf("The contents of '%v' were not kept", uri)
+	}
+	return ioutil.NopCloser(bytes.NewReader(file.contents)), nil
+}
+
+func (backend *CaryatidMemoryBackend) FileSize(uri string) (size int64, exists bool, err error) {
+	size, exists = backend.Store.FileSize(uri)
+	return size, exists, nil
+}
+
+func (backend *CaryatidMemoryBackend) DownloadFile(uri string, localPath string) (err error) {
+	var reader io.ReadCloser
+	if reader, err = backend.OpenBox(context.Background(), uri); err != nil {
+		return
+	}
+	defer reader.Close()
+	_, err = util.CopyReaderAtomic(reader, localPath)
+	return
+}
+
+func (backend *CaryatidMemoryBackend) ListFiles(dirUri string) (files []BackendFile, err error) {
+	prefix := strings.TrimSuffix(dirUri, "/") + "/"
+	for _, uri := range backend.Store.Files() {
+		if strings.HasPrefix(uri, prefix) {
+			size, _ := backend.Store.FileSize(uri)
+			files = append(files, BackendFile{Uri: uri, Size: size})
+		}
+	}
+	return
+}
+
+func (backend *CaryatidMemoryBackend) MoveFile(fromUri string, toUri string) error {
+	return backend.Store.MoveFile(fromUri, toUri)
+}
+
+func (backend *CaryatidMemoryBackend) DeleteFile(uri string) (err error) {
+	return backend.Store.DeleteFile(uri)
+}
+
+func (backend *CaryatidMemoryBackend) FrontendUri(storageUri string) (string, error) {
+	if backend.Frontend != nil {
+		return backend.Frontend.FrontendUri(storageUri)
+	}
+	return storageUri, nil
+}
+
+func (backend *CaryatidMemoryBackend) StorageUri(frontendUri string) (string, error) {
+	if backend.Frontend != nil {
+		return backend.Frontend.StorageUri(frontendUri)
+	}
+	return frontendUri, nil
+}
+
+func (backend *CaryatidMemoryBackend) Scheme() string {
+	return "mem"
+}
+
+// A memory backend for dry runs of a backend that delegates box storage,
+// so that box paths are relative to the same catalog URI as they would be for the real backend
+type dryRunDelegatingBackend struct {
+	*CaryatidMemoryBackend
+	boxCatalogUri string
+}
+
+func (backend *dryRunDelegatingBackend) BoxDelegate() (CaryatidBackend, string) {
+	return backend, backend.boxCatalogUri
+}
+
+// NewDryRunManager returns a manager that behaves like an existing one, but keeps every change in memory
+// The existing catalog is copied into a new MemoryStore, along with an empty placeholder for every box it references,
+// so that operations on the returned manager can be inspected with store.Operations() without touching real storage
+func NewDryRunManager(manager *BackendManager) (dryRunManager *BackendManager, store *MemoryStore, err error) {
+	var (
+		catalogBytes []byte
+		catalog      Catalog
+		storageUri   string
+	)
+
+	if catalogBytes, err = manager.Backend.GetCatalogBytes(); err != nil {
+		return
+	}
+	if err = json.Unmarshal(catalogBytes, &catalog); err != nil {
+		return
+	}
+
+	store = NewMemoryStore()
+	store.files[manager.CatalogUri] = memoryFile{contents: catalogBytes, size: int64(len(catalogBytes))}
+	for _, ref := range catalog.BoxReferences() {
+		if storageUri, err = manager.StorageUri(ref.Uri); err != nil {
+			return
+		}
+		store.files[storageUri] = memoryFile{}
+	}
+
+	boxBackend, boxCatalogUri := manager.boxStorage()
+	memoryBackend := &CaryatidMemoryBackend{Store: store, DiscardBoxContents: true}
+	if frontend, ok := boxBackend.(CaryatidFrontendBackend); ok {
+		memoryBackend.Frontend = frontend
+	}
+	var backend CaryatidBackend = memoryBackend
+	if _, ok := manager.Backend.(CaryatidDelegatingBackend); ok {
+		backend = &dryRunDelegatingBackend{memoryBackend, boxCatalogUri}
+	}
+	dryRunManager = NewBackendManager(manager.CatalogUri, &backend)
+	dryRunManager.PublicBaseUri = manager.PublicBaseUri
+	dryRunManager.BoxPathTemplate = manager.BoxPathTemplate
+	dryRunManager.ConflictRetries = manager.ConflictRetries
+	return
+}
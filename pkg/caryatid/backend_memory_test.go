@@ -0,0 +1,196 @@
+package caryatid
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCaryatidMemoryBackend_ImplementsCaryatidBackend(t *testing.T) {
+	var _ CaryatidBackend = new(CaryatidMemoryBackend)
+	var _ CaryatidFrontendBackend = new(CaryatidMemoryBackend)
+}
+
+func TestCaryatidMemoryBackendConformance(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "caryatid-memory-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	if err = CheckBackendConformance(&CaryatidMemoryBackend{}, "mem://conformance/catalog.json", tempDir); err != nil {
+		t.Fatalf("Memory backend is not conformant: %v", err)
+	}
+}
+
+func TestCaryatidMemoryBackendOperations(t *testing.T) {
+	var (
+		catalogUri = "mem://operations/boxes/MemBox.json"
+		box1Uri    = "mem://operations/boxes/MemBox/MemBox_1.0.0_virtualbox.box"
+		box2Uri    = "mem://operations/boxes/MemBox/MemBox_1.0.0_hyperv.box"
+	)
+
+	tempDir, err := ioutil.TempDir("", "caryatid-memory-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	boxPath := filepath.Join(tempDir, "input.box")
+	if err = CreateTestBoxFile(boxPath, "virtualbox", true); err != nil {
+		t.Fatalf("Error creating test box file: %v", err)
+	}
+	boxBytes, _ := ioutil.ReadFile(boxPath)
+
+	backend, err := NewBackendFromUri(catalogUri)
+	if err != nil {
+		t.Fatalf("Error getting backend: %v", err)
+	}
+	manager := NewBackendManager(catalogUri, &backend)
+	store := GetMemoryStore("operations")
+	store.Reset()
+
+	if err = manager.AddBox(boxPath, "MemBox", "desc", "1.0.0", "virtualbox", "sha1", "0xDECAFBAD"); err != nil {
+		t.Fatalf("Error adding box: %v", err)
+	}
+	if err = manager.AddBox(boxPath, "MemBox", "desc", "1.0.0", "hyperv", "sha1", "0xDECAFBAD"); err != nil {
+		t.Fatalf("Error adding box: %v", err)
+	}
+	if err = manager.DeleteBox(CatalogQueryParams{Provider: "virtualbox"}); err != nil {
+		t.Fatalf("Error deleting box: %v", err)
+	}
+
+	catalogBytes, _ := store.ReadFile(catalogUri)
+	expectedOperations := []MemoryStoreOperation{
+		{"write", box1Uri + ".staging", len(boxBytes), ""},
+		{"move", box1Uri, len(boxBytes), box1Uri + ".staging"},
+		{"write", catalogUri, 0, ""},
+		{"write", box2Uri + ".staging", len(boxBytes), ""},
+		{"move", box2Uri, len(boxBytes), box2Uri + ".staging"},
+		{"write", catalogUri, 0, ""},
+		{"write", catalogUri, len(catalogBytes), ""},
+		{"delete", box1Uri, 0, ""},
+	}
+	operations := store.Operations()
+	if len(operations) != len(expectedOperations) {
+		t.Fatalf("Expected operations\n%v\nbut got\n%v", expectedOperations, operations)
+	}
+	for idx, op := range operations {
+		expected := expectedOperations[idx]
+		if op.Action != expected.Action || op.Uri != expected.Uri || op.FromUri != expected.FromUri || (expected.Size != 0 && op.Size != expected.Size) {
+			t.Fatalf("Expected operation %v to be '%v' but it was '%v'", idx, expected, op)
+		}
+	}
+
+	files := store.Files()
+	if len(files) != 2 || files[0] != catalogUri || files[1] != box2Uri {
+		t.Fatalf("Unexpected files in store: %v", files)
+	}
+	if contents, _ := store.ReadFile(box2Uri); string(contents) != string(boxBytes) {
+		t.Fatalf("Box contents in store do not match the original box file")
+	}
+}
+
+func TestNewDryRunManager(t *testing.T) {
+	var (
+		catalogUri = "mem://dryrun-real/MemBox.json"
+		boxUri     = "mem://dryrun-real/MemBox/MemBox_1.0.0_virtualbox.box"
+	)
+
+	realStore := GetMemoryStore("dryrun-real")
+	realStore.Reset()
+	backend, _ := NewBackendFromUri(catalogUri)
+	manager := NewBackendManager(catalogUri, &backend)
+
+	catalog := Catalog{Name: "MemBox"}
+	catalog.AddBox(catalogUri, "MemBox", "desc", "1.0.0", "virtualbox", "sha1", "0xDECAFBAD")
+	if err := manager.SaveCatalog(catalog); err != nil {
+		t.Fatalf("Error saving catalog: %v", err)
+	}
+	realStore.WriteFile(boxUri, []byte("box"))
+	realOperations := len(realStore.Operations())
+
+	dryRunManager, dryRunStore, err := NewDryRunManager(manager)
+	if err != nil {
+		t.Fatalf("Error creating dry run manager: %v", err)
+	}
+	if err = dryRunManager.DeleteBox(CatalogQueryParams{Version: "1.0.0"}); err != nil {
+		t.Fatalf("Error deleting box in dry run: %v", err)
+	}
+
+	operations := dryRunStore.Operations()
+	if len(operations) != 2 || operations[0].Uri != catalogUri || operations[1].Action != "delete" || operations[1].Uri != boxUri {
+		t.Fatalf("Unexpected dry run operations: %v", operations)
+	}
+	if len(realStore.Operations()) != realOperations {
+		t.Fatalf("Dry run modified the real store: %v", realStore.Operations())
+	}
+}
+
+func TestNewDryRunManagerDiscardsBoxContents(t *testing.T) {
+	var (
+		catalogUri = "mem://dryrun-discard/MemBox.json"
+		boxUri     = "mem://dryrun-discard/MemBox/MemBox_1.0.0_virtualbox.box"
+		contents   = "a box that a dry run should not keep"
+	)
+
+	GetMemoryStore("dryrun-discard").Reset()
+	backend, _ := NewBackendFromUri(catalogUri)
+	manager := NewBackendManager(catalogUri, &backend)
+
+	dryRunManager, dryRunStore, err := NewDryRunManager(manager)
+	if err != nil {
+		t.Fatalf("Error creating dry run manager: %v", err)
+	}
+	reader := strings.NewReader(contents)
+	if err = dryRunManager.AddBoxFromReader(context.Background(), reader, int64(len(contents)), "MemBox", "desc", "1.0.0", "virtualbox", "sha1", ""); err != nil {
+		t.Fatalf("Error adding box in dry run: %v", err)
+	}
+
+	if size, exists := dryRunStore.FileSize(boxUri); !exists || size != int64(len(contents)) {
+		t.Fatalf("Expected a dry run box of %v bytes, but got %v bytes (exists: %v)", len(contents), size, exists)
+	}
+	if data, _ := dryRunStore.ReadFile(boxUri); len(data) != 0 {
+		t.Fatalf("Dry run kept the contents of the box: '%v'", string(data))
+	}
+	var written bool
+	for _, operation := range dryRunStore.Operations() {
+		if operation.Action == "write" && strings.HasPrefix(operation.Uri, boxUri) && operation.Size == len(contents) {
+			written = true
+		}
+	}
+	if !written {
+		t.Fatalf("Expected a write of %v bytes to '%v', but got operations: %v", len(contents), boxUri, dryRunStore.Operations())
+	}
+}
+
+func TestNewDryRunManagerBoxPathTemplate(t *testing.T) {
+	var (
+		catalogUri = "mem://dryrun-template/MemBox.json"
+		boxUri     = "mem://dryrun-template/boxes/MemBox/1.0.0/virtualbox.box"
+		contents   = "a box"
+	)
+
+	GetMemoryStore("dryrun-template").Reset()
+	backend, _ := NewBackendFromUri(catalogUri)
+	manager := NewBackendManager(catalogUri, &backend)
+	manager.BoxPathTemplate = "boxes/{{.Name}}/{{.Version}}/{{.Provider}}.box"
+	manager.ConflictRetries = 2
+
+	dryRunManager, dryRunStore, err := NewDryRunManager(manager)
+	if err != nil {
+		t.Fatalf("Error creating dry run manager: %v", err)
+	}
+	if dryRunManager.BoxPathTemplate != manager.BoxPathTemplate || dryRunManager.ConflictRetries != manager.ConflictRetries {
+		t.Fatalf("Expected the dry run manager to use template '%v' and %v retries, but got '%v' and %v", manager.BoxPathTemplate, manager.ConflictRetries, dryRunManager.BoxPathTemplate, dryRunManager.ConflictRetries)
+	}
+	reader := strings.NewReader(contents)
+	if err = dryRunManager.AddBoxFromReader(context.Background(), reader, int64(len(contents)), "MemBox", "desc", "1.0.0", "virtualbox", "sha1", ""); err != nil {
+		t.Fatalf("Error adding box in dry run: %v", err)
+	}
+	if _, exists := dryRunStore.FileSize(boxUri); !exists {
+		t.Fatalf("Expected the dry run to store the box at '%v', but the store has %v", boxUri, dryRunStore.Files())
+	}
+}
@@ -0,0 +1,287 @@
+package caryatid
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// An in-process OCI registry that keeps everything in memory
+// Anyone may pull, but pushing and deleting take a token from its token service, like most registries
+type testOciRegistry struct {
+	lock      sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string][]byte
+	tags      map[string]map[string]string
+	uploads   int
+	server    *httptest.Server
+}
+
+func newTestOciRegistry() (registry *testOciRegistry) {
+	registry = &testOciRegistry{
+		blobs:     map[string][]byte{},
+		manifests: map[string][]byte{},
+		tags:      map[string]map[string]string{},
+	}
+	registry.server = httptest.NewServer(registry)
+	return
+}
+
+func (registry *testOciRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	if r.URL.Path == "/token" {
+		if username, password, ok := r.BasicAuth(); !ok || username != "pusher" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": "testtoken"})
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/v2/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	rest := r.URL.Path[len("/v2/"):]
+
+	if r.Method != "GET" && r.Method != "HEAD" && r.Header.Get("Authorization") != "Bearer testtoken" {
+		repository := rest
+		for _, endpoint := range []string{"/blobs/", "/manifests/"} {
+			if idx := strings.Index(rest, endpoint); idx >= 0 {
+				repository = rest[0:idx]
+			}
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%v/token",service="test",scope="repository:%v:pull,push"`, registry.server.URL, repository))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case strings.Contains(rest, "/blobs/uploads/"):
+		repository := rest[0:strings.Index(rest, "/blobs/uploads/")]
+		if r.Method == "POST" {
+			registry.uploads++
+			w.Header().Set("Location", fmt.Sprintf("/v2/%v/blobs/uploads/%v?state=x", repository, registry.uploads))
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		if digest := r.URL.Query().Get("digest"); digest != fmt.Sprintf("sha256:%x", sha256.Sum256(data)) || r.URL.Query().Get("state") != "x" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		registry.blobs[r.URL.Query().Get("digest")] = data
+		w.WriteHeader(http.StatusCreated)
+
+	case strings.Contains(rest, "/blobs/"):
+		data, ok := registry.blobs[rest[strings.Index(rest, "/blobs/")+len("/blobs/"):]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+
+	case strings.Contains(rest, "/manifests/"):
+		repository := rest[0:strings.Index(rest, "/manifests/")]
+		reference := rest[len(repository)+len("/manifests/"):]
+		if registry.tags[repository] == nil {
+			registry.tags[repository] = map[string]string{}
+		}
+		if digest, ok := registry.tags[repository][reference]; ok {
+			reference = digest
+		}
+		switch r.Method {
+		case "PUT":
+			data, _ := ioutil.ReadAll(r.Body)
+			digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+			registry.manifests[digest] = data
+			registry.tags[repository][rest[len(repository)+len("/manifests/"):]] = digest
+			w.Header().Set("Docker-Content-Digest", digest)
+			w.WriteHeader(http.StatusCreated)
+		case "DELETE":
+			if _, ok := registry.manifests[reference]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			delete(registry.manifests, reference)
+			for tag, digest := range registry.tags[repository] {
+				if digest == reference {
+					delete(registry.tags[repository], tag)
+				}
+			}
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			data, ok := registry.manifests[reference]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", ociManifestMediaType)
+			w.Header().Set("Docker-Content-Digest", reference)
+			w.Write(data)
+		}
+
+	case strings.HasSuffix(rest, "/tags/list"):
+		repository := strings.TrimSuffix(rest, "/tags/list")
+		if len(registry.tags[repository]) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		tags := []string{}
+		for tag := range registry.tags[repository] {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": repository, "tags": tags})
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestCaryatidOciBackend(t *testing.T) {
+	registry := newTestOciRegistry()
+	defer registry.server.Close()
+
+	tempDir, err := ioutil.TempDir("", "caryatid-oci-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	catalogUri := fmt.Sprintf("oci://%v/conformance/ConformanceBox.json?plain_http=true", registry.server.Listener.Addr())
+	if err = CheckBackendConformance(&CaryatidOciBackend{Username: "pusher", Password: "secret"}, catalogUri, tempDir); err != nil {
+		t.Fatalf("OCI backend is not conformant: %v", err)
+	}
+}
+
+func TestCaryatidOciBackendArtifacts(t *testing.T) {
+	registry := newTestOciRegistry()
+	defer registry.server.Close()
+
+	tempDir, err := ioutil.TempDir("", "caryatid-oci-artifacts-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var (
+		catalogUri                 = fmt.Sprintf("oci://%v/vagrant/TestBox.json?plain_http=true", registry.server.Listener.Addr())
+		boxPath                    = filepath.Join(tempDir, "test.box")
+		backend    CaryatidBackend = &CaryatidOciBackend{Username: "pusher", Password: "secret"}
+		manager                    = NewBackendManager(catalogUri, &backend)
+	)
+	if err = CreateTestBoxFile(boxPath, "vmware_desktop", true); err != nil {
+		t.Fatalf("Error creating test box: %v", err)
+	}
+
+	var wrongBackend CaryatidBackend = &CaryatidOciBackend{Username: "pusher", Password: "wrong"}
+	if err = NewBackendManager(catalogUri, &wrongBackend).AddBox(boxPath, "TestBox", "A box in a registry", "1.0.0", "vmware_desktop", "sha1", "0xDECAFBAD"); err == nil {
+		t.Fatalf("Expected pushing with the wrong password to fail")
+	}
+
+	if err = manager.AddBox(boxPath, "TestBox", "A box in a registry", "1.0.0", "vmware_desktop", "sha1", "0xDECAFBAD"); err != nil {
+		t.Fatalf("Error adding box: %v", err)
+	}
+	if _, ok := registry.tags["vagrant/testbox"]["1.0.0-vmware_desktop"]; !ok {
+		t.Fatalf("Expected box to be tagged '1.0.0-vmware_desktop' in 'vagrant/testbox', but found tags %v", registry.tags)
+	}
+	if _, ok := registry.tags["vagrant/testbox"][OciCatalogTag]; !ok {
+		t.Fatalf("Expected catalog to be tagged '%v' in 'vagrant/testbox', but found tags %v", OciCatalogTag, registry.tags)
+	}
+
+	// Vagrant downloads the box from the registry's blob endpoint, without credentials
+	catalog, _ := manager.GetCatalog()
+	boxUrl := catalog.BoxReferences()[0].Uri
+	if !strings.HasPrefix(boxUrl, registry.server.URL+"/v2/vagrant/testbox/blobs/sha256:") {
+		t.Fatalf("Expected the catalog to refer to a blob URL, but got '%v'", boxUrl)
+	}
+	resp, err := http.Get(boxUrl)
+	if err != nil {
+		t.Fatalf("Error downloading box: %v", err)
+	}
+	downloaded, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if original, _ := ioutil.ReadFile(boxPath); string(downloaded) != string(original) {
+		t.Fatalf("Downloaded box from '%v' does not match the box that was added", boxUrl)
+	}
+
+	if err = manager.DeleteBox(CatalogQueryParams{Version: "1.0.0"}); err != nil {
+		t.Fatalf("Error deleting box: %v", err)
+	}
+	if _, ok := registry.tags["vagrant/testbox"]["1.0.0-vmware_desktop"]; ok {
+		t.Fatalf("Expected deleting the box to remove its tag")
+	}
+}
+
+func TestCaryatidOciBackendSharedBlobs(t *testing.T) {
+	registry := newTestOciRegistry()
+	defer registry.server.Close()
+
+	tempDir, err := ioutil.TempDir("", "caryatid-oci-shared-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var (
+		catalogUri                 = fmt.Sprintf("oci://%v/vagrant/TestBox.json?plain_http=true", registry.server.Listener.Addr())
+		boxPath                    = filepath.Join(tempDir, "test.box")
+		backend    CaryatidBackend = &CaryatidOciBackend{Username: "pusher", Password: "secret"}
+		manager                    = NewBackendManager(catalogUri, &backend)
+	)
+	if err = CreateTestBoxFile(boxPath, "virtualbox", true); err != nil {
+		t.Fatalf("Error creating test box: %v", err)
+	}
+
+	// The same box file in two versions is one blob with two tags
+	for _, version := range []string{"1.0.0", "1.1.0"} {
+		if err = manager.AddBox(boxPath, "TestBox", "A box in a registry", version, "virtualbox", "sha1", "0xDECAFBAD"); err != nil {
+			t.Fatalf("Error adding version %v: %v", version, err)
+		}
+	}
+	catalog, _ := manager.GetCatalog()
+	refs := catalog.BoxReferences()
+	if len(refs) != 2 || refs[0].Uri == refs[1].Uri {
+		t.Fatalf("Expected each version to have its own URL, but got %v", refs)
+	}
+	for _, ref := range refs {
+		storageUri, err := manager.StorageUri(ref.Uri)
+		if err != nil {
+			t.Fatalf("Error determining storage URI of '%v': %v", ref.Uri, err)
+		}
+		if expected := fmt.Sprintf("oci://%v/vagrant/TestBox/TestBox_%v_virtualbox.box", registry.server.Listener.Addr(), ref.Version); storageUri != expected {
+			t.Fatalf("Expected '%v' to be stored at '%v', but got '%v'", ref.Uri, expected, storageUri)
+		}
+	}
+
+	if err = manager.DeleteBox(CatalogQueryParams{Version: "1.0.0"}); err != nil {
+		t.Fatalf("Error deleting box: %v", err)
+	}
+	if _, ok := registry.tags["vagrant/testbox"]["1.0.0-virtualbox"]; ok {
+		t.Fatalf("Expected deleting version 1.0.0 to remove its tag")
+	}
+	if _, ok := registry.tags["vagrant/testbox"]["1.1.0-virtualbox"]; !ok {
+		t.Fatalf("Expected deleting version 1.0.0 to leave the tag of version 1.1.0, but found tags %v", registry.tags["vagrant/testbox"])
+	}
+}
+
+func TestParseAuthChallenge(t *testing.T) {
+	scheme, params := parseAuthChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:vagrant/testbox:pull,push"`)
+	if scheme != "Bearer" || params["realm"] != "https://auth.example.com/token" || params["service"] != "registry.example.com" || params["scope"] != "repository:vagrant/testbox:pull,push" {
+		t.Fatalf("Unexpected scheme '%v' and parameters %v", scheme, params)
+	}
+	if scheme, params = parseAuthChallenge(`Basic realm=registry`); scheme != "Basic" || params["realm"] != "registry" {
+		t.Fatalf("Unexpected scheme '%v' and parameters %v", scheme, params)
+	}
+}
@@ -0,0 +1,47 @@
+/*
+The backend registry, which maps URI schemes to backends
+
+Built-in backends register themselves from init() functions in their own files.
+A backend that lives outside this package can do the same,
+and then any program that imports its package can use it with NewBackendFromUri():
+
+	package mybackend
+
+	func init() {
+		caryatid.RegisterBackend("myscheme", func() caryatid.CaryatidBackend {
+			return &MyBackend{}
+		})
+	}
+*/
+
+package caryatid
+
+import (
+	"sort"
+	"sync"
+)
+
+var (
+	backendRegistry     = map[string]func() CaryatidBackend{}
+	backendRegistryLock sync.RWMutex
+)
+
+// RegisterBackend makes a backend available to NewBackend() and NewBackendFromUri() for a URI scheme
+// The factory must return a new, unconfigured backend each time it is called
+// Registering a scheme that is already registered replaces the existing factory
+func RegisterBackend(scheme string, factory func() CaryatidBackend) {
+	backendRegistryLock.Lock()
+	defer backendRegistryLock.Unlock()
+	backendRegistry[scheme] = factory
+}
+
+// RegisteredBackends returns a sorted list of the URI schemes that have a registered backend
+func RegisteredBackends() (schemes []string) {
+	backendRegistryLock.RLock()
+	defer backendRegistryLock.RUnlock()
+	for scheme := range backendRegistry {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return
+}
@@ -0,0 +1,35 @@
+package caryatid
+
+import (
+	"testing"
+
+	"github.com/mrled/caryatid/internal/util"
+)
+
+func TestRegisterBackend(t *testing.T) {
+	RegisterBackend("caryatid-test", func() CaryatidBackend { return &CaryatidTestBackend{} })
+
+	backend, err := NewBackendFromUri("caryatid-test://example/catalog.json")
+	if err != nil {
+		t.Fatalf("Error getting registered backend: %v", err)
+	}
+	if _, ok := backend.(*CaryatidTestBackend); !ok {
+		t.Fatalf("Expected a *CaryatidTestBackend but got a %T", backend)
+	}
+
+	otherBackend, _ := NewBackend("caryatid-test")
+	if otherBackend == backend {
+		t.Fatalf("Expected NewBackend() to return a new backend each time")
+	}
+
+	schemes := RegisteredBackends()
+	for _, scheme := range []string{"caryatid-test", "file", "s3"} {
+		if !util.StringInSlice(schemes, scheme) {
+			t.Fatalf("Expected '%v' in registered backends %v", scheme, schemes)
+		}
+	}
+
+	if _, err = NewBackend("caryatid-unregistered"); err == nil {
+		t.Fatalf("Expected an error getting an unregistered backend")
+	}
+}
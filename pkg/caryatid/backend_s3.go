@@ -6,11 +6,17 @@ package caryatid
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
-	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -19,7 +25,231 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
+// Settings for connecting to S3 or an S3-compatible service like MinIO or Ceph RGW
+// Each may also be set with a query parameter in the catalog URI,
+// like s3://bucket/catalog.json?endpoint=https://minio.example.com:9000&region=us-east-1&path_style=true&profile=ci
+type S3Settings struct {
+	// The URL of an S3-compatible service; the "endpoint" query parameter
+	// If empty, AWS S3 is used
+	Endpoint string
+
+	// The region of the bucket; the "region" query parameter
+	// If empty, the region from the shared AWS configuration is used
+	Region string
+
+	// A profile from the shared AWS configuration and credentials files; the "profile" query parameter
+	// If empty, the default profile (or $AWS_PROFILE) is used
+	Profile string
+
+	// Address buckets like https://endpoint/bucket/key rather than https://bucket.endpoint/key,
+	// as most S3-compatible services require; the "path_style" query parameter
+	PathStyle bool
+
+	// If set, write presigned HTTPS URLs that expire after this long into the catalog, instead of s3:// URIs,
+	// so Vagrant can download boxes from a private bucket; the "presign" query parameter, like presign=168h
+	// S3 does not accept presigned URLs that last longer than MaxS3PresignExpiry
+	PresignExpiry time.Duration
+
+	// Options for the catalog object, and the lock object next to it; query parameters prefixed with "catalog_"
+	Catalog S3ObjectOptions
+
+	// Options for box objects; query parameters prefixed with "box_"
+	Box S3ObjectOptions
+}
+
+// Options for objects the S3 backend writes
+// Empty options are not sent to S3, so the bucket's defaults apply
+type S3ObjectOptions struct {
+	// Server-side encryption, like AES256 or aws:kms; the "sse" query parameter
+	ServerSideEncryption string
+
+	// The KMS key to encrypt objects with; the "sse_kms_key_id" query parameter
+	// If this is set without ServerSideEncryption, aws:kms is used
+	SSEKMSKeyId string
+
+	// The storage class, like STANDARD_IA or GLACIER_IR; the "storage_class" query parameter
+	StorageClass string
+
+	// A canned ACL, like private or public-read; the "acl" query parameter
+	ACL string
+
+	// The Cache-Control header that S3 serves the object with; the "cache_control" query parameter
+	CacheControl string
+
+	// The Content-Type header that S3 serves the object with; the "content_type" query parameter
+	ContentType string
+}
+
+// The longest that S3 accepts a presigned URL for
+const MaxS3PresignExpiry = 7 * 24 * time.Hour
+
+// Fill in any settings that are not already set from the query parameters of an S3 URI
+func (settings *S3Settings) mergeQuery(query url.Values) (err error) {
+	if settings.Endpoint == "" {
+		settings.Endpoint = query.Get("endpoint")
+	}
+	if settings.Region == "" {
+		settings.Region = query.Get("region")
+	}
+	if settings.Profile == "" {
+		settings.Profile = query.Get("profile")
+	}
+	if pathStyle := query.Get("path_style"); !settings.PathStyle && pathStyle != "" {
+		if settings.PathStyle, err = strconv.ParseBool(pathStyle); err != nil {
+			err = fmt.Errorf("Invalid value '%v' for the S3 path_style setting; expected true or false", pathStyle)
+			return
+		}
+	}
+	if presign := query.Get("presign"); settings.PresignExpiry == 0 && presign != "" {
+		if settings.PresignExpiry, err = time.ParseDuration(presign); err != nil {
+			err = fmt.Errorf("Invalid value '%v' for the S3 presign setting; expected a duration like 168h", presign)
+			return
+		}
+	}
+	if settings.PresignExpiry < 0 || settings.PresignExpiry > MaxS3PresignExpiry {
+		err = fmt.Errorf("Invalid S3 presign expiry '%v'; it must be no longer than %v", settings.PresignExpiry, MaxS3PresignExpiry)
+		return
+	}
+	if err = settings.Catalog.mergeQuery(query, "catalog_"); err != nil {
+		return
+	}
+	err = settings.Box.mergeQuery(query, "box_")
+	return
+}
+
+// Fill in any options that are not already set from the query parameters of an S3 URI that start with prefix
+func (options *S3ObjectOptions) mergeQuery(query url.Values, prefix string) (err error) {
+	for name, option := range map[string]*string{
+		"sse":            &options.ServerSideEncryption,
+		"sse_kms_key_id": &options.SSEKMSKeyId,
+		"storage_class":  &options.StorageClass,
+		"acl":            &options.ACL,
+		"cache_control":  &options.CacheControl,
+		"content_type":   &options.ContentType,
+	} {
+		if *option == "" {
+			*option = query.Get(prefix + name)
+		}
+	}
+	if options.SSEKMSKeyId != "" && options.ServerSideEncryption == "" {
+		options.ServerSideEncryption = s3.ServerSideEncryptionAwsKms
+	}
+
+	for _, check := range []struct {
+		name  string
+		value string
+		valid []string
+	}{
+		{prefix + "sse", options.ServerSideEncryption, s3.ServerSideEncryption_Values()},
+		{prefix + "storage_class", options.StorageClass, s3.StorageClass_Values()},
+		{prefix + "acl", options.ACL, s3.ObjectCannedACL_Values()},
+	} {
+		if check.value != "" && !stringInSlice(check.value, check.valid) {
+			return fmt.Errorf("Invalid value '%v' for the S3 %v setting; expected one of %v", check.value, check.name, strings.Join(check.valid, ", "))
+		}
+	}
+	if options.SSEKMSKeyId != "" && !strings.HasPrefix(options.ServerSideEncryption, s3.ServerSideEncryptionAwsKms) {
+		return fmt.Errorf("The S3 %vsse_kms_key_id setting requires %vsse to be %v", prefix, prefix, s3.ServerSideEncryptionAwsKms)
+	}
+	return
+}
+
+func stringInSlice(value string, slice []string) bool {
+	for _, item := range slice {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Return nil for an empty option, so that it is left out of requests to S3
+func s3Option(option string) *string {
+	if option == "" {
+		return nil
+	}
+	return aws.String(option)
+}
+
+func (options S3ObjectOptions) uploadInput(bucket string, key string, body io.Reader) *s3manager.UploadInput {
+	return &s3manager.UploadInput{
+		Bucket:               aws.String(bucket),
+		Key:                  aws.String(key),
+		Body:                 body,
+		ServerSideEncryption: s3Option(options.ServerSideEncryption),
+		SSEKMSKeyId:          s3Option(options.SSEKMSKeyId),
+		StorageClass:         s3Option(options.StorageClass),
+		ACL:                  s3Option(options.ACL),
+		CacheControl:         s3Option(options.CacheControl),
+		ContentType:          s3Option(options.ContentType),
+	}
+}
+
+func (options S3ObjectOptions) putObjectInput(bucket string, key string, body io.ReadSeeker) *s3.PutObjectInput {
+	return &s3.PutObjectInput{
+		Bucket:               aws.String(bucket),
+		Key:                  aws.String(key),
+		Body:                 body,
+		ServerSideEncryption: s3Option(options.ServerSideEncryption),
+		SSEKMSKeyId:          s3Option(options.SSEKMSKeyId),
+		StorageClass:         s3Option(options.StorageClass),
+		ACL:                  s3Option(options.ACL),
+		CacheControl:         s3Option(options.CacheControl),
+		ContentType:          s3Option(options.ContentType),
+	}
+}
+
+// Copies keep the Cache-Control and Content-Type of the source object,
+// but S3 does not carry over encryption, storage class, or ACL, so those are set again
+func (options S3ObjectOptions) copyObjectInput(bucket string, key string, copySource *string) *s3.CopyObjectInput {
+	return &s3.CopyObjectInput{
+		Bucket:               aws.String(bucket),
+		Key:                  aws.String(key),
+		CopySource:           copySource,
+		ServerSideEncryption: s3Option(options.ServerSideEncryption),
+		SSEKMSKeyId:          s3Option(options.SSEKMSKeyId),
+		StorageClass:         s3Option(options.StorageClass),
+		ACL:                  s3Option(options.ACL),
+	}
+}
+
+func (options S3ObjectOptions) createMultipartUploadInput(bucket string, key string) *s3.CreateMultipartUploadInput {
+	return &s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(bucket),
+		Key:                  aws.String(key),
+		ServerSideEncryption: s3Option(options.ServerSideEncryption),
+		SSEKMSKeyId:          s3Option(options.SSEKMSKeyId),
+		StorageClass:         s3Option(options.StorageClass),
+		ACL:                  s3Option(options.ACL),
+		CacheControl:         s3Option(options.CacheControl),
+		ContentType:          s3Option(options.ContentType),
+	}
+}
+
+// Create an AWS session from the settings, on top of the shared AWS configuration
+func (settings S3Settings) newSession() (*session.Session, error) {
+	config := aws.NewConfig()
+	if settings.Endpoint != "" {
+		config = config.WithEndpoint(settings.Endpoint)
+	}
+	if settings.Region != "" {
+		config = config.WithRegion(settings.Region)
+	}
+	if settings.PathStyle {
+		config = config.WithS3ForcePathStyle(true)
+	}
+	return session.NewSessionWithOptions(session.Options{
+		Config:            *config,
+		Profile:           settings.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+}
+
 type CaryatidS3Backend struct {
+	// Settings for connecting to S3
+	// Any setting left empty here is taken from the query parameters of the catalog URI
+	Settings S3Settings
+
 	AwsSession   *session.Session
 	S3Service    *s3.S3
 	S3Downloader *s3manager.Downloader
@@ -27,6 +257,13 @@ type CaryatidS3Backend struct {
 	Manager      *BackendManager
 
 	CatalogLocation *caryatidS3Location
+
+	// The lock this backend holds on the catalog, if any
+	heldLock *CatalogLock
+}
+
+func init() {
+	RegisterBackend("s3", func() CaryatidBackend { return &CaryatidS3Backend{} })
 }
 
 type caryatidS3Location struct {
@@ -34,23 +271,18 @@ type caryatidS3Location struct {
 	Resource string
 }
 
+// Get the bucket and key from an S3 URI
+// Any query string is ignored, since it holds settings rather than part of the key
 func uri2s3location(uri string) (loc *caryatidS3Location, err error) {
-	s3Regex := regexp.MustCompile("^s3://([a-zA-Z0-9\\-_]+)/(.*)")
-	result := s3Regex.FindAllStringSubmatch(uri, -1)
-
-	if result == nil {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
 		err = fmt.Errorf("Invalid S3 URI '%v'", uri)
 		return
-	} else if len(result) != 1 || len(result[0]) != 3 {
-		err = fmt.Errorf("Apparently the regexp is wrong and I don't know what I'm doing, sorry")
-		return
 	}
 
-	log.Printf("result:\n%v\n", result)
-
 	loc = new(caryatidS3Location)
-	loc.Bucket = result[0][1]
-	loc.Resource = result[0][2]
+	loc.Bucket = u.Host
+	loc.Resource = strings.TrimPrefix(u.Path, "/")
 	return
 }
 
@@ -62,11 +294,20 @@ func (backend *CaryatidS3Backend) verifyCredential() (err error) {
 }
 
 func (backend *CaryatidS3Backend) SetManager(manager *BackendManager) (err error) {
+	var u *url.URL
+
 	backend.Manager = manager
 
-	backend.AwsSession = session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-	}))
+	if u, err = url.Parse(backend.Manager.CatalogUri); err != nil {
+		return
+	}
+	if err = backend.Settings.mergeQuery(u.Query()); err != nil {
+		return
+	}
+	if backend.AwsSession, err = backend.Settings.newSession(); err != nil {
+		err = fmt.Errorf("Could not create an AWS session: %v", err)
+		return
+	}
 	backend.S3Service = s3.New(backend.AwsSession)
 	backend.S3Downloader = s3manager.NewDownloader(backend.AwsSession)
 	backend.S3Uploader = s3manager.NewUploader(backend.AwsSession)
@@ -139,11 +380,10 @@ func (backend *CaryatidS3Backend) GetCatalogBytes() (catalogBytes []byte, err er
 }
 
 func (backend *CaryatidS3Backend) SetCatalogBytes(serializedCatalog []byte) (err error) {
-	upParams := &s3manager.UploadInput{
-		Bucket: aws.String(backend.CatalogLocation.Bucket),
-		Key:    aws.String(backend.CatalogLocation.Resource),
-		Body:   bytes.NewReader(serializedCatalog),
-	}
+	upParams := backend.Settings.Catalog.uploadInput(
+		backend.CatalogLocation.Bucket,
+		backend.CatalogLocation.Resource,
+		bytes.NewReader(serializedCatalog))
 
 	_, err = backend.S3Uploader.Upload(upParams)
 	if err != nil {
@@ -153,41 +393,344 @@ func (backend *CaryatidS3Backend) SetCatalogBytes(serializedCatalog []byte) (err
 	return
 }
 
+// Get an object along with its ETag, which is used as its version
+// If the object does not exist, return nil contents and an empty version
+func (backend *CaryatidS3Backend) getObjectVersion(key string) (contents []byte, version string, err error) {
+	result, err := backend.S3Service.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(backend.CatalogLocation.Bucket),
+		Key:    aws.String(key),
+	})
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey:
+			return nil, "", nil
+		case s3.ErrCodeNoSuchBucket:
+			err = fmt.Errorf("Bucket '%v' does not exist\n", backend.CatalogLocation.Bucket)
+		}
+	}
+	if err != nil {
+		return
+	}
+	defer result.Body.Close()
+
+	if contents, err = ioutil.ReadAll(result.Body); err != nil {
+		return
+	}
+	version = aws.StringValue(result.ETag)
+	return
+}
+
+// Upload an object with a conditional PUT, so that S3 itself rejects the write if the object's ETag has changed
+// An empty version means that the object must not exist yet
+// Only the catalog and its lease are written this way, so they use the catalog options
+func (backend *CaryatidS3Backend) putObjectIfVersion(key string, contents []byte, version string) (err error) {
+	req, _ := backend.S3Service.PutObjectRequest(backend.Settings.Catalog.putObjectInput(
+		backend.CatalogLocation.Bucket, key, bytes.NewReader(contents)))
+	// This version of the SDK predates S3 conditional writes, so set their headers directly
+	if version == "" {
+		req.HTTPRequest.Header.Set("If-None-Match", "*")
+	} else {
+		req.HTTPRequest.Header.Set("If-Match", version)
+	}
+
+	err = req.Send()
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		// 412 Precondition Failed means the ETag did not match,
+		// and 409 Conflict means another conditional write to the same key was in progress
+		if reqErr.StatusCode() == http.StatusPreconditionFailed || reqErr.StatusCode() == http.StatusConflict {
+			return &CatalogConflictError{CatalogUri: fmt.Sprintf("s3://%v/%v", backend.CatalogLocation.Bucket, key), Expected: version}
+		}
+	}
+	return
+}
+
+func (backend *CaryatidS3Backend) GetCatalogBytesVersion() (catalogBytes []byte, version string, err error) {
+	catalogBytes, version, err = backend.getObjectVersion(backend.CatalogLocation.Resource)
+	if err != nil {
+		log.Printf("CaryatidS3Backend.GetCatalogBytesVersion(): Could not download from S3: %v", err)
+	} else if catalogBytes == nil {
+		log.Printf("No file at '%v'; starting with empty catalog\n", backend.Manager.CatalogUri)
+		catalogBytes = []byte("{}")
+	}
+	return
+}
+
+func (backend *CaryatidS3Backend) SetCatalogBytesIfVersion(serializedCatalog []byte, version string) (err error) {
+	err = backend.putObjectIfVersion(backend.CatalogLocation.Resource, serializedCatalog, version)
+	if err != nil && !IsCatalogConflict(err) {
+		log.Println("CaryatidS3Backend.SetCatalogBytesIfVersion(): Error trying to upload catalog: ", err)
+	}
+	return
+}
+
+// The S3 backend keeps its lock in a lease object next to the catalog, like s3://bucket/catalog.json.lock
+type s3LeaseStore struct {
+	backend *CaryatidS3Backend
+}
+
+func (lease s3LeaseStore) key() string {
+	return lease.backend.CatalogLocation.Resource + ".lock"
+}
+
+func (lease s3LeaseStore) readLease() ([]byte, string, error) {
+	return lease.backend.getObjectVersion(lease.key())
+}
+
+func (lease s3LeaseStore) writeLease(leaseBytes []byte, version string) error {
+	return lease.backend.putObjectIfVersion(lease.key(), leaseBytes, version)
+}
+
+func (lease s3LeaseStore) deleteLease() (err error) {
+	_, err = lease.backend.S3Service.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(lease.backend.CatalogLocation.Bucket),
+		Key:    aws.String(lease.key()),
+	})
+	return
+}
+
+func (backend *CaryatidS3Backend) Lock(lock CatalogLock) (err error) {
+	if err = acquireLease(s3LeaseStore{backend}, backend.Manager.CatalogUri, lock); err == nil {
+		backend.heldLock = &lock
+	}
+	return
+}
+
+func (backend *CaryatidS3Backend) Unlock() (err error) {
+	if backend.heldLock == nil {
+		return fmt.Errorf("Not holding the lock on '%v'", backend.Manager.CatalogUri)
+	}
+	if err = releaseLease(s3LeaseStore{backend}, backend.Manager.CatalogUri, *backend.heldLock); err == nil {
+		backend.heldLock = nil
+	}
+	return
+}
+
+func (backend *CaryatidS3Backend) LockStatus() (lock *CatalogLock, err error) {
+	lock, _, err = leaseStatus(s3LeaseStore{backend})
+	return
+}
+
+func (backend *CaryatidS3Backend) BreakLock() (err error) {
+	return s3LeaseStore{backend}.deleteLease()
+}
+
 func (backend *CaryatidS3Backend) CopyBoxFile(path string, boxName string, boxVersion string, boxProvider string) (err error) {
+	var boxUri string
+	if boxUri, err = BoxUriFromCatalogUri(backend.Manager.CatalogUri, boxName, boxVersion, boxProvider); err != nil {
+		return
+	}
+	return backend.UploadFile(path, boxUri)
+}
+
+func (backend *CaryatidS3Backend) UploadFile(path string, uri string) (err error) {
 	var (
-		boxFileLoc  caryatidS3Location
 		fileHandler *os.File
+		fileInfo    os.FileInfo
 	)
 
-	boxFileLoc.Bucket = backend.CatalogLocation.Bucket
+	if fileHandler, err = os.Open(path); err != nil {
+		return
+	}
+	defer fileHandler.Close()
+	if fileInfo, err = fileHandler.Stat(); err != nil {
+		return
+	}
+	return backend.PutBox(context.Background(), uri, fileHandler, fileInfo.Size())
+}
+
+func (backend *CaryatidS3Backend) PutBox(ctx context.Context, uri string, reader io.Reader, size int64) (err error) {
+	var fileLoc *caryatidS3Location
+	if fileLoc, err = uri2s3location(uri); err != nil {
+		return
+	}
 
-	// TODO: Do we need the if statement? Can we just use the second version and be OK if LastIndex() returns -1 ?
-	lastSlashIdx := strings.LastIndex(backend.CatalogLocation.Resource, "/")
-	if lastSlashIdx < 0 {
-		boxFileLoc.Resource = fmt.Sprintf(
-			"%v/%v_%v_%v.box",
-			boxName, boxName, boxVersion, boxProvider)
-	} else {
-		boxFileLoc.Resource = fmt.Sprintf(
-			"%v/%v/%v_%v_%v.box",
-			backend.CatalogLocation.Resource[0:lastSlashIdx],
-			boxName, boxName, boxVersion, boxProvider)
+	// The uploader cannot tell how large a stream is, so make its parts large enough to fit a stream of a known size
+	partSize := func(uploader *s3manager.Uploader) {
+		if minPartSize := size/int64(uploader.MaxUploadParts) + 1; minPartSize > uploader.PartSize {
+			uploader.PartSize = minPartSize
+		}
 	}
+	_, err = backend.S3Uploader.UploadWithContext(ctx, backend.Settings.Box.uploadInput(fileLoc.Bucket, fileLoc.Resource, reader), partSize)
+	return
+}
 
-	if fileHandler, err = os.Open(path); err != nil {
+func (backend *CaryatidS3Backend) OpenBox(ctx context.Context, uri string) (reader io.ReadCloser, err error) {
+	var (
+		fileLoc *caryatidS3Location
+		result  *s3.GetObjectOutput
+	)
+
+	if fileLoc, err = uri2s3location(uri); err != nil {
 		return
 	}
-	defer fileHandler.Close()
+	result, err = backend.S3Service.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(fileLoc.Bucket),
+		Key:    aws.String(fileLoc.Resource),
+	})
+	if err != nil {
+		return
+	}
+	return result.Body, nil
+}
+
+func (backend *CaryatidS3Backend) FileSize(uri string) (size int64, exists bool, err error) {
+	var (
+		fileLoc *caryatidS3Location
+		result  *s3.HeadObjectOutput
+	)
+
+	if fileLoc, err = uri2s3location(uri); err != nil {
+		return
+	}
+	result, err = backend.S3Service.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(fileLoc.Bucket),
+		Key:    aws.String(fileLoc.Resource),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
+		return 0, false, nil
+	} else if err != nil {
+		return
+	}
+	return aws.Int64Value(result.ContentLength), true, nil
+}
+
+func (backend *CaryatidS3Backend) DownloadFile(uri string, localPath string) (err error) {
+	var (
+		fileLoc   *caryatidS3Location
+		localFile *os.File
+	)
+
+	if fileLoc, err = uri2s3location(uri); err != nil {
+		return
+	}
+	if localFile, err = os.Create(localPath); err != nil {
+		return
+	}
+	defer localFile.Close()
+
+	_, err = backend.S3Downloader.Download(localFile, &s3.GetObjectInput{
+		Bucket: aws.String(fileLoc.Bucket),
+		Key:    aws.String(fileLoc.Resource),
+	})
+	return
+}
+
+func (backend *CaryatidS3Backend) ListFiles(dirUri string) (files []BackendFile, err error) {
+	var dirLoc *caryatidS3Location
+
+	if dirLoc, err = uri2s3location(dirUri); err != nil {
+		return
+	}
+	prefix := strings.TrimSuffix(dirLoc.Resource, "/") + "/"
+	err = backend.S3Service.ListObjectsV2Pages(
+		&s3.ListObjectsV2Input{
+			Bucket: aws.String(dirLoc.Bucket),
+			Prefix: aws.String(prefix),
+		},
+		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, object := range page.Contents {
+				files = append(files, BackendFile{
+					Uri:  fmt.Sprintf("s3://%v/%v", dirLoc.Bucket, aws.StringValue(object.Key)),
+					Size: aws.Int64Value(object.Size),
+				})
+			}
+			return true
+		})
+	return
+}
+
+// The largest object S3 can copy in a single request
+const s3MaxCopySize = 5 * 1024 * 1024 * 1024
+
+// The size of each part when copying larger objects with a multipart upload
+const s3CopyPartSize = 1024 * 1024 * 1024
+
+// S3 cannot rename objects, so copy the object to its new key and delete the old one
+// Only boxes are moved, so the copy uses the box options
+func (backend *CaryatidS3Backend) MoveFile(fromUri string, toUri string) (err error) {
+	var (
+		fromLoc *caryatidS3Location
+		toLoc   *caryatidS3Location
+		size    int64
+		exists  bool
+	)
+
+	if fromLoc, err = uri2s3location(fromUri); err != nil {
+		return
+	}
+	if toLoc, err = uri2s3location(toUri); err != nil {
+		return
+	}
+	if size, exists, err = backend.FileSize(fromUri); err != nil {
+		return
+	} else if !exists {
+		return fmt.Errorf("No file at '%v'", fromUri)
+	}
 
-	_, err = backend.S3Uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(boxFileLoc.Bucket),
-		Key:    aws.String(boxFileLoc.Resource),
-		Body:   fileHandler,
+	copySource := aws.String(url.PathEscape(fromLoc.Bucket + "/" + fromLoc.Resource))
+	if size <= s3MaxCopySize {
+		_, err = backend.S3Service.CopyObject(backend.Settings.Box.copyObjectInput(toLoc.Bucket, toLoc.Resource, copySource))
+	} else {
+		err = backend.multipartCopy(copySource, toLoc, size)
+	}
+	if err != nil {
+		return
+	}
+
+	_, err = backend.S3Service.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(fromLoc.Bucket),
+		Key:    aws.String(fromLoc.Resource),
 	})
+	return
+}
+
+// Copy an object that is too large for CopyObject, one part at a time
+func (backend *CaryatidS3Backend) multipartCopy(copySource *string, toLoc *caryatidS3Location, size int64) (err error) {
+	var (
+		upload *s3.CreateMultipartUploadOutput
+		part   *s3.UploadPartCopyOutput
+		parts  []*s3.CompletedPart
+	)
+
+	upload, err = backend.S3Service.CreateMultipartUpload(backend.Settings.Box.createMultipartUploadInput(toLoc.Bucket, toLoc.Resource))
 	if err != nil {
 		return
 	}
+	defer func() {
+		if err != nil {
+			backend.S3Service.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(toLoc.Bucket),
+				Key:      aws.String(toLoc.Resource),
+				UploadId: upload.UploadId,
+			})
+		}
+	}()
+
+	for partNumber, offset := int64(1), int64(0); offset < size; partNumber, offset = partNumber+1, offset+s3CopyPartSize {
+		last := offset + s3CopyPartSize - 1
+		if last >= size {
+			last = size - 1
+		}
+		part, err = backend.S3Service.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:          aws.String(toLoc.Bucket),
+			Key:             aws.String(toLoc.Resource),
+			UploadId:        upload.UploadId,
+			PartNumber:      aws.Int64(partNumber),
+			CopySource:      copySource,
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%v-%v", offset, last)),
+		})
+		if err != nil {
+			return
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: part.CopyPartResult.ETag, PartNumber: aws.Int64(partNumber)})
+	}
 
+	_, err = backend.S3Service.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(toLoc.Bucket),
+		Key:             aws.String(toLoc.Resource),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
 	return
 }
 
@@ -219,6 +762,66 @@ func (backend *CaryatidS3Backend) DeleteFile(uri string) (err error) {
 	return
 }
 
+// FrontendUri returns a presigned HTTPS URL for an s3:// URI if presigned URLs are enabled, and the URI unchanged otherwise
+// The URL is signed with the backend's credentials, and stops working when they do,
+// so temporary credentials may cut its lifetime short
+func (backend *CaryatidS3Backend) FrontendUri(storageUri string) (frontendUri string, err error) {
+	var fileLoc *caryatidS3Location
+
+	if backend.Settings.PresignExpiry == 0 {
+		return storageUri, nil
+	}
+	if fileLoc, err = uri2s3location(storageUri); err != nil {
+		return
+	}
+	req, _ := backend.S3Service.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(fileLoc.Bucket),
+		Key:    aws.String(fileLoc.Resource),
+	})
+	return req.Presign(backend.Settings.PresignExpiry)
+}
+
+// StorageUri converts an HTTPS URL for an object in the catalog's bucket, like a presigned URL, back to an s3:// URI
+// This works whether or not presigned URLs are enabled, so catalogs with presigned URLs can still be managed after turning them off
+func (backend *CaryatidS3Backend) StorageUri(frontendUri string) (storageUri string, err error) {
+	var (
+		u         *url.URL
+		bucketUrl *url.URL
+	)
+
+	if u, err = url.Parse(frontendUri); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return frontendUri, err
+	}
+	if bucketUrl, err = backend.bucketUrl(); err != nil {
+		return
+	}
+	if u.Scheme != bucketUrl.Scheme || u.Host != bucketUrl.Host || !strings.HasPrefix(u.Path, bucketUrl.Path) {
+		return frontendUri, nil
+	}
+	storageUri = fmt.Sprintf("s3://%v/%v", backend.CatalogLocation.Bucket, strings.TrimPrefix(u.Path, bucketUrl.Path))
+	return
+}
+
+// Return the URL that objects in the catalog's bucket are served under,
+// like https://bucket.s3.us-east-1.amazonaws.com/ or, with path-style addressing, https://minio.example.com:9000/bucket/
+func (backend *CaryatidS3Backend) bucketUrl() (bucketUrl *url.URL, err error) {
+	const placeholderKey = "caryatid-placeholder"
+
+	req, _ := backend.S3Service.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(backend.CatalogLocation.Bucket),
+		Key:    aws.String(placeholderKey),
+	})
+	if err = req.Build(); err != nil {
+		return
+	}
+	bucketUrl = &url.URL{
+		Scheme: req.HTTPRequest.URL.Scheme,
+		Host:   req.HTTPRequest.URL.Host,
+		Path:   strings.TrimSuffix(req.HTTPRequest.URL.Path, placeholderKey),
+	}
+	return
+}
+
 func (backend *CaryatidS3Backend) Scheme() string {
 	return "s3"
 }
@@ -0,0 +1,403 @@
+package caryatid
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An object stored in a testS3Server
+type testS3Object struct {
+	Data []byte
+	ETag string
+	// The headers of the request that created the object
+	Header http.Header
+}
+
+// A minimal in-process S3 server that supports path-style requests for the object operations the S3 backend uses
+type testS3Server struct {
+	*httptest.Server
+	Bucket  string
+	Objects map[string]testS3Object
+	lock    sync.Mutex
+}
+
+func newTestS3Server(bucket string) (server *testS3Server) {
+	server = &testS3Server{Bucket: bucket, Objects: map[string]testS3Object{}}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.handle))
+	return
+}
+
+func (server *testS3Server) writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%v</Code><Message>%v</Message></Error>", code, code)
+}
+
+func (server *testS3Server) handle(w http.ResponseWriter, r *http.Request) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	pathParts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if pathParts[0] != server.Bucket {
+		server.writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	if (len(pathParts) != 2 || pathParts[1] == "") && r.Method == "GET" && r.URL.Query().Get("list-type") == "2" {
+		server.list(w, r.URL.Query().Get("prefix"))
+		return
+	} else if len(pathParts) != 2 || pathParts[1] == "" {
+		server.writeError(w, http.StatusNotImplemented, "NotImplemented")
+		return
+	}
+	key := pathParts[1]
+	object, exists := server.Objects[key]
+
+	switch r.Method {
+	case "GET", "HEAD":
+		if !exists {
+			server.writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		data := object.Data
+		status := http.StatusOK
+		var first, last int
+		if n, _ := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &first, &last); n == 2 && len(data) > 0 {
+			if last >= len(data) {
+				last = len(data) - 1
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", first, last, len(data)))
+			data = data[first : last+1]
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("ETag", object.ETag)
+		w.Header().Set("Content-Length", fmt.Sprintf("%v", len(data)))
+		w.WriteHeader(status)
+		if r.Method == "GET" {
+			w.Write(data)
+		}
+
+	case "PUT":
+		if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && (!exists || ifMatch != object.ETag) {
+			server.writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			server.writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+
+		var data []byte
+		header := http.Header{}
+		for name, values := range r.Header {
+			header[name] = append([]string{}, values...)
+		}
+		if copySource := r.Header.Get("X-Amz-Copy-Source"); copySource != "" {
+			copySource, _ = url.PathUnescape(strings.TrimPrefix(copySource, "/"))
+			source, ok := server.Objects[strings.TrimPrefix(copySource, server.Bucket+"/")]
+			if !strings.HasPrefix(copySource, server.Bucket+"/") || !ok {
+				server.writeError(w, http.StatusNotFound, "NoSuchKey")
+				return
+			}
+			data = source.Data
+			// Like S3, copies keep the metadata of the source unless told to replace it
+			if r.Header.Get("X-Amz-Metadata-Directive") != "REPLACE" {
+				for _, name := range []string{"Cache-Control", "Content-Type"} {
+					header.Del(name)
+					if value := source.Header.Get(name); value != "" {
+						header.Set(name, value)
+					}
+				}
+			}
+		} else {
+			data, _ = ioutil.ReadAll(r.Body)
+		}
+
+		object = testS3Object{Data: data, ETag: fmt.Sprintf("\"%x\"", md5.Sum(data)), Header: header}
+		server.Objects[key] = object
+		w.Header().Set("ETag", object.ETag)
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			w.Header().Set("Content-Type", "application/xml")
+			fmt.Fprintf(w, "<CopyObjectResult><ETag>%v</ETag><LastModified>%v</LastModified></CopyObjectResult>", object.ETag, time.Now().UTC().Format(time.RFC3339))
+		}
+
+	case "DELETE":
+		delete(server.Objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		server.writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// Respond to a ListObjectsV2 request with every object whose key starts with prefix, all in one page
+func (server *testS3Server) list(w http.ResponseWriter, prefix string) {
+	var keys []string
+	for key := range server.Objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, "<ListBucketResult><Name>%v</Name><Prefix>%v</Prefix><KeyCount>%v</KeyCount><IsTruncated>false</IsTruncated>", server.Bucket, prefix, len(keys))
+	for _, key := range keys {
+		object := server.Objects[key]
+		fmt.Fprintf(w, "<Contents><Key>%v</Key><Size>%v</Size><ETag>%v</ETag></Contents>", key, len(object.Data), object.ETag)
+	}
+	fmt.Fprintf(w, "</ListBucketResult>")
+}
+
+// Set environment variables for a test
+// The returned function restores their previous values
+func setTestEnvironment(variables map[string]string) (restore func()) {
+	previous := map[string]*string{}
+	for name, value := range variables {
+		if old, exists := os.LookupEnv(name); exists {
+			previous[name] = &old
+		} else {
+			previous[name] = nil
+		}
+		os.Setenv(name, value)
+	}
+	return func() {
+		for name, value := range previous {
+			if value == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *value)
+			}
+		}
+	}
+}
+
+// Point the AWS SDK at fake credentials, rather than any real ones in the environment
+// The fake credentials are also available from a 'caryatid-test' profile
+// The returned function restores the environment and removes the credentials file
+func setTestAwsEnvironment(t *testing.T) (restore func()) {
+	tempDir, err := ioutil.TempDir("", "caryatid-aws-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	credentialsFile := filepath.Join(tempDir, "credentials")
+	credentials := "[caryatid-test]\naws_access_key_id = caryatid-test\naws_secret_access_key = caryatid-test-secret\n"
+	if err = ioutil.WriteFile(credentialsFile, []byte(credentials), 0600); err != nil {
+		os.RemoveAll(tempDir)
+		t.Fatalf("Error writing AWS credentials file: %v", err)
+	}
+	restoreEnvironment := setTestEnvironment(map[string]string{
+		"AWS_ACCESS_KEY_ID":           "caryatid-test",
+		"AWS_SECRET_ACCESS_KEY":       "caryatid-test-secret",
+		"AWS_SESSION_TOKEN":           "",
+		"AWS_PROFILE":                 "",
+		"AWS_CONFIG_FILE":             os.DevNull,
+		"AWS_SHARED_CREDENTIALS_FILE": credentialsFile,
+	})
+	return func() {
+		restoreEnvironment()
+		os.RemoveAll(tempDir)
+	}
+}
+
+func TestCaryatidS3Backend_ImplementsCaryatidBackend(t *testing.T) {
+	var _ CaryatidBackend = new(CaryatidS3Backend)
+	var _ CaryatidVersionedBackend = new(CaryatidS3Backend)
+	var _ CaryatidLockingBackend = new(CaryatidS3Backend)
+	var _ CaryatidStagingBackend = new(CaryatidS3Backend)
+}
+
+func TestCaryatidS3BackendConformance(t *testing.T) {
+	defer setTestAwsEnvironment(t)()
+	server := newTestS3Server("test-bucket")
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "caryatid-s3-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	catalogUri := fmt.Sprintf("s3://test-bucket/some/path/catalog.json?endpoint=%v&region=us-east-1&path_style=true", url.QueryEscape(server.URL))
+	if err = CheckBackendConformance(&CaryatidS3Backend{}, catalogUri, tempDir); err != nil {
+		t.Fatalf("S3 backend is not conformant: %v", err)
+	}
+	if _, exists := server.Objects["some/path/catalog.json"]; !exists {
+		t.Fatalf("Expected the catalog at 'some/path/catalog.json' on the fake S3 server, but found %v", server.Objects)
+	}
+}
+
+func TestCaryatidS3BackendSettings(t *testing.T) {
+	defer setTestAwsEnvironment(t)()
+	server := newTestS3Server("test-bucket")
+	defer server.Close()
+
+	// Settings on the backend take precedence over the catalog URI
+	catalogUri := "s3://test-bucket/catalog.json?endpoint=https://unused.example.com&region=us-west-2&path_style=true&profile=unused"
+	var backend CaryatidBackend = &CaryatidS3Backend{Settings: S3Settings{Endpoint: server.URL, Region: "us-east-1", Profile: "caryatid-test"}}
+	manager := NewBackendManager(catalogUri, &backend)
+
+	settings := backend.(*CaryatidS3Backend).Settings
+	expected := S3Settings{Endpoint: server.URL, Region: "us-east-1", Profile: "caryatid-test", PathStyle: true}
+	if settings != expected {
+		t.Fatalf("Expected settings '%+v' but got '%+v'", expected, settings)
+	}
+
+	if err := manager.SaveCatalog(Catalog{Name: "SettingsBox"}); err != nil {
+		t.Fatalf("Error saving catalog: %v", err)
+	}
+	if _, exists := server.Objects["catalog.json"]; !exists {
+		t.Fatalf("Expected the catalog on the fake S3 server, but found %v", server.Objects)
+	}
+
+	boxUri, _ := BoxUriFromCatalogUri(catalogUri, "SettingsBox", "1.0.0", "virtualbox")
+	if boxUri != "s3://test-bucket/SettingsBox/SettingsBox_1.0.0_virtualbox.box" {
+		t.Fatalf("Expected the settings to be left out of box URIs, but got '%v'", boxUri)
+	}
+
+	var invalid CaryatidBackend = &CaryatidS3Backend{}
+	if err := invalid.SetManager(&BackendManager{CatalogUri: "s3://test-bucket/catalog.json?path_style=sometimes"}); err == nil {
+		t.Fatalf("Expected an invalid path_style setting to fail")
+	}
+}
+
+func TestCaryatidS3BackendObjectOptions(t *testing.T) {
+	defer setTestAwsEnvironment(t)()
+	server := newTestS3Server("test-bucket")
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "caryatid-s3-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	boxPath := filepath.Join(tempDir, "incoming.box")
+	if err = CreateTestBoxFile(boxPath, "virtualbox", true); err != nil {
+		t.Fatalf("Error creating test box file: %v", err)
+	}
+
+	catalogUri := fmt.Sprintf(
+		"s3://test-bucket/catalog.json?endpoint=%v&region=us-east-1&path_style=true&catalog_cache_control=%v&catalog_content_type=application/json&box_storage_class=STANDARD_IA&box_sse_kms_key_id=test-key",
+		url.QueryEscape(server.URL), url.QueryEscape("max-age=60"))
+	var backend CaryatidBackend = &CaryatidS3Backend{Settings: S3Settings{
+		Box: S3ObjectOptions{CacheControl: "max-age=31536000, immutable", ACL: "bucket-owner-full-control"},
+	}}
+	manager := NewBackendManager(catalogUri, &backend)
+
+	if err = manager.AddBox(boxPath, "OptionsBox", "OptionsBox description", "1.0.0", "virtualbox", "sha1", "0xDECAFBAD"); err != nil {
+		t.Fatalf("Error adding box: %v", err)
+	}
+
+	for _, check := range []struct {
+		key      string
+		expected map[string]string
+	}{
+		{"catalog.json", map[string]string{
+			"Cache-Control":                "max-age=60",
+			"Content-Type":                 "application/json",
+			"X-Amz-Server-Side-Encryption": "",
+			"X-Amz-Storage-Class":          "",
+		}},
+		{"OptionsBox/OptionsBox_1.0.0_virtualbox.box", map[string]string{
+			"Cache-Control":                               "max-age=31536000, immutable",
+			"X-Amz-Server-Side-Encryption":                "aws:kms",
+			"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": "test-key",
+			"X-Amz-Storage-Class":                         "STANDARD_IA",
+			"X-Amz-Acl":                                   "bucket-owner-full-control",
+		}},
+	} {
+		object, exists := server.Objects[check.key]
+		if !exists {
+			t.Fatalf("Expected an object at '%v' on the fake S3 server", check.key)
+		}
+		for name, value := range check.expected {
+			if actual := object.Header.Get(name); actual != value {
+				t.Fatalf("Expected the %v header of '%v' to be '%v', but got '%v'", name, check.key, value, actual)
+			}
+		}
+	}
+
+	for _, invalidQuery := range []string{"box_storage_class=CHEAP", "catalog_sse=rot13", "box_acl=everyone", "catalog_sse=AES256&catalog_sse_kms_key_id=test-key"} {
+		var invalid CaryatidBackend = &CaryatidS3Backend{}
+		if err = invalid.SetManager(&BackendManager{CatalogUri: "s3://test-bucket/catalog.json?" + invalidQuery}); err == nil {
+			t.Fatalf("Expected the invalid S3 settings '%v' to fail", invalidQuery)
+		}
+	}
+}
+
+func TestCaryatidS3BackendPresignedUrls(t *testing.T) {
+	defer setTestAwsEnvironment(t)()
+	server := newTestS3Server("test-bucket")
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "caryatid-s3-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	boxPath := filepath.Join(tempDir, "incoming.box")
+	if err = CreateTestBoxFile(boxPath, "virtualbox", true); err != nil {
+		t.Fatalf("Error creating test box file: %v", err)
+	}
+
+	catalogUri := fmt.Sprintf("s3://test-bucket/boxes/catalog.json?endpoint=%v&region=us-east-1&path_style=true&presign=1h", url.QueryEscape(server.URL))
+	var backend CaryatidBackend = &CaryatidS3Backend{}
+	manager := NewBackendManager(catalogUri, &backend)
+	if err = manager.AddBox(boxPath, "PresignBox", "PresignBox description", "1.0.0", "virtualbox", "sha1", "0xDECAFBAD"); err != nil {
+		t.Fatalf("Error adding box: %v", err)
+	}
+
+	catalog, err := manager.GetCatalog()
+	if err != nil {
+		t.Fatalf("Error getting catalog: %v", err)
+	}
+	refs := catalog.BoxReferences()
+	expectedPrefix := server.URL + "/test-bucket/boxes/PresignBox/PresignBox_1.0.0_virtualbox.box?"
+	if len(refs) != 1 || !strings.HasPrefix(refs[0].Uri, expectedPrefix) || !strings.Contains(refs[0].Uri, "X-Amz-Signature=") || !strings.Contains(refs[0].Uri, "X-Amz-Expires=3600") {
+		t.Fatalf("Expected a presigned URL starting with '%v', but catalog was:\n%v", expectedPrefix, catalog.DisplayString())
+	}
+
+	response, err := http.Get(refs[0].Uri)
+	if err != nil {
+		t.Fatalf("Error downloading the presigned URL: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Expected to download the box from the presigned URL, but got status %v", response.Status)
+	}
+
+	storageUri, err := manager.StorageUri(refs[0].Uri)
+	if expected := "s3://test-bucket/boxes/PresignBox/PresignBox_1.0.0_virtualbox.box"; err != nil || storageUri != expected {
+		t.Fatalf("Expected the presigned URL to map back to '%v', but got '%v' and error '%v'", expected, storageUri, err)
+	}
+
+	// Refreshing signs every URL again, even when they have not changed otherwise
+	time.Sleep(time.Second)
+	if refreshed, err := manager.RefreshUris(); err != nil || refreshed != 1 {
+		t.Fatalf("Expected 1 URL to be refreshed, but %v were and got error '%v'", refreshed, err)
+	}
+
+	if err = manager.DeleteBox(CatalogQueryParams{Version: "1.0.0"}); err != nil {
+		t.Fatalf("Error deleting box: %v", err)
+	}
+	if _, exists := server.Objects["boxes/PresignBox/PresignBox_1.0.0_virtualbox.box"]; exists {
+		t.Fatalf("Expected deleting the box to remove it from the fake S3 server")
+	}
+
+	for _, invalidPresign := range []string{"soon", "-1h", "720h"} {
+		var invalid CaryatidBackend = &CaryatidS3Backend{}
+		if err = invalid.SetManager(&BackendManager{CatalogUri: "s3://test-bucket/catalog.json?presign=" + invalidPresign}); err == nil {
+			t.Fatalf("Expected the invalid presign setting '%v' to fail", invalidPresign)
+		}
+	}
+}
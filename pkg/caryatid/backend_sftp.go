@@ -0,0 +1,423 @@
+/*
+The sftp backend, for dealing with a Vagrant catalog on a remote host reachable over SSH
+*/
+
+package caryatid
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/mrled/caryatid/internal/util"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+type CaryatidSftpBackend struct {
+	// Paths to private keys to authenticate with
+	// If empty, the default ~/.ssh/id_* keys are used if they exist
+	// Keys from a running ssh-agent (found via $SSH_AUTH_SOCK) are always tried first
+	IdentityFiles []string
+
+	// Path to a known_hosts file used to verify the server's host key
+	// If empty, ~/.ssh/known_hosts is used
+	KnownHostsPath string
+
+	// The "host:port" address of the SSH server
+	Address string
+
+	// The user to log in as
+	User string
+
+	VagrantCatalogRootPath string
+	VagrantCatalogPath     string
+	Manager                *BackendManager
+
+	sshClient  *ssh.Client
+	sftpClient *sftp.Client
+}
+
+func init() {
+	RegisterBackend("sftp", func() CaryatidBackend { return &CaryatidSftpBackend{} })
+}
+
+func (backend *CaryatidSftpBackend) SetManager(manager *BackendManager) (err error) {
+	var u *url.URL
+
+	backend.Manager = manager
+
+	if u, err = url.Parse(backend.Manager.CatalogUri); err != nil {
+		log.Printf("Error trying to parse sftp catalog URI: %v\n", err)
+		return
+	}
+	if u.Host == "" || u.Path == "" {
+		err = fmt.Errorf("Invalid sftp URI '%v'; expected a URI like sftp://user@host/path/to/catalog.json", backend.Manager.CatalogUri)
+		return
+	}
+
+	backend.Address = u.Host
+	if u.Port() == "" {
+		backend.Address = net.JoinHostPort(u.Hostname(), "22")
+	}
+
+	backend.User = u.User.Username()
+	if backend.User == "" {
+		var current *user.User
+		if current, err = user.Current(); err != nil {
+			log.Printf("Error trying to determine the current user: %v\n", err)
+			return
+		}
+		backend.User = current.Username
+	}
+
+	backend.VagrantCatalogPath = u.Path
+	backend.VagrantCatalogRootPath, _ = path.Split(backend.VagrantCatalogPath)
+
+	return
+}
+
+func (backend *CaryatidSftpBackend) GetManager() (manager *BackendManager, err error) {
+	manager = backend.Manager
+	if manager == nil {
+		err = fmt.Errorf("The Manager property was not set")
+	}
+	return
+}
+
+// Build the list of SSH authentication methods: keys from ssh-agent, then key files
+func (backend *CaryatidSftpBackend) authMethods() (methods []ssh.AuthMethod) {
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err != nil {
+			log.Printf("Could not connect to ssh-agent at '%v': %v\n", sock, err)
+		} else {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+
+	identityFiles := backend.IdentityFiles
+	if len(identityFiles) == 0 {
+		if home, err := util.HomeDir(); err == nil {
+			for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+				identityFiles = append(identityFiles, filepath.Join(home, ".ssh", name))
+			}
+		}
+	}
+
+	var signers []ssh.Signer
+	for _, keyPath := range identityFiles {
+		keyBytes, err := ioutil.ReadFile(keyPath)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			log.Printf("Could not read SSH key '%v': %v\n", keyPath, err)
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(keyBytes)
+		if err != nil {
+			log.Printf("Could not use SSH key '%v' (passphrase-protected keys must be loaded into ssh-agent): %v\n", keyPath, err)
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+
+	return
+}
+
+// Connect to the SSH server, unless we have already done so
+func (backend *CaryatidSftpBackend) connect() (err error) {
+	var hostKeyCallback ssh.HostKeyCallback
+
+	if backend.sftpClient != nil {
+		return
+	}
+
+	knownHostsPath := backend.KnownHostsPath
+	if knownHostsPath == "" {
+		var home string
+		if home, err = util.HomeDir(); err != nil {
+			return
+		}
+		knownHostsPath = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	if hostKeyCallback, err = knownhosts.New(knownHostsPath); err != nil {
+		err = fmt.Errorf("Could not read known hosts file '%v': %v", knownHostsPath, err)
+		return
+	}
+
+	config := &ssh.ClientConfig{
+		User:            backend.User,
+		Auth:            backend.authMethods(),
+		HostKeyCallback: hostKeyCallback,
+	}
+	if backend.sshClient, err = ssh.Dial("tcp", backend.Address, config); err != nil {
+		err = fmt.Errorf("Could not connect to '%v' as '%v': %v", backend.Address, backend.User, err)
+		return
+	}
+	if backend.sftpClient, err = sftp.NewClient(backend.sshClient); err != nil {
+		backend.sshClient.Close()
+		backend.sshClient = nil
+		err = fmt.Errorf("Could not start an sftp session on '%v': %v", backend.Address, err)
+		return
+	}
+
+	return
+}
+
+// Return the port of an sftp:// URI, which is 22 if it does not have one
+func sftpPort(u *url.URL) string {
+	if u.Port() == "" {
+		return "22"
+	}
+	return u.Port()
+}
+
+// Get the remote path from a URI, making sure it refers to the same server as the catalog
+func (backend *CaryatidSftpBackend) remotePath(uri string) (remotePath string, err error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", fmt.Errorf("Could not parse '%v' as URI: %v", uri, err)
+	}
+	if u.Scheme != backend.Scheme() {
+		return "", fmt.Errorf("Expected scheme '%v' but was given a URI with scheme '%v'", backend.Scheme(), u.Scheme)
+	}
+	catalogUri, _ := url.Parse(backend.Manager.CatalogUri)
+	if u.Hostname() != catalogUri.Hostname() || sftpPort(u) != sftpPort(catalogUri) {
+		return "", fmt.Errorf("URI '%v' is not on the same host as the catalog '%v'", uri, backend.Manager.CatalogUri)
+	}
+	if u.Path == "" {
+		return "", fmt.Errorf("No valid path information was provided in the URI '%v'", uri)
+	}
+	remotePath = u.Path
+	return
+}
+
+func (backend *CaryatidSftpBackend) GetCatalogBytes() (catalogBytes []byte, err error) {
+	var file *sftp.File
+
+	if err = backend.connect(); err != nil {
+		return
+	}
+
+	file, err = backend.sftpClient.Open(backend.VagrantCatalogPath)
+	if os.IsNotExist(err) {
+		log.Printf("No file at '%v'; starting with empty catalog\n", backend.Manager.CatalogUri)
+		return []byte("{}"), nil
+	} else if err != nil {
+		log.Printf("Error trying to open catalog: %v\n", err)
+		return
+	}
+	defer file.Close()
+
+	if catalogBytes, err = ioutil.ReadAll(file); err != nil {
+		log.Printf("Error trying to read catalog: %v\n", err)
+	}
+	return
+}
+
+func (backend *CaryatidSftpBackend) SetCatalogBytes(serializedCatalog []byte) (err error) {
+	var file *sftp.File
+
+	if err = backend.connect(); err != nil {
+		return
+	}
+
+	if err = backend.sftpClient.MkdirAll(backend.VagrantCatalogRootPath); err != nil {
+		log.Printf("Error trying to create the catalog root path at '%v': %v\n", backend.VagrantCatalogRootPath, err)
+		return
+	}
+
+	if file, err = backend.sftpClient.Create(backend.VagrantCatalogPath); err != nil {
+		log.Println("Error trying to create catalog: ", err)
+		return
+	}
+
+	// Write errors may only show up when the file is closed, so a failed Close() means the catalog was not saved
+	if _, err = file.Write(serializedCatalog); err != nil {
+		file.Close()
+		log.Println("Error trying to write catalog: ", err)
+		return
+	}
+	if err = file.Close(); err != nil {
+		log.Println("Error trying to write catalog: ", err)
+		return
+	}
+	log.Printf("Catalog updated on '%v' to reflect new value\n", backend.Address)
+	return
+}
+
+func (backend *CaryatidSftpBackend) CopyBoxFile(localPath string, boxName string, boxVersion string, boxProvider string) (err error) {
+	var boxUri string
+
+	if boxUri, err = BoxUriFromCatalogUri(backend.Manager.CatalogUri, boxName, boxVersion, boxProvider); err != nil {
+		log.Printf("Error trying to determine box URI: %v\n", err)
+		return
+	}
+	return backend.UploadFile(localPath, boxUri)
+}
+
+func (backend *CaryatidSftpBackend) UploadFile(localPath string, uri string) (err error) {
+	var (
+		remotePath string
+		localFile  *os.File
+		remoteFile *sftp.File
+		written    int64
+	)
+
+	if err = backend.connect(); err != nil {
+		return
+	}
+	if remotePath, err = backend.remotePath(uri); err != nil {
+		return
+	}
+
+	remoteParentPath, _ := path.Split(remotePath)
+	if err = backend.sftpClient.MkdirAll(remoteParentPath); err != nil {
+		log.Println("Error trying to create the box directory: ", err)
+		return
+	}
+
+	if localFile, err = os.Open(localPath); err != nil {
+		return
+	}
+	defer localFile.Close()
+
+	if remoteFile, err = backend.sftpClient.Create(remotePath); err != nil {
+		log.Printf("Error trying to create remote box file '%v': %v\n", uri, err)
+		return
+	}
+
+	if written, err = io.Copy(remoteFile, localFile); err != nil {
+		remoteFile.Close()
+		log.Printf("Error trying to copy '%v' to '%v': %v\n", localPath, uri, err)
+		return
+	}
+	if err = remoteFile.Close(); err != nil {
+		log.Printf("Error trying to copy '%v' to '%v': %v\n", localPath, uri, err)
+		return
+	}
+	log.Printf("Copied %v bytes from original path at '%v' to new location at '%v'\n", written, localPath, uri)
+	return
+}
+
+func (backend *CaryatidSftpBackend) FileSize(uri string) (size int64, exists bool, err error) {
+	var (
+		remotePath string
+		info       os.FileInfo
+	)
+	if remotePath, err = backend.remotePath(uri); err != nil {
+		return
+	}
+	if err = backend.connect(); err != nil {
+		return
+	}
+	if info, err = backend.sftpClient.Stat(remotePath); os.IsNotExist(err) {
+		return 0, false, nil
+	} else if err != nil {
+		return
+	}
+	return info.Size(), true, nil
+}
+
+func (backend *CaryatidSftpBackend) DownloadFile(uri string, localPath string) (err error) {
+	var (
+		remotePath string
+		remoteFile *sftp.File
+		localFile  *os.File
+		written    int64
+	)
+
+	if remotePath, err = backend.remotePath(uri); err != nil {
+		return
+	}
+	if err = backend.connect(); err != nil {
+		return
+	}
+	if remoteFile, err = backend.sftpClient.Open(remotePath); err != nil {
+		return
+	}
+	defer remoteFile.Close()
+	if localFile, err = os.Create(localPath); err != nil {
+		return
+	}
+
+	if written, err = io.Copy(localFile, remoteFile); err != nil {
+		localFile.Close()
+		log.Printf("Error trying to copy '%v' to '%v': %v\n", uri, localPath, err)
+		return
+	}
+	if err = localFile.Close(); err != nil {
+		log.Printf("Error trying to copy '%v' to '%v': %v\n", uri, localPath, err)
+		return
+	}
+	log.Printf("Copied %v bytes from '%v' to local path at '%v'\n", written, uri, localPath)
+	return
+}
+
+func (backend *CaryatidSftpBackend) ListFiles(dirUri string) (files []BackendFile, err error) {
+	var dirPath string
+	if dirPath, err = backend.remotePath(dirUri); err != nil {
+		return
+	}
+	if err = backend.connect(); err != nil {
+		return
+	}
+	walker := backend.sftpClient.Walk(dirPath)
+	for walker.Step() {
+		if walkErr := walker.Err(); os.IsNotExist(walkErr) && walker.Path() == dirPath {
+			return nil, nil
+		} else if walkErr != nil {
+			return nil, walkErr
+		} else if walker.Stat().IsDir() {
+			continue
+		}
+		relPath := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), dirPath), "/")
+		files = append(files, BackendFile{Uri: strings.TrimSuffix(dirUri, "/") + "/" + relPath, Size: walker.Stat().Size()})
+	}
+	return
+}
+
+// Move a file with the posix-rename sftp extension, which replaces any file already at the destination
+func (backend *CaryatidSftpBackend) MoveFile(fromUri string, toUri string) (err error) {
+	var fromPath, toPath string
+	if fromPath, err = backend.remotePath(fromUri); err != nil {
+		return
+	}
+	if toPath, err = backend.remotePath(toUri); err != nil {
+		return
+	}
+	if err = backend.connect(); err != nil {
+		return
+	}
+	return backend.sftpClient.PosixRename(fromPath, toPath)
+}
+
+func (backend *CaryatidSftpBackend) DeleteFile(uri string) (err error) {
+	var remotePath string
+
+	if remotePath, err = backend.remotePath(uri); err != nil {
+		return
+	}
+	if err = backend.connect(); err != nil {
+		return
+	}
+	err = backend.sftpClient.Remove(remotePath)
+	return
+}
+
+func (backend *CaryatidSftpBackend) Scheme() string {
+	return "sftp"
+}
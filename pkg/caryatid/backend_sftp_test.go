@@ -0,0 +1,205 @@
+package caryatid
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSftpServer is an in-process SSH server that serves the local filesystem over sftp
+type testSftpServer struct {
+	Listener       net.Listener
+	KnownHostsPath string
+	IdentityPath   string
+}
+
+func newTestSftpServer(tempDir string) (server *testSftpServer, err error) {
+	_, hostPrivKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostPrivKey)
+	if err != nil {
+		return
+	}
+	_, clientPrivKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return
+	}
+	clientSigner, err := ssh.NewSignerFromKey(clientPrivKey)
+	if err != nil {
+		return
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), clientSigner.PublicKey().Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("Unknown public key for user '%v'", conn.User())
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	server = &testSftpServer{
+		KnownHostsPath: filepath.Join(tempDir, "known_hosts"),
+		IdentityPath:   filepath.Join(tempDir, "id_ed25519"),
+	}
+
+	pemBlock, err := ssh.MarshalPrivateKey(clientPrivKey, "")
+	if err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(server.IdentityPath, pem.EncodeToMemory(pemBlock), 0600); err != nil {
+		return
+	}
+
+	if server.Listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		return
+	}
+	knownHostsLine := knownhosts.Line([]string{knownhosts.Normalize(server.Listener.Addr().String())}, hostSigner.PublicKey())
+	if err = ioutil.WriteFile(server.KnownHostsPath, []byte(knownHostsLine+"\n"), 0600); err != nil {
+		return
+	}
+
+	go func() {
+		for {
+			conn, err := server.Listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn, config)
+		}
+	}()
+
+	return
+}
+
+func (server *testSftpServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func(in <-chan *ssh.Request) {
+			for req := range in {
+				req.Reply(req.Type == "subsystem" && string(req.Payload[4:]) == "sftp", nil)
+			}
+		}(requests)
+
+		sftpServer, err := sftp.NewServer(channel)
+		if err != nil {
+			return
+		}
+		go func() {
+			sftpServer.Serve()
+			sftpServer.Close()
+		}()
+	}
+}
+
+func TestCaryatidSftpBackend_ImplementsCaryatidBackend(t *testing.T) {
+	var _ CaryatidBackend = new(CaryatidSftpBackend)
+}
+
+func TestCaryatidSftpBackend(t *testing.T) {
+	var (
+		err          error
+		catalogBytes []byte
+		boxName      = "TestSftpBox"
+		testCatalog  = []byte(`{"name":"TestSftpBox"}`)
+	)
+
+	tempDir, err := ioutil.TempDir("", "caryatid-sftp-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	sshAuthSock := os.Getenv("SSH_AUTH_SOCK")
+	os.Unsetenv("SSH_AUTH_SOCK")
+	defer os.Setenv("SSH_AUTH_SOCK", sshAuthSock)
+
+	server, err := newTestSftpServer(tempDir)
+	if err != nil {
+		t.Fatalf("Error starting test sftp server: %v", err)
+	}
+	defer server.Listener.Close()
+
+	catalogPath := filepath.ToSlash(filepath.Join(tempDir, "catalog", fmt.Sprintf("%v.json", boxName)))
+	catalogUri := fmt.Sprintf("sftp://tester@%v%v", server.Listener.Addr().String(), catalogPath)
+
+	sftpBackend := &CaryatidSftpBackend{
+		IdentityFiles:  []string{server.IdentityPath},
+		KnownHostsPath: server.KnownHostsPath,
+	}
+	var backend CaryatidBackend = sftpBackend
+	NewBackendManager(catalogUri, &backend)
+
+	if catalogBytes, err = backend.GetCatalogBytes(); err != nil {
+		t.Fatalf("Error getting nonexistent catalog: %v", err)
+	} else if string(catalogBytes) != "{}" {
+		t.Fatalf("Expected an empty catalog but got '%v'", string(catalogBytes))
+	}
+
+	if err = backend.SetCatalogBytes(testCatalog); err != nil {
+		t.Fatalf("Error setting catalog: %v", err)
+	}
+	if catalogBytes, err = backend.GetCatalogBytes(); err != nil {
+		t.Fatalf("Error getting catalog: %v", err)
+	} else if !bytes.Equal(catalogBytes, testCatalog) {
+		t.Fatalf("Expected catalog '%v' but got '%v'", string(testCatalog), string(catalogBytes))
+	}
+
+	localBoxPath := filepath.Join(tempDir, "input.box")
+	if err = CreateTestBoxFile(localBoxPath, "TestProvider", true); err != nil {
+		t.Fatalf("Error creating test box file: %v", err)
+	}
+	if err = backend.CopyBoxFile(localBoxPath, boxName, "1.0.0", "TestProvider"); err != nil {
+		t.Fatalf("Error copying box file: %v", err)
+	}
+	boxUri, err := BoxUriFromCatalogUri(catalogUri, boxName, "1.0.0", "TestProvider")
+	if err != nil {
+		t.Fatalf("Error getting box URI: %v", err)
+	}
+	remoteBoxPath := filepath.Join(tempDir, "catalog", boxName, fmt.Sprintf("%v_1.0.0_TestProvider.box", boxName))
+	if _, err = os.Stat(remoteBoxPath); err != nil {
+		t.Fatalf("Box file was not copied to '%v': %v", remoteBoxPath, err)
+	}
+
+	if err = backend.DeleteFile(boxUri); err != nil {
+		t.Fatalf("Error deleting box file: %v", err)
+	}
+	if _, err = os.Stat(remoteBoxPath); !os.IsNotExist(err) {
+		t.Fatalf("Box file at '%v' was not deleted", remoteBoxPath)
+	}
+
+	if err = backend.DeleteFile("file:///etc/passwd"); err == nil {
+		t.Fatalf("Deleting a file with the wrong scheme should have failed")
+	}
+	otherPortUri := fmt.Sprintf("sftp://tester@%v:1%v", server.Listener.Addr().(*net.TCPAddr).IP, catalogPath)
+	if err = backend.DeleteFile(otherPortUri); err == nil {
+		t.Fatalf("Deleting a file on another port of the same host should have failed")
+	}
+}
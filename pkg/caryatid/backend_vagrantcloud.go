@@ -0,0 +1,516 @@
+/*
+The Vagrant Cloud backend, for publishing boxes to Vagrant Cloud (HCP Vagrant) through its API
+
+Catalog URIs look like vagrantcloud://username/boxname, for the box Vagrant calls username/boxname
+The catalog's name is the box name without the username, so that the same name works for a self-hosted catalog too
+
+Vagrant Cloud keeps its own catalog, so this backend translates between it and a Caryatid catalog:
+copying a box creates the box, its version, and its provider if they don't exist yet, and uploads the box file;
+saving the catalog sets the description and the checksums of providers, and releases their versions;
+versions that are not released are left out of the catalog, so that saving it never releases a version someone else is still preparing;
+deleting a box deletes its provider, and its version once that has no providers left
+
+Requires an API token in the VAGRANT_CLOUD_TOKEN environment variable, like the vagrant cloud command
+Set server in the query to use another server with the same API, like vagrantcloud://username/boxname?server=https://vagrant.example.com
+*/
+
+package caryatid
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The Vagrant Cloud server, which serves both the API and box downloads
+const DefaultVagrantCloudServer = "https://vagrantcloud.com"
+
+// A box as the Vagrant Cloud API describes it
+type vagrantCloudBox struct {
+	Username         string                `json:"username"`
+	Name             string                `json:"name"`
+	ShortDescription string                `json:"short_description"`
+	Versions         []vagrantCloudVersion `json:"versions"`
+}
+
+type vagrantCloudVersion struct {
+	Version   string                 `json:"version"`
+	Status    string                 `json:"status"`
+	Providers []vagrantCloudProvider `json:"providers"`
+}
+
+type vagrantCloudProvider struct {
+	Name         string `json:"name"`
+	ChecksumType string `json:"checksum_type"`
+	Checksum     string `json:"checksum"`
+}
+
+type CaryatidVagrantCloudBackend struct {
+	// The API token; taken from the VAGRANT_CLOUD_TOKEN environment variable if not set
+	Token string
+
+	// The server to use instead of DefaultVagrantCloudServer, from the server query parameter
+	Server string
+
+	// Whether to make new boxes private, from the private query parameter
+	Private bool
+
+	// The HTTP client to make requests with; http.DefaultClient if nil
+	HttpClient *http.Client
+
+	Manager *BackendManager
+
+	username string
+	boxName  string
+}
+
+func init() {
+	RegisterBackend("vagrantcloud", func() CaryatidBackend { return &CaryatidVagrantCloudBackend{} })
+}
+
+func (backend *CaryatidVagrantCloudBackend) SetManager(manager *BackendManager) (err error) {
+	var u *url.URL
+
+	backend.Manager = manager
+
+	if u, err = url.Parse(backend.Manager.CatalogUri); err != nil {
+		log.Printf("Error trying to parse Vagrant Cloud catalog URI: %v\n", err)
+		return
+	}
+	backend.username = u.Host
+	backend.boxName = strings.Trim(u.Path, "/")
+	if u.Scheme != "vagrantcloud" || backend.username == "" || backend.boxName == "" || strings.Contains(backend.boxName, "/") {
+		err = fmt.Errorf("Invalid Vagrant Cloud URI '%v'; expected a URI like vagrantcloud://username/boxname", backend.Manager.CatalogUri)
+		return
+	}
+
+	query := u.Query()
+	if backend.Server == "" {
+		backend.Server = query.Get("server")
+	}
+	if backend.Server == "" {
+		backend.Server = DefaultVagrantCloudServer
+	}
+	backend.Server = strings.TrimSuffix(backend.Server, "/")
+	if private := query.Get("private"); private != "" {
+		if backend.Private, err = strconv.ParseBool(private); err != nil {
+			err = fmt.Errorf("Invalid value '%v' for private in '%v': %v", private, backend.Manager.CatalogUri, err)
+			return
+		}
+	}
+	if backend.Token == "" {
+		backend.Token = os.Getenv("VAGRANT_CLOUD_TOKEN")
+	}
+	if backend.HttpClient == nil {
+		backend.HttpClient = http.DefaultClient
+	}
+
+	return
+}
+
+func (backend *CaryatidVagrantCloudBackend) GetManager() (manager *BackendManager, err error) {
+	manager = backend.Manager
+	if manager == nil {
+		err = fmt.Errorf("The Manager property was not set")
+	}
+	return
+}
+
+// Return the URL of an API endpoint for the box, like box/username/boxname/versions
+func (backend *CaryatidVagrantCloudBackend) apiUrl(endpoint ...string) string {
+	return fmt.Sprintf("%v/api/v1/%v", backend.Server, strings.Join(endpoint, "/"))
+}
+
+// Return the API path of the box, or of one of its versions or providers
+func (backend *CaryatidVagrantCloudBackend) boxPath(versionProvider ...string) string {
+	boxPath := fmt.Sprintf("box/%v/%v", backend.username, backend.boxName)
+	if len(versionProvider) > 0 {
+		boxPath += "/version/" + url.PathEscape(versionProvider[0])
+	}
+	if len(versionProvider) > 1 {
+		boxPath += "/provider/" + url.PathEscape(versionProvider[1])
+	}
+	return boxPath
+}
+
+// Make an API request with a JSON body, decoding a JSON response into result if it is not nil
+// Returns whether the API found what the request was for
+func (backend *CaryatidVagrantCloudBackend) call(method string, apiUrl string, body interface{}, result interface{}) (found bool, err error) {
+	var (
+		req      *http.Request
+		resp     *http.Response
+		reqBody  io.Reader
+		jsonBody []byte
+	)
+
+	if backend.Token == "" {
+		return false, fmt.Errorf("No Vagrant Cloud token; set the VAGRANT_CLOUD_TOKEN environment variable")
+	}
+	if body != nil {
+		if jsonBody, err = json.Marshal(body); err != nil {
+			return
+		}
+		reqBody = bytes.NewReader(jsonBody)
+	}
+	if req, err = http.NewRequest(method, apiUrl, reqBody); err != nil {
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+backend.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if resp, err = backend.HttpClient.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	} else if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		err = fmt.Errorf("%v '%v' failed with status '%v': %v", method, apiUrl, resp.Status, strings.TrimSpace(string(message)))
+		return
+	}
+	if result != nil {
+		if err = json.NewDecoder(resp.Body).Decode(result); err != nil {
+			return
+		}
+	}
+	return true, nil
+}
+
+// Make an API request for something that must exist
+func (backend *CaryatidVagrantCloudBackend) callExpect(method string, apiUrl string, body interface{}, result interface{}) (err error) {
+	found, err := backend.call(method, apiUrl, body, result)
+	if err == nil && !found {
+		err = fmt.Errorf("%v '%v' failed: not found", method, apiUrl)
+	}
+	return
+}
+
+// Get the box from the API, or nil if it does not exist
+func (backend *CaryatidVagrantCloudBackend) getBox() (box *vagrantCloudBox, err error) {
+	box = &vagrantCloudBox{}
+	found, err := backend.call("GET", backend.apiUrl(backend.boxPath()), nil, box)
+	if err != nil || !found {
+		box = nil
+	}
+	return
+}
+
+// Create the box unless it exists already, and return it
+func (backend *CaryatidVagrantCloudBackend) ensureBox(description string) (box *vagrantCloudBox, err error) {
+	if box, err = backend.getBox(); err != nil || box != nil {
+		return
+	}
+	box = &vagrantCloudBox{}
+	err = backend.callExpect("POST", backend.apiUrl("boxes"), map[string]interface{}{
+		"box": map[string]interface{}{
+			"username":          backend.username,
+			"name":              backend.boxName,
+			"short_description": description,
+			"is_private":        backend.Private,
+		},
+	}, box)
+	if err == nil {
+		log.Printf("Created box '%v/%v' on '%v'\n", backend.username, backend.boxName, backend.Server)
+	}
+	return
+}
+
+// Return a version of the box from the API, or nil if it does not exist
+func (box *vagrantCloudBox) version(version string) *vagrantCloudVersion {
+	for idx := range box.Versions {
+		if box.Versions[idx].Version == version {
+			return &box.Versions[idx]
+		}
+	}
+	return nil
+}
+
+// Return a provider of a version from the API, or nil if it does not exist
+func (version *vagrantCloudVersion) provider(name string) *vagrantCloudProvider {
+	for idx := range version.Providers {
+		if version.Providers[idx].Name == name {
+			return &version.Providers[idx]
+		}
+	}
+	return nil
+}
+
+// Return the version and provider of a box stored at a URI given by DefaultBoxPathTemplate
+func (backend *CaryatidVagrantCloudBackend) parseBoxUri(uri string) (version string, provider string, err error) {
+	var (
+		u    *url.URL
+		name string
+	)
+	if u, err = url.Parse(uri); err != nil {
+		return
+	}
+	if u.Scheme != "vagrantcloud" || u.Host != backend.username {
+		err = fmt.Errorf("URI '%v' is not a box of '%v' on Vagrant Cloud", uri, backend.username)
+		return
+	}
+	if name, version, provider, err = parseDefaultBoxPath(u.Path); err != nil {
+		err = fmt.Errorf("The Vagrant Cloud backend can only store boxes at the default path: %v", err)
+	} else if name != backend.boxName {
+		err = fmt.Errorf("URI '%v' is not a box of '%v/%v'", uri, backend.username, backend.boxName)
+	}
+	return
+}
+
+func (backend *CaryatidVagrantCloudBackend) GetCatalogBytes() (catalogBytes []byte, err error) {
+	var (
+		box        *vagrantCloudBox
+		storageUri string
+		boxUri     string
+	)
+
+	if box, err = backend.getBox(); err != nil {
+		log.Printf("Error trying to get box from Vagrant Cloud: %v\n", err)
+		return
+	} else if box == nil {
+		log.Printf("No box '%v/%v' on '%v'; starting with empty catalog\n", backend.username, backend.boxName, backend.Server)
+		return []byte("{}"), nil
+	}
+
+	catalog := Catalog{Name: backend.boxName, Description: box.ShortDescription}
+	for _, cloudVersion := range box.Versions {
+		// Vagrant clients can't see unreleased versions, and leaving them out keeps SetCatalogBytes from releasing them
+		if cloudVersion.Status != "active" {
+			continue
+		}
+		version := Version{Version: cloudVersion.Version}
+		for _, cloudProvider := range cloudVersion.Providers {
+			if storageUri, err = BoxUriFromCatalogUri(backend.Manager.CatalogUri, backend.boxName, cloudVersion.Version, cloudProvider.Name); err != nil {
+				return
+			}
+			if boxUri, err = backend.FrontendUri(storageUri); err != nil {
+				return
+			}
+			version.Providers = append(version.Providers, Provider{cloudProvider.Name, boxUri, cloudProvider.ChecksumType, cloudProvider.Checksum})
+		}
+		// A version whose providers were all deleted is not a version Vagrant can use
+		if len(version.Providers) > 0 {
+			catalog.Versions = append(catalog.Versions, version)
+		}
+	}
+	return json.Marshal(catalog)
+}
+
+// SetCatalogBytes brings the box on Vagrant Cloud up to date with the catalog
+// Every box in the catalog must have been copied with CopyBoxFile first;
+// boxes on Vagrant Cloud that are not in the catalog are left for DeleteFile
+func (backend *CaryatidVagrantCloudBackend) SetCatalogBytes(serializedCatalog []byte) (err error) {
+	var (
+		catalog Catalog
+		box     *vagrantCloudBox
+	)
+
+	if err = json.Unmarshal(serializedCatalog, &catalog); err != nil {
+		return
+	}
+	if catalog.Name != "" && catalog.Name != backend.boxName {
+		return fmt.Errorf("Catalog name '%v' does not match the Vagrant Cloud box '%v/%v'", catalog.Name, backend.username, backend.boxName)
+	}
+	if box, err = backend.ensureBox(catalog.Description); err != nil {
+		return
+	}
+
+	if box.ShortDescription != catalog.Description {
+		err = backend.callExpect("PUT", backend.apiUrl(backend.boxPath()), map[string]interface{}{
+			"box": map[string]interface{}{"short_description": catalog.Description},
+		}, nil)
+		if err != nil {
+			return
+		}
+	}
+
+	for _, version := range catalog.Versions {
+		cloudVersion := box.version(version.Version)
+		if cloudVersion == nil {
+			return fmt.Errorf("Version '%v' of '%v/%v' has not been uploaded to Vagrant Cloud", version.Version, backend.username, backend.boxName)
+		}
+		for _, provider := range version.Providers {
+			cloudProvider := cloudVersion.provider(provider.Name)
+			if cloudProvider == nil {
+				return fmt.Errorf("Provider '%v' of version '%v' of '%v/%v' has not been uploaded to Vagrant Cloud", provider.Name, version.Version, backend.username, backend.boxName)
+			}
+			if cloudProvider.ChecksumType != provider.ChecksumType || cloudProvider.Checksum != provider.Checksum {
+				err = backend.callExpect("PUT", backend.apiUrl(backend.boxPath(version.Version, provider.Name)), map[string]interface{}{
+					"provider": map[string]interface{}{"checksum_type": provider.ChecksumType, "checksum": provider.Checksum},
+				}, nil)
+				if err != nil {
+					return
+				}
+			}
+		}
+		if cloudVersion.Status != "active" {
+			if err = backend.callExpect("PUT", backend.apiUrl(backend.boxPath(version.Version), "release"), nil, nil); err != nil {
+				return
+			}
+			log.Printf("Released version '%v' of '%v/%v'\n", version.Version, backend.username, backend.boxName)
+		}
+	}
+	return
+}
+
+// CopyBoxFile creates the box, version, and provider on Vagrant Cloud as necessary, and uploads the box file
+// The version is not released until the catalog is saved
+func (backend *CaryatidVagrantCloudBackend) CopyBoxFile(localPath string, boxName string, boxVersion string, boxProvider string) (err error) {
+	var (
+		box       *vagrantCloudBox
+		localFile *os.File
+		fileInfo  os.FileInfo
+		req       *http.Request
+		resp      *http.Response
+		upload    struct {
+			UploadPath string `json:"upload_path"`
+		}
+	)
+
+	if boxName != backend.boxName {
+		return fmt.Errorf("Box name '%v' does not match the Vagrant Cloud box '%v/%v'", boxName, backend.username, backend.boxName)
+	}
+	if box, err = backend.ensureBox(""); err != nil {
+		return
+	}
+	cloudVersion := box.version(boxVersion)
+	if cloudVersion == nil {
+		err = backend.callExpect("POST", backend.apiUrl(backend.boxPath(), "versions"), map[string]interface{}{
+			"version": map[string]interface{}{"version": boxVersion},
+		}, nil)
+		if err != nil {
+			return
+		}
+		cloudVersion = &vagrantCloudVersion{Version: boxVersion}
+	}
+	if cloudVersion.provider(boxProvider) == nil {
+		err = backend.callExpect("POST", backend.apiUrl(backend.boxPath(boxVersion), "providers"), map[string]interface{}{
+			"provider": map[string]interface{}{"name": boxProvider},
+		}, nil)
+		if err != nil {
+			return
+		}
+	}
+
+	if err = backend.callExpect("GET", backend.apiUrl(backend.boxPath(boxVersion, boxProvider), "upload"), nil, &upload); err != nil {
+		return
+	}
+	if localFile, err = os.Open(localPath); err != nil {
+		return
+	}
+	defer localFile.Close()
+	if fileInfo, err = localFile.Stat(); err != nil {
+		return
+	}
+	// The upload path is a presigned URL, so it takes no token
+	if req, err = http.NewRequest("PUT", upload.UploadPath, localFile); err != nil {
+		return
+	}
+	req.ContentLength = fileInfo.Size()
+	if resp, err = backend.HttpClient.Do(req); err != nil {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Uploading '%v' to Vagrant Cloud failed with status '%v'", localPath, resp.Status)
+	}
+	log.Printf("Uploaded %v bytes from original path at '%v' to version '%v' provider '%v' of '%v/%v'\n", fileInfo.Size(), localPath, boxVersion, boxProvider, backend.username, backend.boxName)
+	return
+}
+
+// DeleteFile deletes the provider of a box, and its version too if that has no other providers
+func (backend *CaryatidVagrantCloudBackend) DeleteFile(uri string) (err error) {
+	var (
+		version, provider string
+		box               *vagrantCloudBox
+	)
+
+	if version, provider, err = backend.parseBoxUri(uri); err != nil {
+		return
+	}
+	if _, err = backend.call("DELETE", backend.apiUrl(backend.boxPath(version, provider)), nil, nil); err != nil {
+		return
+	}
+	if box, err = backend.getBox(); err != nil || box == nil {
+		return
+	}
+	if cloudVersion := box.version(version); cloudVersion != nil && len(cloudVersion.Providers) == 0 {
+		_, err = backend.call("DELETE", backend.apiUrl(backend.boxPath(version)), nil, nil)
+		log.Printf("Deleted version '%v' of '%v/%v', which has no providers left\n", version, backend.username, backend.boxName)
+	}
+	return
+}
+
+func (backend *CaryatidVagrantCloudBackend) DownloadFile(uri string, localPath string) (err error) {
+	var (
+		downloadUrl string
+		req         *http.Request
+		resp        *http.Response
+		file        *os.File
+	)
+
+	if downloadUrl, err = backend.FrontendUri(uri); err != nil {
+		return
+	}
+	if req, err = http.NewRequest("GET", downloadUrl, nil); err != nil {
+		return
+	}
+	// With the token, versions that are not released yet and private boxes can be downloaded too
+	// The token is not sent on when the server redirects to where the box is stored
+	if backend.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+backend.Token)
+	}
+	if resp, err = backend.HttpClient.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("GET '%v' failed with status '%v'", downloadUrl, resp.Status)
+	}
+
+	if file, err = os.Create(localPath); err != nil {
+		return
+	}
+	if _, err = io.Copy(file, resp.Body); err != nil {
+		file.Close()
+		os.Remove(localPath)
+		return
+	}
+	return file.Close()
+}
+
+// FrontendUri returns the URL Vagrant downloads a box from, like https://vagrantcloud.com/username/boxes/boxname/versions/1.0.0/providers/virtualbox.box
+func (backend *CaryatidVagrantCloudBackend) FrontendUri(storageUri string) (frontendUri string, err error) {
+	version, provider, err := backend.parseBoxUri(storageUri)
+	if err != nil {
+		return
+	}
+	frontendUri = fmt.Sprintf("%v/%v/boxes/%v/versions/%v/providers/%v.box", backend.Server, backend.username, backend.boxName, url.PathEscape(version), url.PathEscape(provider))
+	return
+}
+
+// StorageUri converts a download URL from the catalog back to a vagrantcloud:// URI
+func (backend *CaryatidVagrantCloudBackend) StorageUri(frontendUri string) (storageUri string, err error) {
+	prefix := fmt.Sprintf("%v/%v/boxes/%v/versions/", backend.Server, backend.username, backend.boxName)
+	versionProvider := strings.Split(strings.TrimSuffix(strings.TrimPrefix(frontendUri, prefix), ".box"), "/providers/")
+	if !strings.HasPrefix(frontendUri, prefix) || len(versionProvider) != 2 {
+		return frontendUri, nil
+	}
+	version, _ := url.PathUnescape(versionProvider[0])
+	provider, _ := url.PathUnescape(versionProvider[1])
+	return BoxUriFromCatalogUri(backend.Manager.CatalogUri, backend.boxName, version, provider)
+}
+
+func (backend *CaryatidVagrantCloudBackend) Scheme() string {
+	return "vagrantcloud"
+}
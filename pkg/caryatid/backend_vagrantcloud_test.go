@@ -0,0 +1,265 @@
+package caryatid
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A fake of the parts of the Vagrant Cloud API that the backend uses, for a single user's boxes
+type testVagrantCloud struct {
+	lock    sync.Mutex
+	boxes   map[string]*vagrantCloudBox
+	uploads map[string][]byte
+	server  *httptest.Server
+}
+
+func newTestVagrantCloud() (cloud *testVagrantCloud) {
+	cloud = &testVagrantCloud{boxes: map[string]*vagrantCloudBox{}, uploads: map[string][]byte{}}
+	cloud.server = httptest.NewServer(cloud)
+	return
+}
+
+func (cloud *testVagrantCloud) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cloud.lock.Lock()
+	defer cloud.lock.Unlock()
+
+	// Uploads and downloads, which take no token
+	if strings.HasPrefix(r.URL.Path, "/upload/") && r.Method == "PUT" {
+		data, _ := ioutil.ReadAll(r.Body)
+		cloud.uploads[strings.TrimPrefix(r.URL.Path, "/upload/")] = data
+		return
+	}
+	if data, ok := cloud.uploads[strings.TrimPrefix(r.URL.Path, "/")]; ok && r.Method == "GET" {
+		w.Write(data)
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer cloudtoken" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var request struct {
+		Box      map[string]interface{} `json:"box"`
+		Version  map[string]interface{} `json:"version"`
+		Provider map[string]interface{} `json:"provider"`
+	}
+	json.NewDecoder(r.Body).Decode(&request)
+
+	segments := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/"), "/")
+	if len(segments) == 1 && segments[0] == "boxes" && r.Method == "POST" {
+		tag := fmt.Sprintf("%v/%v", request.Box["username"], request.Box["name"])
+		cloud.boxes[tag] = &vagrantCloudBox{Username: request.Box["username"].(string), Name: request.Box["name"].(string), ShortDescription: request.Box["short_description"].(string)}
+		json.NewEncoder(w).Encode(cloud.boxes[tag])
+		return
+	}
+	if len(segments) < 3 || segments[0] != "box" || cloud.boxes[segments[1]+"/"+segments[2]] == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	box := cloud.boxes[segments[1]+"/"+segments[2]]
+	segments = segments[3:]
+
+	var version *vagrantCloudVersion
+	if len(segments) >= 2 && segments[0] == "version" {
+		if version = box.version(segments[1]); version == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+	var provider *vagrantCloudProvider
+	if len(segments) >= 4 && segments[2] == "provider" {
+		if provider = version.provider(segments[3]); provider == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+	endpoint := fmt.Sprintf("%v %v", r.Method, strings.Join(segments, "/"))
+
+	switch {
+	case endpoint == "GET ":
+		json.NewEncoder(w).Encode(box)
+	case endpoint == "PUT ":
+		box.ShortDescription = request.Box["short_description"].(string)
+	case endpoint == "POST versions":
+		box.Versions = append(box.Versions, vagrantCloudVersion{Version: request.Version["version"].(string), Status: "unreleased"})
+	case r.Method == "POST" && len(segments) == 3 && segments[2] == "providers":
+		version.Providers = append(version.Providers, vagrantCloudProvider{Name: request.Provider["name"].(string)})
+	case r.Method == "PUT" && len(segments) == 3 && segments[2] == "release":
+		version.Status = "active"
+	case r.Method == "DELETE" && len(segments) == 2:
+		var versions []vagrantCloudVersion
+		for _, v := range box.Versions {
+			if v.Version != version.Version {
+				versions = append(versions, v)
+			}
+		}
+		box.Versions = versions
+	case r.Method == "PUT" && len(segments) == 4:
+		provider.ChecksumType = request.Provider["checksum_type"].(string)
+		provider.Checksum = request.Provider["checksum"].(string)
+	case r.Method == "DELETE" && len(segments) == 4:
+		var providers []vagrantCloudProvider
+		for _, p := range version.Providers {
+			if p.Name != provider.Name {
+				providers = append(providers, p)
+			}
+		}
+		version.Providers = providers
+	case r.Method == "GET" && len(segments) == 5 && segments[4] == "upload":
+		downloadPath := fmt.Sprintf("%v/boxes/%v/versions/%v/providers/%v.box", box.Username, box.Name, version.Version, provider.Name)
+		json.NewEncoder(w).Encode(map[string]string{"upload_path": cloud.server.URL + "/upload/" + downloadPath})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestCaryatidVagrantCloudBackend(t *testing.T) {
+	cloud := newTestVagrantCloud()
+	defer cloud.server.Close()
+
+	tempDir, err := ioutil.TempDir("", "caryatid-vagrantcloud-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	catalogUri := fmt.Sprintf("vagrantcloud://conformance/ConformanceBox?server=%v", cloud.server.URL)
+	if err = CheckBackendConformance(&CaryatidVagrantCloudBackend{Token: "cloudtoken"}, catalogUri, tempDir); err != nil {
+		t.Fatalf("Vagrant Cloud backend is not conformant: %v", err)
+	}
+}
+
+func TestCaryatidVagrantCloudBackendPublish(t *testing.T) {
+	cloud := newTestVagrantCloud()
+	defer cloud.server.Close()
+
+	tempDir, err := ioutil.TempDir("", "caryatid-vagrantcloud-publish-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var (
+		catalogUri                 = fmt.Sprintf("vagrantcloud://example/testbox?server=%v", cloud.server.URL)
+		boxPath                    = filepath.Join(tempDir, "test.box")
+		backend    CaryatidBackend = &CaryatidVagrantCloudBackend{Token: "cloudtoken"}
+		manager                    = NewBackendManager(catalogUri, &backend)
+	)
+	if err = CreateTestBoxFile(boxPath, "virtualbox", true); err != nil {
+		t.Fatalf("Error creating test box: %v", err)
+	}
+
+	var untokenedBackend CaryatidBackend = &CaryatidVagrantCloudBackend{}
+	os.Unsetenv("VAGRANT_CLOUD_TOKEN")
+	if err = NewBackendManager(catalogUri, &untokenedBackend).AddBox(boxPath, "testbox", "Test box", "1.0.0", "virtualbox", "sha1", "0xDECAFBAD"); err == nil || !strings.Contains(err.Error(), "VAGRANT_CLOUD_TOKEN") {
+		t.Fatalf("Expected publishing without a token to fail, but got error %v", err)
+	}
+
+	for _, provider := range []string{"virtualbox", "vmware_desktop"} {
+		if err = manager.AddBox(boxPath, "testbox", "Test box", "1.0.0", provider, "sha1", "0xDECAFBAD"); err != nil {
+			t.Fatalf("Error adding box for %v: %v", provider, err)
+		}
+	}
+	box := cloud.boxes["example/testbox"]
+	if box == nil || box.ShortDescription != "Test box" {
+		t.Fatalf("Expected box 'example/testbox' to be created, but found %v", cloud.boxes)
+	}
+	version := box.version("1.0.0")
+	if version == nil || version.Status != "active" || len(version.Providers) != 2 {
+		t.Fatalf("Expected version 1.0.0 to be released with two providers, but found %v", box.Versions)
+	}
+	if provider := version.provider("virtualbox"); provider.ChecksumType != "sha1" || provider.Checksum != "0xDECAFBAD" {
+		t.Fatalf("Expected the provider's checksum to be set, but found %v", provider)
+	}
+
+	// Vagrant downloads the box from the server, without the token
+	catalog, _ := manager.GetCatalog()
+	boxUrl := catalog.BoxReferences()[0].Uri
+	if expected := cloud.server.URL + "/example/boxes/testbox/versions/1.0.0/providers/virtualbox.box"; boxUrl != expected {
+		t.Fatalf("Expected the catalog to refer to '%v', but got '%v'", expected, boxUrl)
+	}
+	resp, err := http.Get(boxUrl)
+	if err != nil {
+		t.Fatalf("Error downloading box: %v", err)
+	}
+	downloaded, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if original, _ := ioutil.ReadFile(boxPath); string(downloaded) != string(original) {
+		t.Fatalf("Downloaded box from '%v' does not match the box that was added", boxUrl)
+	}
+
+	// Deleting one provider leaves the version, but deleting the last one deletes the version too
+	if err = manager.DeleteBox(CatalogQueryParams{Version: "1.0.0", Provider: "virtualbox"}); err != nil {
+		t.Fatalf("Error deleting provider: %v", err)
+	}
+	if version = box.version("1.0.0"); version == nil || len(version.Providers) != 1 {
+		t.Fatalf("Expected version 1.0.0 to keep one provider, but found %v", box.Versions)
+	}
+	if err = manager.DeleteBox(CatalogQueryParams{Version: "1.0.0"}); err != nil {
+		t.Fatalf("Error deleting version: %v", err)
+	}
+	if len(box.Versions) != 0 {
+		t.Fatalf("Expected version 1.0.0 to be deleted, but found %v", box.Versions)
+	}
+}
+
+func TestCaryatidVagrantCloudBackendUnreleasedVersions(t *testing.T) {
+	cloud := newTestVagrantCloud()
+	defer cloud.server.Close()
+
+	tempDir, err := ioutil.TempDir("", "caryatid-vagrantcloud-unreleased-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var (
+		catalogUri                 = fmt.Sprintf("vagrantcloud://example/testbox?server=%v", cloud.server.URL)
+		boxPath                    = filepath.Join(tempDir, "test.box")
+		backend    CaryatidBackend = &CaryatidVagrantCloudBackend{Token: "cloudtoken"}
+		manager                    = NewBackendManager(catalogUri, &backend)
+	)
+	if err = CreateTestBoxFile(boxPath, "virtualbox", true); err != nil {
+		t.Fatalf("Error creating test box: %v", err)
+	}
+
+	// Someone else is still preparing version 2.0.0 on Vagrant Cloud
+	cloud.boxes["example/testbox"] = &vagrantCloudBox{
+		Username:         "example",
+		Name:             "testbox",
+		ShortDescription: "Test box",
+		Versions: []vagrantCloudVersion{{
+			Version:   "2.0.0",
+			Status:    "unreleased",
+			Providers: []vagrantCloudProvider{{Name: "virtualbox", ChecksumType: "sha1", Checksum: "0xC0FFEE"}},
+		}},
+	}
+
+	catalog, err := manager.GetCatalog()
+	if err != nil {
+		t.Fatalf("Error getting catalog: %v", err)
+	}
+	if refs := catalog.BoxReferences(); len(refs) != 0 {
+		t.Fatalf("Expected the catalog to leave out the unreleased version, but got %v", refs)
+	}
+
+	if err = manager.AddBox(boxPath, "testbox", "Test box", "1.0.0", "virtualbox", "sha1", "0xDECAFBAD"); err != nil {
+		t.Fatalf("Error adding box: %v", err)
+	}
+	box := cloud.boxes["example/testbox"]
+	if version := box.version("1.0.0"); version == nil || version.Status != "active" {
+		t.Fatalf("Expected version 1.0.0 to be released, but found %v", box.Versions)
+	}
+	if version := box.version("2.0.0"); version == nil || version.Status != "unreleased" {
+		t.Fatalf("Expected adding version 1.0.0 to leave version 2.0.0 unreleased, but found %v", box.Versions)
+	}
+}
@@ -0,0 +1,198 @@
+package caryatid
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+func newTestWebDavServer(username string, password string) *httptest.Server {
+	davHandler := &webdav.Handler{
+		FileSystem: webdav.NewMemFS(),
+		LockSystem: webdav.NewMemLS(),
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != username || p != password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		davHandler.ServeHTTP(w, r)
+	}))
+}
+
+// Some servers answer HEAD requests without a Content-Length
+type testResponseWriterWithoutContentLength struct {
+	http.ResponseWriter
+}
+
+func (w testResponseWriterWithoutContentLength) WriteHeader(status int) {
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w testResponseWriterWithoutContentLength) Write(data []byte) (int, error) {
+	w.Header().Del("Content-Length")
+	return w.ResponseWriter.Write(data)
+}
+
+func TestCaryatidWebDavBackend_ImplementsCaryatidBackend(t *testing.T) {
+	var _ CaryatidBackend = new(CaryatidWebDavBackend)
+	var _ CaryatidFrontendBackend = new(CaryatidWebDavBackend)
+	var _ CaryatidStagingBackend = new(CaryatidWebDavBackend)
+}
+
+func TestCaryatidWebDavBackend(t *testing.T) {
+	var (
+		err     error
+		catalog Catalog
+		boxName = "TestDavBox"
+	)
+
+	server := newTestWebDavServer("tester", "secret")
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "caryatid-webdav-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	serverHost := strings.TrimPrefix(server.URL, "http://")
+	catalogUri := fmt.Sprintf("dav://tester:secret@%v/some/sub/path/%v.json", serverHost, boxName)
+	backend, err := NewBackendFromUri(catalogUri)
+	if err != nil {
+		t.Fatalf("Error getting backend: %v", err)
+	}
+	manager := NewBackendManager(catalogUri, &backend)
+
+	localBoxPath := filepath.Join(tempDir, "input.box")
+	if err = CreateTestBoxFile(localBoxPath, "TestProvider", true); err != nil {
+		t.Fatalf("Error creating test box file: %v", err)
+	}
+	if err = manager.AddBox(localBoxPath, boxName, "Test box", "1.0.0", "TestProvider", "sha1", "0xDECAFBAD"); err != nil {
+		t.Fatalf("Error adding box: %v", err)
+	}
+
+	if catalog, err = manager.GetCatalog(); err != nil {
+		t.Fatalf("Error getting catalog: %v", err)
+	}
+	expectedBoxUrl := fmt.Sprintf("%v/some/sub/path/%v/%v_1.0.0_TestProvider.box", server.URL, boxName, boxName)
+	refs := catalog.BoxReferences()
+	if len(refs) != 1 || refs[0].Uri != expectedBoxUrl {
+		t.Fatalf("Expected a single box at '%v' but catalog was:\n%v", expectedBoxUrl, catalog.DisplayString())
+	}
+
+	req, _ := http.NewRequest("GET", expectedBoxUrl, nil)
+	req.SetBasicAuth("tester", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Could not download box from '%v': %v %v", expectedBoxUrl, resp, err)
+	}
+	resp.Body.Close()
+
+	if err = manager.DeleteBox(CatalogQueryParams{Version: "1.0.0"}); err != nil {
+		t.Fatalf("Error deleting box: %v", err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected box at '%v' to be deleted: %v %v", expectedBoxUrl, resp, err)
+	}
+	resp.Body.Close()
+}
+
+func TestCaryatidWebDavBackendUnauthorized(t *testing.T) {
+	server := newTestWebDavServer("tester", "secret")
+	defer server.Close()
+
+	catalogUri := fmt.Sprintf("dav://tester:wrong@%v/catalog.json", strings.TrimPrefix(server.URL, "http://"))
+	var backend CaryatidBackend = &CaryatidWebDavBackend{}
+	NewBackendManager(catalogUri, &backend)
+
+	if _, err := backend.GetCatalogBytes(); err == nil {
+		t.Fatalf("Expected an error getting catalog with bad credentials")
+	}
+	if err := backend.SetCatalogBytes([]byte("{}")); err == nil {
+		t.Fatalf("Expected an error setting catalog with bad credentials")
+	}
+}
+
+func TestCaryatidWebDavBackendOtherHosts(t *testing.T) {
+	var sawCredentials bool
+	otherServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := r.BasicAuth(); ok {
+			sawCredentials = true
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer otherServer.Close()
+	server := newTestWebDavServer("tester", "secret")
+	defer server.Close()
+
+	catalogUri := fmt.Sprintf("dav://tester:secret@%v/catalog.json", strings.TrimPrefix(server.URL, "http://"))
+	var backend CaryatidBackend = &CaryatidWebDavBackend{}
+	NewBackendManager(catalogUri, &backend)
+
+	// A catalog may refer to boxes on other servers, which must not be sent the catalog's credentials
+	if err := backend.DeleteFile(otherServer.URL + "/elsewhere.box"); err != nil {
+		t.Fatalf("Error deleting a box on another host: %v", err)
+	}
+	if sawCredentials {
+		t.Fatalf("Credentials for the catalog's host were sent to another host")
+	}
+}
+
+func TestCaryatidWebDavBackendNoContentLength(t *testing.T) {
+	var (
+		err     error
+		size    int64
+		exists  bool
+		boxName = "TestDavBox"
+	)
+
+	davServer := newTestWebDavServer("tester", "secret")
+	defer davServer.Close()
+	davUrl, _ := url.Parse(davServer.URL)
+	proxy := httputil.NewSingleHostReverseProxy(davUrl)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			w = testResponseWriterWithoutContentLength{w}
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "caryatid-webdav-no-content-length-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	serverHost := strings.TrimPrefix(server.URL, "http://")
+	catalogUri := fmt.Sprintf("dav://tester:secret@%v/%v.json", serverHost, boxName)
+	backend := &CaryatidWebDavBackend{}
+	var caryatidBackend CaryatidBackend = backend
+	manager := NewBackendManager(catalogUri, &caryatidBackend)
+
+	localBoxPath := filepath.Join(tempDir, "input.box")
+	if err = CreateTestBoxFile(localBoxPath, "TestProvider", true); err != nil {
+		t.Fatalf("Error creating test box file: %v", err)
+	}
+	if err = manager.AddBox(localBoxPath, boxName, "Test box", "1.0.0", "TestProvider", "sha1", "0xDECAFBAD"); err != nil {
+		t.Fatalf("Error adding box: %v", err)
+	}
+
+	stat, _ := os.Stat(localBoxPath)
+	boxUri := fmt.Sprintf("dav://%v/%v/%v_1.0.0_TestProvider.box", serverHost, boxName, boxName)
+	if size, exists, err = backend.FileSize(boxUri); err != nil || !exists || size != stat.Size() {
+		t.Fatalf("Expected '%v' to exist with size %v, but got size %v, exists %v, error %v", boxUri, stat.Size(), size, exists, err)
+	}
+}
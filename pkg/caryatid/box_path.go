@@ -0,0 +1,165 @@
+/*
+Templates for where box files are stored, relative to their catalog
+*/
+
+package caryatid
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// The layout of box files that Caryatid has always used,
+// relative to the directory the catalog is in
+const DefaultBoxPathTemplate = "{{.Name}}/{{.Name}}_{{.Version}}_{{.Provider}}.box"
+
+// The fields available to a box path template
+type BoxPathParams struct {
+	Name         string
+	Version      string
+	Provider     string
+	Arch         string
+	ChecksumType string
+	Checksum     string
+}
+
+// Render a box path template, making sure the result is a relative path inside the catalog's directory
+func renderBoxPath(tmpl *template.Template, params BoxPathParams) (boxPath string, err error) {
+	var rendered bytes.Buffer
+	if err = tmpl.Execute(&rendered, params); err != nil {
+		return
+	}
+	boxPath = rendered.String()
+	if boxPath == "" || strings.HasPrefix(boxPath, "/") || strings.HasSuffix(boxPath, "/") || path.Clean(boxPath) != boxPath || boxPath == ".." || strings.HasPrefix(boxPath, "../") {
+		err = fmt.Errorf("Box path template '%v' gave '%v', which is not a relative path inside the catalog's directory", tmpl.Name(), boxPath)
+	}
+	return
+}
+
+// ParseBoxPathTemplate parses a box path template like DefaultBoxPathTemplate, using the fields of BoxPathParams
+// An empty template is DefaultBoxPathTemplate
+// The template must give a different path to boxes for different versions or different providers,
+// unless it uses the checksum, so that one box never replaces another with different contents
+func ParseBoxPathTemplate(text string) (tmpl *template.Template, err error) {
+	if text == "" {
+		text = DefaultBoxPathTemplate
+	}
+	if tmpl, err = template.New(text).Option("missingkey=error").Parse(text); err != nil {
+		return
+	}
+
+	example := BoxPathParams{"example", "1.0.0", "virtualbox", "amd64", "sha1", "1111"}
+	otherVersion := example
+	otherVersion.Version, otherVersion.Checksum = "2.0.0", "2222"
+	otherProvider := example
+	otherProvider.Provider, otherProvider.Checksum = "hyperv", "3333"
+
+	paths := map[string]bool{}
+	for _, params := range []BoxPathParams{example, otherVersion, otherProvider} {
+		var boxPath string
+		if boxPath, err = renderBoxPath(tmpl, params); err != nil {
+			return
+		}
+		paths[boxPath] = true
+	}
+	if len(paths) != 3 {
+		err = fmt.Errorf("Box path template '%v' gives the same path to boxes for different versions or providers", text)
+	}
+	return
+}
+
+// Return whether a box path template uses a field of BoxPathParams
+func boxPathUses(text string, field string) bool {
+	if text == "" {
+		text = DefaultBoxPathTemplate
+	}
+	return strings.Contains(text, "."+field)
+}
+
+// BoxUriFromTemplate returns the URI of a box stored next to a catalog, at the path given by a box path template
+func BoxUriFromTemplate(catalogUri string, pathTemplate string, params BoxPathParams) (boxUri string, err error) {
+	var (
+		tmpl             *template.Template
+		catalogParentUri string
+		boxPath          string
+	)
+
+	if tmpl, err = ParseBoxPathTemplate(pathTemplate); err != nil {
+		return
+	}
+	if catalogParentUri, err = CatalogParentUri(catalogUri); err != nil {
+		return
+	}
+	if boxPath, err = renderBoxPath(tmpl, params); err != nil {
+		return
+	}
+	boxUri = catalogParentUri + "/" + boxPath
+	return
+}
+
+// Return the directory of the static part of a box path template for boxes named name,
+// which is everything before the first field other than the name
+func boxDirPath(tmpl *template.Template, name string) (dirPath string, err error) {
+	const marker = "\x00"
+	var rendered bytes.Buffer
+	if err = tmpl.Execute(&rendered, BoxPathParams{name, marker, marker, marker, marker, marker}); err != nil {
+		return
+	}
+	dirPath = rendered.String()
+	dirPath = path.Dir(dirPath[0:strings.Index(dirPath+marker, marker)])
+	if dirPath == "." {
+		dirPath = ""
+	}
+	return
+}
+
+// BoxDirUriFromTemplate returns the URI of the directory that a box path template puts every box named name under
+// The directory must be specific to name, so that it holds no boxes from other catalogs
+func BoxDirUriFromTemplate(catalogUri string, pathTemplate string, name string) (dirUri string, err error) {
+	var (
+		tmpl             *template.Template
+		catalogParentUri string
+		dirPath          string
+		otherDirPath     string
+	)
+
+	if tmpl, err = ParseBoxPathTemplate(pathTemplate); err != nil {
+		return
+	}
+	if catalogParentUri, err = CatalogParentUri(catalogUri); err != nil {
+		return
+	}
+	if dirPath, err = boxDirPath(tmpl, name); err != nil {
+		return
+	}
+	if otherDirPath, err = boxDirPath(tmpl, name+"-other"); err != nil {
+		return
+	}
+	if dirPath == "" || dirPath == otherDirPath {
+		err = fmt.Errorf("Box path template '%v' does not put boxes named '%v' in a directory of their own", tmpl.Name(), name)
+		return
+	}
+	dirUri = catalogParentUri + "/" + dirPath
+	return
+}
+
+// Return the name, version and provider of a box from the path DefaultBoxPathTemplate gives it,
+// which ends in name/name_version_provider.box
+// Backends that don't store boxes as files use this to find out which box a URI refers to
+func parseDefaultBoxPath(boxPath string) (name string, version string, provider string, err error) {
+	dir, file := path.Split(strings.TrimPrefix(boxPath, "/"))
+	name = path.Base(dir)
+	versionProvider := strings.TrimSuffix(file, ".box")
+	// Versions never contain underscores, but providers like vmware_desktop do
+	underscoreIdx := strings.Index(strings.TrimPrefix(versionProvider, name+"_"), "_")
+	if dir == "" || !strings.HasPrefix(versionProvider, name+"_") || !strings.HasSuffix(file, ".box") || underscoreIdx <= 0 {
+		err = fmt.Errorf("'%v' is not a path given by the default box path template, '%v'", boxPath, DefaultBoxPathTemplate)
+		return
+	}
+	versionProvider = versionProvider[len(name)+1:]
+	version, provider = versionProvider[0:underscoreIdx], versionProvider[underscoreIdx+1:]
+	return
+}
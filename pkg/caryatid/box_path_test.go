@@ -0,0 +1,138 @@
+package caryatid
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseBoxPathTemplate(t *testing.T) {
+	valid := []string{
+		"",
+		DefaultBoxPathTemplate,
+		"{{.Name}}/{{.Version}}/{{.Arch}}/{{.Provider}}.box",
+		"blobs/{{.ChecksumType}}/{{.Checksum}}.box",
+	}
+	for _, text := range valid {
+		if _, err := ParseBoxPathTemplate(text); err != nil {
+			t.Fatalf("Expected box path template '%v' to be valid, but got error %v", text, err)
+		}
+	}
+
+	invalid := []string{
+		"{{.Name}",
+		"{{.Name}}/{{.Nonexistent}}.box",
+		"{{.Name}}/{{.Version}}.box",
+		"{{.Name}}/{{.Provider}}.box",
+		"/{{.Name}}/{{.Version}}_{{.Provider}}.box",
+		"../{{.Name}}/{{.Version}}_{{.Provider}}.box",
+		"{{.Name}}//{{.Version}}_{{.Provider}}.box",
+	}
+	for _, text := range invalid {
+		if _, err := ParseBoxPathTemplate(text); err == nil {
+			t.Fatalf("Expected box path template '%v' to be invalid", text)
+		}
+	}
+}
+
+func TestBoxUriFromTemplate(t *testing.T) {
+	params := BoxPathParams{"testbox", "1.0.0", "virtualbox", "amd64", "sha1", "0xDECAFBAD"}
+
+	boxUri, err := BoxUriFromTemplate("s3://bucket/boxes/catalog.json?region=us-east-2", "{{.Name}}/{{.Version}}/{{.Arch}}/{{.Provider}}.box", params)
+	if err != nil || boxUri != "s3://bucket/boxes/testbox/1.0.0/amd64/virtualbox.box" {
+		t.Fatalf("Unexpected box URI '%v' and error %v", boxUri, err)
+	}
+	defaultUri, _ := BoxUriFromTemplate("file:///srv/boxes/catalog.json", "", params)
+	if expected, _ := BoxUriFromCatalogUri("file:///srv/boxes/catalog.json", "testbox", "1.0.0", "virtualbox"); defaultUri != expected {
+		t.Fatalf("Expected an empty template to give the default box URI '%v', but got '%v'", expected, defaultUri)
+	}
+}
+
+func TestParseDefaultBoxPath(t *testing.T) {
+	name, version, provider, err := parseDefaultBoxPath("/boxes/testbox/testbox_1.0.0_vmware_desktop.box")
+	if err != nil || name != "testbox" || version != "1.0.0" || provider != "vmware_desktop" {
+		t.Fatalf("Unexpected name '%v', version '%v', provider '%v', and error %v", name, version, provider, err)
+	}
+	for _, boxPath := range []string{"testbox_1.0.0_virtualbox.box", "testbox/otherbox_1.0.0_virtualbox.box", "testbox/testbox_1.0.0.box", "testbox/1.0.0/virtualbox.box"} {
+		if _, _, _, err = parseDefaultBoxPath(boxPath); err == nil {
+			t.Fatalf("Expected '%v' not to be a default box path", boxPath)
+		}
+	}
+}
+
+func TestBoxDirUriFromTemplate(t *testing.T) {
+	dirUris := map[string]string{
+		"": "file:///srv/boxes/testbox",
+		"{{.Name}}/{{.Version}}/{{.Provider}}.box": "file:///srv/boxes/testbox",
+		"blobs/{{.Name}}/{{.Checksum}}.box":        "file:///srv/boxes/blobs/testbox",
+	}
+	for text, expected := range dirUris {
+		if dirUri, err := BoxDirUriFromTemplate("file:///srv/boxes/catalog.json", text, "testbox"); err != nil || dirUri != expected {
+			t.Fatalf("Expected box path template '%v' to put boxes in '%v', but got '%v' and error %v", text, expected, dirUri, err)
+		}
+	}
+
+	// Boxes that share a directory with other catalogs cannot be told apart from them
+	for _, text := range []string{"blobs/{{.Checksum}}.box", "{{.Name}}_{{.Version}}_{{.Provider}}.box"} {
+		if _, err := BoxDirUriFromTemplate("file:///srv/boxes/catalog.json", text, "testbox"); err == nil {
+			t.Fatalf("Expected box path template '%v' not to have a directory of its own", text)
+		}
+	}
+}
+
+// Write a box file with the given metadata.json contents
+func writeTestBoxMetadata(t *testing.T, boxPath string, metadata string) {
+	boxFile, err := os.Create(boxPath)
+	if err != nil {
+		t.Fatalf("Error creating box file: %v", err)
+	}
+	defer boxFile.Close()
+	tarWriter := tar.NewWriter(boxFile)
+	defer tarWriter.Close()
+	tarWriter.WriteHeader(&tar.Header{Name: "metadata.json", Mode: 0666, Size: int64(len(metadata))})
+	tarWriter.Write([]byte(metadata))
+}
+
+func TestBackendManagerBoxPathTemplate(t *testing.T) {
+	var (
+		store                   = NewMemoryStore()
+		backend CaryatidBackend = &CaryatidMemoryBackend{Store: store}
+		manager                 = NewBackendManager("mem://templated/boxes/TemplatedBox.json", &backend)
+	)
+	manager.BoxPathTemplate = "{{.Name}}/{{.Version}}/{{.Arch}}/{{.Provider}}.box"
+
+	tempDir, err := ioutil.TempDir("", "caryatid-box-path-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	boxPath := filepath.Join(tempDir, "arm.box")
+	writeTestBoxMetadata(t, boxPath, `{"provider": "libvirt", "architecture": "arm64"}`)
+	if err = manager.AddBox(boxPath, "TemplatedBox", "Templated", "1.0.0", "libvirt", "sha1", "0xDECAFBAD"); err != nil {
+		t.Fatalf("Error adding box: %v", err)
+	}
+	boxUri := "mem://templated/boxes/TemplatedBox/1.0.0/arm64/libvirt.box"
+	if _, exists := store.ReadFile(boxUri); !exists {
+		t.Fatalf("Expected box at '%v', but found files %v", boxUri, store.Files())
+	}
+	if catalog, _ := manager.GetCatalog(); catalog.BoxReferences()[0].Uri != boxUri {
+		t.Fatalf("Expected catalog to refer to '%v', but got:\n%v", boxUri, catalog.DisplayString())
+	}
+	if report, err := manager.Fsck(); err != nil || !report.Clean() {
+		t.Fatalf("Expected templated boxes to pass fsck, but got error %v and report:\n%v", err, report)
+	}
+
+	// Older boxes don't record their architecture, so they can't be stored with a template that uses it
+	oldBoxPath := filepath.Join(tempDir, "old.box")
+	writeTestBoxMetadata(t, oldBoxPath, `{"provider": "libvirt"}`)
+	if err = manager.AddBox(oldBoxPath, "TemplatedBox", "Templated", "1.1.0", "libvirt", "sha1", "0xDECAFBAD"); err == nil || !strings.Contains(err.Error(), "architecture") {
+		t.Fatalf("Expected adding a box without an architecture to fail, but got error %v", err)
+	}
+	if _, _, err = manager.RecoverCatalog("TemplatedBox", "Templated", false, true); err == nil {
+		t.Fatalf("Expected recovering boxes stored with a custom template to fail")
+	}
+}
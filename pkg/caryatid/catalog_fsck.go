@@ -0,0 +1,174 @@
+/*
+Reconciling a Vagrant catalog with the box files in its backend
+*/
+
+package caryatid
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// The problems found when reconciling a catalog with its backend
+type FsckReport struct {
+	// Files in the box's directory that the catalog does not reference,
+	// such as boxes left behind by failed uploads or by deletes that stopped partway through
+	Orphans []BackendFile
+
+	// Catalog entries whose box file does not exist
+	Dangling BoxReferenceList
+
+	// Catalog entries whose box file is empty
+	// The catalog does not record box sizes, but no valid box is empty, so these are failed or truncated uploads
+	SizeMismatches BoxReferenceList
+
+	// Catalog entries whose URI is not in the box's directory in this backend, so they could not be checked
+	// These usually mean that the manager's PublicBaseUri is not the one the boxes were added with
+	Unchecked BoxReferenceList
+}
+
+// Return whether the report found no problems
+func (report FsckReport) Clean() bool {
+	return len(report.Orphans) == 0 && len(report.Dangling) == 0 && len(report.SizeMismatches) == 0 && len(report.Unchecked) == 0
+}
+
+// Return a description of each problem in the report, one per line
+func (report FsckReport) String() (result string) {
+	for _, file := range report.Orphans {
+		result += fmt.Sprintf("Orphaned file: %v (%v bytes)\n", file.Uri, file.Size)
+	}
+	for _, ref := range report.Dangling {
+		result += fmt.Sprintf("Dangling reference: version %v provider %v: %v\n", ref.Version, ref.ProviderName, ref.Uri)
+	}
+	for _, ref := range report.SizeMismatches {
+		result += fmt.Sprintf("Empty box: version %v provider %v: %v\n", ref.Version, ref.ProviderName, ref.Uri)
+	}
+	for _, ref := range report.Unchecked {
+		result += fmt.Sprintf("Unchecked reference: version %v provider %v: %v\n", ref.Version, ref.ProviderName, ref.Uri)
+	}
+	return
+}
+
+// Return the Backend as a CaryatidListingBackend, or an error if it can't list its files
+func (bm *BackendManager) listingBackend() (listing CaryatidListingBackend, err error) {
+	backend, _ := bm.boxStorage()
+	listing, ok := backend.(CaryatidListingBackend)
+	if !ok {
+		err = fmt.Errorf("The '%v' backend cannot list its files", backend.Scheme())
+	}
+	return
+}
+
+// Fsck reconciles the catalog with the files in its backend
+// Only the directory that AddBox writes the catalog's boxes to is examined,
+// so other catalogs and files that share the catalog's parent directory are never reported as orphans
+// The box path template must put the catalog's boxes in a directory of their own for this to work
+func (bm *BackendManager) Fsck() (report FsckReport, err error) {
+	var (
+		listing    CaryatidListingBackend
+		catalog    Catalog
+		boxDirUri  string
+		files      []BackendFile
+		storageUri string
+	)
+
+	if listing, err = bm.listingBackend(); err != nil {
+		return
+	}
+	if catalog, err = bm.GetCatalog(); err != nil {
+		return
+	}
+	if catalog.Name == "" {
+		err = fmt.Errorf("Catalog '%v' has no name, so its boxes cannot be found", bm.CatalogUri)
+		return
+	}
+	_, boxCatalogUri := bm.boxStorage()
+	if boxDirUri, err = BoxDirUriFromTemplate(boxCatalogUri, bm.BoxPathTemplate, catalog.Name); err != nil {
+		return
+	}
+
+	if files, err = listing.ListFiles(boxDirUri); err != nil {
+		log.Printf("Fsck(): Error listing files in '%v': %v\n", boxDirUri, err)
+		return
+	}
+	sizes := map[string]int64{}
+	for _, file := range files {
+		sizes[file.Uri] = file.Size
+	}
+
+	referenced := map[string]bool{}
+	for _, ref := range catalog.BoxReferences() {
+		if storageUri, err = bm.StorageUri(ref.Uri); err != nil {
+			log.Printf("Fsck(): Error determining backend URI for '%v': %v\n", ref.Uri, err)
+			return
+		}
+		referenced[storageUri] = true
+
+		size, exists := sizes[storageUri]
+		if !strings.HasPrefix(storageUri, boxDirUri+"/") {
+			report.Unchecked = append(report.Unchecked, ref)
+		} else if !exists {
+			report.Dangling = append(report.Dangling, ref)
+		} else if size == 0 {
+			report.SizeMismatches = append(report.SizeMismatches, ref)
+		}
+	}
+
+	for _, file := range files {
+		if !referenced[file.Uri] {
+			report.Orphans = append(report.Orphans, file)
+		}
+	}
+	return
+}
+
+// FsckFix reconciles the catalog with its backend like Fsck, then drops dangling references from the catalog and deletes orphaned files
+// It returns the report of what it found, and so what it fixed
+// It refuses to delete anything if some references could not be checked,
+// since their files may be among the orphans
+// If the backend supports locking and the manager does not already hold the lock, the catalog is locked while fixing it,
+// so that a box being added at the same time is not mistaken for an orphan
+func (bm *BackendManager) FsckFix(owner string) (report FsckReport, err error) {
+	if _, lockErr := bm.lockingBackend(); lockErr == nil && bm.lock == nil {
+		if err = bm.Lock(owner, fsckLockTtl); err != nil {
+			return
+		}
+		defer func() {
+			if unlockErr := bm.Unlock(); unlockErr != nil {
+				log.Printf("FsckFix(): Error releasing lock: %v\n", unlockErr)
+			}
+		}()
+	}
+
+	if report, err = bm.Fsck(); err != nil {
+		return
+	}
+	if len(report.Unchecked) > 0 {
+		err = fmt.Errorf("%v references in catalog '%v' could not be checked, so nothing was fixed; if the boxes were added with a public base URI, pass the same one", len(report.Unchecked), bm.CatalogUri)
+		return
+	}
+
+	if len(report.Dangling) > 0 {
+		err = bm.UpdateCatalog(func(catalog *Catalog) error {
+			*catalog = catalog.DeleteReferences(report.Dangling)
+			return nil
+		})
+		if err != nil {
+			log.Printf("FsckFix(): Error saving catalog: %v\n", err)
+			return
+		}
+	}
+	backend, _ := bm.boxStorage()
+	for _, file := range report.Orphans {
+		if err = backend.DeleteFile(file.Uri); err != nil {
+			log.Printf("FsckFix(): Error deleting orphaned file '%v': %v\n", file.Uri, err)
+			return
+		}
+	}
+	return
+}
+
+// How long FsckFix holds the lock on a catalog for
+const fsckLockTtl = time.Hour
@@ -0,0 +1,151 @@
+/*
+Advisory locks on Vagrant catalogs
+
+See also CaryatidLockingBackend
+*/
+
+package caryatid
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"time"
+)
+
+// The default time a lock is held for before other processes may consider it stale
+const DefaultLockTtl = 1 * time.Hour
+
+// A CatalogLock describes who holds the lock on a catalog
+type CatalogLock struct {
+	// A description of who holds the lock, like a user name or a CI job
+	Owner    string    `json:"owner"`
+	Hostname string    `json:"hostname"`
+	Pid      int       `json:"pid"`
+	Acquired time.Time `json:"acquired"`
+	// After this time, the lock is stale and may be taken by someone else
+	// A zero value means the lock never expires
+	Expires time.Time `json:"expires"`
+}
+
+// NewCatalogLock returns a CatalogLock for the current process that expires after ttl
+// If owner is empty, the name of the current user is used
+// If ttl is zero, the lock never expires
+func NewCatalogLock(owner string, ttl time.Duration) (lock CatalogLock) {
+	if owner == "" {
+		if currentUser, err := user.Current(); err == nil {
+			owner = currentUser.Username
+		}
+	}
+	lock.Owner = owner
+	lock.Hostname, _ = os.Hostname()
+	lock.Pid = os.Getpid()
+	lock.Acquired = time.Now().UTC()
+	if ttl != 0 {
+		lock.Expires = lock.Acquired.Add(ttl)
+	}
+	return
+}
+
+// Expired returns true if the lock is stale and may be taken by someone else
+func (lock CatalogLock) Expired() bool {
+	return !lock.Expires.IsZero() && time.Now().After(lock.Expires)
+}
+
+// SameHolder returns true if two locks were taken by the same owner in the same process
+func (lock CatalogLock) SameHolder(other CatalogLock) bool {
+	return lock.Owner == other.Owner && lock.Hostname == other.Hostname && lock.Pid == other.Pid && lock.Acquired.Equal(other.Acquired)
+}
+
+func (lock CatalogLock) String() string {
+	expires := "never expires"
+	if lock.Expired() {
+		expires = fmt.Sprintf("expired at %v", lock.Expires.Format(time.RFC3339))
+	} else if !lock.Expires.IsZero() {
+		expires = fmt.Sprintf("expires at %v", lock.Expires.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("locked by '%v' on host '%v' (pid %v) at %v; %v", lock.Owner, lock.Hostname, lock.Pid, lock.Acquired.Format(time.RFC3339), expires)
+}
+
+// CatalogLockedError means that someone else holds the lock on a catalog
+type CatalogLockedError struct {
+	CatalogUri string
+	Lock       CatalogLock
+}
+
+func (err *CatalogLockedError) Error() string {
+	return fmt.Sprintf("Catalog '%v' is %v", err.CatalogUri, err.Lock)
+}
+
+// IsCatalogLocked returns true if an error is a *CatalogLockedError
+func IsCatalogLocked(err error) bool {
+	_, ok := err.(*CatalogLockedError)
+	return ok
+}
+
+// A leaseStore keeps a lock as a small file next to the catalog, for backends without a native locking mechanism
+// Writes must be conditional, in the same way as CaryatidVersionedBackend.SetCatalogBytesIfVersion()
+type leaseStore interface {
+	// Return the lease file contents and their version, or nil contents if there is no lease file
+	readLease() ([]byte, string, error)
+
+	// Write the lease file, but only if it is at a version returned by readLease(), or does not exist if version is empty
+	// Return a *CatalogConflictError if it has changed
+	writeLease([]byte, string) error
+
+	// Remove the lease file, if it exists
+	deleteLease() error
+}
+
+// Return the lock held in a lease store, if any
+func leaseStatus(store leaseStore) (lock *CatalogLock, version string, err error) {
+	var leaseBytes []byte
+	if leaseBytes, version, err = store.readLease(); err != nil || leaseBytes == nil {
+		return
+	}
+	lock = new(CatalogLock)
+	if err = json.Unmarshal(leaseBytes, lock); err != nil {
+		err = fmt.Errorf("Could not parse lock: %v", err)
+	}
+	return
+}
+
+// Take the lock in a lease store, replacing any expired lock
+func acquireLease(store leaseStore, catalogUri string, lock CatalogLock) (err error) {
+	var (
+		leaseBytes []byte
+		current    *CatalogLock
+		version    string
+	)
+	if leaseBytes, err = json.Marshal(lock); err != nil {
+		return
+	}
+	if current, version, err = leaseStatus(store); err != nil {
+		return
+	}
+	if current != nil && !current.Expired() {
+		return &CatalogLockedError{CatalogUri: catalogUri, Lock: *current}
+	}
+
+	err = store.writeLease(leaseBytes, version)
+	if IsCatalogConflict(err) {
+		// Someone else took the lock between reading and writing it
+		if current, _, statusErr := leaseStatus(store); statusErr == nil && current != nil {
+			return &CatalogLockedError{CatalogUri: catalogUri, Lock: *current}
+		}
+	}
+	return
+}
+
+// Release the lock in a lease store, if it is still held by the holder of lock
+func releaseLease(store leaseStore, catalogUri string, lock CatalogLock) (err error) {
+	var current *CatalogLock
+	if current, _, err = leaseStatus(store); err != nil || current == nil {
+		return
+	}
+	if !current.SameHolder(lock) {
+		return &CatalogLockedError{CatalogUri: catalogUri, Lock: *current}
+	}
+	return store.deleteLease()
+}
@@ -0,0 +1,247 @@
+/*
+Copying a Vagrant catalog and its boxes from one backend to another
+*/
+
+package caryatid
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mrled/caryatid/internal/util"
+)
+
+// The boxes that MigrateCatalog copied, and the ones it found were already in place
+type MigrationReport struct {
+	// Boxes copied to the destination, with their URIs in the destination catalog
+	Copied BoxReferenceList
+
+	// Boxes that the destination catalog already had with the same checksum, so were not copied again
+	// Only a mirror leaves boxes unchanged
+	Unchanged BoxReferenceList
+}
+
+// A box copied to the destination, waiting for the destination catalog to be saved
+type migratedBox struct {
+	version  string
+	provider Provider
+	commit   func()
+	rollback func()
+}
+
+// MigrateCatalog copies every box in the catalog managed by from to the backend managed by to,
+// then writes a catalog there with the same boxes at their new URIs
+// If params is not empty, only the boxes in the source catalog that match it are copied
+// Each box is downloaded through the source backend, checked against the checksum in the source catalog,
+// uploaded through the destination backend, and, if the destination can download its files, checked again there
+// The destination catalog is only written once every box has been copied and checked;
+// if anything fails, the boxes already copied are removed again, and the destination catalog is left alone
+// Unless mirror is set, the destination catalog must be missing or empty
+// If mirror is set, boxes that the destination catalog already has with the same checksum are not copied again,
+// so that a replica can be kept in sync by mirroring to it regularly
+// A mirror never removes boxes from the destination, even if they have been deleted from the source
+// The source may be any backend that can download its files, including the read-only HTTP backend,
+// so that catalogs Caryatid doesn't manage can be mirrored too
+func MigrateCatalog(from *BackendManager, to *BackendManager, params CatalogQueryParams, mirror bool) (report MigrationReport, err error) {
+	var (
+		source      CaryatidDownloadingBackend
+		fromCatalog Catalog
+		toCatalog   Catalog
+		tempDir     string
+		migrated    []migratedBox
+	)
+
+	if from.CatalogUri == to.CatalogUri {
+		err = fmt.Errorf("Cannot migrate catalog '%v' to itself", from.CatalogUri)
+		return
+	}
+	if source, err = from.downloadingBackend(); err != nil {
+		return
+	}
+	if err = to.checkLock(); err != nil {
+		return
+	}
+	if fromCatalog, err = from.GetCatalog(); err != nil {
+		log.Printf("MigrateCatalog(): Error getting source catalog: %v\n", err)
+		return
+	}
+	if fromCatalog, err = fromCatalog.QueryCatalog(params); err != nil {
+		return
+	}
+	if fromCatalog.Name == "" {
+		err = fmt.Errorf("Catalog '%v' has no name, so its boxes cannot be migrated", from.CatalogUri)
+		return
+	}
+	if toCatalog, err = to.GetCatalog(); err != nil {
+		log.Printf("MigrateCatalog(): Error getting destination catalog: %v\n", err)
+		return
+	}
+	if err = checkMigrationDestination(toCatalog, fromCatalog.Name, to.CatalogUri, mirror); err != nil {
+		return
+	}
+
+	if tempDir, err = ioutil.TempDir("", "caryatid-migrate"); err != nil {
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Remove every box copied so far, most recent first, if the migration does not complete
+	defer func() {
+		if err != nil {
+			for idx := len(migrated) - 1; idx >= 0; idx-- {
+				migrated[idx].rollback()
+			}
+		}
+	}()
+
+	for _, version := range fromCatalog.Versions {
+		for _, provider := range version.Providers {
+			ref := BoxReference{version.Version, provider.Name, provider.Url}
+			if mirror && catalogHasChecksum(toCatalog, version.Version, provider) {
+				report.Unchanged = append(report.Unchanged, ref)
+				continue
+			}
+
+			box := migratedBox{version: version.Version, provider: provider}
+			if box.provider.Url, box.commit, box.rollback, err = to.migrateBoxFile(source, from, fromCatalog.Name, version.Version, provider, tempDir); err != nil {
+				log.Printf("MigrateCatalog(): Error copying version %v provider %v from '%v': %v\n", version.Version, provider.Name, provider.Url, err)
+				return
+			}
+			migrated = append(migrated, box)
+			ref.Uri = box.provider.Url
+			report.Copied = append(report.Copied, ref)
+		}
+	}
+
+	if mirror && len(migrated) == 0 && toCatalog.Name == fromCatalog.Name && toCatalog.Description == fromCatalog.Description {
+		log.Printf("MigrateCatalog(): Catalog '%v' is already up to date\n", to.CatalogUri)
+		return
+	}
+
+	err = to.UpdateCatalog(func(catalog *Catalog) error {
+		if err := checkMigrationDestination(*catalog, fromCatalog.Name, to.CatalogUri, mirror); err != nil {
+			return err
+		}
+		catalog.Name = fromCatalog.Name
+		catalog.Description = fromCatalog.Description
+		for _, box := range migrated {
+			p := box.provider
+			if err := catalog.AddBoxUri(p.Url, fromCatalog.Name, fromCatalog.Description, box.version, p.Name, p.ChecksumType, p.Checksum); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("MigrateCatalog(): Error saving destination catalog: %v\n", err)
+		return
+	}
+	for _, box := range migrated {
+		box.commit()
+	}
+	return
+}
+
+// Make sure a catalog can be migrated into
+func checkMigrationDestination(catalog Catalog, name string, catalogUri string, mirror bool) error {
+	if catalog.Name != "" && catalog.Name != name {
+		return fmt.Errorf("Destination catalog '%v' is for boxes named '%v', not '%v'", catalogUri, catalog.Name, name)
+	}
+	if !mirror && len(catalog.Versions) > 0 {
+		return fmt.Errorf("Destination catalog '%v' already has %v versions; mirror to it instead to copy only missing or changed boxes", catalogUri, len(catalog.Versions))
+	}
+	return nil
+}
+
+// Return whether a catalog has a box for version and provider, with the same checksum as provider
+func catalogHasChecksum(catalog Catalog, version string, provider Provider) bool {
+	for _, v := range catalog.Versions {
+		if v.Version != version {
+			continue
+		}
+		for _, p := range v.Providers {
+			if p.Name == provider.Name {
+				return p.ChecksumType == provider.ChecksumType && strings.EqualFold(p.Checksum, provider.Checksum)
+			}
+		}
+	}
+	return false
+}
+
+// Copy one box from the source backend to where AddBox would put it in this backend, checking its checksum on both sides
+// Returns the box's URI in this backend's catalog, and functions to call once the catalog is saved or if it could not be
+func (bm *BackendManager) migrateBoxFile(source CaryatidDownloadingBackend, from *BackendManager, name string, version string, provider Provider, tempDir string) (boxUri string, commit func(), rollback func(), err error) {
+	var (
+		sourceUri    string
+		storageUri   string
+		params       BoxPathParams
+		checksumType = provider.ChecksumType
+		checksum     = provider.Checksum
+	)
+
+	if sourceUri, err = from.StorageUri(provider.Url); err != nil {
+		return
+	}
+
+	localPath := filepath.Join(tempDir, "migrating.box")
+	defer os.Remove(localPath)
+	if err = source.DownloadFile(sourceUri, localPath); err != nil {
+		return
+	}
+	if checksumType == "" {
+		// Without a checksum in the catalog, the copy can still be checked against what was downloaded
+		log.Printf("migrateBoxFile(): The catalog has no checksum for '%v', so it was copied without being verified\n", sourceUri)
+		checksumType = "sha1"
+		if checksum, err = util.Sha1sum(localPath); err != nil {
+			return
+		}
+	} else if err = verifyBoxChecksum(localPath, sourceUri, checksumType, checksum); err != nil {
+		return
+	}
+
+	if params, err = bm.boxPathParams(localPath, name, version, provider.Name, checksumType, checksum); err != nil {
+		return
+	}
+	backend, boxCatalogUri := bm.boxStorage()
+	if storageUri, err = BoxUriFromTemplate(boxCatalogUri, bm.BoxPathTemplate, params); err != nil {
+		return
+	}
+	if commit, rollback, err = bm.storeBoxFile(localPath, storageUri, params); err != nil {
+		return
+	}
+	if boxUri, err = bm.FrontendUri(storageUri); err != nil {
+		rollback()
+		return
+	}
+
+	destination, ok := backend.(CaryatidDownloadingBackend)
+	if !ok {
+		log.Printf("migrateBoxFile(): The '%v' backend cannot download its files, so the copy at '%v' was not checked\n", backend.Scheme(), storageUri)
+		return
+	}
+	verifyPath := filepath.Join(tempDir, "verifying.box")
+	defer os.Remove(verifyPath)
+	if err = destination.DownloadFile(storageUri, verifyPath); err == nil {
+		err = verifyBoxChecksum(verifyPath, storageUri, checksumType, checksum)
+	}
+	if err != nil {
+		rollback()
+	}
+	return
+}
+
+// Return an error unless a downloaded box matches its checksum
+func verifyBoxChecksum(localPath string, uri string, checksumType string, checksum string) (err error) {
+	var actual string
+	if actual, err = util.Checksum(localPath, checksumType); err != nil {
+		return
+	}
+	if !strings.EqualFold(actual, checksum) {
+		err = fmt.Errorf("Box at '%v' has %v checksum '%v', but the catalog says '%v'", uri, checksumType, actual, checksum)
+	}
+	return
+}
@@ -0,0 +1,180 @@
+/*
+Rebuilding a lost Vagrant catalog from the box files in its backend
+*/
+
+package caryatid
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mrled/caryatid/internal/util"
+)
+
+// A file that RecoverCatalog found but did not add to the catalog, and why
+type RecoverySkip struct {
+	File   BackendFile
+	Reason string
+}
+
+func (skip RecoverySkip) String() string {
+	return fmt.Sprintf("%v: %v", skip.File.Uri, skip.Reason)
+}
+
+// Return the Backend as a CaryatidDownloadingBackend, or an error if it can't download its files
+func (bm *BackendManager) downloadingBackend() (downloading CaryatidDownloadingBackend, err error) {
+	backend, _ := bm.boxStorage()
+	downloading, ok := backend.(CaryatidDownloadingBackend)
+	if !ok {
+		err = fmt.Errorf("The '%v' backend cannot download its files", backend.Scheme())
+	}
+	return
+}
+
+// RecoverCatalog rebuilds a lost or corrupted catalog from the box files that AddBox wrote to the backend
+// The boxes are found in the directory AddBox writes boxes named name to,
+// and the version and provider of each are parsed from its file name, like name/name_1.2.3_virtualbox.box
+// This only works for boxes stored with DefaultBoxPathTemplate
+// Each box is downloaded to compute its checksum,
+// and if checkProvider is set, its metadata.json must name the same provider as its file name
+// Files that are not boxes, or that fail these checks, are skipped rather than failing the recovery
+// The recovered catalog replaces the existing one only if it is missing, cannot be read, or has no boxes, unless force is set
+func (bm *BackendManager) RecoverCatalog(name string, description string, checkProvider bool, force bool) (catalog Catalog, skipped []RecoverySkip, err error) {
+	var (
+		listing     CaryatidListingBackend
+		downloading CaryatidDownloadingBackend
+		boxDirUri   string
+		files       []BackendFile
+		tempDir     string
+	)
+
+	if listing, err = bm.listingBackend(); err != nil {
+		return
+	}
+	if downloading, err = bm.downloadingBackend(); err != nil {
+		return
+	}
+	if err = bm.checkLock(); err != nil {
+		return
+	}
+	if bm.BoxPathTemplate != "" && bm.BoxPathTemplate != DefaultBoxPathTemplate {
+		err = fmt.Errorf("Boxes stored with the box path template '%v' do not record their versions and providers in a way that can be recovered", bm.BoxPathTemplate)
+		return
+	}
+	_, boxCatalogUri := bm.boxStorage()
+	if boxDirUri, err = BoxDirUriFromTemplate(boxCatalogUri, DefaultBoxPathTemplate, name); err != nil {
+		return
+	}
+
+	if files, err = listing.ListFiles(boxDirUri); err != nil {
+		log.Printf("RecoverCatalog(): Error listing files in '%v': %v\n", boxDirUri, err)
+		return
+	}
+	if tempDir, err = ioutil.TempDir("", "caryatid-recover"); err != nil {
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	boxFileRegexp := regexp.MustCompile("^" + regexp.QuoteMeta(name) + `_([^_/]+)_([^/]+)\.box$`)
+	catalog = Catalog{Name: name, Description: description}
+	for _, file := range files {
+		var (
+			version, provider  string
+			checksumType, hash string
+			frontendUri        string
+		)
+
+		matches := boxFileRegexp.FindStringSubmatch(strings.TrimPrefix(file.Uri, boxDirUri+"/"))
+		if matches == nil {
+			skipped = append(skipped, RecoverySkip{file, fmt.Sprintf("file name is not like %v_<version>_<provider>.box", name)})
+			continue
+		}
+		version, provider = matches[1], matches[2]
+		if _, versionErr := NewComparableVersion(version); versionErr != nil {
+			skipped = append(skipped, RecoverySkip{file, fmt.Sprintf("'%v' is not a valid version", version)})
+			continue
+		}
+
+		if checksumType, hash, err = bm.recoverBoxChecksum(downloading, file, tempDir, provider, checkProvider); err != nil {
+			skipped = append(skipped, RecoverySkip{file, err.Error()})
+			err = nil
+			continue
+		}
+		if frontendUri, err = bm.FrontendUri(file.Uri); err != nil {
+			return
+		}
+		if err = catalog.AddBoxUri(frontendUri, name, description, version, provider, checksumType, hash); err != nil {
+			return
+		}
+		log.Printf("RecoverCatalog(): Recovered version %v provider %v from '%v'\n", version, provider, file.Uri)
+	}
+
+	if len(catalog.Versions) == 0 {
+		err = fmt.Errorf("Found no boxes to recover in '%v'", boxDirUri)
+		return
+	}
+	err = bm.replaceCatalog(catalog, force)
+	return
+}
+
+// Download a box file and compute its checksum, making sure it is for the expected provider if checkProvider is set
+func (bm *BackendManager) recoverBoxChecksum(downloading CaryatidDownloadingBackend, file BackendFile, tempDir string, provider string, checkProvider bool) (checksumType string, checksum string, err error) {
+	var actualProvider string
+
+	localPath := filepath.Join(tempDir, "recovering.box")
+	defer os.Remove(localPath)
+	if err = downloading.DownloadFile(file.Uri, localPath); err != nil {
+		return "", "", fmt.Errorf("could not download: %v", err)
+	}
+
+	if !checkProvider {
+		checksum, err = util.Sha1sum(localPath)
+		return "sha1", checksum, err
+	}
+	if checksumType, checksum, actualProvider, err = DeriveArtifactInfoFromBoxFile(localPath); err != nil {
+		return "", "", fmt.Errorf("could not read box: %v", err)
+	}
+	if actualProvider != provider {
+		return "", "", fmt.Errorf("box is for provider '%v', but its file name says '%v'", actualProvider, provider)
+	}
+	return
+}
+
+// Save a catalog in place of the existing one
+// Unless force is set, an existing catalog that can be read and has boxes is never replaced
+func (bm *BackendManager) replaceCatalog(catalog Catalog, force bool) (err error) {
+	var (
+		catalogBytes []byte
+		version      string
+	)
+
+	versioned, isVersioned := bm.Backend.(CaryatidVersionedBackend)
+	if isVersioned {
+		catalogBytes, version, err = versioned.GetCatalogBytesVersion()
+	} else {
+		catalogBytes, err = bm.Backend.GetCatalogBytes()
+	}
+	if err != nil {
+		log.Printf("Error trying to get catalog bytes: %v\n", err)
+		return
+	}
+	var existing Catalog
+	if json.Unmarshal(catalogBytes, &existing) == nil && len(existing.Versions) > 0 && !force {
+		return fmt.Errorf("Catalog '%v' still has %v versions, so it was not replaced", bm.CatalogUri, len(existing.Versions))
+	}
+
+	if catalogBytes, err = json.MarshalIndent(catalog, "", "  "); err != nil {
+		log.Println("Error trying to marshal catalog: ", err)
+		return
+	}
+	if isVersioned {
+		return versioned.SetCatalogBytesIfVersion(catalogBytes, version)
+	}
+	return bm.Backend.SetCatalogBytes(catalogBytes)
+}
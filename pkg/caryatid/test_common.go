@@ -6,10 +6,18 @@ package caryatid
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/sha1"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net/url"
 	"os"
+	"path/filepath"
+	"time"
 )
 
 func CreateTestBoxFile(filePath string, providerName string, compress bool) (err error) {
@@ -120,3 +128,188 @@ func (c1 *Catalog) FuzzyEquals(c2 *Catalog, params CatalogFuzzyEqualsParams) boo
 
 	return true
 }
+
+// CheckBackendConformance exercises every CaryatidBackend method through a BackendManager,
+// and returns an error describing the first way the backend misbehaves
+// The catalogUri must point to a location where no catalog exists yet,
+// and workDir must be a writable local directory for temporary box files
+func CheckBackendConformance(backend CaryatidBackend, catalogUri string, workDir string) (err error) {
+	var (
+		catalog      Catalog
+		catalogBytes []byte
+		boxName      = "ConformanceBox"
+		boxPath      = filepath.Join(workDir, "conformance.box")
+		testCatalog  = []byte(`{"name":"ConformanceBox","description":"","versions":null}`)
+	)
+
+	manager := NewBackendManager(catalogUri, &backend)
+	if backendManager, managerErr := backend.GetManager(); managerErr != nil || backendManager != manager {
+		return fmt.Errorf("GetManager() did not return the manager passed to SetManager(): %v", managerErr)
+	}
+	if u, parseErr := url.Parse(catalogUri); parseErr != nil || u.Scheme != backend.Scheme() {
+		return fmt.Errorf("Scheme() returned '%v', which does not match the catalog URI '%v'", backend.Scheme(), catalogUri)
+	}
+
+	if catalogBytes, err = backend.GetCatalogBytes(); err != nil {
+		return fmt.Errorf("GetCatalogBytes() failed for a nonexistent catalog: %v", err)
+	} else if string(catalogBytes) != "{}" {
+		return fmt.Errorf("GetCatalogBytes() returned '%v' for a nonexistent catalog, but should return '{}'", string(catalogBytes))
+	}
+
+	if err = backend.SetCatalogBytes(testCatalog); err != nil {
+		return fmt.Errorf("SetCatalogBytes() failed: %v", err)
+	}
+	if catalogBytes, err = backend.GetCatalogBytes(); err != nil {
+		return fmt.Errorf("GetCatalogBytes() failed: %v", err)
+	} else if string(catalogBytes) != string(testCatalog) {
+		return fmt.Errorf("GetCatalogBytes() returned '%v' after SetCatalogBytes('%v')", string(catalogBytes), string(testCatalog))
+	}
+
+	if versioned, ok := backend.(CaryatidVersionedBackend); ok {
+		var version string
+		if catalogBytes, version, err = versioned.GetCatalogBytesVersion(); err != nil {
+			return fmt.Errorf("GetCatalogBytesVersion() failed: %v", err)
+		} else if string(catalogBytes) != string(testCatalog) || version == "" {
+			return fmt.Errorf("GetCatalogBytesVersion() returned '%v' at version '%v' after SetCatalogBytes('%v')", string(catalogBytes), version, string(testCatalog))
+		}
+		if err = versioned.SetCatalogBytesIfVersion(testCatalog, ""); !IsCatalogConflict(err) {
+			return fmt.Errorf("SetCatalogBytesIfVersion() for a nonexistent catalog should have returned a conflict, but returned: %v", err)
+		}
+		if err = versioned.SetCatalogBytesIfVersion(testCatalog, version); err != nil {
+			return fmt.Errorf("SetCatalogBytesIfVersion() failed at the current version: %v", err)
+		}
+	}
+
+	if locking, ok := backend.(CaryatidLockingBackend); ok {
+		var current *CatalogLock
+		lock := NewCatalogLock("conformance", time.Minute)
+		if err = locking.Lock(lock); err != nil {
+			return fmt.Errorf("Lock() failed: %v", err)
+		}
+		if current, err = locking.LockStatus(); err != nil || current == nil || !current.SameHolder(lock) {
+			return fmt.Errorf("LockStatus() returned '%v' and error '%v' while locked by '%v'", current, err, lock)
+		}
+		if err = locking.Unlock(); err != nil {
+			return fmt.Errorf("Unlock() failed: %v", err)
+		}
+		if current, err = locking.LockStatus(); err != nil || current != nil {
+			return fmt.Errorf("LockStatus() returned '%v' and error '%v' after Unlock()", current, err)
+		}
+		if err = locking.Lock(lock); err != nil {
+			return fmt.Errorf("Lock() failed after Unlock(): %v", err)
+		}
+		if err = locking.BreakLock(); err != nil {
+			return fmt.Errorf("BreakLock() failed: %v", err)
+		}
+		if current, err = locking.LockStatus(); err != nil || current != nil {
+			return fmt.Errorf("LockStatus() returned '%v' and error '%v' after BreakLock()", current, err)
+		}
+		locking.Unlock()
+	}
+
+	if err = CreateTestBoxFile(boxPath, "conformance-provider", true); err != nil {
+		return
+	}
+	defer os.Remove(boxPath)
+
+	if err = manager.AddBox(boxPath, boxName, "A box for conformance testing", "1.2.3", "conformance-provider", "sha1", "0xDECAFBAD"); err != nil {
+		return fmt.Errorf("BackendManager.AddBox() failed: %v", err)
+	}
+	if catalog, err = manager.GetCatalog(); err != nil {
+		return fmt.Errorf("BackendManager.GetCatalog() failed after adding a box: %v", err)
+	}
+	if refs := catalog.BoxReferences(); len(refs) != 1 || refs[0].Version != "1.2.3" || refs[0].ProviderName != "conformance-provider" {
+		return fmt.Errorf("Catalog did not contain exactly the added box:\n%v", catalog.DisplayString())
+	}
+
+	if listing, ok := backend.(CaryatidListingBackend); ok {
+		var (
+			files     []BackendFile
+			report    FsckReport
+			parentUri string
+		)
+		if parentUri, err = CatalogParentUri(catalogUri); err != nil {
+			return
+		}
+		if files, err = listing.ListFiles(parentUri + "/NonexistentDirectory"); err != nil || len(files) != 0 {
+			return fmt.Errorf("ListFiles() returned %v and error '%v' for a nonexistent directory", files, err)
+		}
+		if files, err = listing.ListFiles(parentUri + "/" + boxName); err != nil || len(files) != 1 || files[0].Size == 0 {
+			return fmt.Errorf("ListFiles() returned %v and error '%v' for a directory with one box", files, err)
+		}
+		if report, err = manager.Fsck(); err != nil || !report.Clean() {
+			return fmt.Errorf("BackendManager.Fsck() found problems after adding a box, with error '%v':\n%v", err, report)
+		}
+	}
+
+	if downloading, ok := backend.(CaryatidDownloadingBackend); ok {
+		var (
+			original, downloaded []byte
+			storageUri           string
+			downloadPath         = filepath.Join(workDir, "conformance-download.box")
+		)
+		defer os.Remove(downloadPath)
+		if storageUri, err = manager.StorageUri(catalog.BoxReferences()[0].Uri); err != nil {
+			return
+		}
+		if err = downloading.DownloadFile(storageUri, downloadPath); err != nil {
+			return fmt.Errorf("DownloadFile() failed: %v", err)
+		}
+		if original, err = ioutil.ReadFile(boxPath); err != nil {
+			return
+		}
+		if downloaded, err = ioutil.ReadFile(downloadPath); err != nil || string(downloaded) != string(original) {
+			return fmt.Errorf("DownloadFile() did not copy the box that was added; got error '%v'", err)
+		}
+	}
+
+	if err = manager.DeleteBox(CatalogQueryParams{Version: "1.2.3"}); err != nil {
+		return fmt.Errorf("BackendManager.DeleteBox() failed: %v", err)
+	}
+	if catalog, err = manager.GetCatalog(); err != nil {
+		return fmt.Errorf("BackendManager.GetCatalog() failed after deleting a box: %v", err)
+	}
+	if len(catalog.Versions) != 0 {
+		return fmt.Errorf("Catalog still contained boxes after deleting them:\n%v", catalog.DisplayString())
+	}
+
+	if streaming, ok := backend.(CaryatidStreamingBackend); ok {
+		var (
+			original, streamed []byte
+			storageUri         string
+			reader             io.ReadCloser
+		)
+		if original, err = ioutil.ReadFile(boxPath); err != nil {
+			return
+		}
+		if err = manager.AddBoxFromReader(context.Background(), bytes.NewReader(original), -1, boxName, "A box for conformance testing", "1.2.4", "conformance-provider", "sha1", ""); err != nil {
+			return fmt.Errorf("BackendManager.AddBoxFromReader() failed: %v", err)
+		}
+		if catalog, err = manager.GetCatalog(); err != nil {
+			return fmt.Errorf("BackendManager.GetCatalog() failed after adding a box from a stream: %v", err)
+		}
+		if len(catalog.Versions) != 1 || len(catalog.Versions[0].Providers) != 1 || catalog.Versions[0].Providers[0].Checksum != fmt.Sprintf("%x", sha1.Sum(original)) {
+			return fmt.Errorf("Catalog did not contain exactly the box added from a stream, with its checksum:\n%v", catalog.DisplayString())
+		}
+		if storageUri, err = manager.StorageUri(catalog.BoxReferences()[0].Uri); err != nil {
+			return
+		}
+		if reader, err = streaming.OpenBox(context.Background(), storageUri); err != nil {
+			return fmt.Errorf("OpenBox() failed: %v", err)
+		}
+		streamed, err = ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil || string(streamed) != string(original) {
+			return fmt.Errorf("OpenBox() did not return the box that was added; got error '%v'", err)
+		}
+		if err = manager.DeleteBox(CatalogQueryParams{Version: "1.2.4"}); err != nil {
+			return fmt.Errorf("BackendManager.DeleteBox() failed for a box added from a stream: %v", err)
+		}
+		if _, err = streaming.OpenBox(context.Background(), storageUri); err == nil {
+			return fmt.Errorf("OpenBox() succeeded for '%v' after it was deleted", storageUri)
+		}
+		err = nil
+	}
+
+	return
+}
@@ -15,9 +15,33 @@ import (
 	"github.com/mrled/caryatid/internal/util"
 )
 
+// The parts of a Vagrant box's metadata.json that Caryatid uses
+type boxMetadata struct {
+	Provider     string `json:"provider"`
+	Architecture string `json:"architecture"`
+}
+
 // Determine the provider of a Vagrant box based on its metadata.json
 // See also https://www.packer.io/docs/post-processors/vagrant.html
 func DetermineProvider(boxFilePath string) (result string, err error) {
+	metadata, err := readBoxMetadata(boxFilePath)
+	result = metadata.Provider
+	return
+}
+
+// Determine the architecture of a Vagrant box based on its metadata.json
+// Older boxes do not record their architecture, so this returns an error if it is missing
+func DetermineArchitecture(boxFilePath string) (result string, err error) {
+	metadata, err := readBoxMetadata(boxFilePath)
+	if err == nil && metadata.Architecture == "" {
+		err = fmt.Errorf("The metadata.json file in %v does not set an architecture", boxFilePath)
+	}
+	result = metadata.Architecture
+	return
+}
+
+// Read the metadata.json from a Vagrant box
+func readBoxMetadata(boxFilePath string) (result boxMetadata, err error) {
 	file, err := os.Open(boxFilePath)
 	defer file.Close()
 	if err != nil {
@@ -73,14 +97,7 @@ func DetermineProvider(boxFilePath string) (result string, err error) {
 		}
 	}
 
-	var metadata struct {
-		Provider string `json:"provider"`
-	}
-	if err = json.Unmarshal(metadataContents, &metadata); err != nil {
-		return
-	}
-
-	result = metadata.Provider
+	err = json.Unmarshal(metadataContents, &result)
 	return
 }
 
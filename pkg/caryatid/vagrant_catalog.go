@@ -115,23 +115,42 @@ func (c1 *Catalog) Equals(c2 *Catalog) bool {
 	return true
 }
 
-func BoxUriFromCatalogUri(catalogUri string, name string, version string, provider string) (boxUri string, err error) {
+// CatalogParentUri returns the URI of the directory containing a catalog, without a trailing slash
+// Any query string in the catalog URI, such as backend settings, is not part of the parent URI
+func CatalogParentUri(catalogUri string) (parentUri string, err error) {
+	if queryIdx := strings.Index(catalogUri, "?"); queryIdx >= 0 {
+		catalogUri = catalogUri[0:queryIdx]
+	}
 	lastSlashIdx := strings.LastIndex(catalogUri, "/")
 	if lastSlashIdx < 0 {
 		err = fmt.Errorf("Invalid URI: %v\n", catalogUri)
 		return
 	}
-	catalogParentUri := catalogUri[0:lastSlashIdx]
-	boxUri = fmt.Sprintf("%v/%v/%v_%v_%v.box", catalogParentUri, name, name, version, provider)
+	parentUri = catalogUri[0:lastSlashIdx]
 	return
 }
 
+// BoxUriFromCatalogUri returns the URI of a box stored next to a catalog at the path given by DefaultBoxPathTemplate
+func BoxUriFromCatalogUri(catalogUri string, name string, version string, provider string) (boxUri string, err error) {
+	return BoxUriFromTemplate(catalogUri, DefaultBoxPathTemplate, BoxPathParams{Name: name, Version: version, Provider: provider})
+}
+
 // AddBox updates the Catalog to include a new box file
 // The artifact's Name must match the Catalog's Name, if the Catalog already exists in storage
 // However, the artifact's Description always overwrites the Catalog's Description, even if they are different
 // This minimizes painful end-of-build errors,
 // and lets the user change their mind about the wording of the description
 func (c *Catalog) AddBox(catalogUri string, name string, description string, version string, provider string, checksumType string, checksum string) (err error) {
+	boxUri, err := BoxUriFromCatalogUri(catalogUri, name, version, provider)
+	if err != nil {
+		return
+	}
+	return c.AddBoxUri(boxUri, name, description, version, provider, checksumType, checksum)
+}
+
+// AddBoxUri updates the Catalog to include a new box file at an explicit URI
+// It behaves like AddBox, but does not derive the box URI from the catalog URI
+func (c *Catalog) AddBoxUri(boxUri string, name string, description string, version string, provider string, checksumType string, checksum string) (err error) {
 	if c.Name != "" && name != "" && c.Name != name {
 		err = fmt.Errorf("Catalog.AddBox(): Catalog name '%v' does not match input name '%v'\n", c.Name, name)
 		return
@@ -140,15 +159,11 @@ func (c *Catalog) AddBox(catalogUri string, name string, description string, ver
 	}
 	if c.Name == "" {
 		err = fmt.Errorf("Catalog.AddBox(): Catalog name could not be determined\n")
+		return
 	}
 
 	c.Description = description
 
-	boxUri, err := BoxUriFromCatalogUri(catalogUri, name, version, provider)
-	if err != nil {
-		return
-	}
-
 	newProvider := Provider{provider, boxUri, checksumType, checksum}
 	newVersion := Version{version, []Provider{newProvider}}
 